@@ -0,0 +1,208 @@
+package cniipvlanvpck8s
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"syscall"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+// attachmentsFile records the IPs handed to each attachment, so the IPs
+// of attachments the runtime no longer knows about can be collected, and
+// the interface they're on, for tooling correlating pod IPs with ENIs
+var attachmentsFile = "/var/lib/cni-ipvlan-vpc-k8s/attachments.json"
+
+// Attachment identifies an interface the runtime added to a container
+type Attachment struct {
+	ContainerID string
+	IfName      string
+}
+
+func (a Attachment) key() string {
+	return a.ContainerID + "/" + a.IfName
+}
+
+// AttachmentRecord is what an ADD returned for an attachment: its IPs and
+// the interface, subnet and availability zone they're in, along with the
+// pod it was for when the runtime passed one. The policy routing rules
+// added for its IPs are recorded for DEL to remove.
+type AttachmentRecord struct {
+	IPs              []string        `json:"ips"`
+	InterfaceID      string          `json:"interfaceId,omitempty"`
+	SubnetID         string          `json:"subnetId,omitempty"`
+	AvailabilityZone string          `json:"availabilityZone,omitempty"`
+	PodNamespace     string          `json:"podNamespace,omitempty"`
+	PodName          string          `json:"podName,omitempty"`
+	PolicyRules      []nl.PolicyRule `json:"policyRules,omitempty"`
+}
+
+// UnmarshalJSON also accepts the bare lists of IPs recorded by earlier
+// versions
+func (r *AttachmentRecord) UnmarshalJSON(data []byte) error {
+	var ips []string
+	if err := json.Unmarshal(data, &ips); err == nil {
+		*r = AttachmentRecord{IPs: ips}
+		return nil
+	}
+	type plain AttachmentRecord
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// ipAttachments maps attachment keys to their records
+type ipAttachments map[string]AttachmentRecord
+
+// RecordAttachment remembers the IPs an ADD for the pod returned for the
+// attachment, the interface in the availability zone they were allocated
+// on, and the policy rules added for them
+func RecordAttachment(attachment Attachment, ips []net.IP, intf aws.Interface, availabilityZone string, pod aws.PodInfo, rules []nl.PolicyRule) error {
+	return updateClaims(func(ipClaims) error {
+		attachments := loadAttachments()
+		record := AttachmentRecord{
+			InterfaceID:      intf.ID,
+			SubnetID:         intf.SubnetID,
+			AvailabilityZone: availabilityZone,
+			PodNamespace:     pod.Namespace,
+			PodName:          pod.Name,
+			PolicyRules:      rules,
+		}
+		for _, ip := range ips {
+			record.IPs = append(record.IPs, ip.String())
+		}
+		attachments[attachment.key()] = record
+		return writeJSONAtomic(attachmentsFile, attachments)
+	})
+}
+
+// LookupAttachment returns the record of an attachment, or nil if there
+// is none
+func LookupAttachment(attachment Attachment) (*AttachmentRecord, error) {
+	unlock, err := acquireLocks(DefaultLockTimeout, lockRequest{claimLockName, syscall.LOCK_SH})
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	record, ok := loadAttachments()[attachment.key()]
+	if !ok {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+// RemoveAttachment forgets an attachment torn down by DEL
+func RemoveAttachment(attachment Attachment) error {
+	return updateClaims(func(ipClaims) error {
+		attachments := loadAttachments()
+		delete(attachments, attachment.key())
+		return writeJSONAtomic(attachmentsFile, attachments)
+	})
+}
+
+// CollectGarbage returns the IPs no valid attachment uses: those recorded
+// for attachments missing from valid, and secondary IPs on interfaces
+// created by this plugin which are neither recorded nor bound on the host.
+// keepFree of the latter are kept for the warm pool. Claimed and reserved
+// IPs are never returned. The records of invalid attachments are dropped,
+// as is the exclusivity of interfaces dedicated to their containers, so it
+// must run under LockfileRun, and the IPs deallocated right after.
+func CollectGarbage(valid []Attachment, keepFree int) ([]net.IP, error) {
+	managed, err := aws.ManagedSecondaryIPs()
+	if err != nil {
+		return nil, err
+	}
+	bound, err := nl.GetIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	var garbage []net.IP
+	err = updateClaims(func(claims ipClaims) error {
+		for _, r := range loadReservations() {
+			claims[r.IP] = r.Expires
+		}
+		attachments := loadAttachments()
+		validKeys := map[string]bool{}
+		for _, attachment := range valid {
+			validKeys[attachment.key()] = true
+		}
+		garbage = garbageIPs(managed, bound, claims, attachments, validKeys, keepFree)
+
+		for key := range attachments {
+			if !validKeys[key] {
+				delete(attachments, key)
+			}
+		}
+		validContainers := map[string]bool{}
+		for _, attachment := range valid {
+			validContainers[attachment.ContainerID] = true
+		}
+		if err := pruneExclusiveInterfaces(func(owner string) bool { return validContainers[owner] }); err != nil {
+			return err
+		}
+		return writeJSONAtomic(attachmentsFile, attachments)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return garbage, nil
+}
+
+func garbageIPs(managed []net.IP, bound []nl.BoundIP, claims ipClaims, attachments ipAttachments, valid map[string]bool, keepFree int) []net.IP {
+	inUse := map[string]bool{}
+	stale := map[string]bool{}
+	for key, record := range attachments {
+		for _, ip := range record.IPs {
+			if valid[key] {
+				inUse[ip] = true
+			} else {
+				stale[ip] = true
+			}
+		}
+	}
+	for ip := range claims {
+		inUse[ip] = true
+	}
+
+	var garbage []net.IP
+	for ip := range stale {
+		// An IP given to a new attachment after the stale one is in use
+		if !inUse[ip] {
+			garbage = append(garbage, net.ParseIP(ip))
+		}
+	}
+
+	// Unrecorded IPs may belong to pods added before attachments were
+	// recorded, so only unbound ones are collected
+	for _, ip := range managed {
+		if inUse[ip.String()] || stale[ip.String()] || isBound(bound, ip) {
+			continue
+		}
+		if keepFree > 0 {
+			keepFree--
+			continue
+		}
+		garbage = append(garbage, ip)
+	}
+	return garbage
+}
+
+func isBound(bound []nl.BoundIP, ip net.IP) bool {
+	for _, b := range bound {
+		if b.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadAttachments() ipAttachments {
+	attachments := ipAttachments{}
+	if data, err := ioutil.ReadFile(attachmentsFile); err == nil {
+		// Corrupt records are treated as empty and overwritten
+		_ = json.Unmarshal(data, &attachments)
+	}
+	return attachments
+}
@@ -0,0 +1,107 @@
+package cniipvlanvpck8s
+
+import (
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+func TestGarbageIPs(t *testing.T) {
+	managed := []net.IP{
+		net.ParseIP("10.0.0.10"), // valid attachment
+		net.ParseIP("10.0.0.11"), // stale attachment, still bound
+		net.ParseIP("10.0.0.12"), // unrecorded, bound
+		net.ParseIP("10.0.0.13"), // unrecorded, claimed
+		net.ParseIP("10.0.0.14"), // unrecorded, free
+		net.ParseIP("10.0.0.15"), // unrecorded, free
+	}
+	bound := []nl.BoundIP{
+		{IPNet: &net.IPNet{IP: net.ParseIP("10.0.0.11"), Mask: net.CIDRMask(32, 32)}},
+		{IPNet: &net.IPNet{IP: net.ParseIP("10.0.0.12"), Mask: net.CIDRMask(32, 32)}},
+	}
+	claims := ipClaims{"10.0.0.13": time.Now().Add(time.Minute)}
+	attachments := ipAttachments{
+		Attachment{"valid", "eth0"}.key(): {IPs: []string{"10.0.0.10"}},
+		Attachment{"stale", "eth0"}.key(): {IPs: []string{"10.0.0.11", "2600:1f14::11"}},
+	}
+	valid := map[string]bool{Attachment{"valid", "eth0"}.key(): true}
+
+	cases := []struct {
+		KeepFree int
+		Expected []string
+	}{
+		{KeepFree: 0, Expected: []string{"10.0.0.11", "10.0.0.14", "10.0.0.15", "2600:1f14::11"}},
+		// Stale attachments' IPs don't count towards the warm pool
+		{KeepFree: 1, Expected: []string{"10.0.0.11", "10.0.0.15", "2600:1f14::11"}},
+		{KeepFree: 5, Expected: []string{"10.0.0.11", "2600:1f14::11"}},
+	}
+
+	for i, c := range cases {
+		var garbage []string
+		for _, ip := range garbageIPs(managed, bound, claims, attachments, valid, c.KeepFree) {
+			garbage = append(garbage, ip.String())
+		}
+		sort.Strings(garbage)
+		if len(garbage) != len(c.Expected) {
+			t.Fatalf("%d expected %v, got %v", i, c.Expected, garbage)
+		}
+		for j := range garbage {
+			if garbage[j] != c.Expected[j] {
+				t.Fatalf("%d expected %v, got %v", i, c.Expected, garbage)
+			}
+		}
+	}
+}
+
+func TestRecordAttachment(t *testing.T) {
+	defer withTestClaims(t)()
+
+	attachment := Attachment{ContainerID: "container", IfName: "eth0"}
+	intf := aws.Interface{ID: "eni-lyft-1", SubnetID: "subnet-lyft"}
+	pod := aws.PodInfo{Namespace: "default", Name: "web"}
+	rules := []nl.PolicyRule{{IP: "10.0.0.10", Table: 10001, Priority: nl.PolicyRulePriority}}
+	if err := RecordAttachment(attachment, []net.IP{net.ParseIP("10.0.0.10")}, intf, "us-east-1a", pod, rules); err != nil {
+		t.Fatalf("Failed to record %v: %v", attachment, err)
+	}
+	record, err := LookupAttachment(attachment)
+	if err != nil {
+		t.Fatalf("Failed to look up %v: %v", attachment, err)
+	}
+	expected := &AttachmentRecord{
+		IPs:              []string{"10.0.0.10"},
+		InterfaceID:      "eni-lyft-1",
+		SubnetID:         "subnet-lyft",
+		AvailabilityZone: "us-east-1a",
+		PodNamespace:     "default",
+		PodName:          "web",
+		PolicyRules:      rules,
+	}
+	if !reflect.DeepEqual(record, expected) {
+		t.Fatalf("expected %+v to be recorded, got %+v", expected, record)
+	}
+
+	if err := RemoveAttachment(attachment); err != nil {
+		t.Fatalf("Failed to remove %v: %v", attachment, err)
+	}
+	if _, ok := loadAttachments()[attachment.key()]; ok {
+		t.Fatalf("attachment wasn't removed")
+	}
+}
+
+func TestLoadLegacyAttachments(t *testing.T) {
+	defer withTestClaims(t)()
+
+	if err := ioutil.WriteFile(attachmentsFile, []byte(`{"container/eth0":["10.0.0.10"]}`), 0600); err != nil {
+		t.Fatalf("Failed to write attachments: %v", err)
+	}
+	record := loadAttachments()["container/eth0"]
+	if len(record.IPs) != 1 || record.IPs[0] != "10.0.0.10" || record.InterfaceID != "" {
+		t.Fatalf("unexpected record of a legacy attachment %+v", record)
+	}
+}
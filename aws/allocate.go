@@ -1,22 +1,42 @@
 package aws
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"sort"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
 
-// AllocationResult contains a net.IP / Interface pair
+// AllocationResult contains a net.IP / Interface pair, and optionally
+// an IPv6 address allocated on the same interface
 type AllocationResult struct {
 	*net.IP
 	Interface Interface
+	IPv6      *net.IP
 }
 
 // AllocateIPOn allocates an IP on a specific interface.
-func AllocateIPOn(intf Interface) (*AllocationResult, error) {
+func AllocateIPOn(ctx context.Context, intf Interface) (*AllocationResult, error) {
+	allocs, err := AllocateIPsOn(ctx, intf, 1)
+	if err != nil {
+		return nil, err
+	}
+	return allocs[0], nil
+}
+
+// AllocateIPsOn allocates count IPs on a specific interface in a single
+// EC2 call, returning them once they all show up in metadata. With prefix
+// delegation enough prefixes are assigned for count IPs, and all of their
+// addresses are returned. The call and the wait for metadata are abandoned
+// once ctx is done.
+func AllocateIPsOn(ctx context.Context, intf Interface, count int) ([]*AllocationResult, error) {
 	client, err := newEC2()
 	if err != nil {
 		return nil, err
@@ -24,9 +44,19 @@ func AllocateIPOn(intf Interface) (*AllocationResult, error) {
 	request := ec2.AssignPrivateIpAddressesInput{
 		NetworkInterfaceId: &intf.ID,
 	}
-	request.SetSecondaryPrivateIpAddressCount(1)
+	if prefixDelegation {
+		request.SetIpv4PrefixCount(int64(prefixesFor(count)))
+	} else {
+		request.SetSecondaryPrivateIpAddressCount(int64(count))
+	}
 
-	_, err = client.AssignPrivateIpAddresses(&request)
+	err = withRetryContext(ctx, func() (err error) {
+		_, err = client.AssignPrivateIpAddressesWithContext(ctx, &request)
+		return
+	})
+	if awsErr, ok := err.(awserr.Error); ok && isSubnetExhausted(awsErr) {
+		return nil, SubnetExhaustedError{SubnetID: intf.SubnetID, Err: awsErr}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -34,81 +64,410 @@ func AllocateIPOn(intf Interface) (*AllocationResult, error) {
 	for attempts := 10; attempts > 0; attempts-- {
 		newIntf, err := getInterface(intf.Mac)
 		if err != nil {
-			time.Sleep(1.0 * time.Second)
+			if err := sleepContext(ctx, 1.0*time.Second); err != nil {
+				return nil, err
+			}
 			continue
 		}
 
-		if len(newIntf.IPv4s) != len(intf.IPv4s) {
-			// New address detected
-			for _, newip := range newIntf.IPv4s {
-				found := false
-				for _, oldip := range intf.IPv4s {
-					if newip.Equal(oldip) {
-						found = true
-					}
-				}
-				if !found {
-					// New IP
-					return &AllocationResult{
-						&newip,
-						newIntf,
-					}, nil
-				}
+		// New addresses detected
+		if added := addedIPs(intf.AssignedIPv4s(), newIntf.AssignedIPv4s()); len(added) >= count {
+			var allocs []*AllocationResult
+			for i := range added {
+				allocs = append(allocs, &AllocationResult{
+					IP:        &added[i],
+					Interface: newIntf,
+				})
 			}
+			return allocs, nil
+		}
+		if err := sleepContext(ctx, 1.0*time.Second); err != nil {
+			return nil, err
 		}
-		time.Sleep(1.0 * time.Second)
 	}
 
 	return nil, fmt.Errorf("Can't locate new IP address from AWS")
 }
 
+// isSubnetExhausted reports whether EC2 failed to assign IPs, or a prefix
+// which also needs a free aligned block, for lack of room in the subnet
+func isSubnetExhausted(err awserr.Error) bool {
+	switch err.Code() {
+	case "InsufficientFreeAddressesInSubnet", "InsufficientCidrBlocks":
+		return true
+	}
+	return false
+}
+
+// addedIPs returns the IPs in current which aren't in previous
+func addedIPs(previous, current []net.IP) []net.IP {
+	var added []net.IP
+	for _, newip := range current {
+		found := false
+		for _, oldip := range previous {
+			if newip.Equal(oldip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			added = append(added, newip)
+		}
+	}
+	return added
+}
+
+// AllocateIPv6On allocates an IPv6 address from the subnet's IPv6 block on
+// a specific interface. It gives up once ctx is done.
+func AllocateIPv6On(ctx context.Context, intf Interface) (*net.IP, error) {
+	if intf.SubnetIPv6Cidr == nil {
+		return nil, fmt.Errorf("subnet %v has no IPv6 CIDR block", intf.SubnetID)
+	}
+
+	client, err := newEC2()
+	if err != nil {
+		return nil, err
+	}
+	request := ec2.AssignIpv6AddressesInput{
+		NetworkInterfaceId: &intf.ID,
+	}
+	request.SetIpv6AddressCount(1)
+
+	var resp *ec2.AssignIpv6AddressesOutput
+	err = withRetryContext(ctx, func() (err error) {
+		resp, err = client.AssignIpv6AddressesWithContext(ctx, &request)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Unlike IPv4, EC2 hands back the assigned address directly
+	for _, assigned := range resp.AssignedIpv6Addresses {
+		ip := net.ParseIP(*assigned)
+		if ip != nil {
+			return &ip, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Can't locate new IPv6 address from AWS")
+}
+
+// AllocationStrategy selects which interface a new IP is allocated on
+type AllocationStrategy string
+
+const (
+	// FirstAvailable fills the first interface with room, in order of
+	// the free addresses in its subnet
+	FirstAvailable AllocationStrategy = "first-available"
+	// LeastLoaded balances IPs across interfaces, choosing the one with
+	// the fewest assigned
+	LeastLoaded AllocationStrategy = "least-loaded"
+)
+
+var exclusiveInterfaces map[string]bool
+
+// SetExclusiveInterfaces excludes the interfaces dedicated to a single pod
+// from allocations at an index, which share interfaces between pods
+func SetExclusiveInterfaces(ids []string) {
+	exclusiveInterfaces = map[string]bool{}
+	for _, id := range ids {
+		exclusiveInterfaces[id] = true
+	}
+}
+
+var unreachableInterfaces map[string]bool
+
+// SetUnreachableInterfaces excludes the interfaces whose subnet gateway
+// didn't answer a recent ADD from allocations at an index
+func SetUnreachableInterfaces(ids []string) {
+	unreachableInterfaces = map[string]bool{}
+	for _, id := range ids {
+		unreachableInterfaces[id] = true
+	}
+}
+
 // AllocateIPFirstAvailableAtIndex allocates an IP address, skipping any adapter < the given index
 // Returns a reference to the interface the IP was allocated on
-func AllocateIPFirstAvailableAtIndex(index int) (*AllocationResult, error) {
+func AllocateIPFirstAvailableAtIndex(ctx context.Context, index int) (*AllocationResult, error) {
+	return AllocateIPAtIndex(ctx, index, FirstAvailable, nil)
+}
+
+// AllocateIPAtIndex allocates an IP address on an interface chosen by the
+// strategy, skipping any adapter < the given index
+func AllocateIPAtIndex(ctx context.Context, index int, strategy AllocationStrategy, subnetIDs []string) (*AllocationResult, error) {
+	intf, err := PlanIPAtIndex(index, strategy, subnetIDs)
+	if err != nil {
+		return nil, err
+	}
+	return AllocateIPOn(ctx, *intf)
+}
+
+// AllocateIPsAtIndex allocates up to count IP addresses in a single EC2
+// call, on the first interface with room at or above the given index. Fewer
+// are returned when the interface can't take count more, so callers
+// needing all of them call it again. With prefix delegation the addresses
+// of whole prefixes are returned, which may be more than count.
+func AllocateIPsAtIndex(ctx context.Context, index, count int) ([]*AllocationResult, error) {
+	intf, err := PlanIPAtIndex(index, FirstAvailable, nil)
+	if err != nil {
+		return nil, err
+	}
+	room := ENILimits().IPv4 - intf.ipv4Slots()
+	if prefixDelegation {
+		room *= prefixSize
+	}
+	if count > room {
+		count = room
+	}
+	return AllocateIPsOn(ctx, *intf, count)
+}
+
+// PlanIPFirstAvailableAtIndex returns the interface AllocateIPFirstAvailableAtIndex
+// would allocate an IP on, without calling any mutating EC2 APIs
+func PlanIPFirstAvailableAtIndex(index int) (*Interface, error) {
+	return PlanIPAtIndex(index, FirstAvailable, nil)
+}
+
+// PlanIPAtIndex returns the interface AllocateIPAtIndex would allocate an
+// IP on, without calling any mutating EC2 APIs. Candidate interfaces are
+// restricted to subnetIDs unless it's nil.
+func PlanIPAtIndex(index int, strategy AllocationStrategy, subnetIDs []string) (*Interface, error) {
 	interfaces, err := GetInterfaces()
 	if err != nil {
 		return nil, err
 	}
-	limits := ENILimits()
+	candidates := Pool{Index: index, SubnetIDs: subnetIDs}.WithRoom(interfaces, ENILimits())
+
+	subnets, err := GetSubnetsForInstance()
+	if err != nil {
+		return nil, err
+	}
+
+	intf := chooseInterface(candidates, subnets, strategy)
+	if intf == nil {
+		return nil, newError(ErrInsufficientIPs, "Unable to allocate - no IPs available on any interfaces")
+	}
+	return intf, nil
+}
 
-	var candidates []Interface
+// AllocateSpecificIPAtIndex assigns ip to the first interface at or above
+// the index whose subnet contains it and which has room for another IP,
+// for pods which must keep a fixed address. EC2 moves the IP over if
+// another instance holds it. It fails if the IP is outside of the subnets
+// of those interfaces, reserved by EC2, or already assigned on this
+// instance. The IP is returned once it shows up in metadata.
+func AllocateSpecificIPAtIndex(ctx context.Context, index int, ip net.IP) (*AllocationResult, error) {
+	interfaces, err := GetInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	intf, err := chooseInterfaceForIP(interfaces, ENILimits(), index, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newEC2()
+	if err != nil {
+		return nil, err
+	}
+	request := ec2.AssignPrivateIpAddressesInput{
+		NetworkInterfaceId: &intf.ID,
+	}
+	request.SetPrivateIpAddresses([]*string{aws.String(ip.String())})
+	request.SetAllowReassignment(true)
+
+	err = withRetryContext(ctx, func() (err error) {
+		_, err = client.AssignPrivateIpAddressesWithContext(ctx, &request)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for attempts := 10; attempts > 0; attempts-- {
+		newIntf, err := getInterface(intf.Mac)
+		if err == nil && interfaceWithIP([]Interface{newIntf}, ip) != nil {
+			return &AllocationResult{IP: &ip, Interface: newIntf}, nil
+		}
+		if err := sleepContext(ctx, 1.0*time.Second); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("Can't locate %v in metadata after assigning it", ip)
+}
+
+// chooseInterfaceForIP returns the first interface at or above the index
+// able to take ip, or an error saying why there is none
+func chooseInterfaceForIP(interfaces []Interface, limits ENILimit, index int, ip net.IP) (*Interface, error) {
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("%v is not an IPv4 address", ip)
+	}
 	for _, intf := range interfaces {
-		if intf.Number < index {
+		for _, assigned := range intf.AssignedIPv4s() {
+			if assigned.Equal(ip) {
+				return nil, fmt.Errorf("%v is already in use on interface %v", ip, intf.ID)
+			}
+		}
+	}
+
+	inSubnet := false
+	members := Pool{Index: index}.Interfaces(interfaces)
+	for i, intf := range members {
+		if intf.SubnetCidr == nil || !intf.SubnetCidr.Contains(ip) {
 			continue
 		}
-		if len(intf.IPv4s) < limits.IPv4 {
-			candidates = append(candidates, intf)
+		if isReservedIP(intf.SubnetCidr, ip) {
+			return nil, fmt.Errorf("%v is reserved by EC2 in subnet %v", ip, intf.SubnetID)
+		}
+		inSubnet = true
+		if intf.ipv4Slots() < limits.IPv4 {
+			return &members[i], nil
+		}
+	}
+	if inSubnet {
+		return nil, newError(ErrInsufficientIPs, "no interface in the subnet of %v has room for another IP", ip)
+	}
+	return nil, fmt.Errorf("%v is outside of the subnets of the interfaces at index %d or above", ip, index)
+}
+
+// isReservedIP reports whether ip is one of the first four addresses or
+// the last address of the subnet, which EC2 never assigns
+func isReservedIP(subnet *net.IPNet, ip net.IP) bool {
+	for offset := 0; offset < 4; offset++ {
+		if reserved, err := OffsetIP(subnet, offset); err == nil && reserved.Equal(ip) {
+			return true
 		}
 	}
+	ones, bits := subnet.Mask.Size()
+	last, err := OffsetIP(subnet, 1<<uint(bits-ones)-1)
+	return err == nil && last.Equal(ip)
+}
 
-	subnets, err := GetSubnetsForInstance()
+// AllocateIPv6AtIndex allocates an IPv6 address, and no IPv4 address, on
+// the first interface at or above the index with an IPv6 subnet and room
+// for another address. Candidate interfaces are restricted to subnetIDs
+// unless it's nil.
+func AllocateIPv6AtIndex(ctx context.Context, index int, subnetIDs []string) (*AllocationResult, error) {
+	interfaces, err := GetInterfaces()
 	if err != nil {
 		return nil, err
 	}
+	intf := chooseIPv6Interface(interfaces, ENILimits(), index, subnetIDs)
+	if intf == nil {
+		return nil, newError(ErrInsufficientIPs, "Unable to allocate - no IPv6 addresses available on any interfaces")
+	}
+	ip, err := AllocateIPv6On(ctx, *intf)
+	if err != nil {
+		return nil, err
+	}
+	return &AllocationResult{Interface: *intf, IPv6: ip}, nil
+}
 
+// chooseIPv6Interface returns the first interface able to take another
+// IPv6 address, or nil
+func chooseIPv6Interface(interfaces []Interface, limits ENILimit, index int, subnetIDs []string) *Interface {
+	members := Pool{Index: index, SubnetIDs: subnetIDs}.Interfaces(interfaces)
+	for i, intf := range members {
+		if intf.SubnetIPv6Cidr != nil && len(intf.IPv6s) < limits.IPv6 {
+			return &members[i]
+		}
+	}
+	return nil
+}
+
+// chooseInterface picks the candidate interface to allocate on, skipping
+// those in subnets without free addresses
+func chooseInterface(candidates []Interface, subnets []Subnet, strategy AllocationStrategy) *Interface {
 	sort.Sort(SubnetsByAvailableAddressCount(subnets))
+
+	var chosen *Interface
 	for _, subnet := range subnets {
 		if subnet.AvailableAddressCount <= 0 {
 			continue
 		}
-		for _, intf := range candidates {
-			if intf.SubnetID == subnet.ID {
-				return AllocateIPOn(intf)
+		for i, intf := range candidates {
+			if intf.SubnetID != subnet.ID {
+				continue
+			}
+			if strategy != LeastLoaded {
+				return &candidates[i]
+			}
+			if chosen == nil || len(intf.IPv4s) < len(chosen.IPv4s) ||
+				(len(intf.IPv4s) == len(chosen.IPv4s) && intf.Number < chosen.Number) {
+				chosen = &candidates[i]
 			}
 		}
 	}
-
-	return nil, fmt.Errorf("Unable to allocate - no IPs available on any interfaces")
+	return chosen
 }
 
 // AllocateIPFirstAvailable allocates an IP address on the first available IP address
 // Returns a reference to the interface the IP was allocated on
 func AllocateIPFirstAvailable() (*AllocationResult, error) {
-	return AllocateIPFirstAvailableAtIndex(0)
+	return AllocateIPFirstAvailableAtIndex(context.Background(), 0)
+}
+
+// SubnetExhaustedError is returned when EC2 has no free addresses left in
+// the subnet of the interface an IP was allocated on, although the cached
+// subnet counts may say otherwise. Other subnets may still have room. It
+// is an awserr.Error with the code of the EC2 failure.
+type SubnetExhaustedError struct {
+	SubnetID string
+	Err      awserr.Error
+}
+
+func (e SubnetExhaustedError) Error() string {
+	return fmt.Sprintf("subnet %v is exhausted: %v", e.SubnetID, e.Err)
+}
+
+// Code returns the EC2 error code
+func (e SubnetExhaustedError) Code() string {
+	return e.Err.Code()
+}
+
+// Message returns the EC2 error message
+func (e SubnetExhaustedError) Message() string {
+	return e.Err.Message()
+}
+
+// OrigErr returns the EC2 error
+func (e SubnetExhaustedError) OrigErr() error {
+	return e.Err
+}
+
+// IPNotAssignedError is returned when an IP to deallocate is no longer
+// assigned to any interface. Deallocation is idempotent, so callers may
+// treat it as success.
+type IPNotAssignedError struct {
+	IP net.IP
+}
+
+func (e IPNotAssignedError) Error() string {
+	return fmt.Sprintf("%v is not assigned to any interface", e.IP)
+}
+
+// DeallocationError is returned when EC2 fails to unassign an IP
+type DeallocationError struct {
+	IP  net.IP
+	Err error
 }
 
-// DeallocateIP releases an IP back to AWS
-func DeallocateIP(ipToRelease *net.IP) error {
+func (e DeallocationError) Error() string {
+	return fmt.Sprintf("unable to deallocate %v: %v", e.IP, e.Err)
+}
+
+// Temporary reports whether EC2 was throttled or had a transient problem,
+// so the deallocation can be retried
+func (e DeallocationError) Temporary() bool {
+	return isRetryable(e.Err)
+}
+
+// DeallocateIP releases an IP back to AWS. It returns an
+// IPNotAssignedError if the IP is already released, or a
+// DeallocationError if EC2 fails to release it.
+func DeallocateIP(ctx context.Context, ipToRelease *net.IP) error {
 	client, err := newEC2()
 	if err != nil {
 		return err
@@ -117,18 +476,135 @@ func DeallocateIP(ipToRelease *net.IP) error {
 	if err != nil {
 		return err
 	}
-	for _, intf := range interfaces {
-		for _, ip := range intf.IPv4s {
-			if ipToRelease.Equal(ip) {
-				request := ec2.UnassignPrivateIpAddressesInput{}
-				request.SetNetworkInterfaceId(intf.ID)
-				strIP := ipToRelease.String()
-				request.SetPrivateIpAddresses([]*string{&strIP})
-				_, err = client.UnassignPrivateIpAddresses(&request)
-				return err
+	return deallocateIP(ctx, client, interfaces, *ipToRelease)
+}
+
+func deallocateIP(ctx context.Context, client ec2iface.EC2API, interfaces []Interface, ip net.IP) error {
+	intf := interfaceWithIP(interfaces, ip)
+	if intf == nil {
+		if _, prefix := interfaceWithPrefix(interfaces, ip); prefix != nil {
+			if _, err := deallocatePrefixIPs(ctx, client, interfaces, []net.IP{ip}); err != nil {
+				return DeallocationError{IP: ip, Err: err}
 			}
+			return nil
+		}
+		return IPNotAssignedError{IP: ip}
+	}
+	if err := unassignIP(ctx, client, *intf, ip); err != nil {
+		// Metadata lags behind EC2, which may have released the IP or
+		// the whole interface already
+		if isNotAssigned(err) {
+			return IPNotAssignedError{IP: ip}
 		}
+		return DeallocationError{IP: ip, Err: err}
+	}
+	return nil
+}
+
+// isNotAssigned reports whether EC2 failed to unassign an IP because it
+// isn't assigned to the interface, or the interface is gone
+func isNotAssigned(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch awsErr.Code() {
+	case "InvalidNetworkInterfaceID.NotFound":
+		return true
+	case "InvalidParameterValue":
+		return strings.Contains(awsErr.Message(), "not assigned")
+	}
+	return false
+}
+
+// DeallocateIPs releases several IPs back to AWS, attempting every IP even
+// when some fail. An interface's primary address can't be unassigned and
+// is skipped, as are IPs no longer assigned to any interface, including
+// those EC2 released before metadata caught up. Returns the number of IPs
+// released and an error describing every failure. IPs not attempted
+// before ctx is done count as failures. Addresses of a delegated prefix
+// are released with the prefix, once none of its addresses is in use.
+func DeallocateIPs(ctx context.Context, ips []net.IP) (int, error) {
+	client, err := newEC2()
+	if err != nil {
+		return 0, err
+	}
+	interfaces, err := GetInterfaces()
+	if err != nil {
+		return 0, err
+	}
+
+	released := 0
+	var failures []string
+	var prefixIPs []net.IP
+	for _, ip := range ips {
+		intf := interfaceWithIP(interfaces, ip)
+		if intf != nil && ip.Equal(intf.PrimaryIPv4()) {
+			continue
+		}
+		if _, prefix := interfaceWithPrefix(interfaces, ip); intf == nil && prefix != nil {
+			prefixIPs = append(prefixIPs, ip)
+			continue
+		}
+		err := deallocateIP(ctx, client, interfaces, ip)
+		if _, ok := err.(IPNotAssignedError); ok {
+			continue
+		}
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		released++
+	}
+	if len(prefixIPs) > 0 {
+		n, err := deallocatePrefixIPs(ctx, client, interfaces, prefixIPs)
+		released += n
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return released, fmt.Errorf("unable to deallocate %d of %d IPs: %s",
+			len(failures), len(ips), strings.Join(failures, "; "))
+	}
+	return released, nil
+}
+
+// interfaceWithIP returns the interface an IPv4 or IPv6 address is
+// assigned to, or nil
+func interfaceWithIP(interfaces []Interface, ip net.IP) *Interface {
+	for i, intf := range interfaces {
+		for _, assigned := range intf.IPv4s {
+			if ip.Equal(assigned) {
+				return &interfaces[i]
+			}
+		}
+		for _, assigned := range intf.IPv6s {
+			if ip.Equal(assigned) {
+				return &interfaces[i]
+			}
+		}
+	}
+	return nil
+}
+
+func unassignIP(ctx context.Context, client ec2iface.EC2API, intf Interface, ip net.IP) error {
+	if ip.To4() == nil {
+		request := ec2.UnassignIpv6AddressesInput{}
+		request.SetNetworkInterfaceId(intf.ID)
+		request.SetIpv6Addresses([]*string{aws.String(ip.String())})
+		return withRetryContext(ctx, func() (err error) {
+			_, err = client.UnassignIpv6AddressesWithContext(ctx, &request)
+			return
+		})
 	}
 
-	return fmt.Errorf("IP not found - can't release")
+	request := ec2.UnassignPrivateIpAddressesInput{}
+	request.SetNetworkInterfaceId(intf.ID)
+	request.SetPrivateIpAddresses([]*string{aws.String(ip.String())})
+	return withRetryContext(ctx, func() (err error) {
+		_, err = client.UnassignPrivateIpAddressesWithContext(ctx, &request)
+		return
+	})
 }
@@ -0,0 +1,293 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// newMetadataServer serves the given meta-data paths, relative to
+// /latest/meta-data, and points the package's metadata client at it
+func newMetadataServer(t *testing.T, data map[string]string) func() {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(path.Clean(r.URL.Path), "/latest/meta-data/")
+		// Directory listings keep their trailing slash
+		if strings.HasSuffix(r.URL.Path, "/") {
+			key += "/"
+		}
+		value, ok := data[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, value)
+	}))
+
+	oldMetaData := metaData
+	metaData = ec2metadata.New(sess, &aws.Config{Endpoint: aws.String(ts.URL + "/latest")})
+	return func() {
+		metaData = oldMetaData
+		ts.Close()
+	}
+}
+
+type unassignMock struct {
+	ec2iface.EC2API
+	Fail        string
+	NotAssigned string
+	Unassigned  []string
+}
+
+func (e *unassignMock) UnassignPrivateIpAddressesWithContext(ctx aws.Context, in *ec2.UnassignPrivateIpAddressesInput, opts ...request.Option) (*ec2.UnassignPrivateIpAddressesOutput, error) {
+	if len(in.Ipv4Prefixes) > 0 {
+		e.Unassigned = append(e.Unassigned, aws.StringValue(in.Ipv4Prefixes[0]))
+		return &ec2.UnassignPrivateIpAddressesOutput{}, nil
+	}
+	ip := aws.StringValue(in.PrivateIpAddresses[0])
+	if ip == e.Fail {
+		return nil, fmt.Errorf("unassign failed")
+	}
+	if ip == e.NotAssigned {
+		return nil, awserr.New("InvalidParameterValue", "Some of the specified addresses are not assigned to interface eni-lyft-1", nil)
+	}
+	e.Unassigned = append(e.Unassigned, ip)
+	return &ec2.UnassignPrivateIpAddressesOutput{}, nil
+}
+
+func TestDeallocateIPs(t *testing.T) {
+	mac := "0a:00:00:00:00:01"
+	prefix := "network/interfaces/macs/" + mac + "/"
+	defer newMetadataServer(t, map[string]string{
+		"instance-id":                     "i-lyft",
+		"network/interfaces/macs/":        mac + "/",
+		prefix + "interface-id":           "eni-lyft-1",
+		prefix + "device-number":          "1",
+		prefix + "local-ipv4s":            "10.0.0.10\n10.0.0.11\n10.0.0.12\n10.0.0.13\n10.0.0.14",
+		prefix + "subnet-id":              "subnet-lyft",
+		prefix + "subnet-ipv4-cidr-block": "10.0.0.0/24",
+	})()
+
+	mock := &unassignMock{Fail: "10.0.0.12", NotAssigned: "10.0.0.14"}
+	_ec2Client = mock
+
+	released, err := DeallocateIPs(context.Background(), []net.IP{
+		net.ParseIP("10.0.0.10"), // primary, skipped
+		net.ParseIP("10.0.0.11"),
+		net.ParseIP("10.0.0.12"), // fails
+		net.ParseIP("10.0.0.13"),
+		net.ParseIP("10.0.0.14"), // released in EC2, still in metadata
+		net.ParseIP("10.0.0.99"), // already released
+	})
+	if err == nil {
+		t.Fatalf("expected an error for the failed deallocation")
+	}
+	if !strings.Contains(err.Error(), "10.0.0.12") {
+		t.Fatalf("error doesn't name the failed IP: %v", err)
+	}
+	if released != 2 {
+		t.Fatalf("expected 2 IPs released, got %d", released)
+	}
+	expected := []string{"10.0.0.11", "10.0.0.13"}
+	if !reflect.DeepEqual(mock.Unassigned, expected) {
+		t.Fatalf("expected %v to be unassigned, got %v", expected, mock.Unassigned)
+	}
+}
+
+func TestDeallocatePrefixIPs(t *testing.T) {
+	interfaces := []Interface{{
+		ID:    "eni-lyft-1",
+		IPv4s: []net.IP{net.ParseIP("10.0.0.10")},
+	}}
+	for _, cidr := range []string{"10.0.0.32/28", "10.0.0.48/28"} {
+		_, prefix, _ := net.ParseCIDR(cidr)
+		interfaces[0].IPv4Prefixes = append(interfaces[0].IPv4Prefixes, prefix)
+	}
+	mock := &unassignMock{}
+
+	// Without knowing the addresses in use, prefixes are kept
+	released, err := deallocatePrefixIPs(context.Background(), mock, interfaces, []net.IP{net.ParseIP("10.0.0.33")})
+	if err != nil || released != 0 || len(mock.Unassigned) != 0 {
+		t.Fatalf("expected the prefix kept, got %d %v: %v", released, mock.Unassigned, err)
+	}
+
+	// A prefix is unassigned once only released addresses of it are in use
+	defer SetIPsInUse(nil)
+	SetIPsInUse(func() ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.33"), net.ParseIP("10.0.0.34"), net.ParseIP("10.0.0.50")}, nil
+	})
+	released, err = deallocatePrefixIPs(context.Background(), mock, interfaces, []net.IP{
+		net.ParseIP("10.0.0.33"),
+		net.ParseIP("10.0.0.34"),
+		net.ParseIP("10.0.0.49"), // 10.0.0.50 is still in use
+	})
+	if err != nil || released != 2 {
+		t.Fatalf("expected 2 IPs released, got %d: %v", released, err)
+	}
+	if !reflect.DeepEqual(mock.Unassigned, []string{"10.0.0.32/28"}) {
+		t.Fatalf("expected only 10.0.0.32/28 unassigned, got %v", mock.Unassigned)
+	}
+}
+
+func TestDeallocateIPErrors(t *testing.T) {
+	interfaces := []Interface{{
+		ID:    "eni-lyft-1",
+		IPv4s: []net.IP{net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.11"), net.ParseIP("10.0.0.12")},
+	}}
+	mock := &unassignMock{Fail: "10.0.0.11", NotAssigned: "10.0.0.12"}
+
+	if err := deallocateIP(context.Background(), mock, interfaces, net.ParseIP("10.0.0.99")); err == nil {
+		t.Fatalf("expected an error for an unknown IP")
+	} else if _, ok := err.(IPNotAssignedError); !ok {
+		t.Fatalf("expected an IPNotAssignedError for an unknown IP, got %v", err)
+	}
+	if err := deallocateIP(context.Background(), mock, interfaces, net.ParseIP("10.0.0.12")); err == nil {
+		t.Fatalf("expected an error for an IP EC2 released")
+	} else if _, ok := err.(IPNotAssignedError); !ok {
+		t.Fatalf("expected an IPNotAssignedError for an IP EC2 released, got %v", err)
+	}
+	if err := deallocateIP(context.Background(), mock, interfaces, net.ParseIP("10.0.0.11")); err == nil {
+		t.Fatalf("expected an error for a failed unassign")
+	} else if _, ok := err.(DeallocationError); !ok {
+		t.Fatalf("expected a DeallocationError for a failed unassign, got %v", err)
+	}
+}
+
+func TestChooseInterface(t *testing.T) {
+	ip := func(count int) []net.IP {
+		return make([]net.IP, count)
+	}
+	candidates := []Interface{
+		{Number: 1, SubnetID: "subnet-large", IPv4s: ip(8)},
+		{Number: 2, SubnetID: "subnet-small", IPv4s: ip(2)},
+		{Number: 3, SubnetID: "subnet-full", IPv4s: ip(1)},
+		{Number: 4, SubnetID: "subnet-large", IPv4s: ip(2)},
+	}
+	subnets := []Subnet{
+		{ID: "subnet-small", AvailableAddressCount: 10},
+		{ID: "subnet-large", AvailableAddressCount: 100},
+		{ID: "subnet-full", AvailableAddressCount: 0},
+	}
+
+	cases := []struct {
+		Strategy AllocationStrategy
+		Expected int
+	}{
+		{Strategy: FirstAvailable, Expected: 1},
+		{Strategy: "", Expected: 1},
+		{Strategy: LeastLoaded, Expected: 2},
+	}
+
+	for i, c := range cases {
+		intf := chooseInterface(candidates, subnets, c.Strategy)
+		if intf == nil || intf.Number != c.Expected {
+			t.Fatalf("%d expected eth%d for %q, got %v", i, c.Expected, c.Strategy, intf)
+		}
+	}
+
+	if intf := chooseInterface(nil, subnets, LeastLoaded); intf != nil {
+		t.Fatalf("chose %v without candidates", intf)
+	}
+}
+
+func TestChooseIPv6Interface(t *testing.T) {
+	ip := func(count int) []net.IP {
+		return make([]net.IP, count)
+	}
+	_, v6Subnet, _ := net.ParseCIDR("2600:1f14::/64")
+	interfaces := []Interface{
+		{Number: 0, SubnetID: "subnet-a", SubnetIPv6Cidr: v6Subnet},
+		{Number: 1, SubnetID: "subnet-v4"},
+		{Number: 2, SubnetID: "subnet-a", SubnetIPv6Cidr: v6Subnet, IPv6s: ip(4)},
+		{Number: 3, SubnetID: "subnet-b", SubnetIPv6Cidr: v6Subnet, IPv6s: ip(1)},
+	}
+	limits := ENILimit{IPv6: 4}
+
+	cases := []struct {
+		Index     int
+		SubnetIDs []string
+		Expected  int
+	}{
+		{Index: 0, Expected: 0},
+		// eth1 has no IPv6 subnet and eth2 is full
+		{Index: 1, Expected: 3},
+		{Index: 0, SubnetIDs: []string{"subnet-b"}, Expected: 3},
+		{Index: 1, SubnetIDs: []string{"subnet-a"}, Expected: -1},
+	}
+
+	for i, c := range cases {
+		intf := chooseIPv6Interface(interfaces, limits, c.Index, c.SubnetIDs)
+		if c.Expected < 0 {
+			if intf != nil {
+				t.Fatalf("%d expected no interface, got eth%d", i, intf.Number)
+			}
+			continue
+		}
+		if intf == nil || intf.Number != c.Expected {
+			t.Fatalf("%d expected eth%d, got %v", i, c.Expected, intf)
+		}
+	}
+}
+
+func TestChooseInterfaceForIP(t *testing.T) {
+	_, subnetA, _ := net.ParseCIDR("10.0.0.0/24")
+	_, subnetB, _ := net.ParseCIDR("10.0.1.0/24")
+	interfaces := []Interface{
+		{ID: "eni-0", Number: 0, SubnetCidr: subnetA, IPv4s: []net.IP{net.ParseIP("10.0.0.10")}},
+		{ID: "eni-1", Number: 1, SubnetCidr: subnetA, IPv4s: []net.IP{net.ParseIP("10.0.0.11"), net.ParseIP("10.0.0.12")}},
+		{ID: "eni-2", Number: 2, SubnetCidr: subnetB, IPv4s: []net.IP{net.ParseIP("10.0.1.10")}},
+	}
+	limits := ENILimit{IPv4: 2}
+
+	cases := []struct {
+		IP       string
+		Expected string
+	}{
+		{IP: "10.0.1.20", Expected: "eni-2"},
+		// eth1 is full and eth0 is below the index
+		{IP: "10.0.0.20", Expected: ""},
+		{IP: "10.0.0.12", Expected: ""},
+		{IP: "10.0.1.3", Expected: ""},
+		{IP: "10.0.1.255", Expected: ""},
+		{IP: "10.0.2.20", Expected: ""},
+		{IP: "2600:1f14::10", Expected: ""},
+	}
+
+	for i, c := range cases {
+		intf, err := chooseInterfaceForIP(interfaces, limits, 1, net.ParseIP(c.IP))
+		if c.Expected == "" {
+			if err == nil {
+				t.Fatalf("%d expected no interface for %v, got %v", i, c.IP, intf.ID)
+			}
+			continue
+		}
+		if err != nil || intf.ID != c.Expected {
+			t.Fatalf("%d expected %v for %v, got %v: %v", i, c.Expected, c.IP, intf, err)
+		}
+	}
+}
+
+func TestAddedIPs(t *testing.T) {
+	previous := []net.IP{net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.11")}
+	current := []net.IP{net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.11"), net.ParseIP("10.0.0.12"), net.ParseIP("10.0.0.13")}
+
+	added := addedIPs(previous, current)
+	if !reflect.DeepEqual(added, current[2:]) {
+		t.Fatalf("expected %v to be added, got %v", current[2:], added)
+	}
+	if added := addedIPs(current, previous); len(added) != 0 {
+		t.Fatalf("expected nothing to be added, got %v", added)
+	}
+}
@@ -0,0 +1,130 @@
+package aws
+
+import (
+	"context"
+	"net"
+)
+
+// Client is the EC2 and instance metadata API the plugin allocates
+// through, so tests can substitute FakeClient for a real instance. Calls
+// taking a context give up once it's done.
+type Client interface {
+	GetInterfaces() ([]Interface, error)
+	GetSubnetsForInstance() ([]Subnet, error)
+	AvailabilityZone() (string, error)
+	SubnetIDsWithTags(tags map[string]string) ([]string, error)
+	AttachedInterface(interfaceID string) (*Interface, error)
+	IsIPAssigned(interfaceID string, ip net.IP) (bool, error)
+	AllocateIPOn(ctx context.Context, intf Interface) (*AllocationResult, error)
+	AllocateIPAtIndex(ctx context.Context, index int, strategy AllocationStrategy, subnetIDs []string) (*AllocationResult, error)
+	AllocateSpecificIPAtIndex(ctx context.Context, index int, ip net.IP) (*AllocationResult, error)
+	AllocateIPv6On(ctx context.Context, intf Interface) (*net.IP, error)
+	AllocateIPv6AtIndex(ctx context.Context, index int, subnetIDs []string) (*AllocationResult, error)
+	NewInterface(ctx context.Context, opts InterfaceOptions) (*Interface, error)
+	FreeInterface(intf Interface) error
+	DeallocateIPs(ctx context.Context, ips []net.IP) (int, error)
+	ManagedIPCount() (int, error)
+	SubnetRoutes(intf Interface) ([]*net.IPNet, error)
+	ENILimits() ENILimit
+	CheckMetadata() error
+	CheckDescribeInstance() error
+}
+
+// EC2Client is the Client backed by EC2 and the metadata service of the
+// instance, through this package's functions
+type EC2Client struct{}
+
+// GetInterfaces calls GetInterfaces
+func (EC2Client) GetInterfaces() ([]Interface, error) {
+	return GetInterfaces()
+}
+
+// GetSubnetsForInstance calls GetSubnetsForInstance
+func (EC2Client) GetSubnetsForInstance() ([]Subnet, error) {
+	return GetSubnetsForInstance()
+}
+
+// AvailabilityZone calls AvailabilityZone
+func (EC2Client) AvailabilityZone() (string, error) {
+	return AvailabilityZone()
+}
+
+// SubnetIDsWithTags calls SubnetIDsWithTags
+func (EC2Client) SubnetIDsWithTags(tags map[string]string) ([]string, error) {
+	return SubnetIDsWithTags(tags)
+}
+
+// AttachedInterface calls AttachedInterface
+func (EC2Client) AttachedInterface(interfaceID string) (*Interface, error) {
+	return AttachedInterface(interfaceID)
+}
+
+// IsIPAssigned calls IsIPAssigned
+func (EC2Client) IsIPAssigned(interfaceID string, ip net.IP) (bool, error) {
+	return IsIPAssigned(interfaceID, ip)
+}
+
+// AllocateIPOn calls AllocateIPOn
+func (EC2Client) AllocateIPOn(ctx context.Context, intf Interface) (*AllocationResult, error) {
+	return AllocateIPOn(ctx, intf)
+}
+
+// AllocateIPAtIndex calls AllocateIPAtIndex
+func (EC2Client) AllocateIPAtIndex(ctx context.Context, index int, strategy AllocationStrategy, subnetIDs []string) (*AllocationResult, error) {
+	return AllocateIPAtIndex(ctx, index, strategy, subnetIDs)
+}
+
+// AllocateSpecificIPAtIndex calls AllocateSpecificIPAtIndex
+func (EC2Client) AllocateSpecificIPAtIndex(ctx context.Context, index int, ip net.IP) (*AllocationResult, error) {
+	return AllocateSpecificIPAtIndex(ctx, index, ip)
+}
+
+// AllocateIPv6On calls AllocateIPv6On
+func (EC2Client) AllocateIPv6On(ctx context.Context, intf Interface) (*net.IP, error) {
+	return AllocateIPv6On(ctx, intf)
+}
+
+// AllocateIPv6AtIndex calls AllocateIPv6AtIndex
+func (EC2Client) AllocateIPv6AtIndex(ctx context.Context, index int, subnetIDs []string) (*AllocationResult, error) {
+	return AllocateIPv6AtIndex(ctx, index, subnetIDs)
+}
+
+// NewInterface calls NewInterface
+func (EC2Client) NewInterface(ctx context.Context, opts InterfaceOptions) (*Interface, error) {
+	return NewInterface(ctx, opts)
+}
+
+// FreeInterface calls FreeInterface
+func (EC2Client) FreeInterface(intf Interface) error {
+	return FreeInterface(intf)
+}
+
+// DeallocateIPs calls DeallocateIPs
+func (EC2Client) DeallocateIPs(ctx context.Context, ips []net.IP) (int, error) {
+	return DeallocateIPs(ctx, ips)
+}
+
+// ManagedIPCount calls ManagedIPCount
+func (EC2Client) ManagedIPCount() (int, error) {
+	return ManagedIPCount()
+}
+
+// SubnetRoutes calls SubnetRoutes
+func (EC2Client) SubnetRoutes(intf Interface) ([]*net.IPNet, error) {
+	return SubnetRoutes(intf)
+}
+
+// ENILimits calls ENILimits
+func (EC2Client) ENILimits() ENILimit {
+	return ENILimits()
+}
+
+// CheckMetadata calls CheckMetadata
+func (EC2Client) CheckMetadata() error {
+	return CheckMetadata()
+}
+
+// CheckDescribeInstance calls CheckDescribeInstance
+func (EC2Client) CheckDescribeInstance() error {
+	return CheckDescribeInstance()
+}
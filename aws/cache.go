@@ -0,0 +1,138 @@
+package aws
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	metadataCacheFile = "/run/cni-ipvlan-vpc-k8s/metadata-cache.json"
+	metadataCacheTTL  time.Duration
+)
+
+// Metadata keys that change as IPs are allocated and are never cached
+var uncachedMetadataKeys = map[string]bool{
+	"local-ipv4s": true,
+	"ipv6s":       true,
+}
+
+type metadataCacheEntry struct {
+	Value   string    `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+type metadataCache struct {
+	Entries map[string]metadataCacheEntry `json:"entries"`
+}
+
+var _metadataCache *metadataCache
+var _metadataCacheLock sync.Mutex
+
+// SetMetadataCacheTTL enables an on-disk cache, shared across invocations,
+// of the relatively static instance metadata: the instance identity and the
+// subnet and VPC details of each interface. Addresses assigned to
+// interfaces are always read live. A zero TTL disables the cache.
+func SetMetadataCacheTTL(ttl time.Duration) {
+	metadataCacheTTL = ttl
+}
+
+// cachedMetadata returns the cached value for key, calling fetch and
+// caching its result if there is no unexpired entry. Failed fetches are
+// not cached.
+func cachedMetadata(key string, fetch func() (string, error)) (string, error) {
+	if metadataCacheTTL <= 0 || uncachedMetadataKeys[filepath.Base(key)] {
+		return fetch()
+	}
+
+	_metadataCacheLock.Lock()
+	defer _metadataCacheLock.Unlock()
+
+	cache := loadMetadataCache()
+	if entry, ok := cache.Entries[key]; ok && time.Now().Before(entry.Expires) {
+		return entry.Value, nil
+	}
+
+	value, err := fetch()
+	if err != nil {
+		return value, err
+	}
+	cache.Entries[key] = metadataCacheEntry{
+		Value:   value,
+		Expires: time.Now().Add(metadataCacheTTL),
+	}
+	// The cache is an optimization only, so failing to persist it is fine
+	_ = saveMetadataCache(cache)
+	return value, nil
+}
+
+// invalidateMetadataCache drops every cached entry whose key starts with
+// prefix, for example after the interface topology changes
+func invalidateMetadataCache(prefix string) {
+	if metadataCacheTTL <= 0 {
+		return
+	}
+
+	_metadataCacheLock.Lock()
+	defer _metadataCacheLock.Unlock()
+
+	cache := loadMetadataCache()
+	for key := range cache.Entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(cache.Entries, key)
+		}
+	}
+	_ = saveMetadataCache(cache)
+}
+
+func loadMetadataCache() *metadataCache {
+	if _metadataCache != nil {
+		return _metadataCache
+	}
+
+	cache := &metadataCache{}
+	if data, err := ioutil.ReadFile(metadataCacheFile); err == nil {
+		// A corrupt cache is treated as empty and overwritten
+		_ = json.Unmarshal(data, cache)
+	}
+	if cache.Entries == nil {
+		cache.Entries = map[string]metadataCacheEntry{}
+	}
+	_metadataCache = cache
+	return cache
+}
+
+func saveMetadataCache(cache *metadataCache) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(metadataCacheFile, data)
+}
+
+// writeFileAtomic replaces the file at path, so concurrent invocations
+// never read a partial file
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,90 @@
+package aws
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func withTestMetadataCache(t *testing.T, ttl time.Duration) func() {
+	dir, err := ioutil.TempDir("", "metadata-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldFile, oldTTL := metadataCacheFile, metadataCacheTTL
+	metadataCacheFile = filepath.Join(dir, "cache.json")
+	metadataCacheTTL = ttl
+	_metadataCache = nil
+	return func() {
+		metadataCacheFile, metadataCacheTTL = oldFile, oldTTL
+		_metadataCache = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCachedMetadata(t *testing.T) {
+	defer withTestMetadataCache(t, time.Minute)()
+
+	fetches := 0
+	fetch := func() (string, error) {
+		fetches++
+		return "subnet-lyft", nil
+	}
+	key := "network/interfaces/macs/0a:00:00:00:00:01/subnet-id"
+
+	for i := 0; i < 2; i++ {
+		value, err := cachedMetadata(key, fetch)
+		if err != nil || value != "subnet-lyft" {
+			t.Fatalf("unexpected result %q, %v", value, err)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expected a single fetch, got %d", fetches)
+	}
+
+	// A new process reads the persisted entry
+	_metadataCache = nil
+	if _, err := cachedMetadata(key, fetch); err != nil || fetches != 1 {
+		t.Fatalf("cache wasn't persisted, %d fetches: %v", fetches, err)
+	}
+
+	invalidateMetadataCache("network/interfaces/")
+	if _, err := cachedMetadata(key, fetch); err != nil || fetches != 2 {
+		t.Fatalf("invalidated entry was used, %d fetches: %v", fetches, err)
+	}
+}
+
+func TestCachedMetadataUncached(t *testing.T) {
+	defer withTestMetadataCache(t, time.Minute)()
+
+	fetches := 0
+	fetch := func() (string, error) {
+		fetches++
+		return "10.0.0.10", nil
+	}
+	for i := 0; i < 2; i++ {
+		cachedMetadata("network/interfaces/macs/0a:00:00:00:00:01//local-ipv4s", fetch)
+	}
+	if fetches != 2 {
+		t.Fatalf("assigned addresses were cached, %d fetches", fetches)
+	}
+}
+
+func TestCachedMetadataExpiry(t *testing.T) {
+	defer withTestMetadataCache(t, time.Nanosecond)()
+
+	fetches := 0
+	fetch := func() (string, error) {
+		fetches++
+		return "vpc-lyft", nil
+	}
+	for i := 0; i < 2; i++ {
+		cachedMetadata("network/interfaces/macs/0a:00:00:00:00:01/vpc-id", fetch)
+		time.Sleep(time.Millisecond)
+	}
+	if fetches != 2 {
+		t.Fatalf("expired entry was used, %d fetches", fetches)
+	}
+}
@@ -1,10 +1,15 @@
 package aws
 
 import (
+	"encoding/json"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
@@ -13,48 +18,163 @@ import (
 var sess *session.Session
 var metaData *ec2metadata.EC2Metadata
 
+// _idDoc and _ec2Client are only cached once they're known, so a failed
+// metadata request is retried by the next call rather than leaving them
+// nil
 var _idDoc *ec2metadata.EC2InstanceIdentityDocument
-var _onceIDDoc sync.Once
+var _idDocLock sync.Mutex
 
 var _ec2Client ec2iface.EC2API
-var _onceEc2 sync.Once
+var _ec2Lock sync.Mutex
+
+var assumeRoleARN string
+var assumeRoleExternalID string
+
+var regionOverride string
+var ec2Endpoint string
+var useFIPSEndpoint bool
+
+// assumeRoleExpiryWindow refreshes assumed credentials this long before
+// they expire
+const assumeRoleExpiryWindow = 1 * time.Minute
+
+// CallObserver is notified after every EC2 API call with the operation
+// name, how long the call took and the error it returned, if any
+type CallObserver func(operation string, duration time.Duration, err error)
+
+var callObservers []CallObserver
+
+// ObserveCalls registers an observer for all subsequent EC2 API calls
+func ObserveCalls(observer CallObserver) {
+	callObservers = append(callObservers, observer)
+}
+
+func notifyObservers(r *request.Request) {
+	for _, observer := range callObservers {
+		observer(r.Operation.Name, time.Since(r.Time), r.Error)
+	}
+	traceCall(r)
+}
 
 func init() {
 	sess = session.Must(session.NewSession())
 	metaData = ec2metadata.New(sess)
+	// Session tokens are requested by imdsTokenHandler, which fails
+	// closed with the reason when the metadata service can't be used. It
+	// signs every attempt, as retries are signed again but not rebuilt.
+	metaData.Handlers.Sign.RemoveByName("FetchTokenHandler")
+	metaData.Handlers.Sign.PushBack(imdsTokenHandler)
+	metaData.Handlers.Retry.PushBack(imdsTokenRejectedHandler)
 }
 
 func getIDDoc() (*ec2metadata.EC2InstanceIdentityDocument, error) {
-	var err error
-	_onceIDDoc.Do(func() {
-		// Allow mock ID documents to be inserted
-		if _idDoc == nil {
-			var instance ec2metadata.EC2InstanceIdentityDocument
-			instance, err = metaData.GetInstanceIdentityDocument()
-			if err != nil {
-				return
-			}
-			// Cache the document
-			_idDoc = &instance
-		}
+	_idDocLock.Lock()
+	defer _idDocLock.Unlock()
+	// Allow mock ID documents to be inserted
+	if _idDoc != nil {
+		return _idDoc, nil
+	}
+	doc, err := cachedMetadata("dynamic/instance-identity/document", func() (string, error) {
+		return metaData.GetDynamicData("instance-identity/document")
 	})
-	return _idDoc, err
+	if err != nil {
+		return nil, err
+	}
+	var instance ec2metadata.EC2InstanceIdentityDocument
+	if err := json.Unmarshal([]byte(doc), &instance); err != nil {
+		return nil, err
+	}
+	// Cache the document
+	_idDoc = &instance
+	return _idDoc, nil
+}
+
+// AvailabilityZone returns the availability zone of the instance, which
+// all of its interfaces are in
+func AvailabilityZone() (string, error) {
+	idDoc, err := getIDDoc()
+	if err != nil {
+		return "", err
+	}
+	return idDoc.AvailabilityZone, nil
+}
+
+// SetAssumeRole makes all EC2 calls with credentials from assuming the
+// role, for example to manage interfaces in subnets shared from another
+// account. The external ID is optional. It must be called before the first
+// EC2 call.
+func SetAssumeRole(roleARN, externalID string) {
+	assumeRoleARN = roleARN
+	assumeRoleExternalID = externalID
+}
+
+// SetEndpoints overrides the region read from the instance identity
+// document and the EC2 endpoint resolved for it, for example in isolated
+// regions, and selects FIPS endpoints. Empty values keep the defaults. It
+// must be called before the first EC2 call.
+func SetEndpoints(region, ec2EndpointURL string, useFIPS bool) {
+	regionOverride = region
+	ec2Endpoint = ec2EndpointURL
+	useFIPSEndpoint = useFIPS
+}
+
+// clientRegion returns the region AWS clients are configured for
+func clientRegion(idDoc *ec2metadata.EC2InstanceIdentityDocument) string {
+	if regionOverride != "" {
+		return regionOverride
+	}
+	return idDoc.Region
+}
+
+// newEndpointConfig returns the region and endpoint variant configuration
+// shared by all AWS clients
+func newEndpointConfig(region string) *aws.Config {
+	config := aws.NewConfig().WithRegion(region)
+	if useFIPSEndpoint {
+		config.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	return config
+}
+
+// newEC2Config returns the configuration of EC2 clients in a region
+func newEC2Config(region string) *aws.Config {
+	// Retries are handled by withRetry so the SDK's own retryer is disabled.
+	config := newEndpointConfig(region).WithMaxRetries(0)
+	if assumeRoleARN != "" {
+		// The credentials are cached by the client and refreshed before
+		// they expire
+		stsSess := sess.Copy(newEndpointConfig(region))
+		creds := stscreds.NewCredentials(stsSess, assumeRoleARN, func(p *stscreds.AssumeRoleProvider) {
+			if assumeRoleExternalID != "" {
+				p.ExternalID = aws.String(assumeRoleExternalID)
+			}
+			p.ExpiryWindow = assumeRoleExpiryWindow
+		})
+		config = config.WithCredentials(creds)
+	}
+	return config
 }
 
 // Allocate a new EC2 client configured for the current instance
 // region. Clients are re-used across multiple calls
 func newEC2() (ec2iface.EC2API, error) {
-	var err error
-	_onceEc2.Do(func() {
-		var id *ec2metadata.EC2InstanceIdentityDocument
-		id, err = getIDDoc()
-		if err != nil {
-			return
-		}
-		if _ec2Client == nil {
-			// Use the sess object already defined
-			_ec2Client = ec2.New(sess, aws.NewConfig().WithRegion(id.Region))
-		}
-	})
-	return _ec2Client, err
+	_ec2Lock.Lock()
+	defer _ec2Lock.Unlock()
+	// Allow mock clients to be inserted
+	if _ec2Client != nil {
+		return _ec2Client, nil
+	}
+	id, err := getIDDoc()
+	if err != nil {
+		return nil, err
+	}
+	// Use the sess object already defined
+	config := newEC2Config(clientRegion(id))
+	if ec2Endpoint != "" {
+		config = config.WithEndpoint(ec2Endpoint)
+	}
+	client := ec2.New(sess, config)
+	client.Handlers.Complete.PushBack(notifyObservers)
+	_ec2Client = client
+	return _ec2Client, nil
 }
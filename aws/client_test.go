@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 )
 
 func TestClientCreate(t *testing.T) {
@@ -30,3 +31,59 @@ func TestClientCreate(t *testing.T) {
 	}
 
 }
+
+func TestIDDocRetried(t *testing.T) {
+	oldIDDoc := _idDoc
+	defer func() { _idDoc = oldIDDoc }()
+	_idDoc = nil
+
+	data := map[string]string{}
+	defer newMetadataServer(t, data)()
+
+	// A failed fetch is returned rather than a nil document
+	if _, err := AvailabilityZone(); err == nil {
+		t.Fatalf("expected an error without an identity document")
+	}
+	data["/latest/dynamic/instance-identity/document"] = `{"region": "us-east-1", "availabilityZone": "us-east-1a"}`
+	az, err := AvailabilityZone()
+	if err != nil || az != "us-east-1a" {
+		t.Fatalf("expected the fetch to be retried, got %v, %v", az, err)
+	}
+}
+
+func TestEC2ConfigAssumeRole(t *testing.T) {
+	defer SetAssumeRole("", "")
+
+	if config := newEC2Config("us-east-1"); config.Credentials != nil {
+		t.Errorf("Credentials were overridden without a role")
+	}
+
+	SetAssumeRole("arn:aws:iam::123456789012:role/cni-ipvlan-vpc-k8s", "lyft")
+	config := newEC2Config("us-east-1")
+	if config.Credentials == nil {
+		t.Fatalf("Assumed role credentials weren't configured")
+	}
+	if *config.Region != "us-east-1" {
+		t.Errorf("Unexpected region %v", *config.Region)
+	}
+}
+
+func TestEndpointOverrides(t *testing.T) {
+	defer SetEndpoints("", "", false)
+	idDoc := &ec2metadata.EC2InstanceIdentityDocument{Region: "us-gov-west-1"}
+
+	if region := clientRegion(idDoc); region != "us-gov-west-1" {
+		t.Errorf("Expected the instance's region, got %v", region)
+	}
+	if config := newEC2Config("us-gov-west-1"); config.UseFIPSEndpoint != endpoints.FIPSEndpointStateUnset {
+		t.Errorf("FIPS endpoints were selected by default")
+	}
+
+	SetEndpoints("us-isob-east-1", "https://ec2.us-isob-east-1.sc2s.sgov.gov", true)
+	if region := clientRegion(idDoc); region != "us-isob-east-1" {
+		t.Errorf("Expected the overridden region, got %v", region)
+	}
+	if config := newEC2Config("us-isob-east-1"); config.UseFIPSEndpoint != endpoints.FIPSEndpointStateEnabled {
+		t.Errorf("FIPS endpoints weren't selected")
+	}
+}
@@ -0,0 +1,68 @@
+package aws
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"time"
+)
+
+// emptyInterfacesFile records when each empty interface may be released,
+// shared across invocations. Callers of ReleaseEmptyInterfaces exclude each
+// other, so it needs no lock of its own.
+var emptyInterfacesFile = "/run/cni-ipvlan-vpc-k8s/empty-interfaces.json"
+
+// releaseDeadlines maps interface IDs to when they may be released
+type releaseDeadlines map[string]time.Time
+
+// cooledDown returns the empty interfaces whose cooldown has passed and
+// the deadlines of the others. Interfaces no longer empty lose their
+// deadline, new ones get a deadline a cooldown plus up to a quarter of it
+// in jitter from now, so nodes cycling pods in lockstep don't release at
+// the same moment.
+func cooledDown(empty []string, deadlines releaseDeadlines, now time.Time, cooldown time.Duration) ([]string, releaseDeadlines) {
+	var release []string
+	pending := releaseDeadlines{}
+	for _, id := range empty {
+		deadline, ok := deadlines[id]
+		if !ok {
+			jitter := time.Duration(rand.Int63n(int64(cooldown)/4 + 1))
+			deadline = now.Add(cooldown + jitter)
+		}
+		if now.Before(deadline) {
+			pending[id] = deadline
+		} else {
+			release = append(release, id)
+		}
+	}
+	return release, pending
+}
+
+// nextDeadline returns the earliest deadline, or the zero time if there
+// are none
+func (d releaseDeadlines) nextDeadline() time.Time {
+	var next time.Time
+	for _, deadline := range d {
+		if next.IsZero() || deadline.Before(next) {
+			next = deadline
+		}
+	}
+	return next
+}
+
+func loadReleaseDeadlines() releaseDeadlines {
+	deadlines := releaseDeadlines{}
+	if data, err := ioutil.ReadFile(emptyInterfacesFile); err == nil {
+		// Corrupt state restarts every cooldown
+		_ = json.Unmarshal(data, &deadlines)
+	}
+	return deadlines
+}
+
+func saveReleaseDeadlines(deadlines releaseDeadlines) error {
+	data, err := json.Marshal(deadlines)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(emptyInterfacesFile, data)
+}
@@ -0,0 +1,35 @@
+package aws
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCooledDown(t *testing.T) {
+	now := time.Now()
+	cooldown := time.Minute
+	deadlines := releaseDeadlines{
+		"eni-due":    now.Add(-time.Second),
+		"eni-cool":   now.Add(time.Second),
+		"eni-reused": now.Add(-time.Second),
+	}
+
+	release, pending := cooledDown([]string{"eni-due", "eni-cool", "eni-new"}, deadlines, now, cooldown)
+	if !reflect.DeepEqual(release, []string{"eni-due"}) {
+		t.Fatalf("expected only eni-due to be released, got %v", release)
+	}
+	if _, ok := pending["eni-reused"]; ok {
+		t.Fatalf("interface no longer empty kept its deadline")
+	}
+	if pending["eni-cool"] != deadlines["eni-cool"] {
+		t.Fatalf("existing deadline was changed")
+	}
+	deadline := pending["eni-new"]
+	if deadline.Before(now.Add(cooldown)) || deadline.After(now.Add(cooldown*5/4)) {
+		t.Fatalf("deadline %v of a new empty interface is outside its jittered cooldown", deadline)
+	}
+	if next := pending.nextDeadline(); next != deadlines["eni-cool"] {
+		t.Fatalf("expected the next deadline %v, got %v", deadlines["eni-cool"], next)
+	}
+}
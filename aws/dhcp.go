@@ -0,0 +1,107 @@
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// AmazonProvidedDNS is the domain-name-servers value of DHCP options
+// pointing at the VPC resolver
+const AmazonProvidedDNS = "AmazonProvidedDNS"
+
+// DHCPOptions are the DNS settings of a VPC's DHCP options set
+type DHCPOptions struct {
+	DomainNameServers []string
+	DomainName        string
+}
+
+// VPCDHCPOptions returns the DNS settings of the DHCP options set
+// associated with the VPC. Lookups are kept in the metadata cache.
+func VPCDHCPOptions(vpcID string) (*DHCPOptions, error) {
+	value, err := cachedMetadata("ec2/dhcp-options/"+vpcID, func() (string, error) {
+		options, err := describeVPCDHCPOptions(vpcID)
+		if err != nil {
+			return "", err
+		}
+		data, err := json.Marshal(options)
+		return string(data), err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	options := &DHCPOptions{}
+	if err := json.Unmarshal([]byte(value), options); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+func describeVPCDHCPOptions(vpcID string) (*DHCPOptions, error) {
+	client, err := newEC2()
+	if err != nil {
+		return nil, err
+	}
+
+	var vpcs *ec2.DescribeVpcsOutput
+	err = withRetry(func() (err error) {
+		vpcs, err = client.DescribeVpcs(&ec2.DescribeVpcsInput{
+			VpcIds: []*string{aws.String(vpcID)},
+		})
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(vpcs.Vpcs) == 0 {
+		return nil, fmt.Errorf("VPC %v not found", vpcID)
+	}
+
+	// VPCs without a DHCP options set use the VPC resolver
+	optionsID := aws.StringValue(vpcs.Vpcs[0].DhcpOptionsId)
+	if optionsID == "" || optionsID == "default" {
+		return &DHCPOptions{DomainNameServers: []string{AmazonProvidedDNS}}, nil
+	}
+
+	var output *ec2.DescribeDhcpOptionsOutput
+	err = withRetry(func() (err error) {
+		output, err = client.DescribeDhcpOptions(&ec2.DescribeDhcpOptionsInput{
+			DhcpOptionsIds: []*string{aws.String(optionsID)},
+		})
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(output.DhcpOptions) == 0 {
+		return nil, fmt.Errorf("DHCP options %v of VPC %v not found", optionsID, vpcID)
+	}
+	return parseDHCPOptions(output.DhcpOptions[0].DhcpConfigurations), nil
+}
+
+// parseDHCPOptions extracts the DNS settings of a DHCP options set. Only
+// the first of several space separated domain names is kept.
+func parseDHCPOptions(configurations []*ec2.DhcpConfiguration) *DHCPOptions {
+	options := &DHCPOptions{}
+	for _, config := range configurations {
+		var values []string
+		for _, value := range config.Values {
+			values = append(values, aws.StringValue(value.Value))
+		}
+		switch aws.StringValue(config.Key) {
+		case "domain-name-servers":
+			options.DomainNameServers = values
+		case "domain-name":
+			if len(values) > 0 {
+				if fields := strings.Fields(values[0]); len(fields) > 0 {
+					options.DomainName = fields[0]
+				}
+			}
+		}
+	}
+	return options
+}
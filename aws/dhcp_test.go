@@ -0,0 +1,32 @@
+package aws
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestParseDHCPOptions(t *testing.T) {
+	configuration := func(key string, values ...string) *ec2.DhcpConfiguration {
+		config := &ec2.DhcpConfiguration{Key: aws.String(key)}
+		for _, value := range values {
+			config.Values = append(config.Values, &ec2.AttributeValue{Value: aws.String(value)})
+		}
+		return config
+	}
+
+	options := parseDHCPOptions([]*ec2.DhcpConfiguration{
+		configuration("domain-name-servers", "10.1.0.2", AmazonProvidedDNS),
+		configuration("domain-name", "corp.example.com example.com"),
+		configuration("ntp-servers", "10.1.0.3"),
+	})
+	expected := &DHCPOptions{
+		DomainNameServers: []string{"10.1.0.2", AmazonProvidedDNS},
+		DomainName:        "corp.example.com",
+	}
+	if !reflect.DeepEqual(options, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, options)
+	}
+}
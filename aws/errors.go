@@ -0,0 +1,87 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Kinds of failures callers can handle programmatically, as returned by
+// ErrorKind
+var (
+	// ErrInsufficientIPs means no IP could be allocated, as the subnets or
+	// interfaces are full or the configured budget is used up
+	ErrInsufficientIPs = errors.New("insufficient IP addresses")
+	// ErrThrottled means EC2 kept throttling requests through the retries
+	ErrThrottled = errors.New("EC2 requests throttled")
+	// ErrENILimit means no more interfaces can be attached to the instance
+	ErrENILimit = errors.New("ENI limit reached")
+	// ErrConfig means the configuration, or the permissions and resources
+	// it names, can never work
+	ErrConfig = errors.New("invalid configuration")
+)
+
+// EC2 error codes of each kind of failure
+var ec2ErrorKinds = map[string]error{
+	"InsufficientFreeAddressesInSubnet": ErrInsufficientIPs,
+	"InsufficientCidrBlocks":            ErrInsufficientIPs,
+	"PrivateIpAddressLimitExceeded":     ErrInsufficientIPs,
+	"AttachmentLimitExceeded":           ErrENILimit,
+	"NetworkInterfaceLimitExceeded":     ErrENILimit,
+	"RequestLimitExceeded":              ErrThrottled,
+	"Throttling":                        ErrThrottled,
+	"ThrottlingException":               ErrThrottled,
+	"RequestThrottled":                  ErrThrottled,
+	"UnauthorizedOperation":             ErrConfig,
+	"AuthFailure":                       ErrConfig,
+	"InvalidParameterValue":             ErrConfig,
+	"InvalidParameterCombination":       ErrConfig,
+	"InvalidGroup.NotFound":             ErrConfig,
+	"InvalidSecurityGroupID.NotFound":   ErrConfig,
+	"InvalidSubnetID.NotFound":          ErrConfig,
+}
+
+// Error is a failure of a known kind
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// ErrorKind returns which of ErrInsufficientIPs, ErrThrottled, ErrENILimit
+// and ErrConfig err is, from its type or EC2 error code, or nil if it's
+// none of them
+func ErrorKind(err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *Error:
+		return e.Kind
+	case SubnetExhaustedError:
+		return ErrInsufficientIPs
+	case DeallocationError:
+		return ErrorKind(e.Err)
+	case awserr.Error:
+		return ec2ErrorKinds[e.Code()]
+	}
+	return nil
+}
+
+// WrapError formats an error like fmt.Errorf, keeping the kind of err it
+// describes
+func WrapError(err error, format string, args ...interface{}) error {
+	wrapped := fmt.Errorf(format, args...)
+	if kind := ErrorKind(err); kind != nil {
+		return &Error{Kind: kind, Err: wrapped}
+	}
+	return wrapped
+}
+
+// newError returns an error of a kind formatted like fmt.Errorf
+func newError(kind error, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,45 @@
+package aws
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestErrorKind(t *testing.T) {
+	exhausted := awserr.New("InsufficientFreeAddressesInSubnet", "subnet full", nil)
+	cases := []struct {
+		Err  error
+		Kind error
+	}{
+		{nil, nil},
+		{fmt.Errorf("link down"), nil},
+		{exhausted, ErrInsufficientIPs},
+		{SubnetExhaustedError{SubnetID: "subnet-a", Err: exhausted}, ErrInsufficientIPs},
+		{awserr.New("AttachmentLimitExceeded", "no more", nil), ErrENILimit},
+		{awserr.New("Throttling", "slow down", nil), ErrThrottled},
+		{DeallocationError{Err: awserr.New("RequestLimitExceeded", "slow down", nil)}, ErrThrottled},
+		{awserr.New("UnauthorizedOperation", "denied", nil), ErrConfig},
+		{awserr.New("InternalError", "try again", nil), nil},
+		{newError(ErrENILimit, "too many adapters"), ErrENILimit},
+	}
+	for i, c := range cases {
+		if kind := ErrorKind(c.Err); kind != c.Kind {
+			t.Fatalf("%d expected %v, got %v", i, c.Kind, kind)
+		}
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	err := awserr.New("InsufficientCidrBlocks", "no prefix", nil)
+	wrapped := WrapError(err, "unable to allocate due to %v", err)
+	if ErrorKind(wrapped) != ErrInsufficientIPs || wrapped.Error() != "unable to allocate due to "+err.Error() {
+		t.Fatalf("unexpected wrapped error %v", wrapped)
+	}
+
+	plain := WrapError(fmt.Errorf("link down"), "unable to allocate")
+	if _, ok := plain.(*Error); ok {
+		t.Fatalf("error of no kind was given one: %v", plain)
+	}
+}
@@ -0,0 +1,478 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// FakeClient is an in-memory Client for tests. It makes the same
+// allocation decisions as EC2Client against the interfaces and subnets it
+// holds, handing out addresses in order from each subnet, or /28 prefixes
+// with prefix delegation, and records the calls made. Calls fail with the
+// context's error once it's done.
+type FakeClient struct {
+	sync.Mutex
+	Interfaces []Interface
+	Subnets    []Subnet
+	Limits     ENILimit
+	AZ         string
+	Calls      []string
+	// DefaultSecurityGroup is the VPC default security group applied
+	// with UseVPCDefaultSecurityGroup
+	DefaultSecurityGroup string
+	// Moved are addresses EC2 reassigned to interfaces of other
+	// instances, which Interfaces still list like stale metadata does
+	Moved []string
+	// RouteTables are the importable destinations of each subnet's route
+	// table
+	RouteTables map[string][]*net.IPNet
+	// Unreachable fails the metadata and EC2 checks
+	Unreachable error
+}
+
+func (f *FakeClient) record(format string, args ...interface{}) {
+	f.Calls = append(f.Calls, fmt.Sprintf(format, args...))
+}
+
+func (f *FakeClient) interfaceWithID(id string) *Interface {
+	for i := range f.Interfaces {
+		if f.Interfaces[i].ID == id {
+			return &f.Interfaces[i]
+		}
+	}
+	return nil
+}
+
+// nextIP returns the first address of the block after the ones EC2
+// reserves which no interface holds
+func (f *FakeClient) nextIP(block *net.IPNet) (net.IP, error) {
+	if block == nil {
+		return nil, fmt.Errorf("no CIDR block available")
+	}
+	for offset := 4; ; offset++ {
+		ip, err := OffsetIP(block, offset)
+		if err != nil {
+			return nil, fmt.Errorf("no free addresses in %v", block)
+		}
+		if !f.inUse(ip) {
+			return ip, nil
+		}
+	}
+}
+
+// nextPrefix returns the first /28 of the block clear of the addresses EC2
+// reserves and of those any interface holds
+func (f *FakeClient) nextPrefix(block *net.IPNet) (*net.IPNet, error) {
+	if block == nil {
+		return nil, fmt.Errorf("no CIDR block available")
+	}
+	for offset := prefixSize; ; offset += prefixSize {
+		// The last /28 holds the broadcast address
+		if _, err := OffsetIP(block, offset+prefixSize); err != nil {
+			return nil, fmt.Errorf("no free prefixes in %v", block)
+		}
+		base, _ := OffsetIP(block, offset)
+		prefix := &net.IPNet{IP: base, Mask: net.CIDRMask(28, 32)}
+		free := true
+		for i := 0; i < prefixSize; i++ {
+			if ip, _ := OffsetIP(prefix, i); f.inUse(ip) {
+				free = false
+			}
+		}
+		if free {
+			return prefix, nil
+		}
+	}
+}
+
+// inUse reports whether any interface holds the address, individually or
+// in a prefix
+func (f *FakeClient) inUse(ip net.IP) bool {
+	if interfaceWithIP(f.Interfaces, ip) != nil {
+		return true
+	}
+	for _, intf := range f.Interfaces {
+		for _, prefix := range intf.IPv4Prefixes {
+			if prefix.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *FakeClient) assignIPv4(intf *Interface) (*AllocationResult, error) {
+	if intf.ipv4Slots() >= f.Limits.IPv4 {
+		return nil, newError(ErrInsufficientIPs, "interface %v has no room for another IP", intf.ID)
+	}
+	if prefixDelegation {
+		prefix, err := f.nextPrefix(intf.SubnetCidr)
+		if err != nil {
+			return nil, SubnetExhaustedError{
+				SubnetID: intf.SubnetID,
+				Err:      awserr.New("InsufficientCidrBlocks", err.Error(), nil),
+			}
+		}
+		intf.IPv4Prefixes = append(intf.IPv4Prefixes, prefix)
+		ip := append(net.IP{}, prefix.IP...)
+		return &AllocationResult{IP: &ip, Interface: copyInterface(*intf)}, nil
+	}
+	ip, err := f.nextIP(intf.SubnetCidr)
+	if err != nil {
+		return nil, SubnetExhaustedError{
+			SubnetID: intf.SubnetID,
+			Err:      awserr.New("InsufficientFreeAddressesInSubnet", err.Error(), nil),
+		}
+	}
+	intf.IPv4s = append(intf.IPv4s, ip)
+	return &AllocationResult{IP: &ip, Interface: copyInterface(*intf)}, nil
+}
+
+func (f *FakeClient) assignIPv6(intf *Interface) (*net.IP, error) {
+	if intf.SubnetIPv6Cidr == nil {
+		return nil, fmt.Errorf("subnet %v has no IPv6 CIDR block", intf.SubnetID)
+	}
+	ip, err := f.nextIP(intf.SubnetIPv6Cidr)
+	if err != nil {
+		return nil, err
+	}
+	intf.IPv6s = append(intf.IPv6s, ip)
+	return &ip, nil
+}
+
+func copyInterface(intf Interface) Interface {
+	intf.IPv4s = append([]net.IP{}, intf.IPv4s...)
+	intf.IPv6s = append([]net.IP{}, intf.IPv6s...)
+	intf.IPv4Prefixes = append([]*net.IPNet{}, intf.IPv4Prefixes...)
+	return intf
+}
+
+// GetInterfaces returns copies of the interfaces
+func (f *FakeClient) GetInterfaces() ([]Interface, error) {
+	f.Lock()
+	defer f.Unlock()
+	var interfaces []Interface
+	for _, intf := range f.Interfaces {
+		interfaces = append(interfaces, copyInterface(intf))
+	}
+	return interfaces, nil
+}
+
+// GetSubnetsForInstance returns the subnets
+func (f *FakeClient) GetSubnetsForInstance() ([]Subnet, error) {
+	f.Lock()
+	defer f.Unlock()
+	return append([]Subnet{}, f.Subnets...), nil
+}
+
+// AvailabilityZone returns the availability zone
+func (f *FakeClient) AvailabilityZone() (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.AZ, nil
+}
+
+// SubnetIDsWithTags returns the IDs of the subnets carrying all tags
+func (f *FakeClient) SubnetIDsWithTags(tags map[string]string) ([]string, error) {
+	f.Lock()
+	defer f.Unlock()
+	ids := []string{}
+	for _, subnet := range f.Subnets {
+		if subnet.HasTags(tags) {
+			ids = append(ids, subnet.ID)
+		}
+	}
+	return ids, nil
+}
+
+// AttachedInterface returns the interface with the ID
+func (f *FakeClient) AttachedInterface(interfaceID string) (*Interface, error) {
+	f.Lock()
+	defer f.Unlock()
+	intf := f.interfaceWithID(interfaceID)
+	if intf == nil {
+		return nil, fmt.Errorf("interface %v is not attached", interfaceID)
+	}
+	attached := copyInterface(*intf)
+	return &attached, nil
+}
+
+// IsIPAssigned reports whether the interface holds the address and it
+// hasn't been moved
+func (f *FakeClient) IsIPAssigned(interfaceID string, ip net.IP) (bool, error) {
+	f.Lock()
+	defer f.Unlock()
+	intf := f.interfaceWithID(interfaceID)
+	if intf == nil || containsString(f.Moved, ip.String()) {
+		return false, nil
+	}
+	if interfaceWithIP([]Interface{*intf}, ip) != nil {
+		return true, nil
+	}
+	for _, prefix := range intf.IPv4Prefixes {
+		if prefix.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AllocateIPOn assigns the next address of the interface's subnet
+func (f *FakeClient) AllocateIPOn(ctx context.Context, intf Interface) (*AllocationResult, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.record("AllocateIPOn %v", intf.ID)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	target := f.interfaceWithID(intf.ID)
+	if target == nil {
+		return nil, fmt.Errorf("interface %v is not attached", intf.ID)
+	}
+	return f.assignIPv4(target)
+}
+
+// AllocateIPAtIndex chooses the interface like EC2Client does
+func (f *FakeClient) AllocateIPAtIndex(ctx context.Context, index int, strategy AllocationStrategy, subnetIDs []string) (*AllocationResult, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.record("AllocateIPAtIndex %d", index)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	candidates := Pool{Index: index, SubnetIDs: subnetIDs}.WithRoom(f.Interfaces, f.Limits)
+	chosen := chooseInterface(candidates, append([]Subnet{}, f.Subnets...), strategy)
+	if chosen == nil {
+		return nil, newError(ErrInsufficientIPs, "Unable to allocate - no IPs available on any interfaces")
+	}
+	return f.assignIPv4(f.interfaceWithID(chosen.ID))
+}
+
+// AllocateSpecificIPAtIndex assigns ip to the interface EC2Client would
+// choose
+func (f *FakeClient) AllocateSpecificIPAtIndex(ctx context.Context, index int, ip net.IP) (*AllocationResult, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.record("AllocateSpecificIPAtIndex %d %v", index, ip)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	chosen, err := chooseInterfaceForIP(f.Interfaces, f.Limits, index, ip)
+	if err != nil {
+		return nil, err
+	}
+	intf := f.interfaceWithID(chosen.ID)
+	intf.IPv4s = append(intf.IPv4s, ip)
+	return &AllocationResult{IP: &ip, Interface: copyInterface(*intf)}, nil
+}
+
+// AllocateIPv6On assigns the next address of the interface's IPv6 subnet
+func (f *FakeClient) AllocateIPv6On(ctx context.Context, intf Interface) (*net.IP, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.record("AllocateIPv6On %v", intf.ID)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	target := f.interfaceWithID(intf.ID)
+	if target == nil {
+		return nil, fmt.Errorf("interface %v is not attached", intf.ID)
+	}
+	return f.assignIPv6(target)
+}
+
+// AllocateIPv6AtIndex chooses the interface like EC2Client does
+func (f *FakeClient) AllocateIPv6AtIndex(ctx context.Context, index int, subnetIDs []string) (*AllocationResult, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.record("AllocateIPv6AtIndex %d", index)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	chosen := chooseIPv6Interface(f.Interfaces, f.Limits, index, subnetIDs)
+	if chosen == nil {
+		return nil, newError(ErrInsufficientIPs, "Unable to allocate - no IPv6 addresses available on any interfaces")
+	}
+	ip, err := f.assignIPv6(chosen)
+	if err != nil {
+		return nil, err
+	}
+	return &AllocationResult{Interface: copyInterface(*chosen), IPv6: ip}, nil
+}
+
+// NewInterface attaches an interface with a primary address in the subnet
+// EC2Client would choose
+func (f *FakeClient) NewInterface(ctx context.Context, opts InterfaceOptions) (*Interface, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.record("NewInterface")
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(f.Interfaces) >= f.Limits.Adapters {
+		return nil, newError(ErrENILimit, "too many interfaces attached")
+	}
+	subnets := selectSubnets(f.Subnets, f.Interfaces, f.AZ, opts)
+	if len(subnets) == 0 {
+		return nil, newError(ErrENILimit, "No subnets are available which haven't already been used")
+	}
+	_, cidr, err := net.ParseCIDR(subnets[0].Cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	number := 0
+	for _, intf := range f.Interfaces {
+		if intf.Number >= number {
+			number = intf.Number + 1
+		}
+	}
+	intf := Interface{
+		ID:               fmt.Sprintf("eni-fake-%d", number),
+		Mac:              fmt.Sprintf("0a:00:00:00:00:%02x", number),
+		Number:           number,
+		SubnetID:         subnets[0].ID,
+		SubnetCidr:       cidr,
+		SecurityGroupIds: opts.securityGroupsFor(subnets[0]),
+	}
+	if len(intf.SecurityGroupIds) == 0 && opts.UseVPCDefaultSecurityGroup {
+		intf.SecurityGroupIds = []string{f.DefaultSecurityGroup}
+	}
+	if len(f.Interfaces) > 0 {
+		intf.VpcID = f.Interfaces[0].VpcID
+		intf.VpcPrimaryCidr = f.Interfaces[0].VpcPrimaryCidr
+		intf.VpcCidrs = f.Interfaces[0].VpcCidrs
+	}
+	ip, err := f.nextIP(cidr)
+	if err != nil {
+		return nil, err
+	}
+	intf.IPv4s = []net.IP{ip}
+	f.Interfaces = append(f.Interfaces, intf)
+
+	created := copyInterface(intf)
+	return &created, nil
+}
+
+// FreeInterface detaches the interface
+func (f *FakeClient) FreeInterface(intf Interface) error {
+	f.Lock()
+	defer f.Unlock()
+	f.record("FreeInterface %v", intf.ID)
+	for i := range f.Interfaces {
+		if f.Interfaces[i].ID == intf.ID {
+			f.Interfaces = append(f.Interfaces[:i], f.Interfaces[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("interface %v is not attached", intf.ID)
+}
+
+// DeallocateIPs unassigns the IPs and the delegated prefixes left unused,
+// skipping primary and unassigned ones like EC2Client
+func (f *FakeClient) DeallocateIPs(ctx context.Context, ips []net.IP) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.record("DeallocateIPs %d", len(ips))
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	released := 0
+	var prefixIPs []net.IP
+	for _, ip := range ips {
+		intf := interfaceWithIP(f.Interfaces, ip)
+		if intf == nil {
+			prefixIPs = append(prefixIPs, ip)
+			continue
+		}
+		if ip.Equal(intf.PrimaryIPv4()) {
+			continue
+		}
+		intf.IPv4s = removeIP(intf.IPv4s, ip)
+		intf.IPv6s = removeIP(intf.IPv6s, ip)
+		released++
+	}
+	if len(prefixIPs) == 0 || ipsInUse == nil {
+		return released, nil
+	}
+	inUse, err := ipsInUse()
+	if err != nil {
+		return released, err
+	}
+	for _, r := range releasablePrefixes(f.Interfaces, prefixIPs, inUse) {
+		r.intf.IPv4Prefixes = removePrefix(r.intf.IPv4Prefixes, r.prefix)
+		released += r.ips
+	}
+	return released, nil
+}
+
+// ManagedIPCount counts the secondary IPs and prefix addresses of the
+// interfaces above index 0, which EC2Client would find tagged as ours
+func (f *FakeClient) ManagedIPCount() (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	count := 0
+	for _, intf := range f.Interfaces {
+		if intf.Number == 0 || len(intf.IPv4s) == 0 {
+			continue
+		}
+		count += len(intf.IPv4s) - 1 + prefixSize*len(intf.IPv4Prefixes)
+	}
+	return count, nil
+}
+
+// SubnetRoutes returns the route table of the interface's subnet
+func (f *FakeClient) SubnetRoutes(intf Interface) ([]*net.IPNet, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.RouteTables[intf.SubnetID], nil
+}
+
+// ENILimits returns the limits
+func (f *FakeClient) ENILimits() ENILimit {
+	f.Lock()
+	defer f.Unlock()
+	return f.Limits
+}
+
+// CheckMetadata fails with Unreachable
+func (f *FakeClient) CheckMetadata() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.Unreachable
+}
+
+// CheckDescribeInstance fails with Unreachable
+func (f *FakeClient) CheckDescribeInstance() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.Unreachable
+}
+
+func removeIP(ips []net.IP, ip net.IP) []net.IP {
+	var kept []net.IP
+	for _, candidate := range ips {
+		if !candidate.Equal(ip) {
+			kept = append(kept, candidate)
+		}
+	}
+	return kept
+}
+
+func removePrefix(prefixes []*net.IPNet, prefix *net.IPNet) []*net.IPNet {
+	var kept []*net.IPNet
+	for _, candidate := range prefixes {
+		if candidate.String() != prefix.String() {
+			kept = append(kept, candidate)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,72 @@
+package aws
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func newTestFake() *FakeClient {
+	_, cidr, _ := net.ParseCIDR("198.18.0.0/24")
+	return &FakeClient{
+		Interfaces: []Interface{{
+			ID:         "eni-primary",
+			Number:     0,
+			IPv4s:      []net.IP{net.ParseIP("198.18.0.4")},
+			SubnetID:   "subnet-a",
+			SubnetCidr: cidr,
+		}},
+		Subnets: []Subnet{
+			{ID: "subnet-a", Cidr: "198.18.0.0/24", AvailabilityZone: "us-east-1a", AvailableAddressCount: 100},
+			{ID: "subnet-b", Cidr: "198.18.1.0/24", AvailabilityZone: "us-east-1a", AvailableAddressCount: 100, Tags: map[string]string{"pods": "yes"}},
+		},
+		Limits: ENILimit{Adapters: 2, IPv4: 2},
+		AZ:     "us-east-1a",
+	}
+}
+
+func TestFakeClientAllocates(t *testing.T) {
+	fake := newTestFake()
+
+	alloc, err := fake.AllocateIPAtIndex(context.Background(), 0, FirstAvailable, nil)
+	if err != nil || !alloc.IP.Equal(net.ParseIP("198.18.0.5")) {
+		t.Fatalf("expected 198.18.0.5, got %v: %v", alloc, err)
+	}
+	if _, err := fake.AllocateIPAtIndex(context.Background(), 0, FirstAvailable, nil); err == nil {
+		t.Fatalf("allocated beyond the interface limit")
+	}
+
+	newIf, err := fake.NewInterface(context.Background(), InterfaceOptions{SubnetTags: map[string]string{"pods": "yes"}})
+	if err != nil {
+		t.Fatalf("Failed to create an interface: %v", err)
+	}
+	if newIf.SubnetID != "subnet-b" || newIf.Number != 1 || !newIf.IPv4s[0].Equal(net.ParseIP("198.18.1.4")) {
+		t.Fatalf("unexpected new interface %+v", newIf)
+	}
+	if _, err := fake.NewInterface(context.Background(), InterfaceOptions{}); err == nil {
+		t.Fatalf("created beyond the interface limit")
+	}
+
+	released, err := fake.DeallocateIPs(context.Background(), []net.IP{*alloc.IP, net.ParseIP("198.18.0.4"), net.ParseIP("198.18.9.9")})
+	if err != nil || released != 1 {
+		t.Fatalf("expected 1 IP released, got %d: %v", released, err)
+	}
+	interfaces, _ := fake.GetInterfaces()
+	if len(interfaces[0].IPv4s) != 1 {
+		t.Fatalf("expected only the primary IP left, got %v", interfaces[0].IPv4s)
+	}
+}
+
+func TestFakeClientCopiesInterfaces(t *testing.T) {
+	fake := newTestFake()
+
+	interfaces, _ := fake.GetInterfaces()
+	interfaces[0].IPv4s[0] = net.ParseIP("198.18.0.99")
+	if !fake.Interfaces[0].IPv4s[0].Equal(net.ParseIP("198.18.0.4")) {
+		t.Fatalf("GetInterfaces shares state with the caller")
+	}
+
+	if _, err := fake.AttachedInterface("eni-missing"); err == nil {
+		t.Fatalf("expected an error for an unknown interface")
+	}
+}
@@ -0,0 +1,70 @@
+package aws
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// CheckMetadata verifies the instance metadata service answers. The
+// metadata cache is bypassed.
+func CheckMetadata() error {
+	_, err := metaData.GetDynamicData("instance-identity/document")
+	return err
+}
+
+// CheckCredentials verifies the credentials EC2 calls are made with,
+// including an assumed role, are valid. It returns the ARN they belong to.
+func CheckCredentials() (string, error) {
+	idDoc, err := getIDDoc()
+	if err != nil {
+		return "", err
+	}
+	client := sts.New(sess, newEC2Config(clientRegion(idDoc)))
+	client.Handlers.Complete.PushBack(traceCall)
+
+	var output *sts.GetCallerIdentityOutput
+	err = withRetry(func() (err error) {
+		output, err = client.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		return
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(output.Arn), nil
+}
+
+// CheckDescribeInstance verifies EC2 can be called by describing this
+// instance
+func CheckDescribeInstance() error {
+	client, err := newEC2()
+	if err != nil {
+		return err
+	}
+	idDoc, err := getIDDoc()
+	if err != nil {
+		return err
+	}
+
+	input := &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(idDoc.InstanceID)},
+	}
+	return withRetry(func() (err error) {
+		_, err = client.DescribeInstances(input)
+		return
+	})
+}
+
+// HasCapacity reports whether another IP can be allocated at or above
+// index, on an existing interface or a new one
+func HasCapacity(interfaces []Interface, limits ENILimit, index int) bool {
+	if len(interfaces) < limits.Adapters {
+		return true
+	}
+	for _, intf := range interfaces {
+		if intf.Number >= index && intf.ipv4Slots() < limits.IPv4 {
+			return true
+		}
+	}
+	return false
+}
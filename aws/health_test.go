@@ -0,0 +1,23 @@
+package aws
+
+import (
+	"net"
+	"testing"
+)
+
+// TestHasCapacity checks capacity on existing and new interfaces
+func TestHasCapacity(t *testing.T) {
+	limits := ENILimit{Adapters: 2, IPv4: 2}
+	full := Interface{Number: 1, IPv4s: make([]net.IP, 2)}
+	spare := Interface{Number: 0, IPv4s: make([]net.IP, 1)}
+
+	if !HasCapacity([]Interface{spare}, limits, 1) {
+		t.Fatalf("expected capacity for another interface")
+	}
+	if HasCapacity([]Interface{spare, full}, limits, 1) {
+		t.Fatalf("expected no capacity at index 1")
+	}
+	if !HasCapacity([]Interface{spare, full}, limits, 0) {
+		t.Fatalf("expected capacity on eth0 at index 0")
+	}
+}
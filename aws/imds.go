@@ -0,0 +1,185 @@
+package aws
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	imdsTokenHeader    = "X-aws-ec2-metadata-token"
+	imdsTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+	// The metadata service issues tokens valid for up to 6 hours
+	imdsMaxTokenTTL = 6 * time.Hour
+)
+
+var (
+	// imdsHopLimit is the number of network hops between the plugin and
+	// the metadata service, 1 on the host network
+	imdsHopLimit      = 1
+	imdsTokenTTL      = imdsMaxTokenTTL
+	imdsTokenAttempts = 3
+	imdsTokenTimeout  = 1 * time.Second
+)
+
+var _imdsToken string
+var _imdsTokenExpires time.Time
+var _imdsTokenLock sync.Mutex
+
+// SetIMDSHopLimit sets how many network hops the plugin is from the
+// instance metadata service, for example 2 when the tool runs in a
+// container with its own network namespace. It's only used to explain
+// token request failures. Zero keeps the default of 1.
+func SetIMDSHopLimit(hops int) {
+	if hops > 0 {
+		imdsHopLimit = hops
+	}
+}
+
+// SetIMDSTokenTTL sets how long the IMDSv2 session tokens requested are
+// valid, between a second and 6 hours. Tokens are reused until they are
+// about to expire. Zero keeps the default of 6 hours.
+func SetIMDSTokenTTL(ttl time.Duration) error {
+	if ttl == 0 {
+		imdsTokenTTL = imdsMaxTokenTTL
+		return nil
+	}
+	if ttl < time.Second || ttl > imdsMaxTokenTTL {
+		return fmt.Errorf("IMDSv2 token TTL %v is not between 1s and %v", ttl, imdsMaxTokenTTL)
+	}
+	imdsTokenTTL = ttl
+	return nil
+}
+
+// imdsTokenExpiryWindow returns how long before it expires a token is
+// refreshed, so it can't expire during a request
+func imdsTokenExpiryWindow() time.Duration {
+	if window := imdsTokenTTL / 10; window < time.Minute {
+		return window
+	}
+	return time.Minute
+}
+
+// imdsTokenHandler signs metadata requests with an IMDSv2 session token.
+// Without a token the request fails with the reason the metadata service
+// can't be used, rather than a generic network error.
+func imdsTokenHandler(r *request.Request) {
+	token, err := imdsToken(strings.TrimSuffix(r.ClientInfo.Endpoint, "/"))
+	if err != nil {
+		r.Error = err
+		return
+	}
+	r.HTTPRequest.Header.Set(imdsTokenHeader, token)
+}
+
+// imdsTokenRejectedHandler drops a token the metadata service no longer
+// accepts, for example after it restarted, and retries the request once
+// with a new one. It must run after the client's retryer.
+func imdsTokenRejectedHandler(r *request.Request) {
+	if r.HTTPResponse == nil || r.HTTPResponse.StatusCode != http.StatusUnauthorized {
+		return
+	}
+	_imdsTokenLock.Lock()
+	_imdsToken = ""
+	_imdsTokenLock.Unlock()
+
+	if r.RetryCount == 0 {
+		r.Retryable = aws.Bool(true)
+		return
+	}
+	r.Retryable = aws.Bool(false)
+	r.Error = fmt.Errorf("instance metadata service rejected a new IMDSv2 token for %v", r.Operation.HTTPPath)
+}
+
+// imdsToken returns a cached session token, requesting a new one once it's
+// about to expire. Timeouts and server errors are retried.
+func imdsToken(endpoint string) (string, error) {
+	_imdsTokenLock.Lock()
+	defer _imdsTokenLock.Unlock()
+
+	if _imdsToken != "" && time.Now().Before(_imdsTokenExpires.Add(-imdsTokenExpiryWindow())) {
+		return _imdsToken, nil
+	}
+
+	var err error
+	for attempt := 0; attempt < imdsTokenAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryDelay(attempt))
+		}
+		var token string
+		var retryable bool
+		token, retryable, err = requestIMDSToken(endpoint)
+		if err == nil {
+			_imdsToken = token
+			_imdsTokenExpires = time.Now().Add(imdsTokenTTL)
+			return token, nil
+		}
+		if !retryable {
+			break
+		}
+	}
+	return "", err
+}
+
+// requestIMDSToken requests a session token, reporting whether a failure
+// may be transient
+func requestIMDSToken(endpoint string) (string, bool, error) {
+	req, err := http.NewRequest(http.MethodPut, endpoint+"/api/token", nil)
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set(imdsTokenTTLHeader, strconv.Itoa(int(imdsTokenTTL/time.Second)))
+
+	client := &http.Client{Timeout: imdsTokenTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return "", true, imdsTimeoutError(endpoint)
+		}
+		return "", false, fmt.Errorf("instance metadata service at %v is unreachable: %v. "+
+			"The instance must have its metadata endpoint enabled (HttpEndpoint)", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", true, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK && len(body) > 0:
+		return string(body), false, nil
+	case resp.StatusCode == http.StatusForbidden:
+		return "", false, fmt.Errorf("instance metadata service at %v refused an IMDSv2 token. "+
+			"Check the instance's metadata endpoint is enabled (HttpEndpoint) and no proxy adds X-Forwarded-For", endpoint)
+	case resp.StatusCode >= 500:
+		return "", true, fmt.Errorf("instance metadata service at %v failed to issue an IMDSv2 token: %v", endpoint, resp.Status)
+	}
+	return "", false, fmt.Errorf("instance metadata service at %v returned %v for an IMDSv2 token request", endpoint, resp.Status)
+}
+
+// imdsTimeoutError explains a token request timing out. Token responses
+// are dropped once they've been forwarded more than the instance's
+// HttpPutResponseHopLimit, which the plugin on the host network never hits.
+func imdsTimeoutError(endpoint string) error {
+	if imdsHopLimit > 1 {
+		return fmt.Errorf("IMDSv2 token request to %v timed out. The instance's HttpPutResponseHopLimit "+
+			"must be at least %d for the token to reach the plugin %d hops away", endpoint, imdsHopLimit, imdsHopLimit)
+	}
+	return fmt.Errorf("IMDSv2 token request to %v timed out. Run the plugin on the host network, or set "+
+		"imdsHopLimit and raise the instance's HttpPutResponseHopLimit if it runs in a container", endpoint)
+}
+
+// CheckIMDS verifies the instance metadata service answers requests signed
+// with a session token, returning why it can't be used otherwise
+func CheckIMDS() error {
+	_, err := metaData.GetMetadata("instance-id")
+	return err
+}
@@ -0,0 +1,129 @@
+package aws
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func withIMDSToken(t *testing.T, handler http.HandlerFunc) (string, func()) {
+	ts := httptest.NewServer(handler)
+	oldTimeout := imdsTokenTimeout
+	imdsTokenTimeout = 50 * time.Millisecond
+	_imdsToken = ""
+	return ts.URL + "/latest", func() {
+		imdsTokenTimeout = oldTimeout
+		_imdsToken = ""
+		ts.Close()
+	}
+}
+
+func TestIMDSToken(t *testing.T) {
+	requests := 0
+	endpoint, done := withIMDSToken(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Method != http.MethodPut || r.URL.Path != "/latest/api/token" || r.Header.Get(imdsTokenTTLHeader) != "21600" {
+			t.Errorf("unexpected token request %v %v", r.Method, r.URL.Path)
+		}
+		fmt.Fprint(w, "session-token")
+	})
+	defer done()
+
+	for i := 0; i < 2; i++ {
+		token, err := imdsToken(endpoint)
+		if err != nil || token != "session-token" {
+			t.Fatalf("expected the session token, got %q: %v", token, err)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("expected the token to be cached, got %d requests", requests)
+	}
+}
+
+func TestIMDSTokenRefused(t *testing.T) {
+	requests := 0
+	endpoint, done := withIMDSToken(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusForbidden)
+	})
+	defer done()
+
+	_, err := imdsToken(endpoint)
+	if err == nil || !strings.Contains(err.Error(), "HttpEndpoint") {
+		t.Fatalf("expected an error naming HttpEndpoint, got %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("refused token requests were retried %d times", requests-1)
+	}
+}
+
+func TestIMDSTokenTimeout(t *testing.T) {
+	requests := 0
+	endpoint, done := withIMDSToken(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		time.Sleep(200 * time.Millisecond)
+	})
+	defer done()
+	defer SetIMDSHopLimit(1)
+	SetIMDSHopLimit(2)
+
+	_, err := imdsToken(endpoint)
+	if err == nil || !strings.Contains(err.Error(), "HttpPutResponseHopLimit must be at least 2") {
+		t.Fatalf("expected an error naming the hop limit, got %v", err)
+	}
+	if requests != imdsTokenAttempts {
+		t.Fatalf("expected %d attempts, got %d", imdsTokenAttempts, requests)
+	}
+}
+
+func TestIMDSTokenTTL(t *testing.T) {
+	defer SetIMDSTokenTTL(0)
+
+	if err := SetIMDSTokenTTL(7 * time.Hour); err == nil {
+		t.Fatalf("TTL above 6 hours was accepted")
+	}
+	if err := SetIMDSTokenTTL(time.Millisecond); err == nil {
+		t.Fatalf("TTL below a second was accepted")
+	}
+	if err := SetIMDSTokenTTL(5 * time.Minute); err != nil {
+		t.Fatalf("Failed to set the TTL: %v", err)
+	}
+
+	endpoint, done := withIMDSToken(t, func(w http.ResponseWriter, r *http.Request) {
+		if ttl := r.Header.Get(imdsTokenTTLHeader); ttl != "300" {
+			t.Errorf("expected a TTL of 300 seconds, got %v", ttl)
+		}
+		fmt.Fprint(w, "session-token")
+	})
+	defer done()
+	if _, err := imdsToken(endpoint); err != nil {
+		t.Fatalf("Failed to request a token: %v", err)
+	}
+}
+
+func TestIMDSTokenRejected(t *testing.T) {
+	_imdsToken = "expired"
+	defer func() { _imdsToken = "" }()
+
+	r := &request.Request{
+		Operation:    &request.Operation{HTTPPath: "/meta-data/instance-id"},
+		HTTPResponse: &http.Response{StatusCode: http.StatusUnauthorized},
+		Error:        fmt.Errorf("unauthorized"),
+	}
+	imdsTokenRejectedHandler(r)
+	if !aws.BoolValue(r.Retryable) || _imdsToken != "" {
+		t.Fatalf("rejected token wasn't dropped for a retry")
+	}
+
+	r.RetryCount = 1
+	imdsTokenRejectedHandler(r)
+	if aws.BoolValue(r.Retryable) || !strings.Contains(r.Error.Error(), "rejected a new IMDSv2 token") {
+		t.Fatalf("expected the retry to fail, got %v", r.Error)
+	}
+}
@@ -1,13 +1,17 @@
 package aws
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"os"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 
 	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
 )
@@ -18,10 +22,41 @@ var (
 	interfaceDetachWaitTime       = 1 * time.Second
 	interfacePostDetachSettleTime = 5 * time.Second
 	interfaceDetachAttempts       = 20 // interfaceDetachAttempts * interfaceDetachWaitTime = total wait time
+	// The attachment is polled from the initial wait, doubling up to
+	// the maximum, for at most interfaceSettleTime
+	attachmentPollInitialWait = 250 * time.Millisecond
+	attachmentPollMaxWait     = 4 * time.Second
 )
 
-// NewInterfaceOnSubnetAtIndex creates a new Interface with a specified subnet and index
-func NewInterfaceOnSubnetAtIndex(index int, secGrps []string, subnet Subnet) (*Interface, error) {
+const (
+	// InterfaceMarkerTag is the tag key applied to every interface created by
+	// this plugin, distinguishing them from interfaces managed by other tooling
+	InterfaceMarkerTag = "cni-ipvlan-vpc-k8s"
+	// InterfaceNodeNameTag records the Kubernetes node an interface was
+	// created for
+	InterfaceNodeNameTag = "cni-ipvlan-vpc-k8s/node-name"
+	// InterfacePodNamespaceTag and InterfacePodNameTag record the pod whose
+	// allocation created an interface. Later pods share the interface.
+	InterfacePodNamespaceTag = "cni-ipvlan-vpc-k8s/pod-namespace"
+	InterfacePodNameTag      = "cni-ipvlan-vpc-k8s/pod-name"
+	// InterfaceDescriptionTag repeats a configured description of the
+	// interface, as tags are easier to filter on in cost reports
+	InterfaceDescriptionTag = "cni-ipvlan-vpc-k8s/description"
+)
+
+// PodInfo identifies the Kubernetes pod an allocation is for. Fields are
+// empty outside of Kubernetes.
+type PodInfo struct {
+	Namespace string
+	Name      string
+	UID       string
+}
+
+// NewInterfaceOnSubnetAtIndex creates a new Interface with a specified subnet and index.
+// Tags are applied as the interface is created. Once ctx is done the
+// creation is abandoned, still deleting an interface which failed to
+// attach.
+func NewInterfaceOnSubnetAtIndex(ctx context.Context, index int, subnet Subnet, opts InterfaceOptions) (*Interface, error) {
 	client, err := newEC2()
 	if err != nil {
 		return nil, err
@@ -32,35 +67,82 @@ func NewInterfaceOnSubnetAtIndex(index int, secGrps []string, subnet Subnet) (*I
 		return nil, err
 	}
 
+	// Without the card count EC2 rejects an invalid index itself
+	if opts.NetworkCardIndex > 0 {
+		if cards, err := NetworkCardCount(); err == nil && opts.NetworkCardIndex >= cards {
+			return nil, newError(ErrConfig, "network card %d is out of range, instance type %v has %d",
+				opts.NetworkCardIndex, idDoc.InstanceType, cards)
+		}
+	}
+
 	createReq := &ec2.CreateNetworkInterfaceInput{}
-	createReq.SetDescription(fmt.Sprintf("CNI-ENI %v", idDoc.InstanceID))
+	createReq.SetDescription(opts.description(idDoc.InstanceID))
 	secGrpsPtr := []*string{}
-	for _, grp := range secGrps {
+	for _, grp := range opts.SecurityGroups {
 		newgrp := grp // Need to copy
 		secGrpsPtr = append(secGrpsPtr, &newgrp)
 	}
 
 	createReq.SetGroups(secGrpsPtr)
 	createReq.SetSubnetId(subnet.ID)
+	createReq.SetTagSpecifications([]*ec2.TagSpecification{
+		{
+			ResourceType: aws.String(ec2.ResourceTypeNetworkInterface),
+			Tags:         newEc2Tags(opts.interfaceTags()),
+		},
+	})
 
-	resp, err := client.CreateNetworkInterface(createReq)
+	var resp *ec2.CreateNetworkInterfaceOutput
+	err = withRetryContext(ctx, func() (err error) {
+		resp, err = client.CreateNetworkInterfaceWithContext(ctx, createReq)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	if opts.DisableSourceDestCheck {
+		sourceDestReq := &ec2.ModifyNetworkInterfaceAttributeInput{}
+		sourceDestReq.SetNetworkInterfaceId(*resp.NetworkInterface.NetworkInterfaceId)
+		sourceDestReq.SetSourceDestCheck(&ec2.AttributeBooleanValue{Value: aws.Bool(false)})
+
+		err = withRetryContext(ctx, func() (err error) {
+			_, err = client.ModifyNetworkInterfaceAttributeWithContext(ctx, sourceDestReq)
+			return
+		})
+		if err != nil {
+			// Pods relying on forwarding would be broken, so remove the
+			// interface rather than attach it
+			if delErr := deleteInterface(*resp.NetworkInterface.NetworkInterfaceId); delErr != nil {
+				return nil, delErr
+			}
+			return nil, err
+		}
+	}
+
 	// resp.NetworkInterface.NetworkInterfaceId
 	attachReq := &ec2.AttachNetworkInterfaceInput{}
 	attachReq.SetDeviceIndex(int64(index))
 	attachReq.SetInstanceId(idDoc.InstanceID)
 	attachReq.SetNetworkInterfaceId(*resp.NetworkInterface.NetworkInterfaceId)
+	if opts.NetworkCardIndex > 0 {
+		attachReq.SetNetworkCardIndex(int64(opts.NetworkCardIndex))
+	}
 
-	attachResp, err := client.AttachNetworkInterface(attachReq)
+	var attachResp *ec2.AttachNetworkInterfaceOutput
+	err = withRetryContext(ctx, func() (err error) {
+		attachResp, err = client.AttachNetworkInterfaceWithContext(ctx, attachReq)
+		return
+	})
 	if err != nil {
 		// We attempt to remove the interface we just made due to attachment failure
 		delReq := &ec2.DeleteNetworkInterfaceInput{}
 		delReq.SetNetworkInterfaceId(*resp.NetworkInterface.NetworkInterfaceId)
 
-		_, delErr := client.DeleteNetworkInterface(delReq)
+		delErr := withRetry(func() (err error) {
+			_, err = client.DeleteNetworkInterface(delReq)
+			return
+		})
 		if delErr != nil {
 			return nil, delErr
 		}
@@ -76,7 +158,10 @@ func NewInterfaceOnSubnetAtIndex(index int, secGrps []string, subnet Subnet) (*I
 	modifyReq.SetAttachment(changes)
 	modifyReq.SetNetworkInterfaceId(*resp.NetworkInterface.NetworkInterfaceId)
 
-	_, err = client.ModifyNetworkInterfaceAttribute(modifyReq)
+	err = withRetryContext(ctx, func() (err error) {
+		_, err = client.ModifyNetworkInterfaceAttributeWithContext(ctx, modifyReq)
+		return
+	})
 	if err != nil {
 		// Continue anyway
 		fmt.Fprintf(os.Stderr,
@@ -84,7 +169,14 @@ func NewInterfaceOnSubnetAtIndex(index int, secGrps []string, subnet Subnet) (*I
 			err)
 	}
 
-	for start := time.Now(); time.Since(start) <= interfaceSettleTime; time.Sleep(interfacePollWaitTime) {
+	if err := waitForAttachment(ctx, client, *resp.NetworkInterface.NetworkInterfaceId); err != nil {
+		return nil, removeCreatedInterface(client, *resp.NetworkInterface.NetworkInterfaceId, attachResp.AttachmentId, err)
+	}
+
+	for start := time.Now(); time.Since(start) <= interfaceSettleTime; {
+		if err := sleepContext(ctx, interfacePollWaitTime); err != nil {
+			return nil, removeCreatedInterface(client, *resp.NetworkInterface.NetworkInterfaceId, attachResp.AttachmentId, err)
+		}
 		newInterfaces, err := GetInterfaces()
 		if err != nil {
 			// The metadata server is inconsistent - for example, not
@@ -95,35 +187,249 @@ func NewInterfaceOnSubnetAtIndex(index int, secGrps []string, subnet Subnet) (*I
 		}
 		for _, intf := range newInterfaces {
 			if intf.Mac == *resp.NetworkInterface.MacAddress {
-				configureInterface(&intf)
+				invalidateMetadataCache("network/interfaces/")
+				configureInterface(&intf, newInterfaces)
 				return &intf, nil
 			}
 		}
 
 	}
 
-	return nil, fmt.Errorf("interface did not attach in time")
+	return nil, removeCreatedInterface(client, *resp.NetworkInterface.NetworkInterfaceId, attachResp.AttachmentId,
+		fmt.Errorf("interface did not attach in time"))
 }
 
-// Fire and forget method to configure an interface
-func configureInterface(intf *Interface) {
+// removeCreatedInterface detaches and deletes an interface newInterface
+// gave up on, like TeardownInterfaces, so it isn't leaked. The ADD may
+// have run out of time, so the removal isn't bound by it. It returns
+// cause, along with the removal's failure if any.
+func removeCreatedInterface(client ec2iface.EC2API, interfaceID string, attachmentID *string, cause error) error {
+	eni := &ec2.NetworkInterface{
+		NetworkInterfaceId: aws.String(interfaceID),
+		Attachment:         &ec2.NetworkInterfaceAttachment{AttachmentId: attachmentID},
+	}
+	defer invalidateMetadataCache("network/interfaces/")
+	if err := teardownInterface(context.Background(), client, eni); err != nil {
+		return fmt.Errorf("%v, and unable to remove interface %v: %v", cause, interfaceID, err)
+	}
+	return cause
+}
+
+// waitForAttachment polls EC2 with exponential backoff until the interface
+// is in use and its attachment is attached. The link can show up on the
+// host while EC2 is still attaching, dropping the first packets.
+func waitForAttachment(ctx context.Context, client ec2iface.EC2API, interfaceID string) error {
+	input := &ec2.DescribeNetworkInterfacesInput{
+		NetworkInterfaceIds: []*string{aws.String(interfaceID)},
+	}
+	wait := attachmentPollInitialWait
+	for start := time.Now(); ; {
+		var output *ec2.DescribeNetworkInterfacesOutput
+		err := withRetryContext(ctx, func() (err error) {
+			output, err = client.DescribeNetworkInterfacesWithContext(ctx, input)
+			return
+		})
+		if err != nil {
+			return err
+		}
+		if len(output.NetworkInterfaces) == 1 && isAttached(output.NetworkInterfaces[0]) {
+			return nil
+		}
+		if time.Since(start) > interfaceSettleTime {
+			return fmt.Errorf("interface %v was not attached after %v", interfaceID, interfaceSettleTime)
+		}
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+		if wait *= 2; wait > attachmentPollMaxWait {
+			wait = attachmentPollMaxWait
+		}
+	}
+}
+
+func isAttached(eni *ec2.NetworkInterface) bool {
+	return aws.StringValue(eni.Status) == ec2.NetworkInterfaceStatusInUse &&
+		eni.Attachment != nil &&
+		aws.StringValue(eni.Attachment.Status) == ec2.AttachmentStatusAttached
+}
+
+// Fire and forget method to configure an interface. Its link, and the
+// primary interface's it takes the MTU of, are found by MAC, as the
+// kernel's ethN naming doesn't necessarily follow the device index.
+func configureInterface(intf *Interface, interfaces []Interface) {
 	// Found a match, going to try to make sure the interface is up
-	err := nl.UpInterfacePoll(intf.LocalName())
+	name, err := nl.LinkNameByMacPoll(intf.Mac, 0, 0)
+	if err == nil {
+		err = nl.UpInterfacePoll(name)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr,
-			"Interface %v could not be enabled. Networking will be broken.\n",
-			intf.LocalName())
+			"Interface %v could not be enabled. Networking will be broken: %v\n",
+			intf.LocalName(), err)
 		return
 	}
-	baseMtu, err := nl.GetMtu("eth0")
+	primary := "eth0"
+	for _, other := range interfaces {
+		if other.Number == 0 {
+			if found, err := nl.LinkNameByMac(other.Mac); err == nil {
+				primary = found
+			}
+		}
+	}
+	baseMtu, err := nl.GetMtu(primary)
 	if err != nil || baseMtu < 1000 || baseMtu > 9001 {
 		return
 	}
-	nl.SetMtu(intf.LocalName(), baseMtu)
+	nl.SetMtu(name, baseMtu)
 }
 
-// NewInterface creates an Interface based on specified parameters
-func NewInterface(secGrps []string, requiredTags map[string]string) (*Interface, error) {
+// InterfaceOptions controls how NewInterface selects a subnet for, and
+// configures, a new interface
+type InterfaceOptions struct {
+	// SecurityGroups are applied to the new interface
+	SecurityGroups []string
+	// SubnetTags must all be present on a subnet for it to be used
+	SubnetTags map[string]string
+	// SubnetIDs restricts new interfaces to exactly these subnets, taking
+	// precedence over SubnetTags
+	SubnetIDs []string
+	// SubnetExcludeTags rule out subnets carrying all of them, whichever
+	// of SubnetIDs, SubnetTags or NamespaceSubnetTags selected them
+	SubnetExcludeTags map[string]string
+	// MinimumFreeIPs skips subnets with fewer available addresses
+	MinimumFreeIPs int
+	// MaxInterfaces caps the number of interfaces created by this plugin
+	// attached to the instance, zero means no limit
+	MaxInterfaces int
+	// Tags are applied to the new interface in addition to the standard
+	// marker and node name tags
+	Tags map[string]string
+	// NodeName is the Kubernetes node name recorded on the interface,
+	// defaulting to the hostname
+	NodeName string
+	// DisableSourceDestCheck turns off source/destination checking so
+	// pods can forward traffic
+	DisableSourceDestCheck bool
+	// SubnetSecurityGroups override SecurityGroups based on the tags of
+	// the selected subnet. The first matching entry is used.
+	SubnetSecurityGroups []SubnetSecurityGroups
+	// Pod is the pod the interface is created for
+	Pod PodInfo
+	// NamespaceSubnetTags are the subnet tags for pods by namespace. When
+	// the pod's namespace is listed they replace both SubnetIDs and
+	// SubnetTags.
+	NamespaceSubnetTags map[string]map[string]string
+	// DescriptionPrefix replaces the default description of the interface
+	// with one combining it, the node name and ClusterName
+	DescriptionPrefix string
+	// ClusterName identifies the cluster in the description
+	ClusterName string
+	// UseVPCDefaultSecurityGroup applies the VPC's default security group
+	// when no other security group is configured for the subnet
+	UseVPCDefaultSecurityGroup bool
+	// NetworkCardIndex is the network card the interface is attached to,
+	// zero being the default card
+	NetworkCardIndex int
+}
+
+// nodeName returns the node the interface is created for
+func (opts InterfaceOptions) nodeName() string {
+	if opts.NodeName != "" {
+		return opts.NodeName
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// description returns the description of a new interface, either
+// prefix:node:cluster, leaving out empty parts, or CNI-ENI and the
+// instance ID
+func (opts InterfaceOptions) description(instanceID string) string {
+	if opts.DescriptionPrefix == "" {
+		return fmt.Sprintf("CNI-ENI %v", instanceID)
+	}
+	parts := []string{opts.DescriptionPrefix}
+	for _, part := range []string{opts.nodeName(), opts.ClusterName} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	description := strings.Join(parts, ":")
+	// EC2 limits descriptions to 255 characters
+	if len(description) > 255 {
+		description = description[:255]
+	}
+	return description
+}
+
+// namespaceSubnetTags returns the subnet tags for the pod's namespace, if
+// it's listed in NamespaceSubnetTags
+func (opts InterfaceOptions) namespaceSubnetTags() (map[string]string, bool) {
+	if opts.Pod.Namespace == "" {
+		return nil, false
+	}
+	tags, ok := opts.NamespaceSubnetTags[opts.Pod.Namespace]
+	return tags, ok
+}
+
+// SubnetSecurityGroups are the security groups for interfaces in subnets
+// carrying all of the tags
+type SubnetSecurityGroups struct {
+	SubnetTags     map[string]string
+	SecurityGroups []string
+}
+
+// securityGroupsFor returns the security groups for a new interface in
+// the subnet
+func (opts InterfaceOptions) securityGroupsFor(subnet Subnet) []string {
+OUTER:
+	for _, candidate := range opts.SubnetSecurityGroups {
+		for tagKey, tagValue := range candidate.SubnetTags {
+			if value, ok := subnet.Tags[tagKey]; !ok || value != tagValue {
+				continue OUTER
+			}
+		}
+		return candidate.SecurityGroups
+	}
+	return opts.SecurityGroups
+}
+
+// interfaceTags returns the full set of tags for a new interface. The
+// standard tags take precedence over configured ones so interfaces can
+// always be identified as ours.
+func (opts InterfaceOptions) interfaceTags() map[string]string {
+	tags := map[string]string{}
+	for k, v := range opts.Tags {
+		tags[k] = v
+	}
+	if nodeName := opts.nodeName(); nodeName != "" {
+		tags[InterfaceNodeNameTag] = nodeName
+	}
+	if opts.DescriptionPrefix != "" {
+		tags[InterfaceDescriptionTag] = opts.description("")
+	}
+	if opts.Pod.Namespace != "" {
+		tags[InterfacePodNamespaceTag] = opts.Pod.Namespace
+	}
+	if opts.Pod.Name != "" {
+		tags[InterfacePodNameTag] = opts.Pod.Name
+	}
+	tags[InterfaceMarkerTag] = "true"
+	return tags
+}
+
+// InterfacePlan describes the interface NewInterface would create
+type InterfacePlan struct {
+	// Index is the device index the interface would be attached at
+	Index            int
+	Subnet           Subnet
+	AvailabilityZone string
+	SecurityGroups   []string
+}
+
+// PlanNewInterface decides where NewInterface would create an interface,
+// without calling any mutating EC2 APIs
+func PlanNewInterface(opts InterfaceOptions) (*InterfacePlan, error) {
 	subnets, err := GetSubnetsForInstance()
 	if err != nil {
 		return nil, err
@@ -135,26 +441,111 @@ func NewInterface(secGrps []string, requiredTags map[string]string) (*Interface,
 	}
 
 	if len(subnets) <= len(existingInterfaces) {
-		return nil, fmt.Errorf("not enough available subnets to make a new interface")
+		return nil, newError(ErrENILimit, "not enough available subnets to make a new interface")
 	}
 
 	limits := ENILimits()
 	if len(existingInterfaces) >= limits.Adapters {
-		return nil, fmt.Errorf("too many adapters on this instance already")
+		return nil, newError(ErrENILimit, "too many adapters on this instance already")
+	}
+
+	if opts.MaxInterfaces > 0 {
+		managed, err := ManagedInterfaceCount()
+		if err != nil {
+			return nil, err
+		}
+		if managed >= opts.MaxInterfaces {
+			return nil, newError(ErrENILimit, "ENI limit reached: %d of %d interfaces created by this plugin are attached",
+				managed, opts.MaxInterfaces)
+		}
+	}
+
+	idDoc, err := getIDDoc()
+	if err != nil {
+		return nil, err
+	}
+
+	availableSubnets := selectSubnets(subnets, existingInterfaces, idDoc.AvailabilityZone, opts)
+	if len(availableSubnets) <= 0 {
+		return nil, newError(ErrENILimit, "No subnets are available which haven't already been used")
+	}
+
+	subnet := availableSubnets[0]
+	secGrps := opts.securityGroupsFor(subnet)
+	if len(secGrps) == 0 && opts.UseVPCDefaultSecurityGroup && len(existingInterfaces) > 0 {
+		defaultGroup, err := DefaultSecurityGroup(existingInterfaces[0].VpcID)
+		if err != nil {
+			return nil, err
+		}
+		secGrps = []string{defaultGroup}
+	}
+	if len(secGrps) == 0 {
+		return nil, newError(ErrConfig, "no security groups configured for subnet %v", subnet.ID)
+	}
+	// All interfaces of an instance share its VPC
+	if len(existingInterfaces) > 0 {
+		if err := ValidateSecurityGroups(secGrps, existingInterfaces[0].VpcID); err != nil {
+			return nil, err
+		}
+	}
+
+	return &InterfacePlan{
+		Index:            len(existingInterfaces),
+		Subnet:           subnet,
+		AvailabilityZone: idDoc.AvailabilityZone,
+		SecurityGroups:   secGrps,
+	}, nil
+}
+
+// NewInterface creates an Interface based on specified parameters
+func NewInterface(ctx context.Context, opts InterfaceOptions) (*Interface, error) {
+	plan, err := PlanNewInterface(opts)
+	if err != nil {
+		return nil, err
 	}
+	opts.SecurityGroups = plan.SecurityGroups
+	return NewInterfaceOnSubnetAtIndex(ctx, plan.Index, plan.Subnet, opts)
+}
 
+// selectSubnets returns the subnets a new interface may be created in,
+// best candidate first. Subnets must be in the instance's availability
+// zone, as EC2 refuses to attach interfaces across zones, match the tags
+// of the pod's namespace, or be listed in SubnetIDs, or otherwise match
+// SubnetTags, not carry SubnetExcludeTags, not be in use by an existing
+// interface and have enough free addresses.
+func selectSubnets(subnets []Subnet, existingInterfaces []Interface, az string, opts InterfaceOptions) []Subnet {
 	var availableSubnets []Subnet
 
-OUTER:
+	// A new interface consumes at least one address for its primary IP
+	minimumFreeIPs := opts.MinimumFreeIPs
+	if minimumFreeIPs < 1 {
+		minimumFreeIPs = 1
+	}
+
+	namespaceTags, namespaced := opts.namespaceSubnetTags()
+
 	for _, newSubnet := range subnets {
-		// Match incoming tags
-		for tagKey, tagValue := range requiredTags {
-			value, ok := newSubnet.Tags[tagKey]
-			// Skip untagged subnets and ones not matching
-			// the required tag
-			if !ok || (ok && value != tagValue) {
-				continue OUTER
+		if newSubnet.AvailabilityZone != az {
+			continue
+		}
+		if namespaced {
+			if !newSubnet.HasTags(namespaceTags) {
+				continue
+			}
+		} else if len(opts.SubnetIDs) > 0 {
+			if !containsString(opts.SubnetIDs, newSubnet.ID) {
+				continue
 			}
+		} else if !newSubnet.HasTags(opts.SubnetTags) {
+			// Skip untagged subnets and ones not matching the
+			// required tags
+			continue
+		}
+		if len(opts.SubnetExcludeTags) > 0 && newSubnet.HasTags(opts.SubnetExcludeTags) {
+			continue
+		}
+		if newSubnet.AvailableAddressCount < minimumFreeIPs {
+			continue
 		}
 		var matched bool
 		for _, intf := range existingInterfaces {
@@ -170,17 +561,14 @@ OUTER:
 	// assign new interfaces to subnets with most available addresses
 	sort.Sort(SubnetsByAvailableAddressCount(availableSubnets))
 
-	if len(availableSubnets) <= 0 {
-		return nil, fmt.Errorf("No subnets are available which haven't already been used")
-	}
-
-	return NewInterfaceOnSubnetAtIndex(len(existingInterfaces), secGrps, availableSubnets[0])
+	return availableSubnets
 }
 
 // RemoveInterface gracefull shutdown and removal of interfaces
 // Simply detach the interface, wait for it to come down and then
-// removes.
-func RemoveInterface(interfaceIDs []string) error {
+// removes. It gives up, possibly leaving an interface detached, once ctx
+// is done.
+func RemoveInterface(ctx context.Context, interfaceIDs []string) error {
 	client, err := newEC2()
 	if err != nil {
 		return err
@@ -202,28 +590,44 @@ func RemoveInterface(interfaceIDs []string) error {
 		}
 
 		// Detach the networkinterface
-		_, err = client.DetachNetworkInterface(detachInterfaceInput)
+		err = withRetryContext(ctx, func() (err error) {
+			_, err = client.DetachNetworkInterface(detachInterfaceInput)
+			return
+		})
 		if err != nil {
 			fmt.Printf("Error occurced when trying to detach %v interface, use --force to override this check", interfaceID)
 			return err
 		}
 
 		// Wait for the interface to be removed
-		if err := waitUtilInterfaceDetaches(interfaceID); err != nil {
+		if err := waitUtilInterfaceDetaches(ctx, interfaceID); err != nil {
 			return err
 		}
 
 		// Even after the interface detaches, you cannot delete right away
-		time.Sleep(interfacePostDetachSettleTime)
+		if err := sleepContext(ctx, interfacePostDetachSettleTime); err != nil {
+			return err
+		}
 
 		// Now we can safely remove the interface
 		if err := deleteInterface(interfaceID); err != nil {
 			return err
 		}
 	}
+	invalidateMetadataCache("network/interfaces/")
 	return nil
 }
 
+// FreeInterface detaches and deletes an interface this process has just
+// created but is unable to use, so failed allocations don't leave ENIs
+// behind counting against the account's limits.
+func FreeInterface(intf Interface) error {
+	if intf.ID == "" {
+		return fmt.Errorf("interface %v has no ID, can't free it", intf.Mac)
+	}
+	return RemoveInterface(context.Background(), []string{intf.ID})
+}
+
 func deleteInterface(interfaceID string) error {
 	client, err := newEC2()
 	if err != nil {
@@ -234,11 +638,13 @@ func deleteInterface(interfaceID string) error {
 		NetworkInterfaceId: aws.String(interfaceID),
 	}
 
-	_, err = client.DeleteNetworkInterface(deleteInterfaceInput)
-	return err
+	return withRetry(func() (err error) {
+		_, err = client.DeleteNetworkInterface(deleteInterfaceInput)
+		return
+	})
 }
 
-func waitUtilInterfaceDetaches(interfaceID string) error {
+func waitUtilInterfaceDetaches(ctx context.Context, interfaceID string) error {
 	var interfaceDescription *ec2.NetworkInterface
 
 	interfaceDescription, err := describeNetworkInterface(interfaceID)
@@ -257,9 +663,371 @@ func waitUtilInterfaceDetaches(interfaceID string) error {
 			return fmt.Errorf("Interface %v has not detached yet, use --force to override this check", interfaceID)
 		}
 
-		time.Sleep(interfaceDetachWaitTime)
+		if err := sleepContext(ctx, interfaceDetachWaitTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ManagedInterfaceCount returns the number of interfaces created by this
+// plugin, identified by InterfaceMarkerTag, attached to the instance
+func ManagedInterfaceCount() (int, error) {
+	interfaces, err := describeManagedInterfaces()
+	if err != nil {
+		return 0, err
+	}
+	return len(interfaces), nil
+}
+
+// ManagedSecondaryIPs returns the secondary private IPv4 addresses EC2 has
+// assigned to interfaces created by this plugin attached to the instance.
+// Primary addresses are never included.
+func ManagedSecondaryIPs() ([]net.IP, error) {
+	interfaces, err := describeManagedInterfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, eni := range interfaces {
+		for _, addr := range eni.PrivateIpAddresses {
+			if aws.BoolValue(addr.Primary) {
+				continue
+			}
+			if ip := net.ParseIP(aws.StringValue(addr.PrivateIpAddress)); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// ManagedIPCount returns the number of secondary IPv4 addresses, counting
+// every address of delegated prefixes, EC2 has assigned to interfaces
+// created by this plugin attached to the instance
+func ManagedIPCount() (int, error) {
+	interfaces, err := describeManagedInterfaces()
+	if err != nil {
+		return 0, err
 	}
+	return managedIPCount(interfaces), nil
+}
+
+func managedIPCount(interfaces []*ec2.NetworkInterface) int {
+	count := 0
+	for _, eni := range interfaces {
+		for _, addr := range eni.PrivateIpAddresses {
+			if !aws.BoolValue(addr.Primary) {
+				count++
+			}
+		}
+		count += prefixSize * len(eni.Ipv4Prefixes)
+	}
+	return count
+}
+
+// interfacesInUse returns the IDs of the interfaces recorded as used by a
+// pod on this node. Without it, or ipsInUse, no interface is released.
+var interfacesInUse func() ([]string, error)
 
+// SetInterfacesInUse sets how ReleaseEmptyInterfaces finds the interfaces
+// dedicated to a pod or recorded for an attachment, which it never
+// releases
+func SetInterfacesInUse(inUse func() ([]string, error)) {
+	interfacesInUse = inUse
+}
+
+// ReleaseEmptyInterfaces detaches and deletes interfaces created by this
+// plugin which have no secondary IPv4 addresses or prefixes left and no
+// address a pod uses, keeping minimumWarm of them attached for future
+// pods. Interfaces at lower device indexes are kept. Enough empty
+// interfaces are also kept for warmTarget interfaces with spare capacity
+// to remain, so a warm ENI target isn't undone by the release. With a
+// cooldown, interfaces are only released once they have been empty for
+// about that long, across invocations. It returns the IDs of the removed
+// interfaces and when the next release may be due, the zero time if none
+// is pending. Callers must exclude concurrent allocations. Removal gives
+// up once ctx is done.
+func ReleaseEmptyInterfaces(ctx context.Context, minimumWarm int, warmTarget int, cooldown time.Duration) ([]string, time.Time, error) {
+	interfaces, err := describeManagedInterfaces()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if warmTarget > 0 {
+		minimumWarm = warmKeep(interfaces, minimumWarm, warmTarget, ENILimits().IPv4)
+	}
+	// Pods use the primary IP of the interfaces created for them and IPv6
+	// addresses, which leave an interface looking empty
+	if ipsInUse == nil || interfacesInUse == nil {
+		return nil, time.Time{}, nil
+	}
+	inUse, err := ipsInUse()
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("unable to find the addresses in use: %v", err)
+	}
+	usedIDs, err := interfacesInUse()
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("unable to find the interfaces in use: %v", err)
+	}
+	release := emptyInterfaceIDs(interfaces, minimumWarm, inUse, usedIDs)
+
+	var pending releaseDeadlines
+	if cooldown > 0 {
+		release, pending = cooledDown(release, loadReleaseDeadlines(), time.Now(), cooldown)
+		if err := saveReleaseDeadlines(pending); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	if len(release) == 0 {
+		return nil, pending.nextDeadline(), nil
+	}
+	return release, pending.nextDeadline(), RemoveInterface(ctx, release)
+}
+
+// emptyInterfaceIDs returns the IDs of the interfaces with only a primary
+// IPv4 address and no delegated prefixes, except for the minimumWarm
+// lowest device indexes. Interfaces in usedIDs or with an address in
+// inUse aren't empty.
+func emptyInterfaceIDs(interfaces []*ec2.NetworkInterface, minimumWarm int, inUse []net.IP, usedIDs []string) []string {
+	var empty []*ec2.NetworkInterface
+	for _, eni := range interfaces {
+		if containsString(usedIDs, aws.StringValue(eni.NetworkInterfaceId)) || hasAddressInUse(eni, inUse) {
+			continue
+		}
+		// Only interfaces carrying the marker are ours to delete
+		var marked bool
+		for _, tag := range eni.TagSet {
+			if aws.StringValue(tag.Key) == InterfaceMarkerTag {
+				marked = true
+			}
+		}
+		if marked && eni.Attachment != nil && isEmpty(eni) {
+			empty = append(empty, eni)
+		}
+	}
+	sort.Slice(empty, func(i, j int) bool {
+		return aws.Int64Value(empty[i].Attachment.DeviceIndex) < aws.Int64Value(empty[j].Attachment.DeviceIndex)
+	})
+
+	var ids []string
+	for i, eni := range empty {
+		if i >= minimumWarm {
+			ids = append(ids, aws.StringValue(eni.NetworkInterfaceId))
+		}
+	}
+	return ids
+}
+
+// warmKeep returns how many empty interfaces must be kept for warmTarget
+// interfaces to have spare capacity, counting those which are partially
+// used, and at least minimumWarm. With an unknown IPv4 limit, no
+// partially used interface is counted.
+func warmKeep(interfaces []*ec2.NetworkInterface, minimumWarm int, warmTarget int, limit int) int {
+	keep := warmTarget
+	for _, eni := range interfaces {
+		if !isEmpty(eni) && hasSpareCapacity(eni, limit) {
+			keep--
+		}
+	}
+	if keep < minimumWarm {
+		keep = minimumWarm
+	}
+	return keep
+}
+
+// SpareInterfaceCount returns the number of interfaces created by this
+// plugin attached to the instance which can take another IPv4 address or
+// prefix
+func SpareInterfaceCount() (int, error) {
+	limit := ENILimits().IPv4
+	if limit == 0 {
+		return 0, fmt.Errorf("unable to determine the IPv4 limit of this instance's interfaces")
+	}
+	interfaces, err := describeManagedInterfaces()
+	if err != nil {
+		return 0, err
+	}
+	var spare int
+	for _, eni := range interfaces {
+		if hasSpareCapacity(eni, limit) {
+			spare++
+		}
+	}
+	return spare, nil
+}
+
+// hasSpareCapacity reports whether an attached interface uses fewer than
+// limit IPv4 slots, each prefix taking one like an address
+func hasSpareCapacity(eni *ec2.NetworkInterface, limit int) bool {
+	return eni.Attachment != nil && len(eni.PrivateIpAddresses)+len(eni.Ipv4Prefixes) < limit
+}
+
+// isEmpty reports whether the interface holds only its primary IPv4
+// address
+func isEmpty(eni *ec2.NetworkInterface) bool {
+	return len(eni.PrivateIpAddresses) <= 1 && len(eni.Ipv4Prefixes) == 0
+}
+
+// hasAddressInUse reports whether any IPv4 or IPv6 address of the
+// interface is in inUse
+func hasAddressInUse(eni *ec2.NetworkInterface, inUse []net.IP) bool {
+	var addrs []string
+	for _, addr := range eni.PrivateIpAddresses {
+		addrs = append(addrs, aws.StringValue(addr.PrivateIpAddress))
+	}
+	for _, addr := range eni.Ipv6Addresses {
+		addrs = append(addrs, aws.StringValue(addr.Ipv6Address))
+	}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		for _, used := range inUse {
+			if ip != nil && ip.Equal(used) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func describeManagedInterfaces() ([]*ec2.NetworkInterface, error) {
+	client, err := newEC2()
+	if err != nil {
+		return nil, err
+	}
+	idDoc, err := getIDDoc()
+	if err != nil {
+		return nil, err
+	}
+
+	describeInterfaceInput := &ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{
+			newEc2Filter("attachment.instance-id", idDoc.InstanceID),
+			newEc2Filter("tag-key", InterfaceMarkerTag),
+		},
+	}
+
+	var interfaceDescribeOutput *ec2.DescribeNetworkInterfacesOutput
+	err = withRetry(func() (err error) {
+		interfaceDescribeOutput, err = client.DescribeNetworkInterfaces(describeInterfaceInput)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return interfaceDescribeOutput.NetworkInterfaces, nil
+}
+
+// InterfaceIndexForIP asks EC2 which interface attached to this instance
+// an address is assigned to, returning its device index. Unlike the
+// metadata service EC2 reflects reassignments immediately.
+func InterfaceIndexForIP(ip net.IP) (int, error) {
+	client, err := newEC2()
+	if err != nil {
+		return 0, err
+	}
+	idDoc, err := getIDDoc()
+	if err != nil {
+		return 0, err
+	}
+
+	addressFilter := "addresses.private-ip-address"
+	if ip.To4() == nil {
+		addressFilter = "ipv6-addresses.ipv6-address"
+	}
+	describeInterfaceInput := &ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{
+			newEc2Filter("attachment.instance-id", idDoc.InstanceID),
+			newEc2Filter(addressFilter, ip.String()),
+		},
+	}
+
+	var interfaceDescribeOutput *ec2.DescribeNetworkInterfacesOutput
+	err = withRetry(func() (err error) {
+		interfaceDescribeOutput, err = client.DescribeNetworkInterfaces(describeInterfaceInput)
+		return
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, eni := range interfaceDescribeOutput.NetworkInterfaces {
+		if eni.Attachment != nil && eni.Attachment.DeviceIndex != nil {
+			return int(*eni.Attachment.DeviceIndex), nil
+		}
+	}
+	return 0, fmt.Errorf("%v is not assigned to any interface on this instance", ip)
+}
+
+// IsIPAssigned asks EC2 whether an address is still assigned to the
+// interface, individually or in one of its prefixes. The metadata service
+// may still list an address moved to another interface out of band. An
+// interface which no longer exists holds no addresses.
+func IsIPAssigned(interfaceID string, ip net.IP) (bool, error) {
+	eni, err := describeNetworkInterface(interfaceID)
+	if isGone(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return eniHasIP(eni, ip), nil
+}
+
+func eniHasIP(eni *ec2.NetworkInterface, ip net.IP) bool {
+	for _, addr := range eni.PrivateIpAddresses {
+		if ip.Equal(net.ParseIP(aws.StringValue(addr.PrivateIpAddress))) {
+			return true
+		}
+	}
+	for _, prefix := range eni.Ipv4Prefixes {
+		_, block, err := net.ParseCIDR(aws.StringValue(prefix.Ipv4Prefix))
+		if err == nil && block.Contains(ip) {
+			return true
+		}
+	}
+	for _, addr := range eni.Ipv6Addresses {
+		if ip.Equal(net.ParseIP(aws.StringValue(addr.Ipv6Address))) {
+			return true
+		}
+	}
+	return false
+}
+
+// AttachedInterface returns an interface provisioned outside of the plugin,
+// after verifying with EC2 that it's attached to this instance
+func AttachedInterface(interfaceID string) (*Interface, error) {
+	idDoc, err := getIDDoc()
+	if err != nil {
+		return nil, err
+	}
+	eni, err := describeNetworkInterface(interfaceID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAttached(eni, idDoc.InstanceID); err != nil {
+		return nil, err
+	}
+
+	interfaces, err := GetInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, intf := range interfaces {
+		if intf.ID == interfaceID {
+			return &intf, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %v is not in the instance metadata yet", interfaceID)
+}
+
+// checkAttached verifies the interface is attached to the instance
+func checkAttached(eni *ec2.NetworkInterface, instanceID string) error {
+	if eni.Attachment == nil || aws.StringValue(eni.Attachment.InstanceId) != instanceID {
+		return fmt.Errorf("interface %v is not attached to instance %v",
+			aws.StringValue(eni.NetworkInterfaceId), instanceID)
+	}
 	return nil
 }
 
@@ -274,7 +1042,11 @@ func describeNetworkInterface(interfaceID string) (*ec2.NetworkInterface, error)
 		NetworkInterfaceIds: aws.StringSlice(interfaceIDList),
 	}
 
-	interfaceDescribeOutput, err := client.DescribeNetworkInterfaces(describeInterfaceInput)
+	var interfaceDescribeOutput *ec2.DescribeNetworkInterfacesOutput
+	err = withRetry(func() (err error) {
+		interfaceDescribeOutput, err = client.DescribeNetworkInterfaces(describeInterfaceInput)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -1,10 +1,16 @@
 package aws
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
@@ -14,6 +20,13 @@ type ec2ClientMock struct {
 	NetworkDescribeResponse ec2.DescribeNetworkInterfacesOutput
 	NetworkDeleteResponse   ec2.DeleteNetworkInterfaceOutput
 	NetworkDetachResponse   ec2.DetachNetworkInterfaceOutput
+	InstanceTypesResponse   ec2.DescribeInstanceTypesOutput
+	// Calls records the interfaces detached and deleted
+	Calls []string
+}
+
+func (e *ec2ClientMock) DescribeInstanceTypes(in *ec2.DescribeInstanceTypesInput) (*ec2.DescribeInstanceTypesOutput, error) {
+	return &e.InstanceTypesResponse, nil
 }
 
 func (e *ec2ClientMock) DescribeNetworkInterfaces(in *ec2.DescribeNetworkInterfacesInput) (*ec2.DescribeNetworkInterfacesOutput, error) {
@@ -21,17 +34,186 @@ func (e *ec2ClientMock) DescribeNetworkInterfaces(in *ec2.DescribeNetworkInterfa
 }
 
 func (e *ec2ClientMock) DeleteNetworkInterface(in *ec2.DeleteNetworkInterfaceInput) (*ec2.DeleteNetworkInterfaceOutput, error) {
+	e.Calls = append(e.Calls, "delete "+aws.StringValue(in.NetworkInterfaceId))
 	return &e.NetworkDeleteResponse, nil
 }
 
+func (e *ec2ClientMock) DetachNetworkInterfaceWithContext(ctx aws.Context, in *ec2.DetachNetworkInterfaceInput, opts ...request.Option) (*ec2.DetachNetworkInterfaceOutput, error) {
+	e.Calls = append(e.Calls, "detach "+aws.StringValue(in.AttachmentId))
+	return &e.NetworkDetachResponse, nil
+}
+
 func (e *ec2ClientMock) DetachNetworkInterface(in *ec2.DetachNetworkInterfaceInput) (*ec2.DetachNetworkInterfaceOutput, error) {
 	return &e.NetworkDetachResponse, nil
 }
 
+// attachingMock reports the interface attaching until the given number of
+// describes have been made
+type attachingMock struct {
+	ec2iface.EC2API
+	attachedAfter int
+	describes     int
+}
+
+func (a *attachingMock) DescribeNetworkInterfacesWithContext(ctx aws.Context, in *ec2.DescribeNetworkInterfacesInput, opts ...request.Option) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	a.describes++
+	eni := &ec2.NetworkInterface{
+		NetworkInterfaceId: in.NetworkInterfaceIds[0],
+		Status:             aws.String(ec2.NetworkInterfaceStatusAvailable),
+		Attachment:         &ec2.NetworkInterfaceAttachment{Status: aws.String(ec2.AttachmentStatusAttaching)},
+	}
+	if a.describes >= a.attachedAfter {
+		eni.Status = aws.String(ec2.NetworkInterfaceStatusInUse)
+		eni.Attachment.Status = aws.String(ec2.AttachmentStatusAttached)
+	}
+	return &ec2.DescribeNetworkInterfacesOutput{NetworkInterfaces: []*ec2.NetworkInterface{eni}}, nil
+}
+
+func TestWaitForAttachment(t *testing.T) {
+	oldInitial, oldMax, oldSettle := attachmentPollInitialWait, attachmentPollMaxWait, interfaceSettleTime
+	attachmentPollInitialWait, attachmentPollMaxWait = time.Millisecond, 2*time.Millisecond
+	defer func() {
+		attachmentPollInitialWait, attachmentPollMaxWait, interfaceSettleTime = oldInitial, oldMax, oldSettle
+	}()
+
+	client := &attachingMock{attachedAfter: 3}
+	if err := waitForAttachment(context.Background(), client, "eni-new"); err != nil {
+		t.Fatalf("Failed to wait for the attachment: %v", err)
+	}
+	if client.describes != 3 {
+		t.Fatalf("expected 3 describes, got %d", client.describes)
+	}
+
+	interfaceSettleTime = 5 * time.Millisecond
+	client = &attachingMock{attachedAfter: 1000}
+	if err := waitForAttachment(context.Background(), client, "eni-stuck"); err == nil {
+		t.Fatalf("interface that never attached was reported attached")
+	}
+}
+
+func TestRemoveCreatedInterface(t *testing.T) {
+	oldSettle := interfacePostDetachSettleTime
+	interfacePostDetachSettleTime = 1
+	defer func() {
+		interfacePostDetachSettleTime = oldSettle
+		_ec2Client = nil
+	}()
+
+	client := &ec2ClientMock{NetworkDescribeResponse: ec2.DescribeNetworkInterfacesOutput{
+		NetworkInterfaces: []*ec2.NetworkInterface{{Status: aws.String("available")}},
+	}}
+	_ec2Client = client
+	cause := fmt.Errorf("interface did not attach in time")
+	if err := removeCreatedInterface(client, "eni-new", aws.String("eni-attach-1"), cause); err != cause {
+		t.Fatalf("expected the cause to be returned, got %v", err)
+	}
+	if !reflect.DeepEqual(client.Calls, []string{"detach eni-attach-1", "delete eni-new"}) {
+		t.Errorf("expected the interface to be detached and deleted, got %v", client.Calls)
+	}
+}
+
 // func TestNewInterfaceOnSubnetAtIndex(t *testing.T) {}
 // func TestConfigureInterface(t *testing.T) {}
 // func TestNewInterface(t *testing.T) {}
 
+func TestSelectSubnetsOtherAZ(t *testing.T) {
+	subnets := []Subnet{
+		{ID: "subnet-other-az", AvailabilityZone: "us-east-1b", AvailableAddressCount: 1000, Tags: map[string]string{"k8s": "true"}},
+	}
+	opts := InterfaceOptions{SubnetTags: map[string]string{"k8s": "true"}}
+
+	if selected := selectSubnets(subnets, nil, "us-east-1a", opts); len(selected) != 0 {
+		t.Fatalf("subnet in another availability zone was selected: %v", selected)
+	}
+}
+
+func TestSelectSubnets(t *testing.T) {
+	subnets := []Subnet{
+		{ID: "subnet-small", AvailabilityZone: "us-east-1a", AvailableAddressCount: 4, Tags: map[string]string{"k8s": "true"}},
+		{ID: "subnet-large", AvailabilityZone: "us-east-1a", AvailableAddressCount: 200, Tags: map[string]string{"k8s": "true"}},
+		{ID: "subnet-used", AvailabilityZone: "us-east-1a", AvailableAddressCount: 300, Tags: map[string]string{"k8s": "true"}},
+		{ID: "subnet-untagged", AvailabilityZone: "us-east-1a", AvailableAddressCount: 500, Tags: map[string]string{}},
+		{ID: "subnet-full", AvailabilityZone: "us-east-1a", AvailableAddressCount: 0, Tags: map[string]string{"k8s": "true"}},
+		{ID: "subnet-other-az", AvailabilityZone: "us-east-1b", AvailableAddressCount: 1000, Tags: map[string]string{"k8s": "true"}},
+	}
+	existing := []Interface{{SubnetID: "subnet-used"}}
+
+	cases := []struct {
+		Opts     InterfaceOptions
+		Expected []string
+	}{
+		{
+			Opts:     InterfaceOptions{SubnetTags: map[string]string{"k8s": "true"}},
+			Expected: []string{"subnet-large", "subnet-small"},
+		},
+		{
+			Opts:     InterfaceOptions{SubnetTags: map[string]string{"k8s": "true"}, MinimumFreeIPs: 10},
+			Expected: []string{"subnet-large"},
+		},
+		{
+			Opts:     InterfaceOptions{},
+			Expected: []string{"subnet-untagged", "subnet-large", "subnet-small"},
+		},
+		{
+			Opts: InterfaceOptions{
+				SubnetTags: map[string]string{"k8s": "true"},
+				SubnetIDs:  []string{"subnet-small", "subnet-untagged", "subnet-used", "subnet-other-az"},
+			},
+			Expected: []string{"subnet-untagged", "subnet-small"},
+		},
+		{
+			Opts: InterfaceOptions{
+				SubnetIDs:           []string{"subnet-small"},
+				Pod:                 PodInfo{Namespace: "staging"},
+				NamespaceSubnetTags: map[string]map[string]string{"prod": {"k8s": "true"}},
+			},
+			Expected: []string{"subnet-small"},
+		},
+		{
+			Opts: InterfaceOptions{
+				SubnetIDs:           []string{"subnet-untagged"},
+				Pod:                 PodInfo{Namespace: "prod"},
+				NamespaceSubnetTags: map[string]map[string]string{"prod": {"k8s": "true"}},
+			},
+			Expected: []string{"subnet-large", "subnet-small"},
+		},
+	}
+
+	for i, c := range cases {
+		selected := selectSubnets(subnets, existing, "us-east-1a", c.Opts)
+		var ids []string
+		for _, subnet := range selected {
+			ids = append(ids, subnet.ID)
+		}
+		if !reflect.DeepEqual(ids, c.Expected) {
+			t.Fatalf("%d expected subnets %v, got %v", i, c.Expected, ids)
+		}
+	}
+}
+
+func TestSelectSubnetsExcludeTags(t *testing.T) {
+	subnets := []Subnet{
+		{ID: "subnet-pods", AvailabilityZone: "us-east-1a", AvailableAddressCount: 100, Tags: map[string]string{"k8s": "true"}},
+		{ID: "subnet-rds", AvailabilityZone: "us-east-1a", AvailableAddressCount: 200, Tags: map[string]string{"k8s": "true", "reserved": "rds"}},
+		{ID: "subnet-other", AvailabilityZone: "us-east-1a", AvailableAddressCount: 300, Tags: map[string]string{"k8s": "true", "reserved": "none"}},
+	}
+	exclude := map[string]string{"reserved": "rds"}
+
+	// Included by tags or by ID, the excluded subnet is skipped
+	for _, opts := range []InterfaceOptions{
+		{SubnetTags: map[string]string{"k8s": "true"}, SubnetExcludeTags: exclude},
+		{SubnetIDs: []string{"subnet-pods", "subnet-rds", "subnet-other"}, SubnetExcludeTags: exclude},
+	} {
+		var ids []string
+		for _, subnet := range selectSubnets(subnets, nil, "us-east-1a", opts) {
+			ids = append(ids, subnet.ID)
+		}
+		if !reflect.DeepEqual(ids, []string{"subnet-other", "subnet-pods"}) {
+			t.Fatalf("expected subnet-rds to be excluded, got %v", ids)
+		}
+	}
+}
+
 func TestRemoveInterface(t *testing.T) {
 	interfaceDetachAttempts = 1
 	interfacePostDetachSettleTime = 1
@@ -81,7 +263,7 @@ func TestRemoveInterface(t *testing.T) {
 		_ec2Client = &ec2ClientMock{
 			NetworkDescribeResponse: c.NetworkDescribeResponse,
 		}
-		err := RemoveInterface(c.Input)
+		err := RemoveInterface(context.Background(), c.Input)
 
 		if err != nil {
 			t.Fatalf("%d Mock returned an error: %v", i, err)
@@ -145,7 +327,7 @@ func TestWaitUntilInterfaceDetaches(t *testing.T) {
 
 	for i, c := range cases {
 		_ec2Client = &ec2ClientMock{NetworkDescribeResponse: c.Response}
-		err := waitUtilInterfaceDetaches(c.Input)
+		err := waitUtilInterfaceDetaches(context.Background(), c.Input)
 
 		if err != nil {
 			if err.Error() != c.Expected {
@@ -202,3 +384,311 @@ func TestDescribeNetworkInterface(t *testing.T) {
 		}
 	}
 }
+
+func TestInterfaceIndexForIP(t *testing.T) {
+	oldIDDoc := _idDoc
+	defer func() { _idDoc = oldIDDoc }()
+	_idDoc = &ec2metadata.EC2InstanceIdentityDocument{
+		Region:     "us-east-1",
+		InstanceID: "i-lyft",
+	}
+
+	cases := []struct {
+		Response ec2.DescribeNetworkInterfacesOutput
+		Expected int
+		Error    bool
+	}{
+		{
+			Response: ec2.DescribeNetworkInterfacesOutput{
+				NetworkInterfaces: []*ec2.NetworkInterface{
+					{
+						Attachment: &ec2.NetworkInterfaceAttachment{
+							DeviceIndex: aws.Int64(2),
+						},
+						NetworkInterfaceId: aws.String("eni-lyft-1"),
+					},
+				},
+			},
+			Expected: 2,
+		},
+		{
+			Response: ec2.DescribeNetworkInterfacesOutput{},
+			Error:    true,
+		},
+	}
+
+	for i, c := range cases {
+		_ec2Client = &ec2ClientMock{NetworkDescribeResponse: c.Response}
+		index, err := InterfaceIndexForIP(net.ParseIP("10.0.0.10"))
+		if c.Error {
+			if err == nil {
+				t.Fatalf("%d expected an error for an unassigned IP", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d Mock returned an error: %v", i, err)
+		}
+		if index != c.Expected {
+			t.Fatalf("%d expected index %d, got %d", i, c.Expected, index)
+		}
+	}
+}
+
+func TestCheckAttached(t *testing.T) {
+	cases := []struct {
+		Attachment *ec2.NetworkInterfaceAttachment
+		Error      bool
+	}{
+		{
+			Attachment: &ec2.NetworkInterfaceAttachment{InstanceId: aws.String("i-lyft")},
+		},
+		{
+			Attachment: &ec2.NetworkInterfaceAttachment{InstanceId: aws.String("i-other")},
+			Error:      true,
+		},
+		{
+			Error: true,
+		},
+	}
+
+	for i, c := range cases {
+		eni := &ec2.NetworkInterface{
+			NetworkInterfaceId: aws.String("eni-lyft-1"),
+			Attachment:         c.Attachment,
+		}
+		err := checkAttached(eni, "i-lyft")
+		if c.Error != (err != nil) {
+			t.Fatalf("%d expected error %v, got %v", i, c.Error, err)
+		}
+	}
+}
+
+func TestManagedInterfaceCount(t *testing.T) {
+	oldIDDoc := _idDoc
+	defer func() { _idDoc = oldIDDoc }()
+	_idDoc = &ec2metadata.EC2InstanceIdentityDocument{
+		Region:     "us-east-1",
+		InstanceID: "i-lyft",
+	}
+
+	_ec2Client = &ec2ClientMock{
+		NetworkDescribeResponse: ec2.DescribeNetworkInterfacesOutput{
+			NetworkInterfaces: []*ec2.NetworkInterface{
+				{NetworkInterfaceId: aws.String("eni-lyft-1")},
+				{NetworkInterfaceId: aws.String("eni-lyft-2")},
+			},
+		},
+	}
+	count, err := ManagedInterfaceCount()
+	if err != nil {
+		t.Fatalf("Mock returned an error: %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 managed interfaces, got %d", count)
+	}
+}
+
+func TestInterfaceTags(t *testing.T) {
+	opts := InterfaceOptions{
+		Tags: map[string]string{
+			"team":             "networking",
+			InterfaceMarkerTag: "false",
+		},
+		NodeName: "ip-10-0-0-1.ec2.internal",
+		Pod:      PodInfo{Namespace: "default", Name: "web-0"},
+	}
+	expected := map[string]string{
+		"team":                   "networking",
+		InterfaceMarkerTag:       "true",
+		InterfaceNodeNameTag:     "ip-10-0-0-1.ec2.internal",
+		InterfacePodNamespaceTag: "default",
+		InterfacePodNameTag:      "web-0",
+	}
+	if tags := opts.interfaceTags(); !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("expected %v, got %v", expected, tags)
+	}
+	if opts.Tags[InterfaceMarkerTag] != "false" {
+		t.Fatalf("configured tags were modified")
+	}
+}
+
+func TestInterfaceDescription(t *testing.T) {
+	opts := InterfaceOptions{NodeName: "ip-10-0-0-1.ec2.internal"}
+	if description := opts.description("i-lyft"); description != "CNI-ENI i-lyft" {
+		t.Fatalf("unexpected default description %q", description)
+	}
+	if _, ok := opts.interfaceTags()[InterfaceDescriptionTag]; ok {
+		t.Fatalf("default description was tagged")
+	}
+
+	opts.DescriptionPrefix = "cni"
+	opts.ClusterName = "prod"
+	expected := "cni:ip-10-0-0-1.ec2.internal:prod"
+	if description := opts.description("i-lyft"); description != expected {
+		t.Fatalf("expected %q, got %q", expected, description)
+	}
+	if tag := opts.interfaceTags()[InterfaceDescriptionTag]; tag != expected {
+		t.Fatalf("expected the description tag %q, got %q", expected, tag)
+	}
+
+	opts.ClusterName = ""
+	if description := opts.description("i-lyft"); description != "cni:ip-10-0-0-1.ec2.internal" {
+		t.Fatalf("unexpected description without a cluster %q", description)
+	}
+}
+
+func TestManagedSecondaryIPs(t *testing.T) {
+	oldIDDoc := _idDoc
+	defer func() { _idDoc = oldIDDoc }()
+	_idDoc = &ec2metadata.EC2InstanceIdentityDocument{
+		Region:     "us-east-1",
+		InstanceID: "i-lyft",
+	}
+
+	_ec2Client = &ec2ClientMock{
+		NetworkDescribeResponse: ec2.DescribeNetworkInterfacesOutput{
+			NetworkInterfaces: []*ec2.NetworkInterface{
+				{
+					NetworkInterfaceId: aws.String("eni-lyft-1"),
+					PrivateIpAddresses: []*ec2.NetworkInterfacePrivateIpAddress{
+						{PrivateIpAddress: aws.String("10.0.0.10"), Primary: aws.Bool(true)},
+						{PrivateIpAddress: aws.String("10.0.0.11"), Primary: aws.Bool(false)},
+						{PrivateIpAddress: aws.String("10.0.0.12"), Primary: aws.Bool(false)},
+					},
+				},
+			},
+		},
+	}
+	ips, err := ManagedSecondaryIPs()
+	if err != nil {
+		t.Fatalf("Mock returned an error: %v", err)
+	}
+	expected := []net.IP{net.ParseIP("10.0.0.11"), net.ParseIP("10.0.0.12")}
+	if !reflect.DeepEqual(ips, expected) {
+		t.Fatalf("expected %v, got %v", expected, ips)
+	}
+}
+
+func TestSecurityGroupsFor(t *testing.T) {
+	opts := InterfaceOptions{
+		SecurityGroups: []string{"sg-default"},
+		SubnetSecurityGroups: []SubnetSecurityGroups{
+			{SubnetTags: map[string]string{"tier": "public"}, SecurityGroups: []string{"sg-public"}},
+			{SubnetTags: map[string]string{"tier": "private"}, SecurityGroups: []string{"sg-private"}},
+		},
+	}
+
+	cases := []struct {
+		Tags     map[string]string
+		Expected []string
+	}{
+		{Tags: map[string]string{"tier": "public", "k8s": "true"}, Expected: []string{"sg-public"}},
+		{Tags: map[string]string{"tier": "private"}, Expected: []string{"sg-private"}},
+		{Tags: map[string]string{"tier": "dmz"}, Expected: []string{"sg-default"}},
+		{Tags: map[string]string{}, Expected: []string{"sg-default"}},
+	}
+
+	for i, c := range cases {
+		secGrps := opts.securityGroupsFor(Subnet{ID: "subnet-lyft", Tags: c.Tags})
+		if !reflect.DeepEqual(secGrps, c.Expected) {
+			t.Fatalf("%d expected %v, got %v", i, c.Expected, secGrps)
+		}
+	}
+}
+
+func TestEmptyInterfaceIDs(t *testing.T) {
+	eni := func(id string, index int64, ips int, marked bool) *ec2.NetworkInterface {
+		intf := &ec2.NetworkInterface{
+			NetworkInterfaceId: aws.String(id),
+			Attachment:         &ec2.NetworkInterfaceAttachment{DeviceIndex: aws.Int64(index)},
+		}
+		for i := 0; i < ips; i++ {
+			intf.PrivateIpAddresses = append(intf.PrivateIpAddresses, &ec2.NetworkInterfacePrivateIpAddress{})
+		}
+		if marked {
+			intf.TagSet = []*ec2.Tag{{Key: aws.String(InterfaceMarkerTag), Value: aws.String("true")}}
+		}
+		return intf
+	}
+	interfaces := []*ec2.NetworkInterface{
+		eni("eni-empty-3", 3, 1, true),
+		eni("eni-used", 1, 2, true),
+		eni("eni-empty-2", 2, 1, true),
+		eni("eni-unmarked", 4, 1, false),
+		eni("eni-prefix", 5, 1, true),
+	}
+	interfaces[4].Ipv4Prefixes = []*ec2.Ipv4PrefixSpecification{{Ipv4Prefix: aws.String("10.0.0.16/28")}}
+
+	if ids := emptyInterfaceIDs(interfaces, 0, nil, nil); !reflect.DeepEqual(ids, []string{"eni-empty-2", "eni-empty-3"}) {
+		t.Fatalf("expected both empty interfaces, got %v", ids)
+	}
+	if ids := emptyInterfaceIDs(interfaces, 1, nil, nil); !reflect.DeepEqual(ids, []string{"eni-empty-3"}) {
+		t.Fatalf("expected the highest empty interface, got %v", ids)
+	}
+	if ids := emptyInterfaceIDs(interfaces, 2, nil, nil); len(ids) != 0 {
+		t.Fatalf("expected all empty interfaces to be kept warm, got %v", ids)
+	}
+
+	// A pod on the primary IPv4 or an IPv6 address of an interface, or
+	// one it's dedicated to, is using it
+	interfaces[0].PrivateIpAddresses[0].PrivateIpAddress = aws.String("10.0.0.30")
+	interfaces[2].Ipv6Addresses = []*ec2.NetworkInterfaceIpv6Address{{Ipv6Address: aws.String("2600:1f18::30")}}
+	inUse := []net.IP{net.ParseIP("10.0.0.30"), net.ParseIP("2600:1f18::30")}
+	if ids := emptyInterfaceIDs(interfaces, 0, inUse, nil); len(ids) != 0 {
+		t.Fatalf("expected the interfaces in use to be kept, got %v", ids)
+	}
+	if ids := emptyInterfaceIDs(interfaces, 0, inUse[:1], []string{"eni-empty-2"}); len(ids) != 0 {
+		t.Fatalf("expected the interfaces in use to be kept, got %v", ids)
+	}
+	if ids := emptyInterfaceIDs(interfaces, 0, inUse[:1], nil); !reflect.DeepEqual(ids, []string{"eni-empty-2"}) {
+		t.Fatalf("expected the unused interface, got %v", ids)
+	}
+}
+
+func TestManagedIPCount(t *testing.T) {
+	interfaces := []*ec2.NetworkInterface{{
+		PrivateIpAddresses: []*ec2.NetworkInterfacePrivateIpAddress{
+			{Primary: aws.Bool(true)},
+			{Primary: aws.Bool(false)},
+			{Primary: aws.Bool(false)},
+		},
+	}, {
+		PrivateIpAddresses: []*ec2.NetworkInterfacePrivateIpAddress{{Primary: aws.Bool(true)}},
+		Ipv4Prefixes:       []*ec2.Ipv4PrefixSpecification{{Ipv4Prefix: aws.String("10.0.0.16/28")}},
+	}}
+
+	if count := managedIPCount(interfaces); count != 18 {
+		t.Fatalf("expected 2 secondary IPs and 16 prefix addresses, got %d", count)
+	}
+}
+
+func TestWarmKeep(t *testing.T) {
+	eni := func(ips int) *ec2.NetworkInterface {
+		intf := &ec2.NetworkInterface{Attachment: &ec2.NetworkInterfaceAttachment{}}
+		for i := 0; i < ips; i++ {
+			intf.PrivateIpAddresses = append(intf.PrivateIpAddresses, &ec2.NetworkInterfacePrivateIpAddress{})
+		}
+		return intf
+	}
+	// One partially used, one full and two empty interfaces
+	interfaces := []*ec2.NetworkInterface{eni(3), eni(10), eni(1), eni(1)}
+
+	cases := []struct {
+		MinimumWarm, WarmTarget, Expected int
+	}{
+		{0, 1, 0},
+		{0, 2, 1},
+		{0, 3, 2},
+		{2, 1, 2},
+		{1, 3, 2},
+	}
+	for i, c := range cases {
+		if keep := warmKeep(interfaces, c.MinimumWarm, c.WarmTarget, 10); keep != c.Expected {
+			t.Fatalf("%d expected to keep %d, got %d", i, c.Expected, keep)
+		}
+	}
+	if keep := warmKeep(interfaces, 0, 2, 0); keep != 2 {
+		t.Fatalf("expected an unknown limit to keep the target, got %d", keep)
+	}
+}
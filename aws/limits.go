@@ -1,5 +1,15 @@
 package aws
 
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
 // ENILimit contains limits for adapter count and addresses
 type ENILimit struct {
 	Adapters int
@@ -9,6 +19,10 @@ type ENILimit struct {
 
 var eniLimits map[string]ENILimit
 
+// Limits looked up from EC2 by this process
+var describedLimits = map[string]ENILimit{}
+var describedLimitsLock sync.Mutex
+
 func init() {
 	// This table of limits referenced from:
 	// http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/using-eni.html
@@ -111,11 +125,111 @@ func ENILimitsForInstanceType(itype string) (limit ENILimit) {
 	return
 }
 
-// ENILimits returns the limits based on the system's instance type
+// ENILimits returns the limits based on the system's instance type. They
+// are looked up from EC2 so new instance types are supported, falling back
+// to the built-in table if that fails.
 func ENILimits() ENILimit {
 	id, err := getIDDoc()
 	if err != nil || id == nil {
 		return ENILimit{}
 	}
+	if limit, err := describeENILimits(id.InstanceType); err == nil {
+		return limit
+	}
 	return ENILimitsForInstanceType(id.InstanceType)
 }
+
+// describeENILimits asks EC2 for the limits of an instance type. Results
+// are kept for the life of the process and in the metadata cache.
+func describeENILimits(itype string) (ENILimit, error) {
+	describedLimitsLock.Lock()
+	defer describedLimitsLock.Unlock()
+
+	if limit, ok := describedLimits[itype]; ok {
+		return limit, nil
+	}
+
+	var limit ENILimit
+	encoded, err := cachedMetadata("ec2/instance-types/"+itype, func() (string, error) {
+		limit, err := describeInstanceType(itype)
+		if err != nil {
+			return "", err
+		}
+		data, err := json.Marshal(limit)
+		return string(data), err
+	})
+	if err != nil {
+		return limit, err
+	}
+	if err := json.Unmarshal([]byte(encoded), &limit); err != nil {
+		return limit, err
+	}
+
+	describedLimits[itype] = limit
+	return limit, nil
+}
+
+// NetworkCardCount returns the number of network cards of the system's
+// instance type, which ENIs can be attached to by index. The result is
+// kept in the metadata cache.
+func NetworkCardCount() (int, error) {
+	id, err := getIDDoc()
+	if err != nil {
+		return 0, err
+	}
+	encoded, err := cachedMetadata("ec2/instance-types/"+id.InstanceType+"/network-cards", func() (string, error) {
+		infos, err := describeInstanceTypeInfo(id.InstanceType)
+		if err != nil {
+			return "", err
+		}
+		for _, info := range infos {
+			if info.NetworkInfo != nil {
+				return strconv.FormatInt(aws.Int64Value(info.NetworkInfo.MaximumNetworkCards), 10), nil
+			}
+		}
+		return "", fmt.Errorf("no network cards described for instance type %v", id.InstanceType)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(encoded)
+}
+
+func describeInstanceTypeInfo(itype string) ([]*ec2.InstanceTypeInfo, error) {
+	client, err := newEC2()
+	if err != nil {
+		return nil, err
+	}
+
+	input := &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: aws.StringSlice([]string{itype}),
+	}
+	var output *ec2.DescribeInstanceTypesOutput
+	err = withRetry(func() (err error) {
+		output, err = client.DescribeInstanceTypes(input)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.InstanceTypes, nil
+}
+
+func describeInstanceType(itype string) (ENILimit, error) {
+	infos, err := describeInstanceTypeInfo(itype)
+	if err != nil {
+		return ENILimit{}, err
+	}
+
+	for _, info := range infos {
+		if info.NetworkInfo == nil {
+			continue
+		}
+		return ENILimit{
+			Adapters: int(aws.Int64Value(info.NetworkInfo.MaximumNetworkInterfaces)),
+			IPv4:     int(aws.Int64Value(info.NetworkInfo.Ipv4AddressesPerInterface)),
+			IPv6:     int(aws.Int64Value(info.NetworkInfo.Ipv6AddressesPerInterface)),
+		}, nil
+	}
+	return ENILimit{}, fmt.Errorf("no network limits described for instance type %v", itype)
+}
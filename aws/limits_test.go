@@ -3,7 +3,9 @@ package aws
 import (
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
 func TestLimitsReturn(t *testing.T) {
@@ -15,9 +17,41 @@ func TestLimitsReturn(t *testing.T) {
 		AvailabilityZone: "us-east-1a",
 		InstanceType:     "r4.xlarge",
 	}
+	// EC2 describes nothing, so the built-in table is used
+	_ec2Client = &ec2ClientMock{}
 
 	limits := ENILimits()
 	if limits.Adapters != 4 && limits.IPv4 != 15 {
 		t.Fatalf("No valid limit returned for r4.xlarge %v", limits)
 	}
 }
+
+func TestLimitsDescribed(t *testing.T) {
+	oldIDDoc := _idDoc
+	defer func() { _idDoc = oldIDDoc }()
+
+	_idDoc = &ec2metadata.EC2InstanceIdentityDocument{
+		Region:           "us-east-1",
+		AvailabilityZone: "us-east-1a",
+		InstanceType:     "m5.large",
+	}
+	_ec2Client = &ec2ClientMock{
+		InstanceTypesResponse: ec2.DescribeInstanceTypesOutput{
+			InstanceTypes: []*ec2.InstanceTypeInfo{
+				{
+					InstanceType: aws.String("m5.large"),
+					NetworkInfo: &ec2.NetworkInfo{
+						MaximumNetworkInterfaces:  aws.Int64(3),
+						Ipv4AddressesPerInterface: aws.Int64(10),
+						Ipv6AddressesPerInterface: aws.Int64(10),
+					},
+				},
+			},
+		},
+	}
+
+	expected := ENILimit{Adapters: 3, IPv4: 10, IPv6: 10}
+	if limits := ENILimits(); limits != expected {
+		t.Fatalf("expected %v for m5.large, got %v", expected, limits)
+	}
+}
@@ -14,13 +14,18 @@ type Interface struct {
 	Mac    string
 	Number int
 	IPv4s  []net.IP
+	IPv6s  []net.IP
+	// IPv4Prefixes are the /28 prefixes delegated to the interface
+	IPv4Prefixes []*net.IPNet
 
-	SubnetID   string
-	SubnetCidr *net.IPNet
+	SubnetID       string
+	SubnetCidr     *net.IPNet
+	SubnetIPv6Cidr *net.IPNet
 
 	VpcID            string
 	VpcPrimaryCidr   *net.IPNet
 	VpcCidrs         []*net.IPNet
+	VpcIPv6Cidrs     []*net.IPNet
 	SecurityGroupIds []string
 }
 
@@ -29,6 +34,27 @@ func (i Interface) LocalName() string {
 	return fmt.Sprintf("eth%d", i.Number)
 }
 
+// PrimaryIPv4 returns the interface's primary private address, which the
+// metadata service always lists first. Returns nil if it has none.
+func (i Interface) PrimaryIPv4() net.IP {
+	if len(i.IPv4s) == 0 {
+		return nil
+	}
+	return i.IPv4s[0]
+}
+
+// Gateway returns the VPC router address for the interface's subnet. Per
+// https://docs.aws.amazon.com/AmazonVPC/latest/UserGuide/VPC_Subnets.html
+// the router is the first host address of the subnet.
+func (i Interface) Gateway() (net.IP, error) {
+	return SubnetGateway(i.SubnetCidr)
+}
+
+// IPv6Gateway returns the VPC router address for the interface's IPv6 subnet
+func (i Interface) IPv6Gateway() (net.IP, error) {
+	return SubnetGateway(i.SubnetIPv6Cidr)
+}
+
 // Interfaces contains a slice of Interface
 type Interfaces []Interface
 
@@ -39,6 +65,8 @@ func (a Interfaces) Less(i, j int) bool { return a[i].Number < a[j].Number }
 // EC2 generally gives the following data blocks from an interface in meta-data
 // device-number
 // interface-id
+// ipv4-prefix
+// ipv6s
 // local-hostname
 // local-ipv4s
 // mac
@@ -47,6 +75,7 @@ func (a Interfaces) Less(i, j int) bool { return a[i].Number < a[j].Number }
 // security-groups
 // subnet-id
 // subnet-ipv4-cidr-block
+// subnet-ipv6-cidr-blocks
 // vpc-id
 // vpc-ipv4-cidr-block
 // vpc-ipv4-cidr-blocks
@@ -58,7 +87,9 @@ func getInterface(mac string) (Interface, error) {
 
 	prefix := fmt.Sprintf("network/interfaces/macs/%s/", mac)
 	get := func(val string) (data string, err error) {
-		return metaData.GetMetadata(fmt.Sprintf("%s/%s", prefix, val))
+		return cachedMetadata(prefix+val, func() (string, error) {
+			return metaData.GetMetadata(fmt.Sprintf("%s/%s", prefix, val))
+		})
 	}
 	metadataParser := func(metadataId string, modifer func(*Interface, string) error) error {
 		metadata, _ := get(metadataId)
@@ -98,6 +129,29 @@ func getInterface(mac string) (Interface, error) {
 		return iface, err
 	}
 
+	if err := metadataParser("ipv4-prefix", func(iface *Interface, value string) error {
+		for _, prefix := range strings.Split(value, "\n") {
+			if _, parsed, err := net.ParseCIDR(prefix); err == nil {
+				iface.IPv4Prefixes = append(iface.IPv4Prefixes, parsed)
+			}
+		}
+		return nil
+	}); err != nil {
+		return iface, err
+	}
+
+	if err := metadataParser("ipv6s", func(iface *Interface, value string) error {
+		for _, ipv6 := range strings.Split(value, "\n") {
+			parsed := net.ParseIP(ipv6)
+			if parsed != nil {
+				iface.IPv6s = append(iface.IPv6s, parsed)
+			}
+		}
+		return nil
+	}); err != nil {
+		return iface, err
+	}
+
 	if err := metadataParser("subnet-id", func(iface *Interface, value string) error {
 		iface.SubnetID = value
 		return nil
@@ -113,6 +167,15 @@ func getInterface(mac string) (Interface, error) {
 		return iface, err
 	}
 
+	if err := metadataParser("subnet-ipv6-cidr-blocks", func(iface *Interface, value string) error {
+		var err error
+		// Subnets carry at most a single IPv6 block
+		_, iface.SubnetIPv6Cidr, err = net.ParseCIDR(strings.Split(value, "\n")[0])
+		return err
+	}); err != nil {
+		return iface, err
+	}
+
 	if err := metadataParser("vpc-id", func(iface *Interface, value string) error {
 		iface.VpcID = value
 		return nil
@@ -141,6 +204,19 @@ func getInterface(mac string) (Interface, error) {
 		return iface, err
 	}
 
+	if err := metadataParser("vpc-ipv6-cidr-blocks", func(iface *Interface, value string) error {
+		for _, vpcCidr := range strings.Split(value, "\n") {
+			_, net, err := net.ParseCIDR(vpcCidr)
+			if err != nil {
+				return err
+			}
+			iface.VpcIPv6Cidrs = append(iface.VpcIPv6Cidrs, net)
+		}
+		return nil
+	}); err != nil {
+		return iface, err
+	}
+
 	if err := metadataParser("security-group-ids", func(iface *Interface, value string) error {
 		secGrps := strings.Split(value, "\n")
 		iface.SecurityGroupIds = secGrps
@@ -161,8 +237,8 @@ func Available() bool {
 func GetInterfaces() ([]Interface, error) {
 	var interfaces []Interface
 
-	if !metaData.Available() {
-		return nil, fmt.Errorf("EC2 Metadata not available")
+	if err := CheckIMDS(); err != nil {
+		return nil, fmt.Errorf("EC2 Metadata not available: %v", err)
 	}
 
 	macResult, err := metaData.GetMetadata("network/interfaces/macs/")
@@ -0,0 +1,54 @@
+package aws
+
+// Pool is the set of interfaces an allocation may use: those at or above
+// Index, in one of SubnetIDs unless it's nil, and not dedicated to a pod.
+// Its interfaces may be in several subnets, so a subnet running out of
+// addresses doesn't block allocations while another member's subnet has
+// room.
+type Pool struct {
+	Index     int
+	SubnetIDs []string
+}
+
+// Interfaces returns the members of the pool, in the order given
+func (p Pool) Interfaces(interfaces []Interface) []Interface {
+	var members []Interface
+	for _, intf := range interfaces {
+		if p.contains(intf) {
+			members = append(members, intf)
+		}
+	}
+	return members
+}
+
+// WithRoom returns the members able to take another IPv4 address
+func (p Pool) WithRoom(interfaces []Interface, limits ENILimit) []Interface {
+	var members []Interface
+	for _, intf := range p.Interfaces(interfaces) {
+		if intf.ipv4Slots() < limits.IPv4 {
+			members = append(members, intf)
+		}
+	}
+	return members
+}
+
+// Subnets returns the subnets the members are in, once each and in the
+// order of their first member, leaving out exclude. The result is never
+// nil, as a nil SubnetIDs puts no restriction on a pool.
+func (p Pool) Subnets(interfaces []Interface, exclude []string) []string {
+	subnets := []string{}
+	for _, intf := range p.Interfaces(interfaces) {
+		if containsString(exclude, intf.SubnetID) || containsString(subnets, intf.SubnetID) {
+			continue
+		}
+		subnets = append(subnets, intf.SubnetID)
+	}
+	return subnets
+}
+
+func (p Pool) contains(intf Interface) bool {
+	if intf.Number < p.Index || exclusiveInterfaces[intf.ID] || unreachableInterfaces[intf.ID] {
+		return false
+	}
+	return p.SubnetIDs == nil || containsString(p.SubnetIDs, intf.SubnetID)
+}
@@ -0,0 +1,57 @@
+package aws
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+	defer SetExclusiveInterfaces(nil)
+	defer SetUnreachableInterfaces(nil)
+
+	full := []net.IP{net.ParseIP("10.0.1.5"), net.ParseIP("10.0.1.6")}
+	interfaces := []Interface{
+		{ID: "eni-0", Number: 0, SubnetID: "subnet-a"},
+		{ID: "eni-1", Number: 1, SubnetID: "subnet-a", IPv4s: full},
+		{ID: "eni-2", Number: 2, SubnetID: "subnet-b"},
+		{ID: "eni-3", Number: 3, SubnetID: "subnet-c"},
+		{ID: "eni-4", Number: 4, SubnetID: "subnet-b"},
+	}
+	limits := ENILimit{IPv4: 2}
+	SetExclusiveInterfaces([]string{"eni-3"})
+
+	ids := func(interfaces []Interface) []string {
+		var ids []string
+		for _, intf := range interfaces {
+			ids = append(ids, intf.ID)
+		}
+		return ids
+	}
+
+	pool := Pool{Index: 1}
+	if members := ids(pool.Interfaces(interfaces)); !reflect.DeepEqual(members, []string{"eni-1", "eni-2", "eni-4"}) {
+		t.Errorf("expected the shared interfaces at index 1 or above, got %v", members)
+	}
+	// A full subnet-a interface leaves the pool's subnet-b ones
+	if members := ids(pool.WithRoom(interfaces, limits)); !reflect.DeepEqual(members, []string{"eni-2", "eni-4"}) {
+		t.Errorf("expected the interfaces with room, got %v", members)
+	}
+	if subnets := pool.Subnets(interfaces, nil); !reflect.DeepEqual(subnets, []string{"subnet-a", "subnet-b"}) {
+		t.Errorf("expected each subnet once, got %v", subnets)
+	}
+
+	pool = Pool{Index: 1, SubnetIDs: []string{"subnet-b"}}
+	if members := ids(pool.Interfaces(interfaces)); !reflect.DeepEqual(members, []string{"eni-2", "eni-4"}) {
+		t.Errorf("expected the interfaces in subnet-b, got %v", members)
+	}
+	if subnets := pool.Subnets(interfaces, []string{"subnet-b"}); subnets == nil || len(subnets) != 0 {
+		t.Errorf("expected an empty, non-nil list of subnets, got %#v", subnets)
+	}
+
+	// Interfaces whose gateway didn't answer leave the pool
+	SetUnreachableInterfaces([]string{"eni-2"})
+	if members := ids(pool.Interfaces(interfaces)); !reflect.DeepEqual(members, []string{"eni-4"}) {
+		t.Errorf("expected the reachable interfaces in subnet-b, got %v", members)
+	}
+}
@@ -0,0 +1,160 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// prefixSize is the number of addresses in a delegated /28 prefix
+const prefixSize = 16
+
+var prefixDelegation bool
+
+// SetPrefixDelegation makes IPv4 allocations assign /28 prefixes to
+// interfaces rather than single secondary IPs. The addresses of a prefix
+// are handed to pods one at a time, like secondary IPs already assigned.
+func SetPrefixDelegation(enabled bool) {
+	prefixDelegation = enabled
+}
+
+// AssignedIPv4s returns the interface's IPv4 addresses along with every
+// address of its delegated prefixes
+func (i Interface) AssignedIPv4s() []net.IP {
+	ips := append([]net.IP{}, i.IPv4s...)
+	for _, prefix := range i.IPv4Prefixes {
+		for offset := 0; ; offset++ {
+			ip, err := OffsetIP(prefix, offset)
+			if err != nil {
+				break
+			}
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// ipv4Slots returns how much of the interface's IPv4 limit is used. EC2
+// counts each delegated prefix as one address.
+func (i Interface) ipv4Slots() int {
+	return len(i.IPv4s) + len(i.IPv4Prefixes)
+}
+
+// prefixesFor returns the number of prefixes holding count addresses
+func prefixesFor(count int) int {
+	return (count + prefixSize - 1) / prefixSize
+}
+
+// ipsInUse returns the addresses still in use on this node. Without it
+// delegated prefixes are never unassigned.
+var ipsInUse func() ([]net.IP, error)
+
+// SetIPsInUse sets how DeallocateIPs finds the addresses bound, claimed,
+// held or reserved on this node, so it unassigns a delegated prefix once
+// none of its addresses is
+func SetIPsInUse(inUse func() ([]net.IP, error)) {
+	ipsInUse = inUse
+}
+
+// interfaceWithPrefix returns the interface and its delegated prefix
+// holding ip, or nil
+func interfaceWithPrefix(interfaces []Interface, ip net.IP) (*Interface, *net.IPNet) {
+	for i, intf := range interfaces {
+		for _, prefix := range intf.IPv4Prefixes {
+			if prefix.Contains(ip) {
+				return &interfaces[i], prefix
+			}
+		}
+	}
+	return nil, nil
+}
+
+// prefixRelease is a delegated prefix to unassign, with the number of
+// released addresses it holds
+type prefixRelease struct {
+	intf   *Interface
+	prefix *net.IPNet
+	ips    int
+}
+
+// releasablePrefixes returns the prefixes holding any of ips which hold no
+// address of inUse other than those of ips
+func releasablePrefixes(interfaces []Interface, ips []net.IP, inUse []net.IP) []prefixRelease {
+	released := map[string]bool{}
+	for _, ip := range ips {
+		released[ip.String()] = true
+	}
+	var releases []prefixRelease
+	seen := map[string]int{}
+	for _, ip := range ips {
+		intf, prefix := interfaceWithPrefix(interfaces, ip)
+		if prefix == nil {
+			continue
+		}
+		if i, ok := seen[prefix.String()]; ok {
+			if i >= 0 {
+				releases[i].ips++
+			}
+			continue
+		}
+		seen[prefix.String()] = -1
+		used := false
+		for _, u := range inUse {
+			if prefix.Contains(u) && !released[u.String()] {
+				used = true
+				break
+			}
+		}
+		if !used {
+			seen[prefix.String()] = len(releases)
+			releases = append(releases, prefixRelease{intf: intf, prefix: prefix, ips: 1})
+		}
+	}
+	return releases
+}
+
+// deallocatePrefixIPs unassigns the delegated prefixes left unused once
+// ips are released. The addresses of a prefix still in use stay assigned
+// with it, and aren't counted as released.
+func deallocatePrefixIPs(ctx context.Context, client ec2iface.EC2API, interfaces []Interface, ips []net.IP) (int, error) {
+	if ipsInUse == nil {
+		return 0, nil
+	}
+	inUse, err := ipsInUse()
+	if err != nil {
+		return 0, fmt.Errorf("unable to find the prefix addresses in use: %v", err)
+	}
+
+	released := 0
+	var failures []string
+	for _, r := range releasablePrefixes(interfaces, ips, inUse) {
+		if err := unassignPrefix(ctx, client, *r.intf, r.prefix); err != nil {
+			// Metadata lags behind EC2, which may have released the
+			// prefix already
+			if !isNotAssigned(err) {
+				failures = append(failures, fmt.Sprintf("unable to unassign prefix %v: %v", r.prefix, err))
+			}
+			continue
+		}
+		released += r.ips
+	}
+	if len(failures) > 0 {
+		return released, fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return released, nil
+}
+
+func unassignPrefix(ctx context.Context, client ec2iface.EC2API, intf Interface, prefix *net.IPNet) error {
+	request := ec2.UnassignPrivateIpAddressesInput{}
+	request.SetNetworkInterfaceId(intf.ID)
+	request.SetIpv4Prefixes([]*string{aws.String(prefix.String())})
+	return withRetryContext(ctx, func() (err error) {
+		_, err = client.UnassignPrivateIpAddressesWithContext(ctx, &request)
+		return
+	})
+}
@@ -0,0 +1,65 @@
+package aws
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestAssignedIPv4s(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("10.0.0.32/28")
+	intf := Interface{
+		IPv4s:        []net.IP{net.ParseIP("10.0.0.10")},
+		IPv4Prefixes: []*net.IPNet{prefix},
+	}
+
+	ips := intf.AssignedIPv4s()
+	if len(ips) != 17 || !ips[0].Equal(net.ParseIP("10.0.0.10")) ||
+		!ips[1].Equal(net.ParseIP("10.0.0.32")) || !ips[16].Equal(net.ParseIP("10.0.0.47")) {
+		t.Fatalf("expected the IP and the prefix's 16 addresses, got %v", ips)
+	}
+	if slots := intf.ipv4Slots(); slots != 2 {
+		t.Fatalf("expected the prefix to take a single slot, got %d", slots)
+	}
+}
+
+func TestPrefixesFor(t *testing.T) {
+	cases := map[int]int{1: 1, 16: 1, 17: 2, 32: 2}
+	for count, expected := range cases {
+		if prefixes := prefixesFor(count); prefixes != expected {
+			t.Fatalf("expected %d prefixes for %d IPs, got %d", expected, count, prefixes)
+		}
+	}
+}
+
+func TestFakeClientDelegatesPrefixes(t *testing.T) {
+	SetPrefixDelegation(true)
+	defer SetPrefixDelegation(false)
+	fake := newTestFake()
+
+	alloc, err := fake.AllocateIPAtIndex(context.Background(), 0, FirstAvailable, nil)
+	if err != nil || !alloc.IP.Equal(net.ParseIP("198.18.0.16")) {
+		t.Fatalf("expected the first address of 198.18.0.16/28, got %v: %v", alloc, err)
+	}
+	if len(alloc.Interface.IPv4Prefixes) != 1 || len(alloc.Interface.AssignedIPv4s()) != 17 {
+		t.Fatalf("expected a prefix on the interface, got %+v", alloc.Interface)
+	}
+	// The prefix counts against the limit of 2 like an IP
+	if _, err := fake.AllocateIPAtIndex(context.Background(), 0, FirstAvailable, nil); err == nil {
+		t.Fatalf("allocated beyond the interface limit")
+	}
+
+	// Addresses of a prefix aren't unassigned individually
+	released, err := fake.DeallocateIPs(context.Background(), []net.IP{*alloc.IP})
+	if err != nil || released != 0 {
+		t.Fatalf("expected nothing released, got %d: %v", released, err)
+	}
+
+	// The prefix is, once no other address of it is in use
+	defer SetIPsInUse(nil)
+	SetIPsInUse(func() ([]net.IP, error) { return []net.IP{*alloc.IP}, nil })
+	released, err = fake.DeallocateIPs(context.Background(), []net.IP{*alloc.IP})
+	if err != nil || released != 1 || len(fake.Interfaces[0].IPv4Prefixes) != 0 {
+		t.Fatalf("expected the prefix unassigned, got %d %v: %v", released, fake.Interfaces[0].IPv4Prefixes, err)
+	}
+}
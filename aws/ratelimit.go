@@ -0,0 +1,109 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+var (
+	// rateLimitFile holds the token bucket shared by all invocations on
+	// the node. It is locked while it's updated.
+	rateLimitFile = "/run/cni-ipvlan-vpc-k8s/ec2-rate-limit.json"
+	rateLimit     float64
+)
+
+// tokenBucket is the persisted state of the rate limiter. Tokens go
+// negative when callers have reserved calls ahead of the refill.
+type tokenBucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// SetRateLimit limits the EC2 calls of all invocations on the node
+// together to callsPerSecond, with bursts of up to a second's worth. Zero
+// disables the limit.
+func SetRateLimit(callsPerSecond float64) {
+	rateLimit = callsPerSecond
+}
+
+// rateLimitBurst is the capacity of the bucket
+func rateLimitBurst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// reserve takes a token from the bucket after refilling it for the time
+// passed, returning the new state and how long the caller must wait for
+// its token
+func (b tokenBucket) reserve(now time.Time, rate float64) (tokenBucket, time.Duration) {
+	burst := rateLimitBurst(rate)
+	if b.Updated.IsZero() || now.Before(b.Updated) {
+		b.Tokens = burst
+	} else {
+		b.Tokens += now.Sub(b.Updated).Seconds() * rate
+		if b.Tokens > burst {
+			b.Tokens = burst
+		}
+	}
+	b.Updated = now
+	b.Tokens--
+	if b.Tokens >= 0 {
+		return b, 0
+	}
+	return b, time.Duration(-b.Tokens / rate * float64(time.Second))
+}
+
+// waitForRateLimit blocks until the caller may make an EC2 call, or ctx is
+// done. The limiter fails open: if the bucket can't be read, calls are
+// made right away.
+func waitForRateLimit(ctx context.Context) error {
+	if rateLimit <= 0 {
+		return nil
+	}
+	wait, err := reserveRateLimit(time.Now())
+	if err != nil || wait <= 0 {
+		return nil
+	}
+	return sleepContext(ctx, wait)
+}
+
+func reserveRateLimit(now time.Time) (time.Duration, error) {
+	if err := os.MkdirAll(filepath.Dir(rateLimitFile), 0755); err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(rateLimitFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return 0, err
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	var bucket tokenBucket
+	if data, err := ioutil.ReadAll(file); err == nil {
+		// A corrupt bucket starts full
+		_ = json.Unmarshal(data, &bucket)
+	}
+	bucket, wait := bucket.reserve(now, rateLimit)
+
+	data, err := json.Marshal(bucket)
+	if err != nil {
+		return 0, err
+	}
+	if err := file.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := file.WriteAt(data, 0); err != nil {
+		return 0, err
+	}
+	return wait, nil
+}
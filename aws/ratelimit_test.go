@@ -0,0 +1,67 @@
+package aws
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	now := time.Now()
+	bucket := tokenBucket{}
+
+	// A new bucket allows a burst of one second's worth of calls
+	var wait time.Duration
+	for i := 0; i < 5; i++ {
+		bucket, wait = bucket.reserve(now, 5)
+		if wait != 0 {
+			t.Fatalf("call %d within the burst waited %v", i, wait)
+		}
+	}
+	bucket, wait = bucket.reserve(now, 5)
+	if wait != 200*time.Millisecond {
+		t.Fatalf("expected the first call past the burst to wait 200ms, got %v", wait)
+	}
+	bucket, wait = bucket.reserve(now, 5)
+	if wait != 400*time.Millisecond {
+		t.Fatalf("expected the next call to queue behind it, got %v", wait)
+	}
+
+	// The bucket refills over time, up to the burst
+	bucket, wait = bucket.reserve(now.Add(time.Hour), 5)
+	if wait != 0 || bucket.Tokens != 4 {
+		t.Fatalf("expected a full bucket after an hour, got %v tokens and a %v wait", bucket.Tokens, wait)
+	}
+}
+
+func TestReserveRateLimitShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ratelimit")
+	if err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oldFile, oldLimit := rateLimitFile, rateLimit
+	defer func() { rateLimitFile, rateLimit = oldFile, oldLimit }()
+	rateLimitFile = filepath.Join(dir, "ec2-rate-limit.json")
+	rateLimit = 2
+
+	// Each reservation stands for a separate invocation, which only
+	// shares the bucket through the file
+	now := time.Now()
+	var waits []time.Duration
+	for i := 0; i < 4; i++ {
+		wait, err := reserveRateLimit(now)
+		if err != nil {
+			t.Fatalf("Failed to reserve: %v", err)
+		}
+		waits = append(waits, wait)
+	}
+	expected := []time.Duration{0, 0, 500 * time.Millisecond, time.Second}
+	for i := range expected {
+		if waits[i] != expected[i] {
+			t.Fatalf("expected waits %v, got %v", expected, waits)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package aws
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+var (
+	retryAttempts  = 5
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 10 * time.Second
+)
+
+// Error codes returned by EC2 when a request is throttled or the service
+// has a transient problem. Anything else, for example
+// InsufficientFreeAddressesInSubnet, will fail the same way on a retry.
+var retryableCodes = map[string]bool{
+	"RequestLimitExceeded": true,
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"RequestThrottled":     true,
+	"InternalError":        true,
+	"InternalFailure":      true,
+	"ServiceUnavailable":   true,
+	"Unavailable":          true,
+}
+
+// SetRetryPolicy configures how many times throttled and transient EC2
+// failures are retried, and the base delay of the exponential backoff
+// between attempts. Zero values keep the defaults, a negative retry count
+// disables retries.
+func SetRetryPolicy(retries int, baseDelay time.Duration) {
+	if retries < 0 {
+		retryAttempts = 0
+	} else if retries > 0 {
+		retryAttempts = retries
+	}
+	if baseDelay > 0 {
+		retryBaseDelay = baseDelay
+	}
+}
+
+func isRetryable(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		return retryableCodes[awsErr.Code()]
+	}
+	return false
+}
+
+// retryDelay returns a full jitter backoff for the given attempt
+func retryDelay(attempt int) time.Duration {
+	ceiling := math.Min(float64(retryMaxDelay), float64(retryBaseDelay)*math.Pow(2, float64(attempt)))
+	if ceiling < 1 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// withRetry runs an EC2 call, retrying it with exponential backoff while
+// it fails with a throttling or transient error
+func withRetry(call func() error) error {
+	return withRetryContext(context.Background(), call)
+}
+
+// withRetryContext is withRetry giving up with the context's error once
+// it's done, including while backing off or waiting for the rate limit.
+// The call itself must be made with the context to be interrupted.
+func withRetryContext(ctx context.Context, call func() error) error {
+	for attempt := 0; ; attempt++ {
+		if err := waitForRateLimit(ctx); err != nil {
+			return err
+		}
+		err := call()
+		if err == nil || attempt >= retryAttempts || !isRetryable(err) {
+			return err
+		}
+		if err := sleepContext(ctx, retryDelay(attempt)); err != nil {
+			return err
+		}
+	}
+}
+
+// sleepContext waits for the duration, or returns the context's error if
+// it's done first
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
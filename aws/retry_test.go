@@ -0,0 +1,83 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestWithRetry(t *testing.T) {
+	oldAttempts, oldDelay := retryAttempts, retryBaseDelay
+	defer func() { retryAttempts, retryBaseDelay = oldAttempts, oldDelay }()
+	retryAttempts = 3
+	retryBaseDelay = time.Microsecond
+
+	cases := []struct {
+		Err      error
+		Expected int
+	}{
+		{nil, 1},
+		{awserr.New("RequestLimitExceeded", "slow down", nil), 4},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 503, "req-1"), 4},
+		{awserr.New("InsufficientFreeAddressesInSubnet", "no addresses", nil), 1},
+		{fmt.Errorf("not an AWS error"), 1},
+	}
+
+	for i, c := range cases {
+		calls := 0
+		err := withRetry(func() error {
+			calls++
+			return c.Err
+		})
+		if err != c.Err {
+			t.Fatalf("%d unexpected error returned: %v", i, err)
+		}
+		if calls != c.Expected {
+			t.Fatalf("%d expected %d calls, got %d", i, c.Expected, calls)
+		}
+	}
+}
+
+func TestWithRetryRecovers(t *testing.T) {
+	oldDelay := retryBaseDelay
+	defer func() { retryBaseDelay = oldDelay }()
+	retryBaseDelay = time.Microsecond
+
+	calls := 0
+	err := withRetry(func() error {
+		calls++
+		if calls < 3 {
+			return awserr.New("Throttling", "", nil)
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expected success after 3 calls, got %v after %d", err, calls)
+	}
+}
+
+func TestWithRetryContextDeadline(t *testing.T) {
+	oldAttempts, oldDelay := retryAttempts, retryBaseDelay
+	defer func() { retryAttempts, retryBaseDelay = oldAttempts, oldDelay }()
+	retryAttempts = 100
+	retryBaseDelay = time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	start := time.Now()
+	err := withRetryContext(ctx, func() error {
+		calls++
+		return awserr.New("Throttling", "", nil)
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to be exceeded, got %v after %d calls", err, calls)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("backoff outlived the deadline by %v", elapsed)
+	}
+}
@@ -0,0 +1,72 @@
+package aws
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// SubnetRoutes returns the destinations of the route table of the
+// interface's subnet, or of its VPC's main route table when the subnet
+// has none of its own. Routes which can't be imported into a Pod are left
+// out: blackholes, prefix lists, the VPC's local routes, which the plugin
+// adds already, and default routes, which are left to setDefaultRoute.
+func SubnetRoutes(intf Interface) ([]*net.IPNet, error) {
+	client, err := newEC2()
+	if err != nil {
+		return nil, err
+	}
+
+	describe := func(filters ...*ec2.Filter) ([]*ec2.RouteTable, error) {
+		input := &ec2.DescribeRouteTablesInput{Filters: filters}
+		var output *ec2.DescribeRouteTablesOutput
+		err := withRetry(func() (err error) {
+			output, err = client.DescribeRouteTables(input)
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+		return output.RouteTables, nil
+	}
+
+	tables, err := describe(newEc2Filter("association.subnet-id", intf.SubnetID))
+	if err == nil && len(tables) == 0 {
+		tables, err = describe(newEc2Filter("vpc-id", intf.VpcID), newEc2Filter("association.main", "true"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no route table found for subnet %v", intf.SubnetID)
+	}
+	return importableRoutes(tables[0]), nil
+}
+
+// importableRoutes returns the destinations of the table's routes which
+// can be imported
+func importableRoutes(table *ec2.RouteTable) []*net.IPNet {
+	var dsts []*net.IPNet
+	for _, route := range table.Routes {
+		if aws.StringValue(route.State) == ec2.RouteStateBlackhole ||
+			route.DestinationPrefixListId != nil ||
+			aws.StringValue(route.GatewayId) == "local" {
+			continue
+		}
+		cidr := aws.StringValue(route.DestinationCidrBlock)
+		if cidr == "" {
+			cidr = aws.StringValue(route.DestinationIpv6CidrBlock)
+		}
+		_, dst, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		if ones, _ := dst.Mask.Size(); ones == 0 {
+			continue
+		}
+		dsts = append(dsts, dst)
+	}
+	return dsts
+}
@@ -0,0 +1,24 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestImportableRoutes(t *testing.T) {
+	table := &ec2.RouteTable{Routes: []*ec2.Route{
+		{DestinationCidrBlock: aws.String("10.0.0.0/16"), GatewayId: aws.String("local"), State: aws.String("active")},
+		{DestinationCidrBlock: aws.String("0.0.0.0/0"), NatGatewayId: aws.String("nat-1"), State: aws.String("active")},
+		{DestinationCidrBlock: aws.String("172.16.0.0/12"), TransitGatewayId: aws.String("tgw-1"), State: aws.String("active")},
+		{DestinationCidrBlock: aws.String("192.168.0.0/16"), TransitGatewayId: aws.String("tgw-2"), State: aws.String("blackhole")},
+		{DestinationPrefixListId: aws.String("pl-1"), GatewayId: aws.String("vpce-1"), State: aws.String("active")},
+		{DestinationIpv6CidrBlock: aws.String("2600:1f14:1::/56"), TransitGatewayId: aws.String("tgw-1"), State: aws.String("active")},
+	}}
+
+	dsts := importableRoutes(table)
+	if len(dsts) != 2 || dsts[0].String() != "172.16.0.0/12" || dsts[1].String() != "2600:1f14:1::/56" {
+		t.Fatalf("expected the transit gateway routes, got %v", dsts)
+	}
+}
@@ -0,0 +1,92 @@
+package aws
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ValidateSecurityGroups verifies the security groups exist in the VPC,
+// so a stale or mistyped ID fails with a clear error rather than deep in
+// CreateNetworkInterface. Successful validations are kept in the metadata
+// cache.
+func ValidateSecurityGroups(groupIDs []string, vpcID string) error {
+	sorted := append([]string{}, groupIDs...)
+	sort.Strings(sorted)
+
+	_, err := cachedMetadata("ec2/security-groups/"+vpcID+"/"+strings.Join(sorted, ","), func() (string, error) {
+		return "valid", validateSecurityGroups(sorted, vpcID)
+	})
+	return err
+}
+
+// DefaultSecurityGroup returns the ID of the VPC's default security
+// group, keeping it in the metadata cache
+func DefaultSecurityGroup(vpcID string) (string, error) {
+	return cachedMetadata("ec2/default-security-group/"+vpcID, func() (string, error) {
+		return defaultSecurityGroup(vpcID)
+	})
+}
+
+func defaultSecurityGroup(vpcID string) (string, error) {
+	client, err := newEC2()
+	if err != nil {
+		return "", err
+	}
+
+	input := &ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			newEc2Filter("group-name", "default"),
+			newEc2Filter("vpc-id", vpcID),
+		},
+	}
+	var output *ec2.DescribeSecurityGroupsOutput
+	err = withRetry(func() (err error) {
+		output, err = client.DescribeSecurityGroups(input)
+		return
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(output.SecurityGroups) == 0 {
+		return "", newError(ErrConfig, "no default security group found in VPC %v", vpcID)
+	}
+	return aws.StringValue(output.SecurityGroups[0].GroupId), nil
+}
+
+func validateSecurityGroups(groupIDs []string, vpcID string) error {
+	client, err := newEC2()
+	if err != nil {
+		return err
+	}
+
+	// Filtering rather than listing the IDs returns the groups which do
+	// exist, instead of failing on the first missing one
+	input := &ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			newEc2Filter("group-id", groupIDs...),
+			newEc2Filter("vpc-id", vpcID),
+		},
+	}
+	var output *ec2.DescribeSecurityGroupsOutput
+	err = withRetry(func() (err error) {
+		output, err = client.DescribeSecurityGroups(input)
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	found := map[string]bool{}
+	for _, group := range output.SecurityGroups {
+		found[aws.StringValue(group.GroupId)] = true
+	}
+	for _, id := range groupIDs {
+		if !found[id] {
+			return newError(ErrConfig, "security group %v not found in VPC %v", id, vpcID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package aws
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+type securityGroupsMock struct {
+	ec2iface.EC2API
+	Existing []string
+}
+
+func (e *securityGroupsMock) DescribeSecurityGroups(in *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+	output := &ec2.DescribeSecurityGroupsOutput{}
+	for _, id := range e.Existing {
+		output.SecurityGroups = append(output.SecurityGroups, &ec2.SecurityGroup{GroupId: aws.String(id)})
+	}
+	return output, nil
+}
+
+func TestValidateSecurityGroups(t *testing.T) {
+	oldIDDoc := _idDoc
+	defer func() { _idDoc = oldIDDoc }()
+	_idDoc = &ec2metadata.EC2InstanceIdentityDocument{Region: "us-east-1"}
+	_ec2Client = &securityGroupsMock{Existing: []string{"sg-web"}}
+
+	if err := ValidateSecurityGroups([]string{"sg-web"}, "vpc-lyft"); err != nil {
+		t.Fatalf("existing security group failed validation: %v", err)
+	}
+
+	err := ValidateSecurityGroups([]string{"sg-web", "sg-typo"}, "vpc-lyft")
+	if err == nil || !strings.Contains(err.Error(), "security group sg-typo not found in VPC vpc-lyft") {
+		t.Fatalf("expected sg-typo to be reported missing, got %v", err)
+	}
+}
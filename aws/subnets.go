@@ -1,6 +1,7 @@
 package aws
 
 import (
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
@@ -8,6 +9,7 @@ import (
 type Subnet struct {
 	ID                    string
 	Cidr                  string
+	AvailabilityZone      string
 	IsDefault             bool
 	AvailableAddressCount int
 	Name                  string
@@ -23,6 +25,32 @@ func (a SubnetsByAvailableAddressCount) Less(i, j int) bool {
 	return a[i].AvailableAddressCount > a[j].AvailableAddressCount
 }
 
+// HasTags reports whether the subnet carries all of the tags
+func (s Subnet) HasTags(tags map[string]string) bool {
+	for tagKey, tagValue := range tags {
+		if value, ok := s.Tags[tagKey]; !ok || value != tagValue {
+			return false
+		}
+	}
+	return true
+}
+
+// SubnetIDsWithTags returns the IDs of the subnets in the instance's
+// availability zone carrying all of the tags
+func SubnetIDsWithTags(tags map[string]string) ([]string, error) {
+	subnets, err := GetSubnetsForInstance()
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, subnet := range subnets {
+		if subnet.HasTags(tags) {
+			ids = append(ids, subnet.ID)
+		}
+	}
+	return ids, nil
+}
+
 // GetSubnetsForInstance returns a list of subnets for the running instance
 func GetSubnetsForInstance() ([]Subnet, error) {
 	var subnets []Subnet
@@ -40,8 +68,11 @@ func GetSubnetsForInstance() ([]Subnet, error) {
 
 	input := &ec2.DescribeSubnetsInput{}
 	input.Filters = []*ec2.Filter{newEc2Filter("availabilityZone", az)}
-	result, err := ec2Client.DescribeSubnets(input)
-
+	var result *ec2.DescribeSubnetsOutput
+	err = withRetry(func() (err error) {
+		result, err = ec2Client.DescribeSubnets(input)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -50,9 +81,10 @@ func GetSubnetsForInstance() ([]Subnet, error) {
 		subnet := Subnet{
 			ID:                    *awsSub.SubnetId,
 			Cidr:                  *awsSub.CidrBlock,
+			AvailabilityZone:      aws.StringValue(awsSub.AvailabilityZone),
 			IsDefault:             *awsSub.DefaultForAz,
 			AvailableAddressCount: int(*awsSub.AvailableIpAddressCount),
-			Tags: map[string]string{},
+			Tags:                  map[string]string{},
 		}
 		// Set all the tags on the result
 		for _, tag := range awsSub.Tags {
@@ -0,0 +1,131 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// TeardownInterfaces returns every interface created by this plugin
+// attached to the instance to EC2, for decommissioning the node. The
+// secondary IPs and prefixes of each are unassigned before it's detached
+// and deleted. The primary interface and interfaces without
+// InterfaceMarkerTag are never touched, and interfaces which disappear
+// meanwhile count as removed. Every interface is attempted even when some
+// fail. Returns the IDs of the removed interfaces.
+func TeardownInterfaces(ctx context.Context) ([]string, error) {
+	client, err := newEC2()
+	if err != nil {
+		return nil, err
+	}
+	interfaces, err := describeManagedInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	defer invalidateMetadataCache("network/interfaces/")
+
+	candidates := teardownCandidates(interfaces)
+	var removed, failures []string
+	for _, eni := range candidates {
+		id := aws.StringValue(eni.NetworkInterfaceId)
+		if err := teardownInterface(ctx, client, eni); err != nil {
+			failures = append(failures, fmt.Sprintf("%v: %v", id, err))
+			continue
+		}
+		removed = append(removed, id)
+	}
+
+	if len(failures) > 0 {
+		return removed, fmt.Errorf("unable to tear down %d of %d interfaces: %s",
+			len(failures), len(candidates), strings.Join(failures, "; "))
+	}
+	return removed, nil
+}
+
+// teardownCandidates returns the attached interfaces carrying the marker,
+// excluding the one at device index 0
+func teardownCandidates(interfaces []*ec2.NetworkInterface) []*ec2.NetworkInterface {
+	var candidates []*ec2.NetworkInterface
+	for _, eni := range interfaces {
+		if eni.Attachment == nil || aws.Int64Value(eni.Attachment.DeviceIndex) == 0 {
+			continue
+		}
+		for _, tag := range eni.TagSet {
+			if aws.StringValue(tag.Key) == InterfaceMarkerTag {
+				candidates = append(candidates, eni)
+				break
+			}
+		}
+	}
+	return candidates
+}
+
+func teardownInterface(ctx context.Context, client ec2iface.EC2API, eni *ec2.NetworkInterface) error {
+	id := aws.StringValue(eni.NetworkInterfaceId)
+
+	request := ec2.UnassignPrivateIpAddressesInput{}
+	request.SetNetworkInterfaceId(id)
+	for _, addr := range eni.PrivateIpAddresses {
+		if !aws.BoolValue(addr.Primary) {
+			request.PrivateIpAddresses = append(request.PrivateIpAddresses, addr.PrivateIpAddress)
+		}
+	}
+	for _, prefix := range eni.Ipv4Prefixes {
+		request.Ipv4Prefixes = append(request.Ipv4Prefixes, prefix.Ipv4Prefix)
+	}
+	if len(request.PrivateIpAddresses) > 0 || len(request.Ipv4Prefixes) > 0 {
+		err := withRetryContext(ctx, func() (err error) {
+			_, err = client.UnassignPrivateIpAddressesWithContext(ctx, &request)
+			return
+		})
+		if isGone(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to unassign secondary IPs: %v", err)
+		}
+	}
+
+	detach := &ec2.DetachNetworkInterfaceInput{AttachmentId: eni.Attachment.AttachmentId}
+	err := withRetryContext(ctx, func() (err error) {
+		_, err = client.DetachNetworkInterfaceWithContext(ctx, detach)
+		return
+	})
+	if err != nil && !isGone(err) {
+		return fmt.Errorf("unable to detach: %v", err)
+	}
+	if err := waitUtilInterfaceDetaches(ctx, id); err != nil {
+		if isGone(err) {
+			return nil
+		}
+		return err
+	}
+
+	// Even after the interface detaches, you cannot delete right away
+	if err := sleepContext(ctx, interfacePostDetachSettleTime); err != nil {
+		return err
+	}
+	if err := deleteInterface(id); err != nil && !isGone(err) {
+		return fmt.Errorf("unable to delete: %v", err)
+	}
+	return nil
+}
+
+// isGone reports whether EC2 failed because the interface or its
+// attachment no longer exists
+func isGone(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch awsErr.Code() {
+	case "InvalidNetworkInterfaceID.NotFound", "InvalidAttachmentID.NotFound":
+		return true
+	}
+	return false
+}
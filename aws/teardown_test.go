@@ -0,0 +1,46 @@
+package aws
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestTeardownCandidates(t *testing.T) {
+	eni := func(id string, index int64, marked bool) *ec2.NetworkInterface {
+		intf := &ec2.NetworkInterface{
+			NetworkInterfaceId: aws.String(id),
+			Attachment:         &ec2.NetworkInterfaceAttachment{DeviceIndex: aws.Int64(index)},
+		}
+		if marked {
+			intf.TagSet = []*ec2.Tag{{Key: aws.String(InterfaceMarkerTag), Value: aws.String("true")}}
+		}
+		return intf
+	}
+	interfaces := []*ec2.NetworkInterface{
+		eni("eni-primary", 0, true),
+		eni("eni-managed", 1, true),
+		eni("eni-unmarked", 2, false),
+		{NetworkInterfaceId: aws.String("eni-detached")},
+	}
+
+	candidates := teardownCandidates(interfaces)
+	if len(candidates) != 1 || aws.StringValue(candidates[0].NetworkInterfaceId) != "eni-managed" {
+		t.Fatalf("expected only eni-managed, got %v", candidates)
+	}
+}
+
+func TestIsGone(t *testing.T) {
+	if !isGone(awserr.New("InvalidNetworkInterfaceID.NotFound", "gone", nil)) {
+		t.Fatalf("missing interface isn't gone")
+	}
+	if !isGone(awserr.New("InvalidAttachmentID.NotFound", "gone", nil)) {
+		t.Fatalf("missing attachment isn't gone")
+	}
+	if isGone(awserr.New("UnauthorizedOperation", "denied", nil)) || isGone(fmt.Errorf("failed")) || isGone(nil) {
+		t.Fatalf("other errors are gone")
+	}
+}
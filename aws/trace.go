@@ -0,0 +1,107 @@
+package aws
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// TracedCall summarizes an AWS API call for tracing. Params holds the
+// request parameters with secrets redacted, the response body is left out.
+type TracedCall struct {
+	Operation  string
+	Params     map[string]interface{}
+	Duration   time.Duration
+	StatusCode int
+	RequestID  string
+	Err        error
+}
+
+// CallTracer is notified after every AWS API call with its summary
+type CallTracer func(call TracedCall)
+
+var callTracers []CallTracer
+
+// redacted replaces the values of parameters which may hold secrets
+const redacted = "REDACTED"
+
+// secretParams are lowercased fragments of parameter names whose values
+// are never traced
+var secretParams = []string{"secret", "token", "password", "credential", "accesskey", "userdata", "privatekey"}
+
+// TraceCalls registers a tracer for all subsequent AWS API calls
+func TraceCalls(tracer CallTracer) {
+	callTracers = append(callTracers, tracer)
+}
+
+func traceCall(r *request.Request) {
+	if len(callTracers) == 0 {
+		return
+	}
+	call := TracedCall{
+		Operation: r.Operation.Name,
+		Params:    redactParams(r.Params),
+		Duration:  time.Since(r.Time),
+		RequestID: r.RequestID,
+		Err:       r.Error,
+	}
+	if r.HTTPResponse != nil {
+		call.StatusCode = r.HTTPResponse.StatusCode
+	}
+	for _, tracer := range callTracers {
+		tracer(call)
+	}
+}
+
+// redactParams converts request parameters to a map through their JSON
+// encoding, dropping unset fields and redacting secrets at any depth.
+// Request headers, which carry the signature and session token, are never
+// part of the parameters.
+func redactParams(params interface{}) map[string]interface{} {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil
+	}
+	if cleaned, ok := redactValue(decoded).(map[string]interface{}); ok {
+		return cleaned
+	}
+	return nil
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if field == nil {
+				delete(v, key)
+			} else if isSecretParam(key) {
+				v[key] = redacted
+			} else {
+				v[key] = redactValue(field)
+			}
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+		return v
+	}
+	return value
+}
+
+func isSecretParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range secretParams {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
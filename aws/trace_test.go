@@ -0,0 +1,42 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+func TestRedactParams(t *testing.T) {
+	params := redactParams(&ec2.DescribeNetworkInterfacesInput{
+		NetworkInterfaceIds: []*string{aws.String("eni-1")},
+		NextToken:           aws.String("page-token"),
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("attachment.instance-id"),
+			Values: []*string{aws.String("i-1")},
+		}},
+	})
+	if params["NextToken"] != redacted {
+		t.Fatalf("token not redacted: %v", params)
+	}
+	if _, ok := params["MaxResults"]; ok {
+		t.Fatalf("unset parameter traced: %v", params)
+	}
+	ids, ok := params["NetworkInterfaceIds"].([]interface{})
+	if !ok || len(ids) != 1 || ids[0] != "eni-1" {
+		t.Fatalf("interface IDs not traced: %v", params)
+	}
+
+	params = redactParams(&sts.AssumeRoleInput{
+		RoleArn:      aws.String("arn:aws:iam::123456789012:role/cni"),
+		SerialNumber: aws.String("mfa"),
+		TokenCode:    aws.String("123456"),
+	})
+	if params["TokenCode"] != redacted {
+		t.Fatalf("token code not redacted: %v", params)
+	}
+	if params["RoleArn"] != "arn:aws:iam::123456789012:role/cni" {
+		t.Fatalf("role not traced: %v", params)
+	}
+}
@@ -1,6 +1,11 @@
 package aws
 
 import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
@@ -14,3 +19,156 @@ func newEc2Filter(name string, values ...string) *ec2.Filter {
 	}
 	return filter
 }
+
+// newEc2Tags converts a tag map to EC2 tags, sorted by key so requests are
+// deterministic
+func newEc2Tags(tags map[string]string) []*ec2.Tag {
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var ec2Tags []*ec2.Tag
+	for _, k := range keys {
+		ec2Tags = append(ec2Tags, &ec2.Tag{
+			Key:   aws.String(k),
+			Value: aws.String(tags[k]),
+		})
+	}
+	return ec2Tags
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// OffsetIP returns the address offset hosts past the network address of
+// cidr. It works for both IPv4 and IPv6 blocks and never modifies cidr.
+func OffsetIP(cidr *net.IPNet, offset int) (net.IP, error) {
+	if cidr == nil {
+		return nil, fmt.Errorf("no CIDR block available")
+	}
+	base := cidr.IP.To4()
+	if base == nil {
+		base = cidr.IP.To16()
+	}
+	if base == nil {
+		return nil, fmt.Errorf("invalid CIDR block %v", cidr)
+	}
+
+	ip := make(net.IP, len(base))
+	copy(ip, base)
+	carry := offset
+	for i := len(ip) - 1; i >= 0 && carry > 0; i-- {
+		sum := int(ip[i]) + carry
+		ip[i] = byte(sum & 0xff)
+		carry = sum >> 8
+	}
+
+	if carry > 0 || !cidr.Contains(ip) {
+		return nil, fmt.Errorf("offset %d is outside of %v", offset, cidr)
+	}
+	return ip, nil
+}
+
+// SubnetGateway returns the first usable host address of the subnet, which
+// the VPC router takes. That's the network address plus one, except in
+// /31 and /127 subnets, where both addresses are usable. Subnets without
+// room for both a gateway and a pod are an error.
+func SubnetGateway(cidr *net.IPNet) (net.IP, error) {
+	if cidr == nil {
+		return nil, fmt.Errorf("no CIDR block available")
+	}
+	ones, bits := cidr.Mask.Size()
+	if bits == 0 {
+		return nil, fmt.Errorf("subnet %v has a non-contiguous mask", cidr)
+	}
+	network := &net.IPNet{IP: cidr.IP.Mask(cidr.Mask), Mask: cidr.Mask}
+	switch bits - ones {
+	case 0:
+		return nil, fmt.Errorf("subnet %v is too small to hold a gateway and a pod", cidr)
+	case 1:
+		return OffsetIP(network, 0)
+	}
+	return OffsetIP(network, 1)
+}
+
+// AggregateCIDRs merges overlapping and adjacent blocks of one address
+// family into the fewest blocks covering exactly the same addresses, so
+// contiguous blocks that form a single prefix collapse into it. Blocks
+// separated by a gap are never merged, as the broader block would route
+// addresses outside of all of them.
+func AggregateCIDRs(cidrs []*net.IPNet) []*net.IPNet {
+	type addrRange struct{ start, end *big.Int }
+	var ranges []addrRange
+	bits := 0
+	for _, cidr := range cidrs {
+		ones, size := cidr.Mask.Size()
+		ip := cidr.IP.To4()
+		if size == 128 {
+			ip = cidr.IP.To16()
+		}
+		if size == 0 || ip == nil {
+			continue
+		}
+		bits = size
+		start := new(big.Int).SetBytes(ip.Mask(cidr.Mask))
+		end := new(big.Int).Lsh(big.NewInt(1), uint(size-ones))
+		end.Add(end, start).Sub(end, big.NewInt(1))
+		ranges = append(ranges, addrRange{start, end})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start.Cmp(ranges[j].start) < 0 })
+
+	var merged []addrRange
+	for _, r := range ranges {
+		if last := len(merged) - 1; last >= 0 {
+			next := new(big.Int).Add(merged[last].end, big.NewInt(1))
+			if r.start.Cmp(next) <= 0 {
+				if r.end.Cmp(merged[last].end) > 0 {
+					merged[last].end = r.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+
+	var aggregated []*net.IPNet
+	for _, r := range merged {
+		aggregated = append(aggregated, rangeCIDRs(r.start, r.end, bits)...)
+	}
+	return aggregated
+}
+
+// rangeCIDRs returns the fewest aligned blocks covering start to end
+func rangeCIDRs(start, end *big.Int, bits int) []*net.IPNet {
+	var cidrs []*net.IPNet
+	start = new(big.Int).Set(start)
+	for start.Cmp(end) <= 0 {
+		// Grow the block while start stays aligned to it and it ends
+		// within the range
+		hostBits := 0
+		for hostBits < bits && start.Bit(hostBits) == 0 {
+			blockEnd := new(big.Int).Lsh(big.NewInt(1), uint(hostBits+1))
+			blockEnd.Add(blockEnd, start).Sub(blockEnd, big.NewInt(1))
+			if blockEnd.Cmp(end) > 0 {
+				break
+			}
+			hostBits++
+		}
+
+		ip := make(net.IP, bits/8)
+		startBytes := start.Bytes()
+		copy(ip[len(ip)-len(startBytes):], startBytes)
+		cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits-hostBits, bits)})
+
+		start.Add(start, new(big.Int).Lsh(big.NewInt(1), uint(hostBits)))
+	}
+	return cidrs
+}
@@ -1,6 +1,7 @@
 package aws
 
 import (
+	"net"
 	"reflect"
 	"testing"
 
@@ -48,3 +49,123 @@ func TestNewEc2Filter(t *testing.T) {
 		}
 	}
 }
+
+func TestOffsetIP(t *testing.T) {
+	cases := []struct {
+		Cidr     string
+		Offset   int
+		Expected string
+	}{
+		{"10.0.0.0/16", 1, "10.0.0.1"},
+		{"10.0.0.0/16", 2, "10.0.0.2"},
+		{"10.0.1.0/24", 256, ""},
+		{"10.0.0.0/16", 256, "10.0.1.0"},
+		{"2600:1f18::/64", 1, "2600:1f18::1"},
+	}
+
+	for i, c := range cases {
+		_, cidr, _ := net.ParseCIDR(c.Cidr)
+		original := cidr.String()
+		ip, err := OffsetIP(cidr, c.Offset)
+		if c.Expected == "" {
+			if err == nil {
+				t.Fatalf("%d expected an error, got %v", i, ip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d OffsetIP returned an error: %v", i, err)
+		}
+		if !ip.Equal(net.ParseIP(c.Expected)) {
+			t.Fatalf("%d expected %v, got %v", i, c.Expected, ip)
+		}
+		if cidr.String() != original {
+			t.Fatalf("%d OffsetIP modified its input", i)
+		}
+	}
+
+	if _, err := OffsetIP(nil, 1); err == nil {
+		t.Fatalf("nil CIDR did not return an error")
+	}
+}
+
+func TestSubnetGateway(t *testing.T) {
+	cases := []struct {
+		Cidr     string
+		Expected string
+	}{
+		{"10.0.0.0/16", "10.0.0.1"},
+		{"10.0.1.16/28", "10.0.1.17"},
+		{"10.0.1.16/30", "10.0.1.17"},
+		{"10.0.1.16/31", "10.0.1.16"},
+		{"10.0.1.16/32", ""},
+		{"2600:1f18::/64", "2600:1f18::1"},
+		{"2600:1f18::/127", "2600:1f18::"},
+		{"2600:1f18::/128", ""},
+	}
+
+	for i, c := range cases {
+		_, cidr, _ := net.ParseCIDR(c.Cidr)
+		gw, err := SubnetGateway(cidr)
+		if c.Expected == "" {
+			if err == nil {
+				t.Fatalf("%d expected an error, got %v", i, gw)
+			}
+			continue
+		}
+		if err != nil || !gw.Equal(net.ParseIP(c.Expected)) {
+			t.Fatalf("%d expected %v, got %v: %v", i, c.Expected, gw, err)
+		}
+	}
+
+	// The host bits of the address are ignored
+	gw, err := SubnetGateway(&net.IPNet{IP: net.ParseIP("10.0.1.20"), Mask: net.CIDRMask(28, 32)})
+	if err != nil || !gw.Equal(net.ParseIP("10.0.1.17")) {
+		t.Fatalf("expected 10.0.1.17, got %v: %v", gw, err)
+	}
+	if _, err := SubnetGateway(nil); err == nil {
+		t.Fatalf("nil CIDR did not return an error")
+	}
+}
+
+func TestAggregateCIDRs(t *testing.T) {
+	cases := []struct {
+		Cidrs    []string
+		Expected []string
+	}{
+		{[]string{"10.0.0.0/16"}, []string{"10.0.0.0/16"}},
+		{[]string{"10.1.0.0/24", "10.1.1.0/24"}, []string{"10.1.0.0/23"}},
+		{[]string{"10.0.0.0/16", "10.0.5.0/24", "10.1.0.0/16"}, []string{"10.0.0.0/15"}},
+		// Contiguous, but a single prefix would cover 10.1.0.0/24 and
+		// 10.1.3.0/24 too
+		{[]string{"10.1.1.0/24", "10.1.2.0/24"}, []string{"10.1.1.0/24", "10.1.2.0/24"}},
+		{[]string{"10.2.0.0/16", "10.0.0.0/16"}, []string{"10.0.0.0/16", "10.2.0.0/16"}},
+		{[]string{"2600:1f14::/56", "2600:1f14:0:100::/56"}, []string{"2600:1f14::/55"}},
+	}
+
+	for i, c := range cases {
+		var cidrs []*net.IPNet
+		for _, s := range c.Cidrs {
+			_, cidr, _ := net.ParseCIDR(s)
+			cidrs = append(cidrs, cidr)
+		}
+		var aggregated []string
+		for _, cidr := range AggregateCIDRs(cidrs) {
+			aggregated = append(aggregated, cidr.String())
+		}
+		if !reflect.DeepEqual(aggregated, c.Expected) {
+			t.Fatalf("%d expected %v, got %v", i, c.Expected, aggregated)
+		}
+	}
+}
+
+func TestNewEc2Tags(t *testing.T) {
+	tags := newEc2Tags(map[string]string{"team": "networking", "env": "prod"})
+	expected := []*ec2.Tag{
+		{Key: aws.String("env"), Value: aws.String("prod")},
+		{Key: aws.String("team"), Value: aws.String("networking")},
+	}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("expected %v, got %v", expected, tags)
+	}
+}
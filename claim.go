@@ -0,0 +1,353 @@
+package cniipvlanvpck8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+const claimLockName = "cni-ipvlan-vpc-k8s-claims.flock"
+
+var (
+	claimsFile = "/run/cni-ipvlan-vpc-k8s/claims.json"
+	// claimTTL bounds how long an IP handed to an ADD stays reserved
+	// before the runtime binds it in the container's namespace. Claims of
+	// failed ADDs expire after it.
+	claimTTL = 2 * time.Minute
+	// cooldownsFile holds the IPs released by a DEL which aren't offered
+	// as free again yet
+	cooldownsFile = "/run/cni-ipvlan-vpc-k8s/cooldowns.json"
+)
+
+// SetStateDir keeps the plugin's state files in dir rather than under
+// /run and /var/lib, so the plugin can run unprivileged in tests
+func SetStateDir(dir string) {
+	claimsFile = filepath.Join(dir, "claims.json")
+	cooldownsFile = filepath.Join(dir, "cooldowns.json")
+	heldFile = filepath.Join(dir, "held.json")
+	reservationsFile = filepath.Join(dir, "reservations.json")
+	attachmentsFile = filepath.Join(dir, "attachments.json")
+	exclusiveFile = filepath.Join(dir, "exclusive.json")
+	unreachableFile = filepath.Join(dir, "unreachable.json")
+	plansDir = filepath.Join(dir, "plans")
+	exhaustionFile = filepath.Join(dir, "exhaustion-events.json")
+}
+
+// IP allocations are returned before the runtime binds them to a link in
+// the container's namespace, and ADDs at different interface indexes can
+// share interfaces, so an IP that isn't bound yet can't be considered
+// free. Each ADD claims the IP it returns, and claimed IPs are excluded
+// from free IPs until they expire or are released.
+type ipClaims map[string]time.Time
+
+// ClaimFreeIPAtIndex atomically finds a free IP of interfaces at or above
+// index and claims it. The IP reserved for owner is preferred if it's still free,
+// IPs reserved for other owners are skipped. Only interfaces in subnetIDs
+// are considered unless it's nil, and never those dedicated to a
+// container or whose gateway didn't answer. Returns nil if no IP is free.
+func ClaimFreeIPAtIndex(interfaces []aws.Interface, index int, owner string, subnetIDs []string) (*aws.AllocationResult, error) {
+	return claimFirstFree(owner, func(claims ipClaims) ([]*aws.AllocationResult, error) {
+		free, err := findFreeIPsAtIndex(reachableInterfaces(sharedInterfaces(interfaces, loadExclusiveInterfaces())), index, claims)
+		if err != nil || subnetIDs == nil {
+			return free, err
+		}
+		return inSubnets(free, subnetIDs), nil
+	})
+}
+
+// ClaimFreeIPOn atomically finds a free IPv4 address on the interface and
+// claims it, preferring the one reserved for owner. Returns nil if none is
+// free.
+func ClaimFreeIPOn(intf aws.Interface, owner string) (*aws.AllocationResult, error) {
+	return claimFirstFree(owner, func(claims ipClaims) ([]*aws.AllocationResult, error) {
+		return findFreeIPsOn(intf, claims)
+	})
+}
+
+// ClaimFreeIPv6On atomically finds a free IPv6 address on the interface
+// and claims it. Returns nil if none is free.
+func ClaimFreeIPv6On(intf aws.Interface) (*net.IP, error) {
+	alloc, err := claimFirstFree("", func(claims ipClaims) ([]*aws.AllocationResult, error) {
+		ip, err := findFreeIPv6On(intf, claims)
+		if err != nil || ip == nil {
+			return nil, err
+		}
+		return []*aws.AllocationResult{{IP: ip, Interface: intf}}, nil
+	})
+	if err != nil || alloc == nil {
+		return nil, err
+	}
+	return alloc.IP, nil
+}
+
+// ClaimFreeIPv6AtIndex atomically finds a free IPv6 address of interfaces
+// at or above index and claims it, for pods without IPv4. Only interfaces in subnetIDs
+// are considered unless it's nil, and never those dedicated to a
+// container or whose gateway didn't answer. Returns nil if none is free.
+func ClaimFreeIPv6AtIndex(interfaces []aws.Interface, index int, subnetIDs []string) (*aws.AllocationResult, error) {
+	alloc, err := claimFirstFree("", func(claims ipClaims) ([]*aws.AllocationResult, error) {
+		free, err := findFreeIPv6sAtIndex(reachableInterfaces(sharedInterfaces(interfaces, loadExclusiveInterfaces())), index, claims)
+		if err != nil || subnetIDs == nil {
+			return free, err
+		}
+		return inSubnets(free, subnetIDs), nil
+	})
+	if err != nil || alloc == nil {
+		return nil, err
+	}
+	return &aws.AllocationResult{Interface: alloc.Interface, IPv6: alloc.IP}, nil
+}
+
+// ClaimIP reserves an IP allocated from EC2 until it's bound, as it
+// may show up as free in metadata before that
+func ClaimIP(ip net.IP) error {
+	return updateClaims(func(claims ipClaims) error {
+		claims[ip.String()] = time.Now().Add(claimTTL)
+		return nil
+	})
+}
+
+// ClaimRequestedIP atomically claims an IP a pod asked for by address. It
+// fails if the IP is claimed, reserved for another owner or bound to a
+// local link. A reservation of owner is used up.
+func ClaimRequestedIP(ip net.IP, owner string) error {
+	return claimRequestedIP(ip, owner, nl.GetIPs)
+}
+
+func claimRequestedIP(ip net.IP, owner string, boundIPs func() ([]nl.BoundIP, error)) error {
+	return updateClaims(func(claims ipClaims) error {
+		if _, ok := claims[ip.String()]; ok {
+			return fmt.Errorf("%v is already claimed by another pod", ip)
+		}
+		reservations := loadReservations()
+		for key, r := range reservations {
+			if r.IP == ip.String() && key != owner {
+				return fmt.Errorf("%v is reserved for another pod", ip)
+			}
+		}
+		bound, err := boundIPs()
+		if err != nil {
+			return err
+		}
+		for _, b := range bound {
+			if b.IPNet.IP.Equal(ip) {
+				return fmt.Errorf("%v is already in use on %v", ip, b.Label)
+			}
+		}
+
+		if _, ok := reservations[owner]; ok && owner != "" {
+			delete(reservations, owner)
+			if err := writeJSONAtomic(reservationsFile, reservations); err != nil {
+				return err
+			}
+		}
+		claims[ip.String()] = time.Now().Add(claimTTL)
+		return nil
+	})
+}
+
+// ReleaseClaims drops the claims of IPs which are being deallocated
+func ReleaseClaims(ips []net.IP) error {
+	return updateClaims(func(claims ipClaims) error {
+		for _, ip := range ips {
+			delete(claims, ip.String())
+		}
+		return nil
+	})
+}
+
+// ReleaseIPs drops the claims of IPs a DEL freed and keeps them from being
+// found free for cooldown, so an IP released under churn isn't handed to
+// another pod within moments. Reservations and requests by address are not
+// held back.
+func ReleaseIPs(ips []net.IP, cooldown time.Duration) error {
+	return updateClaims(func(claims ipClaims) error {
+		cooldowns := loadExpiring(cooldownsFile)
+		until := time.Now().Add(cooldown)
+		for _, ip := range ips {
+			delete(claims, ip.String())
+			cooldowns[ip.String()] = until
+		}
+		return writeJSONAtomic(cooldownsFile, cooldowns)
+	})
+}
+
+// claimFirstFree claims the first IP find returns, or the one reserved
+// for owner, holding the claims lock so concurrent callers can't find the
+// same IP. find must exclude the IPs passed to it, which are the claimed
+// IPs and those reserved for other owners.
+func claimFirstFree(owner string, find func(ipClaims) ([]*aws.AllocationResult, error)) (*aws.AllocationResult, error) {
+	var claimed *aws.AllocationResult
+	err := updateClaims(func(claims ipClaims) error {
+		reservations := loadReservations()
+		excluded := ipClaims{}
+		for ip, expires := range claims {
+			excluded[ip] = expires
+		}
+		for ip, until := range loadExpiring(cooldownsFile) {
+			if r, ok := reservations[owner]; !ok || owner == "" || r.IP != ip {
+				excluded[ip] = until
+			}
+		}
+		for key, r := range reservations {
+			if key != owner {
+				excluded[r.IP] = r.Expires
+			}
+		}
+
+		free, err := find(excluded)
+		if err != nil || len(free) == 0 {
+			return err
+		}
+		claimed = free[0]
+
+		if r, ok := reservations[owner]; ok && owner != "" {
+			for _, alloc := range free {
+				if alloc.IP.String() == r.IP {
+					claimed = alloc
+					break
+				}
+			}
+			// The owner is getting an IP, whether or not it's the
+			// reserved one, and reserves again when it's deleted
+			delete(reservations, owner)
+			if err := writeJSONAtomic(reservationsFile, reservations); err != nil {
+				return err
+			}
+		}
+		claims[claimed.IP.String()] = time.Now().Add(claimTTL)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// claimedIPs returns the IPs with unexpired claims, reservations or
+// cooldowns
+func claimedIPs() (ipClaims, error) {
+	unlock, err := acquireLocks(DefaultLockTimeout, lockRequest{claimLockName, syscall.LOCK_SH})
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	claims := loadClaims()
+	for ip, until := range loadExpiring(cooldownsFile) {
+		claims[ip] = until
+	}
+	for _, r := range loadReservations() {
+		claims[r.IP] = r.Expires
+	}
+	return claims, nil
+}
+
+// IPsInUse returns the IPs bound to a local link, claimed by an ADD, held
+// by a DEL or reserved for a pod. A delegated prefix holding any of them
+// stays assigned.
+func IPsInUse() ([]net.IP, error) {
+	unlock, err := acquireLocks(DefaultLockTimeout, lockRequest{claimLockName, syscall.LOCK_SH})
+	if err != nil {
+		return nil, err
+	}
+	inUse := loadClaims()
+	for ip, deadline := range loadIPTimes(heldFile) {
+		inUse[ip] = deadline
+	}
+	for _, r := range loadReservations() {
+		inUse[r.IP] = r.Expires
+	}
+	unlock()
+
+	var ips []net.IP
+	for ip := range inUse {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	bound, err := nl.GetIPs()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bound {
+		ips = append(ips, b.IPNet.IP)
+	}
+	return ips, nil
+}
+
+// updateClaims modifies the claims under an exclusive lock, which also
+// covers the reservations
+func updateClaims(update func(ipClaims) error) error {
+	unlock, err := acquireLocks(DefaultLockTimeout, lockRequest{claimLockName, syscall.LOCK_EX})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	claims := loadClaims()
+	if err := update(claims); err != nil {
+		return err
+	}
+	return writeJSONAtomic(claimsFile, claims)
+}
+
+func loadClaims() ipClaims {
+	return loadExpiring(claimsFile)
+}
+
+// loadExpiring reads IPs with their expiry from path, dropping the expired
+// ones
+func loadExpiring(path string) ipClaims {
+	claims := loadIPTimes(path)
+	now := time.Now()
+	for ip, expires := range claims {
+		if now.After(expires) {
+			delete(claims, ip)
+		}
+	}
+	return claims
+}
+
+// loadIPTimes reads IPs with a time each from path
+func loadIPTimes(path string) ipClaims {
+	claims := ipClaims{}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		// Corrupt claims are treated as empty and overwritten
+		_ = json.Unmarshal(data, &claims)
+	}
+	return claims
+}
+
+// writeJSONAtomic replaces the file at path with v encoded as JSON
+func writeJSONAtomic(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,310 @@
+package cniipvlanvpck8s
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+func withTestClaims(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "claims")
+	if err != nil {
+		t.Fatalf("Failed to create claims dir: %v", err)
+	}
+	oldClaimsFile, oldCooldownsFile, oldHeldFile, oldReservationsFile, oldAttachmentsFile, oldExclusiveFile, oldUnreachableFile, oldPlansDir := claimsFile, cooldownsFile, heldFile, reservationsFile, attachmentsFile, exclusiveFile, unreachableFile, plansDir
+	claimsFile = filepath.Join(dir, "claims.json")
+	cooldownsFile = filepath.Join(dir, "cooldowns.json")
+	heldFile = filepath.Join(dir, "held.json")
+	reservationsFile = filepath.Join(dir, "reservations.json")
+	attachmentsFile = filepath.Join(dir, "attachments.json")
+	exclusiveFile = filepath.Join(dir, "exclusive.json")
+	unreachableFile = filepath.Join(dir, "unreachable.json")
+	plansDir = filepath.Join(dir, "plans")
+	return func() {
+		claimsFile, cooldownsFile, heldFile, reservationsFile, attachmentsFile, exclusiveFile, unreachableFile, plansDir = oldClaimsFile, oldCooldownsFile, oldHeldFile, oldReservationsFile, oldAttachmentsFile, oldExclusiveFile, oldUnreachableFile, oldPlansDir
+		os.RemoveAll(dir)
+	}
+}
+
+// TestClaimFreeInParallel runs many ADDs' free IP claims at once against
+// the same interface, which must never hand out an IP twice
+func TestClaimFreeInParallel(t *testing.T) {
+	defer withTestClaims(t)()
+
+	var assigned []net.IP
+	for i := 0; i < 10; i++ {
+		assigned = append(assigned, net.ParseIP(fmt.Sprintf("10.0.0.%d", 10+i)))
+	}
+	interfaces := []aws.Interface{{Number: 1, IPv4s: assigned}}
+	find := func(claims ipClaims) ([]*aws.AllocationResult, error) {
+		return freeIPs(interfaces, nil, claims, 1), nil
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan *aws.AllocationResult, 3*len(assigned))
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			alloc, err := claimFirstFree("", find)
+			if err != nil {
+				t.Errorf("Claim failed: %v", err)
+			}
+			results <- alloc
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	claimed := map[string]bool{}
+	for alloc := range results {
+		if alloc == nil {
+			continue
+		}
+		if claimed[alloc.IP.String()] {
+			t.Fatalf("%v was claimed twice", alloc.IP)
+		}
+		claimed[alloc.IP.String()] = true
+	}
+	if len(claimed) != len(assigned) {
+		t.Fatalf("expected all %d IPs to be claimed, got %d", len(assigned), len(claimed))
+	}
+}
+
+func TestReleaseClaims(t *testing.T) {
+	defer withTestClaims(t)()
+
+	ip := net.ParseIP("10.0.0.10")
+	interfaces := []aws.Interface{{Number: 1, IPv4s: []net.IP{ip}}}
+
+	if err := ClaimIP(ip); err != nil {
+		t.Fatalf("Failed to claim %v: %v", ip, err)
+	}
+	claims, err := claimedIPs()
+	if err != nil {
+		t.Fatalf("Failed to load claims: %v", err)
+	}
+	if free := freeIPs(interfaces, nil, claims, 0); len(free) != 0 {
+		t.Fatalf("claimed IP is free: %v", free)
+	}
+
+	if err := ReleaseClaims([]net.IP{ip}); err != nil {
+		t.Fatalf("Failed to release %v: %v", ip, err)
+	}
+	claims, err = claimedIPs()
+	if err != nil {
+		t.Fatalf("Failed to load claims: %v", err)
+	}
+	if free := freeIPs(interfaces, nil, claims, 0); len(free) != 1 {
+		t.Fatalf("released IP isn't free: %v", free)
+	}
+}
+
+func TestReleaseIPsCooldown(t *testing.T) {
+	defer withTestClaims(t)()
+
+	released, reserved, other := net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.11"), net.ParseIP("10.0.0.12")
+	interfaces := []aws.Interface{{Number: 1, IPv4s: []net.IP{released, reserved, other}}}
+	find := func(claims ipClaims) ([]*aws.AllocationResult, error) {
+		return freeIPs(interfaces, nil, claims, 1), nil
+	}
+
+	if err := ReleaseIPs([]net.IP{released, reserved}, time.Minute); err != nil {
+		t.Fatalf("Failed to release IPs: %v", err)
+	}
+	if err := ReserveIP("pod-a", reserved, time.Minute); err != nil {
+		t.Fatalf("Failed to reserve %v: %v", reserved, err)
+	}
+	claims, err := claimedIPs()
+	if err != nil {
+		t.Fatalf("Failed to load claims: %v", err)
+	}
+	if free := freeIPs(interfaces, nil, claims, 1); len(free) != 1 || !free[0].IP.Equal(other) {
+		t.Fatalf("expected only %v to be free during the cooldown, got %v", other, free)
+	}
+
+	// The owner of a reservation isn't held back by the cooldown
+	alloc, err := claimFirstFree("pod-a", find)
+	if err != nil || alloc == nil || !alloc.IP.Equal(reserved) {
+		t.Fatalf("expected pod-a to claim %v, got %v: %v", reserved, alloc, err)
+	}
+	alloc, err = claimFirstFree("pod-b", find)
+	if err != nil || alloc == nil || !alloc.IP.Equal(other) {
+		t.Fatalf("expected pod-b to claim %v, got %v: %v", other, alloc, err)
+	}
+
+	// Once the cooldown is over the IP is free again
+	if err := ReleaseIPs([]net.IP{released}, -time.Second); err != nil {
+		t.Fatalf("Failed to release %v: %v", released, err)
+	}
+	alloc, err = claimFirstFree("pod-c", find)
+	if err != nil || alloc == nil || !alloc.IP.Equal(released) {
+		t.Fatalf("expected pod-c to claim %v, got %v: %v", released, alloc, err)
+	}
+}
+
+func TestClaimReservedIP(t *testing.T) {
+	defer withTestClaims(t)()
+
+	first, reserved, other := net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.11"), net.ParseIP("10.0.0.12")
+	interfaces := []aws.Interface{{Number: 1, IPv4s: []net.IP{first, reserved, other}}}
+	find := func(claims ipClaims) ([]*aws.AllocationResult, error) {
+		return freeIPs(interfaces, nil, claims, 1), nil
+	}
+
+	if err := ReserveIP("pod-a", reserved, time.Minute); err != nil {
+		t.Fatalf("Failed to reserve %v: %v", reserved, err)
+	}
+	if err := ReserveIP("pod-b", first, time.Minute); err != nil {
+		t.Fatalf("Failed to reserve %v: %v", first, err)
+	}
+
+	// Other pods skip both reservations
+	alloc, err := claimFirstFree("pod-c", find)
+	if err != nil || alloc == nil || !alloc.IP.Equal(other) {
+		t.Fatalf("expected pod-c to claim %v, got %v: %v", other, alloc, err)
+	}
+
+	// The owner gets its reserved IP back, and the reservation is used up
+	alloc, err = claimFirstFree("pod-a", find)
+	if err != nil || alloc == nil || !alloc.IP.Equal(reserved) {
+		t.Fatalf("expected pod-a to claim %v, got %v: %v", reserved, alloc, err)
+	}
+	if _, ok := loadReservations()["pod-a"]; ok {
+		t.Fatalf("reservation of pod-a wasn't removed")
+	}
+}
+
+func TestClaimRequestedIP(t *testing.T) {
+	defer withTestClaims(t)()
+
+	requested, reserved, bound := net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.11"), net.ParseIP("10.0.0.12")
+	boundIPs := func() ([]nl.BoundIP, error) {
+		return []nl.BoundIP{{IPNet: &net.IPNet{IP: bound, Mask: net.CIDRMask(32, 32)}, Label: "eth1"}}, nil
+	}
+	if err := ReserveIP("pod-a", reserved, time.Minute); err != nil {
+		t.Fatalf("Failed to reserve %v: %v", reserved, err)
+	}
+
+	if err := claimRequestedIP(requested, "pod-b", boundIPs); err != nil {
+		t.Fatalf("Failed to claim %v: %v", requested, err)
+	}
+	if err := claimRequestedIP(requested, "pod-c", boundIPs); err == nil {
+		t.Fatalf("claimed %v twice", requested)
+	}
+	if err := claimRequestedIP(bound, "pod-b", boundIPs); err == nil {
+		t.Fatalf("claimed bound %v", bound)
+	}
+	if err := claimRequestedIP(reserved, "pod-b", boundIPs); err == nil {
+		t.Fatalf("claimed %v reserved for another pod", reserved)
+	}
+	if err := claimRequestedIP(reserved, "pod-a", boundIPs); err != nil {
+		t.Fatalf("Failed to claim reserved %v for its owner: %v", reserved, err)
+	}
+	if _, ok := loadReservations()["pod-a"]; ok {
+		t.Fatalf("reservation of pod-a wasn't removed")
+	}
+}
+
+func TestClaimSkipsExclusiveInterfaces(t *testing.T) {
+	defer withTestClaims(t)()
+
+	shared, dedicated := net.ParseIP("10.0.0.10"), net.ParseIP("10.0.1.10")
+	interfaces := []aws.Interface{
+		{ID: "eni-dedicated", Number: 1, IPv4s: []net.IP{dedicated}},
+		{ID: "eni-shared", Number: 2, IPv4s: []net.IP{shared}},
+	}
+	if err := ReserveExclusiveInterface("eni-dedicated", "container-a"); err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+	find := func(claims ipClaims) ([]*aws.AllocationResult, error) {
+		return freeIPs(sharedInterfaces(interfaces, loadExclusiveInterfaces()), nil, claims, 1), nil
+	}
+
+	alloc, err := claimFirstFree("", find)
+	if err != nil || alloc == nil || !alloc.IP.Equal(shared) {
+		t.Fatalf("expected %v, got %v: %v", shared, alloc, err)
+	}
+	if alloc, err := claimFirstFree("", find); err != nil || alloc != nil {
+		t.Fatalf("expected no free IP, got %v: %v", alloc, err)
+	}
+
+	if err := ReleaseExclusiveInterface("container-a"); err != nil {
+		t.Fatalf("Failed to release: %v", err)
+	}
+	alloc, err = claimFirstFree("", find)
+	if err != nil || alloc == nil || !alloc.IP.Equal(dedicated) {
+		t.Fatalf("expected %v once released, got %v: %v", dedicated, alloc, err)
+	}
+}
+
+func TestClaimSkipsUnreachableInterfaces(t *testing.T) {
+	defer withTestClaims(t)()
+
+	reachable, unreachable := net.ParseIP("10.0.0.10"), net.ParseIP("10.0.1.10")
+	interfaces := []aws.Interface{
+		{ID: "eni-unreachable", Number: 1, IPv4s: []net.IP{unreachable}},
+		{ID: "eni-reachable", Number: 2, IPv4s: []net.IP{reachable}},
+	}
+	if err := MarkGatewayUnreachable("eni-unreachable"); err != nil {
+		t.Fatalf("Failed to mark: %v", err)
+	}
+	if ids, err := UnreachableInterfaceIDs(); err != nil || !reflect.DeepEqual(ids, []string{"eni-unreachable"}) {
+		t.Fatalf("expected eni-unreachable to be skipped, got %v: %v", ids, err)
+	}
+	find := func(claims ipClaims) ([]*aws.AllocationResult, error) {
+		return freeIPs(reachableInterfaces(interfaces), nil, claims, 1), nil
+	}
+
+	alloc, err := claimFirstFree("", find)
+	if err != nil || alloc == nil || !alloc.IP.Equal(reachable) {
+		t.Fatalf("expected %v, got %v: %v", reachable, alloc, err)
+	}
+	if alloc, err := claimFirstFree("", find); err != nil || alloc != nil {
+		t.Fatalf("expected no free IP, got %v: %v", alloc, err)
+	}
+
+	// The interface is used again once the skip expired
+	oldTTL := unreachableTTL
+	unreachableTTL = -time.Second
+	defer func() { unreachableTTL = oldTTL }()
+	if err := MarkGatewayUnreachable("eni-unreachable"); err != nil {
+		t.Fatalf("Failed to mark: %v", err)
+	}
+	alloc, err = claimFirstFree("", find)
+	if err != nil || alloc == nil || !alloc.IP.Equal(unreachable) {
+		t.Fatalf("expected %v once expired, got %v: %v", unreachable, alloc, err)
+	}
+}
+
+func TestInterfaceIDsInUse(t *testing.T) {
+	defer withTestClaims(t)()
+
+	if err := ReserveExclusiveInterface("eni-dedicated", "container-a"); err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+	attachment := Attachment{ContainerID: "container-b", IfName: "eth0"}
+	intf := aws.Interface{ID: "eni-attached"}
+	if err := RecordAttachment(attachment, []net.IP{net.ParseIP("10.0.0.10")}, intf, "", aws.PodInfo{}, nil); err != nil {
+		t.Fatalf("Failed to record: %v", err)
+	}
+
+	ids, err := InterfaceIDsInUse()
+	if err != nil {
+		t.Fatalf("Failed to list: %v", err)
+	}
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"eni-attached", "eni-dedicated"}) {
+		t.Errorf("expected the dedicated and attached interfaces, got %v", ids)
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/urfave/cli"
 
@@ -40,7 +46,7 @@ func filterBuild(input string) (map[string]string, error) {
 }
 
 func actionNewInterface(c *cli.Context) error {
-	return cniipvlanvpck8s.LockfileRun(func() error {
+	return cniipvlanvpck8s.LockfileRunContext(context.Background(), func(ctx context.Context) error {
 		filtersRaw := c.String("subnet_filter")
 		filters, err := filterBuild(filtersRaw)
 		if err != nil {
@@ -48,13 +54,39 @@ func actionNewInterface(c *cli.Context) error {
 			return err
 		}
 
+		tags, err := filterBuild(c.String("tags"))
+		if err != nil {
+			fmt.Printf("Invalid tag specification %v", err)
+			return err
+		}
+
 		secGrps := c.Args()
 
 		if len(secGrps) <= 0 {
 			fmt.Println("please specify security groups")
 			return fmt.Errorf("need security groups")
 		}
-		newIf, err := aws.NewInterface(secGrps, filters)
+		opts := aws.InterfaceOptions{
+			SecurityGroups: secGrps,
+			SubnetTags:     filters,
+			MinimumFreeIPs: c.Int("minimum_free_ips"),
+			Tags:           tags,
+		}
+		if c.Bool("dry-run") {
+			plan, err := aws.PlanNewInterface(opts)
+			if err != nil {
+				fmt.Println(err)
+				return err
+			}
+			printInterfacePlan(plan)
+			return nil
+		}
+
+		if c.IsSet("count") {
+			return newInterfaces(ctx, opts, c.Int("count"))
+		}
+
+		newIf, err := aws.NewInterface(ctx, opts)
 		if err != nil {
 			fmt.Println(err)
 			return err
@@ -65,8 +97,51 @@ func actionNewInterface(c *cli.Context) error {
 	})
 }
 
+// newInterfaces attaches interfaces until count of them are managed by the
+// plugin, printing the ID of each new one, so it can run on every boot
+func newInterfaces(ctx context.Context, opts aws.InterfaceOptions, count int) error {
+	managed, err := aws.ManagedInterfaceCount()
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	interfaces, err := aws.GetInterfaces()
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	limit := aws.ENILimits().Adapters
+
+	missing := missingInterfaces(count, managed, len(interfaces), limit)
+	if missing < count-managed {
+		fmt.Fprintf(os.Stderr, "Only %d more interfaces fit the instance limit of %d\n", missing, limit)
+	}
+	for i := 0; i < missing; i++ {
+		newIf, err := aws.NewInterface(ctx, opts)
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+		fmt.Println(newIf.ID)
+	}
+	return nil
+}
+
+// missingInterfaces returns how many interfaces to create for count of
+// them to be managed, without attaching more than limit
+func missingInterfaces(count, managed, attached, limit int) int {
+	missing := count - managed
+	if room := limit - attached; missing > room {
+		missing = room
+	}
+	if missing < 0 {
+		return 0
+	}
+	return missing
+}
+
 func actionRemoveInterface(c *cli.Context) error {
-	return cniipvlanvpck8s.LockfileRun(func() error {
+	return cniipvlanvpck8s.LockfileRunContext(context.Background(), func(ctx context.Context) error {
 		interfaces := c.Args()
 
 		if len(interfaces) <= 0 {
@@ -74,7 +149,7 @@ func actionRemoveInterface(c *cli.Context) error {
 			return fmt.Errorf("Insufficent Arguments")
 		}
 
-		if err := aws.RemoveInterface(interfaces); err != nil {
+		if err := aws.RemoveInterface(ctx, interfaces); err != nil {
 			fmt.Println(err)
 			return err
 		}
@@ -83,8 +158,23 @@ func actionRemoveInterface(c *cli.Context) error {
 	})
 }
 
+// actionTeardown removes every managed interface of the instance, for
+// decommissioning the node
+func actionTeardown(c *cli.Context) error {
+	return cniipvlanvpck8s.LockfileRunContext(context.Background(), func(ctx context.Context) error {
+		removed, err := aws.TeardownInterfaces(ctx)
+		for _, id := range removed {
+			fmt.Printf("removed %v\n", id)
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+		return err
+	})
+}
+
 func actionDeallocate(c *cli.Context) error {
-	return cniipvlanvpck8s.LockfileRun(func() error {
+	return cniipvlanvpck8s.LockfileRunContext(context.Background(), func(ctx context.Context) error {
 		releaseIps := c.Args()
 		for _, toRelease := range releaseIps {
 
@@ -99,7 +189,7 @@ func actionDeallocate(c *cli.Context) error {
 				return fmt.Errorf("IP parse error")
 			}
 
-			err := aws.DeallocateIP(&ip)
+			err := aws.DeallocateIP(ctx, &ip)
 			if err != nil {
 				fmt.Printf("deallocation failed: %v\n", err)
 				return err
@@ -109,10 +199,50 @@ func actionDeallocate(c *cli.Context) error {
 	})
 }
 
+func printInterfacePlan(plan *aws.InterfacePlan) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(w, "would create interface\teth%d\t\n", plan.Index)
+	fmt.Fprintf(w, "subnet\t%v (%v available)\t\n", plan.Subnet.ID, plan.Subnet.AvailableAddressCount)
+	fmt.Fprintf(w, "cidr\t%v\t\n", plan.Subnet.Cidr)
+	fmt.Fprintf(w, "availability zone\t%v\t\n", plan.AvailabilityZone)
+	fmt.Fprintf(w, "security groups\t%v\t\n", strings.Join(plan.SecurityGroups, ","))
+	w.Flush()
+}
+
+// actionAllocatePlan reports how an ADD at the index would be satisfied,
+// in the order the IPAM plugin tries: reusing a free IP, allocating on an
+// existing interface, or creating a new interface
+func actionAllocatePlan(index int) error {
+	free, err := cniipvlanvpck8s.FindFreeIPsAtIndex(index)
+	if err == nil && len(free) > 0 {
+		fmt.Printf("would reuse free IP %v on %v\n", free[0].IP, free[0].Interface.LocalName())
+		return nil
+	}
+
+	intf, err := aws.PlanIPFirstAvailableAtIndex(index)
+	if err == nil {
+		fmt.Printf("would allocate a new IP on %v (%v, subnet %v)\n",
+			intf.LocalName(), intf.ID, intf.SubnetID)
+		return nil
+	}
+
+	fmt.Printf("no existing interface has capacity (%v), a new interface would be created:\n", err)
+	plan, err := aws.PlanNewInterface(aws.InterfaceOptions{})
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	printInterfacePlan(plan)
+	return nil
+}
+
 func actionAllocate(c *cli.Context) error {
-	return cniipvlanvpck8s.LockfileRun(func() error {
+	return cniipvlanvpck8s.LockfileRunContext(context.Background(), func(ctx context.Context) error {
 		index := c.Int("index")
-		res, err := aws.AllocateIPFirstAvailableAtIndex(index)
+		if c.Bool("dry-run") {
+			return actionAllocatePlan(index)
+		}
+		res, err := aws.AllocateIPFirstAvailableAtIndex(ctx, index)
 		if err != nil {
 			fmt.Println(err)
 			return err
@@ -125,6 +255,9 @@ func actionAllocate(c *cli.Context) error {
 }
 
 func actionFreeIps(c *cli.Context) error {
+	if c.Bool("gc") {
+		return actionCollectOrphanedIps(c)
+	}
 	ips, err := cniipvlanvpck8s.FindFreeIPsAtIndex(0)
 	if err != nil {
 		fmt.Println(err)
@@ -141,6 +274,198 @@ func actionFreeIps(c *cli.Context) error {
 	return nil
 }
 
+// actionList prints every secondary IP on managed interfaces with the pod
+// owning it, as a table or as JSON for scripting
+func actionList(c *cli.Context) error {
+	ips, err := cniipvlanvpck8s.ListManagedIPs()
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	if c.Bool("json") {
+		if ips == nil {
+			ips = []cniipvlanvpck8s.ManagedIP{}
+		}
+		data, err := json.MarshalIndent(ips, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "ip\tadapter\tid\tsubnet\tin_use\tcontainer\tpod\t")
+	for _, ip := range ips {
+		pod := ""
+		if ip.PodName != "" {
+			pod = ip.PodNamespace + "/" + ip.PodName
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n",
+			ip.IP,
+			ip.Adapter,
+			ip.InterfaceID,
+			ip.SubnetID,
+			ip.InUse,
+			ip.ContainerID,
+			pod)
+	}
+	w.Flush()
+	return nil
+}
+
+// actionPlan prints the plan ADD recorded for a container as JSON
+func actionPlan(c *cli.Context) error {
+	if c.NArg() != 1 {
+		fmt.Println("please specify a container ID")
+		return fmt.Errorf("Insufficent Arguments")
+	}
+	plan, err := cniipvlanvpck8s.LoadPlan(c.Args().First())
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// actionCollectOrphanedIps deallocates secondary IPs on managed interfaces
+// not used by any pod. It's safe to run repeatedly, each run only acts on
+// the current EC2 and host state.
+func actionCollectOrphanedIps(c *cli.Context) error {
+	return cniipvlanvpck8s.LockfileRunContext(context.Background(), func(ctx context.Context) error {
+		orphans, err := cniipvlanvpck8s.FindOrphanedIPs()
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+
+		failed := 0
+		for _, orphan := range orphans {
+			err := aws.DeallocateIP(ctx, orphan.IP)
+			if _, ok := err.(aws.IPNotAssignedError); ok {
+				fmt.Printf("%v on %v is already deallocated\n", orphan.IP, orphan.Interface.LocalName())
+				continue
+			}
+			if err != nil {
+				fmt.Printf("deallocation of %v on %v failed: %v\n",
+					orphan.IP, orphan.Interface.LocalName(), err)
+				failed++
+				continue
+			}
+			fmt.Printf("deallocated %v on %v\n", orphan.IP, orphan.Interface.LocalName())
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d orphaned IPs could not be deallocated", failed, len(orphans))
+		}
+		return nil
+	})
+}
+
+// actionReconcile reports the differences between the IPs EC2 assigns to
+// the instance and the IPs used on the host, deallocating orphaned IPs
+// with --fix. Stale addresses are only reported, as fixing them requires
+// restarting the pods holding them.
+func actionReconcile(c *cli.Context) error {
+	return cniipvlanvpck8s.LockfileRunContext(context.Background(), func(ctx context.Context) error {
+		rec, err := cniipvlanvpck8s.Reconcile()
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "state	adapter	ip	")
+		for _, orphan := range rec.Orphaned {
+			fmt.Fprintf(w, "orphaned	%v	%v	\n", orphan.Interface.LocalName(), orphan.IP)
+		}
+		for _, stale := range rec.Stale {
+			fmt.Fprintf(w, "stale	%v	%v	\n", stale.Label, stale.IP)
+		}
+		w.Flush()
+
+		if !c.Bool("fix") || len(rec.Orphaned) == 0 {
+			return nil
+		}
+		ips := make([]net.IP, 0, len(rec.Orphaned))
+		for _, orphan := range rec.Orphaned {
+			ips = append(ips, *orphan.IP)
+		}
+		released, err := aws.DeallocateIPs(ctx, ips)
+		fmt.Printf("deallocated %d of %d orphaned IPs\n", released, len(ips))
+		return err
+	})
+}
+
+// Exit codes of the healthcheck command, one per failure class
+const (
+	healthMetadataFailed   = 2
+	healthCredentialFailed = 3
+	healthEC2Failed        = 4
+	healthSubnetFailed     = 5
+	healthCapacityFailed   = 6
+)
+
+// actionHealthCheck verifies the node can allocate pod IPs, for gating
+// node readiness. Each failure class exits with its own code.
+func actionHealthCheck(c *cli.Context) error {
+	filters, err := filterBuild(c.String("subnet_filter"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Invalid filter specification %v", err), 1)
+	}
+
+	if err := aws.CheckMetadata(); err != nil {
+		return cli.NewExitError(fmt.Sprintf("instance metadata unreachable: %v", err), healthMetadataFailed)
+	}
+	fmt.Println("instance metadata: ok")
+
+	arn, err := aws.CheckCredentials()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("credentials invalid: %v", err), healthCredentialFailed)
+	}
+	fmt.Printf("credentials: ok (%v)\n", arn)
+
+	if err := aws.CheckDescribeInstance(); err != nil {
+		return cli.NewExitError(fmt.Sprintf("unable to describe this instance: %v", err), healthEC2Failed)
+	}
+	fmt.Println("ec2: ok")
+
+	minimumFreeIPs := c.Int("minimum_free_ips")
+	if minimumFreeIPs < 1 {
+		minimumFreeIPs = 1
+	}
+	subnets, err := aws.GetSubnetsForInstance()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("unable to list subnets: %v", err), healthSubnetFailed)
+	}
+	var candidates int
+	for _, subnet := range subnets {
+		if subnet.HasTags(filters) && subnet.AvailableAddressCount >= minimumFreeIPs {
+			candidates++
+		}
+	}
+	if candidates == 0 {
+		return cli.NewExitError(fmt.Sprintf("no subnet matching %v has %d free IPs", filters, minimumFreeIPs),
+			healthSubnetFailed)
+	}
+	fmt.Printf("subnets: ok (%d candidates)\n", candidates)
+
+	interfaces, err := aws.GetInterfaces()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("unable to list interfaces: %v", err), healthCapacityFailed)
+	}
+	if !aws.HasCapacity(interfaces, aws.ENILimits(), c.Int("index")) {
+		return cli.NewExitError("no ENI capacity: every interface is full and no more can be attached",
+			healthCapacityFailed)
+	}
+	fmt.Println("capacity: ok")
+	return nil
+}
+
 func actionLimits(c *cli.Context) error {
 	limit := aws.ENILimits()
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
@@ -178,16 +503,17 @@ func actionEniIf(c *cli.Context) error {
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-	fmt.Fprintln(w, "iface\tmac\tid\tsubnet\tsubnet_cidr\tsecgrps\tvpc\tips\t")
+	fmt.Fprintln(w, "iface\tmac\tid\tsubnet\tsubnet_cidr\tsecgrps\tvpc\tips\tprefixes\t")
 	for _, iface := range interfaces {
-		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n", iface.LocalName(),
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n", iface.LocalName(),
 			iface.Mac,
 			iface.ID,
 			iface.SubnetID,
 			iface.SubnetCidr,
 			iface.SecurityGroupIds,
 			iface.VpcID,
-			iface.IPv4s)
+			iface.IPv4s,
+			iface.IPv4Prefixes)
 
 	}
 
@@ -195,6 +521,59 @@ func actionEniIf(c *cli.Context) error {
 	return nil
 }
 
+// actionVpcInfo prints the VPC CIDRs the plugin routes and, for each
+// attached interface, the gateway and DNS server it derives for Pods
+func actionVpcInfo(c *cli.Context) error {
+	interfaces, err := aws.GetInterfaces()
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	if len(interfaces) == 0 {
+		return fmt.Errorf("no interfaces attached")
+	}
+	az, err := aws.AvailabilityZone()
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	vpc := interfaces[0]
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(w, "vpc:\t%v\t\n", vpc.VpcID)
+	fmt.Fprintf(w, "primary_cidr:\t%v\t\n", vpc.VpcPrimaryCidr)
+	fmt.Fprintf(w, "cidrs:\t%v\t\n", vpc.VpcCidrs)
+	fmt.Fprintf(w, "ipv6_cidrs:\t%v\t\n", vpc.VpcIPv6Cidrs)
+	fmt.Fprintf(w, "availability_zone:\t%v\t\n", az)
+	w.Flush()
+	fmt.Println()
+
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "iface\tid\tsubnet\tsubnet_cidr\tgateway\tipv6_cidr\tipv6_gateway\tdns\t")
+	for _, iface := range interfaces {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n",
+			iface.LocalName(),
+			iface.ID,
+			iface.SubnetID,
+			iface.SubnetCidr,
+			derived(iface.Gateway()),
+			iface.SubnetIPv6Cidr,
+			derived(iface.IPv6Gateway()),
+			derived(aws.OffsetIP(iface.VpcPrimaryCidr, 2)))
+	}
+	w.Flush()
+	return nil
+}
+
+// derived formats an address computed from a CIDR, or the reason it
+// couldn't be
+func derived(ip net.IP, err error) string {
+	if err != nil {
+		return "-"
+	}
+	return ip.String()
+}
+
 func actionSubnets(c *cli.Context) error {
 	subnets, err := aws.GetSubnetsForInstance()
 	if err != nil {
@@ -217,9 +596,30 @@ func actionSubnets(c *cli.Context) error {
 	return nil
 }
 
+func actionServeMetrics(c *cli.Context) error {
+	file := c.String("file")
+	if file == "" {
+		fmt.Println("please specify the metrics file written by the plugin")
+		return fmt.Errorf("need a metrics file")
+	}
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(data)
+	})
+	return http.ListenAndServe(c.String("listen"), nil)
+}
+
 func main() {
-	if !aws.Available() {
-		fmt.Fprintln(os.Stderr, "This command must be run from a running ec2 instance")
+	rand.Seed(time.Now().UnixNano())
+
+	if err := aws.CheckIMDS(); err != nil {
+		fmt.Fprintf(os.Stderr, "This command must be run from a running ec2 instance: %v\n", err)
 		os.Exit(1)
 	}
 
@@ -229,17 +629,54 @@ func main() {
 	}
 
 	app := cli.NewApp()
+	app.Flags = []cli.Flag{
+		cli.BoolFlag{
+			Name:   "trace",
+			EnvVar: "CNI_IPVLAN_TRACE",
+			Usage:  "Log every AWS call with its parameters, latency and error to stderr",
+		},
+		cli.DurationFlag{
+			Name:   "lock-hold-timeout",
+			EnvVar: "CNI_IPVLAN_LOCK_HOLD_TIMEOUT",
+			Usage:  "Abandon a command still holding the node's lock after this long",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if c.GlobalBool("trace") {
+			cniipvlanvpck8s.TraceAWSCalls(cniipvlanvpck8s.NewStreamLogger(os.Stderr))
+		}
+		cniipvlanvpck8s.SetLockHoldTimeout(c.GlobalDuration("lock-hold-timeout"))
+		aws.SetIPsInUse(cniipvlanvpck8s.IPsInUse)
+		aws.SetInterfacesInUse(cniipvlanvpck8s.InterfaceIDsInUse)
+		return nil
+	}
 	app.Commands = []cli.Command{
 		{
 			Name:      "new-interface",
 			Usage:     "Create a new interface",
 			Action:    actionNewInterface,
-			ArgsUsage: "[--subnet_filter=k,v] [security_group_ids...]",
+			ArgsUsage: "[--subnet_filter=k,v] [--minimum_free_ips=n] [--tags=k,v] [--count=n] [--dry-run] [security_group_ids...]",
 			Flags: []cli.Flag{
 				cli.StringFlag{
-					Name:  "subnet_filter",
+					Name:  "subnet_filter, subnet-tags",
 					Usage: "Comma separated key=value filters to restrict subnets",
 				},
+				cli.IntFlag{
+					Name:  "minimum_free_ips",
+					Usage: "Skip subnets with fewer available addresses",
+				},
+				cli.StringFlag{
+					Name:  "tags",
+					Usage: "Comma separated key=value tags applied to the interface",
+				},
+				cli.IntFlag{
+					Name:  "count",
+					Usage: "Attach interfaces until this many are managed by the plugin, printing their IDs",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Print the interface that would be created without creating it",
+				},
 			},
 		},
 		{
@@ -248,6 +685,11 @@ func main() {
 			Action:    actionRemoveInterface,
 			ArgsUsage: "[interface_id...]",
 		},
+		{
+			Name:   "teardown",
+			Usage:  "Detach and delete every ENI created by the plugin",
+			Action: actionTeardown,
+		},
 		{
 			Name:      "deallocate",
 			Usage:     "Deallocate a private IP",
@@ -260,12 +702,53 @@ func main() {
 			Action: actionAllocate,
 			Flags: []cli.Flag{
 				cli.IntFlag{Name: "index"},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Print how an IP would be allocated without allocating it",
+				},
+			},
+		},
+		{
+			Name:      "free-ips",
+			Usage:     "List all currently unassigned AWS IP addresses",
+			Action:    actionFreeIps,
+			ArgsUsage: "[--gc]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "gc",
+					Usage: "Deallocate unused secondary IPs on interfaces created by the plugin",
+				},
 			},
 		},
 		{
-			Name:   "free-ips",
-			Usage:  "List all currently unassigned AWS IP addresses",
-			Action: actionFreeIps,
+			Name:      "list",
+			Usage:     "List the secondary IPs of managed interfaces and the pods using them",
+			Action:    actionList,
+			ArgsUsage: "[--json]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the IPs as a JSON array",
+				},
+			},
+		},
+		{
+			Name:      "plan",
+			Usage:     "Print the allocation plan recorded for a container",
+			Action:    actionPlan,
+			ArgsUsage: "container_id",
+		},
+		{
+			Name:      "reconcile",
+			Usage:     "Compare the IPs assigned in EC2 against those used on the host",
+			Action:    actionReconcile,
+			ArgsUsage: "[--fix]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "fix",
+					Usage: "Deallocate orphaned secondary IPs on interfaces created by the plugin",
+				},
+			},
 		},
 		{
 			Name:   "eniif",
@@ -277,16 +760,89 @@ func main() {
 			Usage:  "List all bound IP addresses",
 			Action: actionAddr,
 		},
+		{
+			Name:   "vpc-info",
+			Usage:  "Show the VPC CIDRs and the gateway and DNS derived for each interface",
+			Action: actionVpcInfo,
+		},
 		{
 			Name:   "subnets",
 			Usage:  "Show available subnets for this host",
 			Action: actionSubnets,
 		},
+		{
+			Name:   "serve-metrics",
+			Usage:  "Serve the plugin's metrics textfile over HTTP for Prometheus",
+			Action: actionServeMetrics,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: "127.0.0.1:61678",
+					Usage: "Address to serve /metrics on",
+				},
+				cli.StringFlag{
+					Name:  "file",
+					Usage: "Metrics textfile configured as metricsFile in the IPAM config",
+				},
+			},
+		},
+		{
+			Name:      "healthcheck",
+			Usage:     "Verify EC2 access and ENI capacity, exiting non-zero on failure",
+			Action:    actionHealthCheck,
+			ArgsUsage: "[--subnet_filter=k,v] [--minimum_free_ips=n] [--index=n]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "subnet_filter",
+					Usage: "Comma separated key=value tags candidate subnets must carry",
+				},
+				cli.IntFlag{
+					Name:  "minimum_free_ips",
+					Usage: "Free IPs a candidate subnet must have",
+				},
+				cli.IntFlag{
+					Name:  "index",
+					Usage: "First interface index used for pod IPs",
+				},
+			},
+		},
 		{
 			Name:   "limits",
 			Usage:  "Display limits for ENI for this instance type",
 			Action: actionLimits,
 		},
+		{
+			Name:      "selftest",
+			Usage:     "Run ADD in a throwaway namespace, reach the gateway and VPC DNS, then DEL and check the IP was deallocated",
+			Action:    actionSelftest,
+			ArgsUsage: "--conf=file [--cni-path=dirs] [--ifname=name] [--timeout=d] [--skip-deallocation-check]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "conf",
+					Usage: "Network configuration or configuration list to run",
+				},
+				cli.StringFlag{
+					Name:   "cni-path",
+					Value:  "/opt/cni/bin",
+					EnvVar: "CNI_PATH",
+					Usage:  "Directories holding the plugins",
+				},
+				cli.StringFlag{
+					Name:  "ifname",
+					Value: "eth0",
+					Usage: "Name of the interface in the namespace",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: 2 * time.Second,
+					Usage: "How long to wait for the gateway and DNS to answer",
+				},
+				cli.BoolFlag{
+					Name:  "skip-deallocation-check",
+					Usage: "Don't require EC2 to unassign the IP, for configurations keeping IPs",
+				},
+			},
+		},
 	}
 	app.Version = version
 	app.Copyright = "(c) 2017 Lyft Inc."
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"net"
 	"testing"
 )
 
@@ -37,3 +39,30 @@ func TestFilterBuildMulti(t *testing.T) {
 	}
 
 }
+
+func TestMissingInterfaces(t *testing.T) {
+	cases := []struct {
+		count, managed, attached, limit int
+		expected                        int
+	}{
+		{count: 3, managed: 0, attached: 1, limit: 4, expected: 3},
+		{count: 3, managed: 1, attached: 2, limit: 4, expected: 2},
+		{count: 3, managed: 3, attached: 4, limit: 4, expected: 0},
+		{count: 2, managed: 3, attached: 4, limit: 8, expected: 0},
+		{count: 5, managed: 0, attached: 1, limit: 3, expected: 2},
+	}
+	for i, c := range cases {
+		if missing := missingInterfaces(c.count, c.managed, c.attached, c.limit); missing != c.expected {
+			t.Fatalf("%d expected %d interfaces, got %d", i, c.expected, missing)
+		}
+	}
+}
+
+func TestDerived(t *testing.T) {
+	if ip := derived(net.ParseIP("10.0.0.1"), nil); ip != "10.0.0.1" {
+		t.Errorf("expected 10.0.0.1, got %v", ip)
+	}
+	if ip := derived(nil, fmt.Errorf("no CIDR block available")); ip != "-" {
+		t.Errorf("expected - for a failure, got %v", ip)
+	}
+}
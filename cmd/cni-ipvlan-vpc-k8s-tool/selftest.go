@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/urfave/cli"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+// selftestDNSName is looked up to check the VPC DNS answers. Any answer,
+// even NXDOMAIN, will do.
+const selftestDNSName = "amazonaws.com"
+
+// selftestConfig is a network configuration as the runtime reads it: a
+// single plugin or a list of them, run in order on ADD and in reverse on
+// DEL
+type selftestConfig struct {
+	name       string
+	cniVersion string
+	plugins    []map[string]interface{}
+}
+
+func loadSelftestConfig(path string) (*selftestConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf map[string]interface{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("%v is not a network configuration: %v", path, err)
+	}
+	parsed := &selftestConfig{}
+	parsed.name, _ = conf["name"].(string)
+	parsed.cniVersion, _ = conf["cniVersion"].(string)
+	list, ok := conf["plugins"].([]interface{})
+	if !ok {
+		parsed.plugins = []map[string]interface{}{conf}
+		return parsed, nil
+	}
+	for _, plugin := range list {
+		pluginConf, ok := plugin.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("plugins of %v must be objects", path)
+		}
+		parsed.plugins = append(parsed.plugins, pluginConf)
+	}
+	if len(parsed.plugins) == 0 {
+		return nil, fmt.Errorf("%v lists no plugins", path)
+	}
+	return parsed, nil
+}
+
+// pluginConf returns the configuration the plugin is invoked with, which
+// carries the list's name and version and the result of the plugin before
+// it
+func (c *selftestConfig) pluginConf(plugin map[string]interface{}, prevResult types.Result) ([]byte, error) {
+	conf := map[string]interface{}{}
+	for key, value := range plugin {
+		conf[key] = value
+	}
+	if c.name != "" {
+		conf["name"] = c.name
+	}
+	if c.cniVersion != "" {
+		conf["cniVersion"] = c.cniVersion
+	}
+	if prevResult != nil {
+		conf["prevResult"] = prevResult
+	}
+	return json.Marshal(conf)
+}
+
+func (c *selftestConfig) pluginPath(plugin map[string]interface{}, paths []string) (string, error) {
+	pluginType, _ := plugin["type"].(string)
+	if pluginType == "" {
+		return "", fmt.Errorf("plugin without a type")
+	}
+	return invoke.FindInPath(pluginType, paths)
+}
+
+// add runs ADD through the plugins, returning the last result
+func (c *selftestConfig) add(args *invoke.Args, paths []string) (types.Result, error) {
+	var result types.Result
+	for _, plugin := range c.plugins {
+		path, err := c.pluginPath(plugin, paths)
+		if err != nil {
+			return nil, err
+		}
+		conf, err := c.pluginConf(plugin, result)
+		if err != nil {
+			return nil, err
+		}
+		result, err = invoke.ExecPluginWithResult(context.TODO(), path, conf, args, nil)
+		if err != nil {
+			return nil, fmt.Errorf("ADD of %v failed: %v", filepath.Base(path), err)
+		}
+	}
+	return result, nil
+}
+
+// del runs DEL through the plugins in reverse, carrying on past failures
+// so as much as possible is cleaned up
+func (c *selftestConfig) del(args *invoke.Args, paths []string) error {
+	var failures []string
+	for i := len(c.plugins) - 1; i >= 0; i-- {
+		path, err := c.pluginPath(c.plugins[i], paths)
+		if err == nil {
+			var conf []byte
+			if conf, err = c.pluginConf(c.plugins[i], nil); err == nil {
+				err = invoke.ExecPluginWithoutResult(context.TODO(), path, conf, args, nil)
+			}
+		}
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("DEL failed: %v", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func actionSelftest(c *cli.Context) error {
+	if c.String("conf") == "" {
+		return cli.NewExitError("--conf is required", 1)
+	}
+	conf, err := loadSelftestConfig(c.String("conf"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	paths := filepath.SplitList(c.String("cni-path"))
+	timeout := c.Duration("timeout")
+
+	netns, err := testutils.NewNS()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("unable to create a namespace: %v", err), 1)
+	}
+	defer testutils.UnmountNS(netns)
+	defer netns.Close()
+
+	args := &invoke.Args{
+		ContainerID: fmt.Sprintf("selftest-%08x", rand.Uint32()),
+		NetNS:       netns.Path(),
+		IfName:      c.String("ifname"),
+		Path:        strings.Join(paths, ":"),
+	}
+	addArgs, delArgs := *args, *args
+	addArgs.Command, delArgs.Command = "ADD", "DEL"
+	fmt.Printf("namespace: %v, container %v\n", netns.Path(), args.ContainerID)
+
+	deleted := false
+	defer func() {
+		// Clean up after failures too
+		if !deleted {
+			if err := conf.del(&delArgs, paths); err != nil {
+				fmt.Printf("cleanup: %v\n", err)
+			}
+		}
+	}()
+
+	result, err := conf.add(&addArgs, paths)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	res, err := current.NewResultFromResult(result)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("unable to read the ADD result: %v", err), 1)
+	}
+	ipConf := selftestIPv4(res)
+	if ipConf == nil {
+		return cli.NewExitError("the ADD result has no IPv4 address", 1)
+	}
+	ip := ipConf.Address.IP
+	fmt.Printf("add: ok (%v)\n", ipConf.Address.String())
+
+	interfaceID, dns, err := selftestInterface(args.ContainerID, args.IfName, ip)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	for _, nameserver := range res.DNS.Nameservers {
+		if server := net.ParseIP(nameserver); server != nil && server.To4() != nil {
+			dns = server
+			break
+		}
+	}
+	gateway := ipConf.Gateway
+	if gateway == nil {
+		// On-link routes leave the gateway out of the result
+		if gateway, err = aws.OffsetIP(&net.IPNet{IP: ip.Mask(ipConf.Address.Mask), Mask: ipConf.Address.Mask}, 1); err != nil {
+			return cli.NewExitError(fmt.Sprintf("unable to derive the subnet gateway: %v", err), 1)
+		}
+	}
+
+	err = netns.Do(func(ns.NetNS) error {
+		if err := pingICMP(gateway, timeout); err != nil {
+			return fmt.Errorf("gateway %v unreachable: %v", gateway, err)
+		}
+		fmt.Printf("gateway: ok (%v)\n", gateway)
+		if dns == nil {
+			return fmt.Errorf("no VPC DNS server known")
+		}
+		if err := queryDNS(dns, selftestDNSName, timeout); err != nil {
+			return fmt.Errorf("DNS server %v unreachable: %v", dns, err)
+		}
+		fmt.Printf("dns: ok (%v)\n", dns)
+		return nil
+	})
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	deleted = true
+	if err := conf.del(&delArgs, paths); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println("del: ok")
+
+	bound, err := nl.GetIPs()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("unable to list bound IPs: %v", err), 1)
+	}
+	for _, b := range bound {
+		if b.IPNet.IP.Equal(ip) {
+			return cli.NewExitError(fmt.Sprintf("%v is still bound to %v after DEL", ip, b.Label), 1)
+		}
+	}
+	if c.Bool("skip-deallocation-check") {
+		return nil
+	}
+	if interfaceID == "" {
+		return cli.NewExitError(fmt.Sprintf("no interface of %v known to check its deallocation", ip), 1)
+	}
+	assigned, err := aws.IsIPAssigned(interfaceID, ip)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("unable to check the deallocation of %v: %v", ip, err), 1)
+	}
+	if assigned {
+		return cli.NewExitError(fmt.Sprintf("%v is still assigned to %v after DEL; configurations keeping IPs, "+
+			"such as skipDeallocation, warm pools or prefix delegation, need --skip-deallocation-check", ip, interfaceID), 1)
+	}
+	fmt.Printf("deallocation: ok (%v)\n", interfaceID)
+	return nil
+}
+
+// selftestIPv4 returns the IPv4 configuration of a result
+func selftestIPv4(res *current.Result) *current.IPConfig {
+	for _, ipConf := range res.IPs {
+		if ipConf.Address.IP.To4() != nil {
+			return ipConf
+		}
+	}
+	return nil
+}
+
+// selftestInterface returns the interface ID holding the IP, from the
+// plugin's attachment record or else from metadata, and the VPC DNS server
+func selftestInterface(containerID, ifName string, ip net.IP) (string, net.IP, error) {
+	interfaces, err := aws.GetInterfaces()
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to list interfaces: %v", err)
+	}
+	var dns net.IP
+	if len(interfaces) > 0 && interfaces[0].VpcPrimaryCidr != nil {
+		dns, _ = aws.OffsetIP(interfaces[0].VpcPrimaryCidr, 2)
+	}
+
+	record, err := cniipvlanvpck8s.LookupAttachment(cniipvlanvpck8s.Attachment{ContainerID: containerID, IfName: ifName})
+	if err == nil && record != nil && record.InterfaceID != "" {
+		return record.InterfaceID, dns, nil
+	}
+	for _, intf := range interfaces {
+		for _, assigned := range intf.AssignedIPv4s() {
+			if assigned.Equal(ip) {
+				return intf.ID, dns, nil
+			}
+		}
+	}
+	return "", dns, nil
+}
+
+// pingICMP sends an echo request to ip and waits for its reply
+func pingICMP(ip net.IP, timeout time.Duration) error {
+	conn, err := net.DialTimeout("ip4:icmp", ip.String(), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	id := uint16(rand.Uint32())
+	request := []byte{8, 0, 0, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint16(request[4:], id)
+	binary.BigEndian.PutUint16(request[2:], icmpChecksum(request))
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reply := make([]byte, 1500)
+	for {
+		n, err := conn.Read(reply)
+		if err != nil {
+			return err
+		}
+		// Other ICMP traffic reaches the socket too
+		if n >= 8 && reply[0] == 0 && binary.BigEndian.Uint16(reply[4:]) == id {
+			return nil
+		}
+	}
+}
+
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// queryDNS sends an A query for name to server and waits for its answer.
+// The socket is made in the calling thread's namespace, unlike lookups by
+// net.Resolver.
+func queryDNS(server net.IP, name string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(server.String(), "53"), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	id := uint16(rand.Uint32())
+	// Header: the ID, recursion desired and one question
+	query := []byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(query, id)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	// The root label, type A and class IN
+	query = append(query, 0, 0, 1, 0, 1)
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(query); err != nil {
+		return err
+	}
+	reply := make([]byte, 512)
+	for {
+		n, err := conn.Read(reply)
+		if err != nil {
+			return err
+		}
+		if n >= 12 && binary.BigEndian.Uint16(reply) == id && reply[2]&0x80 != 0 {
+			return nil
+		}
+	}
+}
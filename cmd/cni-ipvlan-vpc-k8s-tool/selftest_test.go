@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSelftestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "selftest")
+	if err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "10-ipvlan.conflist")
+	list := `{"cniVersion": "0.3.1", "name": "cni-ipvlan-vpc-k8s", "plugins": [
+		{"type": "cni-ipvlan-vpc-k8s-ipvlan", "ipam": {"type": "cni-ipvlan-vpc-k8s-ipam", "interfaceIndex": 1}},
+		{"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp"}]}`
+	if err := ioutil.WriteFile(path, []byte(list), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	conf, err := loadSelftestConfig(path)
+	if err != nil || len(conf.plugins) != 2 {
+		t.Fatalf("expected two plugins, got %v: %v", conf, err)
+	}
+	data, err := conf.pluginConf(conf.plugins[1], nil)
+	if err != nil {
+		t.Fatalf("Failed to build plugin config: %v", err)
+	}
+	var plugin map[string]interface{}
+	json.Unmarshal(data, &plugin)
+	if plugin["name"] != "cni-ipvlan-vpc-k8s" || plugin["cniVersion"] != "0.3.1" || plugin["type"] != "cni-ipvlan-vpc-k8s-unnumbered-ptp" {
+		t.Errorf("expected the list's name and version on the plugin, got %v", plugin)
+	}
+	if _, ok := conf.plugins[1]["name"]; ok {
+		t.Errorf("building the plugin config changed the list")
+	}
+}
+
+func TestICMPChecksum(t *testing.T) {
+	// An echo request with ID 1 and sequence 1
+	request := []byte{8, 0, 0, 0, 0, 1, 0, 1}
+	if sum := icmpChecksum(request); sum != 0xf7fd {
+		t.Fatalf("expected checksum 0xf7fd, got %#x", sum)
+	}
+}
@@ -0,0 +1,168 @@
+package cniipvlanvpck8s
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// ExhaustionAnnotation is the Node annotation holding the reason of the
+	// last exhaustion reported
+	ExhaustionAnnotation = "cni-ipvlan-vpc-k8s/last-exhaustion"
+	// ExhaustionTimeAnnotation is the Node annotation holding when the last
+	// exhaustion was reported, in RFC 3339
+	ExhaustionTimeAnnotation = "cni-ipvlan-vpc-k8s/last-exhaustion-time"
+)
+
+var (
+	// exhaustionFile records when each reason was last reported, so a node
+	// failing every ADD doesn't flood the API server. Concurrent reports
+	// race on it, at worst reporting twice.
+	exhaustionFile = "/run/cni-ipvlan-vpc-k8s/exhaustion-events.json"
+	// exhaustionInterval is the least time between reports of a reason
+	exhaustionInterval = time.Minute
+	// kubeTimeout bounds each request to the API server, as reports are
+	// made while an ADD is failing
+	kubeTimeout = 2 * time.Second
+)
+
+// KubeAPI is how to reach the Kubernetes API server: its URL, a file
+// holding a bearer token and, unless the server's certificate is signed
+// by a system root, a file holding its CA
+type KubeAPI struct {
+	Server    string
+	TokenFile string
+	CAFile    string
+}
+
+type objectMeta struct {
+	Name        string            `json:"name,omitempty"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type objectReference struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	UID  string `json:"uid"`
+}
+
+type eventSource struct {
+	Component string `json:"component"`
+	Host      string `json:"host"`
+}
+
+type event struct {
+	APIVersion     string          `json:"apiVersion"`
+	Kind           string          `json:"kind"`
+	Metadata       objectMeta      `json:"metadata"`
+	InvolvedObject objectReference `json:"involvedObject"`
+	Reason         string          `json:"reason"`
+	Message        string          `json:"message"`
+	Type           string          `json:"type"`
+	Source         eventSource     `json:"source"`
+	FirstTimestamp time.Time       `json:"firstTimestamp"`
+	LastTimestamp  time.Time       `json:"lastTimestamp"`
+	Count          int             `json:"count"`
+}
+
+// ReportExhaustion emits a Warning Event on the node and annotates it with
+// the reason, such as IPExhausted, for dashboards to alert on. A reason
+// reported within the last minute isn't reported again.
+func ReportExhaustion(api KubeAPI, node, reason, message string) error {
+	now := time.Now()
+	reported := map[string]time.Time{}
+	if data, err := ioutil.ReadFile(exhaustionFile); err == nil {
+		// Corrupt state reports again
+		_ = json.Unmarshal(data, &reported)
+	}
+	if last, ok := reported[reason]; ok && now.Sub(last) < exhaustionInterval {
+		return nil
+	}
+
+	client, token, err := api.client()
+	if err != nil {
+		return err
+	}
+	// Node events live in the default namespace, the node's name being
+	// its UID as for the kubelet's
+	ev := event{
+		APIVersion:     "v1",
+		Kind:           "Event",
+		Metadata:       objectMeta{Name: fmt.Sprintf("%v.%x", node, now.UnixNano()), Namespace: "default"},
+		InvolvedObject: objectReference{Kind: "Node", Name: node, UID: node},
+		Reason:         reason,
+		Message:        message,
+		Type:           "Warning",
+		Source:         eventSource{Component: "cni-ipvlan-vpc-k8s", Host: node},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if err := api.request(client, token, "POST", "/api/v1/namespaces/default/events", "application/json", ev); err != nil {
+		return fmt.Errorf("unable to create event: %v", err)
+	}
+	patch := struct {
+		Metadata objectMeta `json:"metadata"`
+	}{objectMeta{Annotations: map[string]string{
+		ExhaustionAnnotation:     reason,
+		ExhaustionTimeAnnotation: now.UTC().Format(time.RFC3339),
+	}}}
+	if err := api.request(client, token, "PATCH", "/api/v1/nodes/"+url.PathEscape(node), "application/merge-patch+json", patch); err != nil {
+		return fmt.Errorf("unable to annotate node %v: %v", node, err)
+	}
+
+	reported[reason] = now
+	return writeJSONAtomic(exhaustionFile, reported)
+}
+
+func (api KubeAPI) client() (*http.Client, string, error) {
+	token, err := ioutil.ReadFile(api.TokenFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to read the API server token: %v", err)
+	}
+	transport := &http.Transport{}
+	if api.CAFile != "" {
+		ca, err := ioutil.ReadFile(api.CAFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to read the API server CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, "", fmt.Errorf("no certificates in %v", api.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport, Timeout: kubeTimeout}, strings.TrimSpace(string(token)), nil
+}
+
+func (api KubeAPI) request(client *http.Client, token, method, path, contentType string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(api.Server, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		reply, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v %v returned %v: %s", method, path, resp.Status, bytes.TrimSpace(reply))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package cniipvlanvpck8s
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestReportExhaustion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatalf("Failed to create state dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oldExhaustionFile := exhaustionFile
+	exhaustionFile = filepath.Join(dir, "exhaustion-events.json")
+	defer func() { exhaustionFile = oldExhaustionFile }()
+
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("Failed to write token: %v", err)
+	}
+
+	var mu sync.Mutex
+	var requests []string
+	var reported event
+	var patch struct {
+		Metadata objectMeta `json:"metadata"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case "POST":
+			json.NewDecoder(r.Body).Decode(&reported)
+		case "PATCH":
+			json.NewDecoder(r.Body).Decode(&patch)
+		}
+	}))
+	defer server.Close()
+
+	api := KubeAPI{Server: server.URL, TokenFile: tokenFile}
+	if err := ReportExhaustion(api, "node-a", "IPExhausted", "subnet is full"); err != nil {
+		t.Fatalf("Failed to report exhaustion: %v", err)
+	}
+	if len(requests) != 2 || requests[0] != "POST /api/v1/namespaces/default/events" || requests[1] != "PATCH /api/v1/nodes/node-a" {
+		t.Fatalf("expected an event and a node patch, got %v", requests)
+	}
+	if reported.InvolvedObject.Kind != "Node" || reported.InvolvedObject.Name != "node-a" || reported.Reason != "IPExhausted" || reported.Type != "Warning" {
+		t.Errorf("unexpected event %+v", reported)
+	}
+	if patch.Metadata.Annotations[ExhaustionAnnotation] != "IPExhausted" || patch.Metadata.Annotations[ExhaustionTimeAnnotation] == "" {
+		t.Errorf("unexpected annotations %v", patch.Metadata.Annotations)
+	}
+
+	// A repeat within the interval isn't reported, another reason is
+	if err := ReportExhaustion(api, "node-a", "IPExhausted", "subnet is full"); err != nil {
+		t.Fatalf("Failed to report exhaustion again: %v", err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("expected the repeat to be skipped, got %v", requests)
+	}
+	if err := ReportExhaustion(api, "node-a", "ENILimitReached", "no more ENIs"); err != nil {
+		t.Fatalf("Failed to report exhaustion: %v", err)
+	}
+	if len(requests) != 4 {
+		t.Fatalf("expected another reason to be reported, got %v", requests)
+	}
+
+	// Without credentials nothing is sent
+	api.TokenFile = filepath.Join(dir, "missing")
+	if err := ReportExhaustion(api, "node-a", "Other", "message"); err == nil || len(requests) != 4 {
+		t.Fatalf("expected an error without a token, got %v after %v", err, requests)
+	}
+}
@@ -0,0 +1,114 @@
+package cniipvlanvpck8s
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"syscall"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+)
+
+// exclusiveFile records the interfaces dedicated to a single container,
+// which no other pod is allocated on
+var exclusiveFile = "/var/lib/cni-ipvlan-vpc-k8s/exclusive.json"
+
+// exclusiveInterfaces maps interface IDs to the container they're
+// dedicated to
+type exclusiveInterfaces map[string]string
+
+// ReserveExclusiveInterface dedicates the interface to the container
+// until ReleaseExclusiveInterface
+func ReserveExclusiveInterface(interfaceID, containerID string) error {
+	return updateClaims(func(ipClaims) error {
+		exclusive := loadExclusiveInterfaces()
+		exclusive[interfaceID] = containerID
+		return writeJSONAtomic(exclusiveFile, exclusive)
+	})
+}
+
+// ReleaseExclusiveInterface returns the interfaces dedicated to the
+// container to the shared pool
+func ReleaseExclusiveInterface(containerID string) error {
+	return updateClaims(func(ipClaims) error {
+		return pruneExclusiveInterfaces(func(owner string) bool {
+			return owner != containerID
+		})
+	})
+}
+
+// ExclusiveInterfaceIDs returns the IDs of the interfaces dedicated to a
+// container
+func ExclusiveInterfaceIDs() ([]string, error) {
+	unlock, err := acquireLocks(DefaultLockTimeout, lockRequest{claimLockName, syscall.LOCK_SH})
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var ids []string
+	for id := range loadExclusiveInterfaces() {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// InterfaceIDsInUse returns the IDs of the interfaces dedicated to a
+// container or recorded for an attachment
+func InterfaceIDsInUse() ([]string, error) {
+	unlock, err := acquireLocks(DefaultLockTimeout, lockRequest{claimLockName, syscall.LOCK_SH})
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var ids []string
+	for id := range loadExclusiveInterfaces() {
+		ids = append(ids, id)
+	}
+	for _, record := range loadAttachments() {
+		if record.InterfaceID != "" {
+			ids = append(ids, record.InterfaceID)
+		}
+	}
+	return ids, nil
+}
+
+// pruneExclusiveInterfaces drops the interfaces whose owner keep rejects.
+// It must be called under the claims lock.
+func pruneExclusiveInterfaces(keep func(owner string) bool) error {
+	exclusive := loadExclusiveInterfaces()
+	pruned := false
+	for id, owner := range exclusive {
+		if !keep(owner) {
+			delete(exclusive, id)
+			pruned = true
+		}
+	}
+	if !pruned {
+		return nil
+	}
+	return writeJSONAtomic(exclusiveFile, exclusive)
+}
+
+// sharedInterfaces returns the interfaces not dedicated to a container
+func sharedInterfaces(interfaces []aws.Interface, exclusive exclusiveInterfaces) []aws.Interface {
+	if len(exclusive) == 0 {
+		return interfaces
+	}
+	var shared []aws.Interface
+	for _, intf := range interfaces {
+		if _, ok := exclusive[intf.ID]; !ok {
+			shared = append(shared, intf)
+		}
+	}
+	return shared
+}
+
+func loadExclusiveInterfaces() exclusiveInterfaces {
+	exclusive := exclusiveInterfaces{}
+	if data, err := ioutil.ReadFile(exclusiveFile); err == nil {
+		// Corrupt records are treated as empty and overwritten
+		_ = json.Unmarshal(data, &exclusive)
+	}
+	return exclusive
+}
@@ -1,6 +1,8 @@
 package cniipvlanvpck8s
 
 import (
+	"net"
+
 	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
 	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
 )
@@ -9,25 +11,68 @@ import (
 // from the EC2 metadata service and the currently used addresses
 // within netlink. This is inherently somewhat racey - for example
 // newly provisioned addresses may not show up immediately in metadata
-// and are subject to a few seconds of delay.
+// and are subject to a few seconds of delay. IPs claimed by an ADD but not
+// bound yet are not free, nor are IPs of interfaces dedicated to a
+// container. Use ClaimFreeIPAtIndex to allocate a free IP.
 func FindFreeIPsAtIndex(index int) ([]*aws.AllocationResult, error) {
-	freeIps := []*aws.AllocationResult{}
-
 	interfaces, err := aws.GetInterfaces()
 	if err != nil {
 		return nil, err
 	}
+	return FindFreeIPsAmong(interfaces, index)
+}
+
+// FindFreeIPsAmong is FindFreeIPsAtIndex over interfaces listed by the
+// caller
+func FindFreeIPsAmong(interfaces []aws.Interface, index int) ([]*aws.AllocationResult, error) {
+	claims, err := claimedIPs()
+	if err != nil {
+		return nil, err
+	}
+	return findFreeIPsAtIndex(sharedInterfaces(interfaces, loadExclusiveInterfaces()), index, claims)
+}
+
+func findFreeIPsAtIndex(interfaces []aws.Interface, index int, claims ipClaims) ([]*aws.AllocationResult, error) {
+	assigned, err := nl.GetIPs()
+	if err != nil {
+		return nil, err
+	}
+	return freeIPs(interfaces, assigned, claims, index), nil
+}
+
+// freeIPs returns the IPv4s of interfaces at or above index, including
+// those of delegated prefixes, neither bound to any local link nor claimed
+func freeIPs(interfaces []aws.Interface, assigned []nl.BoundIP, claims ipClaims, index int) []*aws.AllocationResult {
+	return freeAddresses(interfaces, assigned, claims, index, func(intf aws.Interface) []net.IP {
+		return intf.AssignedIPv4s()
+	})
+}
+
+func findFreeIPv6sAtIndex(interfaces []aws.Interface, index int, claims ipClaims) ([]*aws.AllocationResult, error) {
 	assigned, err := nl.GetIPs()
 	if err != nil {
 		return nil, err
 	}
+	return freeIPv6s(interfaces, assigned, claims, index), nil
+}
+
+// freeIPv6s is freeIPs for IPv6 addresses. The address is returned in IP
+// rather than IPv6, as that's what claims are made on.
+func freeIPv6s(interfaces []aws.Interface, assigned []nl.BoundIP, claims ipClaims, index int) []*aws.AllocationResult {
+	return freeAddresses(interfaces, assigned, claims, index, func(intf aws.Interface) []net.IP {
+		return intf.IPv6s
+	})
+}
+
+func freeAddresses(interfaces []aws.Interface, assigned []nl.BoundIP, claims ipClaims, index int, addresses func(aws.Interface) []net.IP) []*aws.AllocationResult {
+	freeIps := []*aws.AllocationResult{}
 
 	for _, intf := range interfaces {
 		if intf.Number < index {
 			continue
 		}
-		for _, intfIP := range intf.IPv4s {
-			found := false
+		for _, intfIP := range addresses(intf) {
+			_, found := claims[intfIP.String()]
 			for _, assignedIP := range assigned {
 				if assignedIP.IPNet.IP.Equal(intfIP) {
 					found = true
@@ -38,11 +83,97 @@ func FindFreeIPsAtIndex(index int) ([]*aws.AllocationResult, error) {
 				intfIPCopy := intfIP
 				// No match, record as free
 				freeIps = append(freeIps, &aws.AllocationResult{
-					&intfIPCopy,
-					intf,
+					IP:        &intfIPCopy,
+					Interface: intf,
 				})
 			}
 		}
 	}
-	return freeIps, nil
+	return freeIps
+}
+
+// findFreeIPsOn returns the free IPv4s of a single interface
+func findFreeIPsOn(intf aws.Interface, claims ipClaims) ([]*aws.AllocationResult, error) {
+	assigned, err := nl.GetIPs()
+	if err != nil {
+		return nil, err
+	}
+	return freeIPs([]aws.Interface{intf}, assigned, claims, 0), nil
+}
+
+// inSubnets returns the allocations on interfaces in one of the subnets
+func inSubnets(allocs []*aws.AllocationResult, subnetIDs []string) []*aws.AllocationResult {
+	matching := []*aws.AllocationResult{}
+	for _, alloc := range allocs {
+		for _, id := range subnetIDs {
+			if alloc.Interface.SubnetID == id {
+				matching = append(matching, alloc)
+				break
+			}
+		}
+	}
+	return matching
+}
+
+// FindFreeIPv6On locates an IPv6 address assigned to the interface in EC2
+// which is neither bound to any local interface nor claimed. Returns nil if
+// none is free.
+func FindFreeIPv6On(intf aws.Interface) (*net.IP, error) {
+	claims, err := claimedIPs()
+	if err != nil {
+		return nil, err
+	}
+	return findFreeIPv6On(intf, claims)
+}
+
+func findFreeIPv6On(intf aws.Interface, claims ipClaims) (*net.IP, error) {
+	assigned, err := nl.GetIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, intfIP := range intf.IPv6s {
+		_, found := claims[intfIP.String()]
+		for _, assignedIP := range assigned {
+			if assignedIP.IPNet.IP.Equal(intfIP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			intfIPCopy := intfIP
+			return &intfIPCopy, nil
+		}
+	}
+	return nil, nil
+}
+
+// FindOrphanedIPs locates secondary IPs assigned in EC2 to interfaces
+// created by this plugin which no running pod or namespace on the host is
+// using. The primary address of an interface is never returned. The
+// result includes any IPs held in a warm pool.
+func FindOrphanedIPs() ([]*aws.AllocationResult, error) {
+	free, err := FindFreeIPsAtIndex(0)
+	if err != nil {
+		return nil, err
+	}
+	managed, err := aws.ManagedSecondaryIPs()
+	if err != nil {
+		return nil, err
+	}
+	return orphanedIPs(free, managed), nil
+}
+
+// orphanedIPs returns the free IPs which are also managed secondary IPs
+func orphanedIPs(free []*aws.AllocationResult, managed []net.IP) []*aws.AllocationResult {
+	orphans := []*aws.AllocationResult{}
+	for _, alloc := range free {
+		for _, ip := range managed {
+			if alloc.IP.Equal(ip) {
+				orphans = append(orphans, alloc)
+				break
+			}
+		}
+	}
+	return orphans
 }
@@ -0,0 +1,86 @@
+package cniipvlanvpck8s
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+func TestOrphanedIPs(t *testing.T) {
+	primary := net.ParseIP("10.0.0.10")
+	orphan := net.ParseIP("10.0.0.11")
+	unmanaged := net.ParseIP("10.0.1.12")
+	free := []*aws.AllocationResult{
+		{IP: &primary},
+		{IP: &orphan},
+		{IP: &unmanaged},
+	}
+	managed := []net.IP{net.ParseIP("10.0.0.11"), net.ParseIP("10.0.0.13")}
+
+	orphans := orphanedIPs(free, managed)
+	if len(orphans) != 1 || !orphans[0].IP.Equal(orphan) {
+		t.Fatalf("expected only %v to be orphaned, got %v", orphan, orphans)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	interfaces := []aws.Interface{{
+		Number:     1,
+		SubnetCidr: subnet,
+		IPv4s: []net.IP{
+			net.ParseIP("10.0.0.10"),
+			net.ParseIP("10.0.0.11"),
+			net.ParseIP("10.0.0.12"),
+		},
+	}}
+	bound := []nl.BoundIP{
+		{IPNet: &net.IPNet{IP: net.ParseIP("10.0.0.10")}, Label: "eth1"},
+		{IPNet: &net.IPNet{IP: net.ParseIP("10.0.0.11")}, Label: "eth0"},
+		{IPNet: &net.IPNet{IP: net.ParseIP("10.0.0.20")}, Label: "eth0"},
+		{IPNet: &net.IPNet{IP: net.ParseIP("172.16.0.1")}, Label: "docker0"},
+	}
+	managed := []net.IP{net.ParseIP("10.0.0.11"), net.ParseIP("10.0.0.12")}
+
+	rec := reconcile(interfaces, bound, nil, managed)
+	if len(rec.Orphaned) != 1 || !rec.Orphaned[0].IP.Equal(net.ParseIP("10.0.0.12")) {
+		t.Fatalf("expected only 10.0.0.12 to be orphaned, got %v", rec.Orphaned)
+	}
+	if len(rec.Stale) != 1 || !rec.Stale[0].IP.Equal(net.ParseIP("10.0.0.20")) {
+		t.Fatalf("expected only 10.0.0.20 to be stale, got %v", rec.Stale)
+	}
+}
+
+func TestFreeIPv6s(t *testing.T) {
+	bound, claimed, free := net.ParseIP("2600:1f14::10"), net.ParseIP("2600:1f14::11"), net.ParseIP("2600:1f14::12")
+	interfaces := []aws.Interface{
+		{Number: 0, IPv4s: []net.IP{net.ParseIP("10.0.0.10")}, IPv6s: []net.IP{net.ParseIP("2600:1f14::1")}},
+		{Number: 1, IPv4s: []net.IP{net.ParseIP("10.0.0.11")}, IPv6s: []net.IP{bound, claimed, free}},
+	}
+	assigned := []nl.BoundIP{{IPNet: &net.IPNet{IP: bound, Mask: net.CIDRMask(128, 128)}}}
+	claims := ipClaims{claimed.String(): time.Now().Add(time.Minute)}
+
+	ips := freeIPv6s(interfaces, assigned, claims, 1)
+	if len(ips) != 1 || !ips[0].IP.Equal(free) {
+		t.Fatalf("expected only %v to be free, got %v", free, ips)
+	}
+}
+
+func TestFreeIPsInPrefixes(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("10.0.0.16/28")
+	interfaces := []aws.Interface{{
+		Number:       1,
+		IPv4s:        []net.IP{net.ParseIP("10.0.0.10")},
+		IPv4Prefixes: []*net.IPNet{prefix},
+	}}
+	assigned := []nl.BoundIP{{IPNet: &net.IPNet{IP: net.ParseIP("10.0.0.16"), Mask: net.CIDRMask(32, 32)}}}
+	claims := ipClaims{"10.0.0.17": time.Now().Add(time.Minute)}
+
+	ips := freeIPs(interfaces, assigned, claims, 1)
+	if len(ips) != 15 || !ips[0].IP.Equal(net.ParseIP("10.0.0.10")) || !ips[1].IP.Equal(net.ParseIP("10.0.0.18")) {
+		t.Fatalf("expected 10.0.0.10 and the prefix from 10.0.0.18 to be free, got %v", ips)
+	}
+}
@@ -0,0 +1,75 @@
+package cniipvlanvpck8s
+
+import (
+	"net"
+	"time"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+// heldFile records when each IP held by a DEL may be deallocated. It's
+// covered by the claims lock.
+var heldFile = "/run/cni-ipvlan-vpc-k8s/held.json"
+
+// HoldIPs keeps IPs a DEL freed assigned for delay rather than
+// deallocating them, so pods replacing the deleted ones during churn reuse
+// them without EC2 calls. They're free meanwhile. TakeHeldIPs returns the
+// ones still unused once the delay passed.
+func HoldIPs(ips []net.IP, delay time.Duration) error {
+	return updateClaims(func(ipClaims) error {
+		held := loadIPTimes(heldFile)
+		deadline := time.Now().Add(delay)
+		for _, ip := range ips {
+			held[ip.String()] = deadline
+		}
+		return writeJSONAtomic(heldFile, held)
+	})
+}
+
+// TakeHeldIPs returns the held IPs whose delay has passed without being
+// reused, claiming them so ADDs leave them alone while they're
+// deallocated. The caller releases the claims with ReleaseClaims. Holds of
+// IPs reused meanwhile are dropped, as their next DEL holds them again.
+func TakeHeldIPs() ([]net.IP, error) {
+	return takeHeldIPs(nl.GetIPs)
+}
+
+func takeHeldIPs(boundIPs func() ([]nl.BoundIP, error)) ([]net.IP, error) {
+	var due []net.IP
+	err := updateClaims(func(claims ipClaims) error {
+		held := loadIPTimes(heldFile)
+		if len(held) == 0 {
+			return nil
+		}
+		bound, err := boundIPs()
+		if err != nil {
+			return err
+		}
+		inUse := map[string]bool{}
+		for _, b := range bound {
+			inUse[b.IPNet.IP.String()] = true
+		}
+		for _, r := range loadReservations() {
+			inUse[r.IP] = true
+		}
+
+		now := time.Now()
+		for ip, deadline := range held {
+			if _, claimed := claims[ip]; claimed || inUse[ip] {
+				delete(held, ip)
+				continue
+			}
+			if now.Before(deadline) {
+				continue
+			}
+			delete(held, ip)
+			claims[ip] = now.Add(claimTTL)
+			due = append(due, net.ParseIP(ip))
+		}
+		return writeJSONAtomic(heldFile, held)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return due, nil
+}
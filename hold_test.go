@@ -0,0 +1,45 @@
+package cniipvlanvpck8s
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+func TestTakeHeldIPs(t *testing.T) {
+	defer withTestClaims(t)()
+
+	due, pending, reused, bound := net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.11"), net.ParseIP("10.0.0.12"), net.ParseIP("10.0.0.13")
+	if err := HoldIPs([]net.IP{due, reused, bound}, -time.Second); err != nil {
+		t.Fatalf("Failed to hold IPs: %v", err)
+	}
+	if err := HoldIPs([]net.IP{pending}, time.Minute); err != nil {
+		t.Fatalf("Failed to hold %v: %v", pending, err)
+	}
+	// Reused by other pods during the delay
+	if err := ClaimIP(reused); err != nil {
+		t.Fatalf("Failed to claim %v: %v", reused, err)
+	}
+	boundIPs := func() ([]nl.BoundIP, error) {
+		return []nl.BoundIP{{IPNet: &net.IPNet{IP: bound}, Label: "eth0"}}, nil
+	}
+
+	ips, err := takeHeldIPs(boundIPs)
+	if err != nil || len(ips) != 1 || !ips[0].Equal(due) {
+		t.Fatalf("expected only %v to be due, got %v: %v", due, ips, err)
+	}
+	claims, err := claimedIPs()
+	if err != nil {
+		t.Fatalf("Failed to load claims: %v", err)
+	}
+	if _, ok := claims[due.String()]; !ok {
+		t.Errorf("expected %v to be claimed while it's deallocated", due)
+	}
+
+	held := loadIPTimes(heldFile)
+	if _, ok := held[pending.String()]; len(held) != 1 || !ok {
+		t.Errorf("expected only %v to stay held, got %v", pending, held)
+	}
+}
@@ -0,0 +1,115 @@
+package cniipvlanvpck8s
+
+import (
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+// ManagedIP is a secondary IP on an interface created by this plugin, with
+// the attachment recorded for it, if any
+type ManagedIP struct {
+	IP           string `json:"ip"`
+	Adapter      string `json:"adapter,omitempty"`
+	InterfaceID  string `json:"interfaceId,omitempty"`
+	SubnetID     string `json:"subnetId,omitempty"`
+	InUse        bool   `json:"inUse"`
+	ContainerID  string `json:"containerId,omitempty"`
+	IfName       string `json:"ifName,omitempty"`
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+}
+
+// ListManagedIPs returns every secondary IP EC2 assigns to interfaces
+// created by this plugin, whether it's bound in a namespace on the host,
+// and the attachment ADD recorded it for
+func ListManagedIPs() ([]ManagedIP, error) {
+	managed, err := aws.ManagedSecondaryIPs()
+	if err != nil {
+		return nil, err
+	}
+	interfaces, err := aws.GetInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	bound, err := nl.GetIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := acquireLocks(DefaultLockTimeout, lockRequest{claimLockName, syscall.LOCK_SH})
+	if err != nil {
+		return nil, err
+	}
+	attachments := loadAttachments()
+	unlock()
+
+	return listManagedIPs(managed, interfaces, bound, attachments), nil
+}
+
+// listManagedIPs lists the managed IPs in the order of the interfaces they
+// are on. IPs missing from the interfaces, as metadata lags behind EC2,
+// come last.
+func listManagedIPs(managed []net.IP, interfaces []aws.Interface, bound []nl.BoundIP, attachments ipAttachments) []ManagedIP {
+	remaining := map[string]bool{}
+	for _, ip := range managed {
+		remaining[ip.String()] = true
+	}
+
+	var ips []ManagedIP
+	add := func(ip net.IP, intf *aws.Interface) {
+		entry := ManagedIP{IP: ip.String(), InUse: isBound(bound, ip)}
+		if intf != nil {
+			entry.Adapter = intf.LocalName()
+			entry.InterfaceID = intf.ID
+			entry.SubnetID = intf.SubnetID
+		}
+		for key, record := range attachments {
+			if containsString(record.IPs, entry.IP) {
+				entry.ContainerID, entry.IfName = splitAttachmentKey(key)
+				entry.PodNamespace = record.PodNamespace
+				entry.PodName = record.PodName
+				if entry.InterfaceID == "" {
+					entry.InterfaceID = record.InterfaceID
+					entry.SubnetID = record.SubnetID
+				}
+				break
+			}
+		}
+		ips = append(ips, entry)
+		delete(remaining, entry.IP)
+	}
+
+	for i := range interfaces {
+		for _, ip := range interfaces[i].IPv4s {
+			if remaining[ip.String()] {
+				add(ip, &interfaces[i])
+			}
+		}
+	}
+	for _, ip := range managed {
+		if remaining[ip.String()] {
+			add(ip, nil)
+		}
+	}
+	return ips
+}
+
+func splitAttachmentKey(key string) (containerID, ifName string) {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return key, ""
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
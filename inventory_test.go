@@ -0,0 +1,37 @@
+package cniipvlanvpck8s
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+func TestListManagedIPs(t *testing.T) {
+	primary, used, free, lagging := net.ParseIP("10.0.0.4"), net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.11"), net.ParseIP("10.0.0.12")
+	interfaces := []aws.Interface{{
+		ID:       "eni-pods",
+		Number:   1,
+		SubnetID: "subnet-a",
+		IPv4s:    []net.IP{primary, used, free},
+	}}
+	bound := []nl.BoundIP{{IPNet: &net.IPNet{IP: used, Mask: net.CIDRMask(32, 32)}, Label: "eth0"}}
+	attachments := ipAttachments{
+		"container-a/eth0": {IPs: []string{"10.0.0.10"}, InterfaceID: "eni-pods", PodNamespace: "default", PodName: "web"},
+		"container-b/eth0": {IPs: []string{"10.0.0.12"}, InterfaceID: "eni-pods", SubnetID: "subnet-a"},
+	}
+
+	ips := listManagedIPs([]net.IP{lagging, free, used}, interfaces, bound, attachments)
+	expected := []ManagedIP{
+		{IP: "10.0.0.10", Adapter: "eth1", InterfaceID: "eni-pods", SubnetID: "subnet-a", InUse: true,
+			ContainerID: "container-a", IfName: "eth0", PodNamespace: "default", PodName: "web"},
+		{IP: "10.0.0.11", Adapter: "eth1", InterfaceID: "eni-pods", SubnetID: "subnet-a"},
+		// Not in metadata yet, the interface comes from the record
+		{IP: "10.0.0.12", InterfaceID: "eni-pods", SubnetID: "subnet-a", ContainerID: "container-b", IfName: "eth0"},
+	}
+	if !reflect.DeepEqual(ips, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, ips)
+	}
+}
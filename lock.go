@@ -1,17 +1,369 @@
 package cniipvlanvpck8s
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/nightlyone/lockfile"
 )
 
-// LockfileRun wraps execution of a specified function around a file lock
+const (
+	// DefaultLockTimeout bounds how long a lock is waited for when no
+	// timeout is given
+	DefaultLockTimeout = 100 * time.Second
+	// DefaultLockHoldTimeout bounds how long an operation holding a lock
+	// runs when no timeout is set
+	DefaultLockHoldTimeout = 5 * time.Minute
+
+	globalLockName    = "cni-ipvlan-vpc-k8s.flock"
+	interfaceLockName = "cni-ipvlan-vpc-k8s-interfaces.flock"
+	// legacyLockName is the lockfile releases before the flock locks took
+	// for every operation, in the temporary directory. With SetLegacyLock
+	// it's taken along with the global lock, shared or exclusive, so their
+	// invocations still exclude ours while a node is upgraded. It can be
+	// dropped in the next release.
+	legacyLockName = "cni-ipvlan-vpc-k8s.lock"
+)
+
+// Environment variables overriding where lock files are kept, disabling
+// locking and taking the legacy lock, for the tool and processes the
+// plugin starts
+const (
+	LockDirEnv     = "CNI_IPVLAN_LOCK_DIR"
+	DisableLockEnv = "CNI_IPVLAN_DISABLE_LOCK"
+	LegacyLockEnv  = "CNI_IPVLAN_LEGACY_LOCK"
+)
+
+var lockPollInterval = 20 * time.Millisecond
+
+var (
+	lockDir         string
+	lockingEnabled  = true
+	legacyLocking   = false
+	lockHoldTimeout = DefaultLockHoldTimeout
+)
+
+// The legacy lockfile belongs to the process, removing it on the first
+// unlock, so it's shared by the process's holders of the global lock
+var (
+	legacyLockMu      sync.Mutex
+	legacyLockHolders int
+	legacyLock        lockfile.Lockfile
+)
+
+// SetLockDir keeps the lock files in dir rather than the temporary
+// directory, for example when that isn't writable. An empty dir keeps the
+// default, or the directory in CNI_IPVLAN_LOCK_DIR.
+func SetLockDir(dir string) {
+	lockDir = dir
+}
+
+// DisableLocking makes every lock acquire immediately without excluding
+// anything. Concurrent invocations then race on EC2 allocations and the
+// claims, handing the same IP to several pods, so it's only safe when a
+// single invocation runs at a time, as in tests. Setting
+// CNI_IPVLAN_DISABLE_LOCK to 1 has the same effect.
+func DisableLocking(disabled bool) {
+	lockingEnabled = !disabled
+}
+
+// SetLegacyLock makes every holder of the global lock, and so every
+// invocation, also take the lockfile of older releases. It's only needed
+// while a node still runs those, as it serializes all invocations on the
+// node. Setting CNI_IPVLAN_LEGACY_LOCK to 1 has the same effect.
+func SetLegacyLock(enabled bool) {
+	legacyLocking = enabled
+}
+
+// SetLockHoldTimeout bounds how long an operation run by
+// LockfileRunContext, IndexLockfileRun or under IndexLockContext holds its
+// lock, so a stuck invocation can't wedge the node. Zero keeps the
+// default.
+func SetLockHoldTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultLockHoldTimeout
+	}
+	lockHoldTimeout = timeout
+}
+
+// LockEnv returns the environment carrying the lock settings to a child
+// process
+func LockEnv() []string {
+	var env []string
+	if dir := lockDirectory(); dir != os.TempDir() {
+		env = append(env, LockDirEnv+"="+dir)
+	}
+	if !locksEnabled() {
+		env = append(env, DisableLockEnv+"=1")
+	}
+	if legacyLockEnabled() {
+		env = append(env, LegacyLockEnv+"=1")
+	}
+	return env
+}
+
+func lockDirectory() string {
+	if lockDir != "" {
+		return lockDir
+	}
+	if dir := os.Getenv(LockDirEnv); dir != "" {
+		return dir
+	}
+	return os.TempDir()
+}
+
+func locksEnabled() bool {
+	return lockingEnabled && os.Getenv(DisableLockEnv) != "1"
+}
+
+func legacyLockEnabled() bool {
+	return legacyLocking || os.Getenv(LegacyLockEnv) == "1"
+}
+
+// LockTimeoutError is returned when a lock could not be acquired in time.
+// It is temporary, the operation can be retried.
+type LockTimeoutError struct {
+	Name    string
+	Timeout time.Duration
+}
+
+func (e LockTimeoutError) Error() string {
+	return fmt.Sprintf("lock %v not acquired within %v", e.Name, e.Timeout)
+}
+
+// Temporary reports that the operation can be retried
+func (e LockTimeoutError) Temporary() bool {
+	return true
+}
+
+// LockHoldTimeoutError is returned when a function run under a lock
+// failed once its context was cancelled for holding the lock too long.
+// The lock was held until it returned. It is temporary, the operation can
+// be retried.
+type LockHoldTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e LockHoldTimeoutError) Error() string {
+	return fmt.Sprintf("operation holding a lock did not finish within %v", e.Timeout)
+}
+
+// Temporary reports that the operation can be retried
+func (e LockHoldTimeoutError) Temporary() bool {
+	return true
+}
+
+// LockfileRun wraps execution of a specified function around an
+// exclusive lock, excluding every other locked operation on the node. As
+// run can't be cancelled it isn't bounded by the lock hold timeout, so
+// operations making EC2 calls use LockfileRunContext.
 func LockfileRun(run func() error) error {
-	lock, err := lockfile.New(filepath.Join(os.TempDir(), "cni-ipvlan-vpc-k8s.lock"))
+	unlock, err := acquireLocks(DefaultLockTimeout, lockRequest{globalLockName, syscall.LOCK_EX})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return run()
+}
+
+// LockfileRunContext is LockfileRun for a function taking a context, which
+// is cancelled once ctx is done or the lock has been held for the lock
+// hold timeout. The lock is held until run returns, so it must pass the
+// context to every EC2 call and stop when it's done.
+func LockfileRunContext(ctx context.Context, run func(ctx context.Context) error) error {
+	unlock, err := acquireLocks(DefaultLockTimeout, lockRequest{globalLockName, syscall.LOCK_EX})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return runHeld(ctx, run)
+}
+
+// runHeld runs a function holding a lock with a context cancelled once
+// ctx is done or the lock hold timeout passed, turning its failure after
+// the latter into a LockHoldTimeoutError
+func runHeld(ctx context.Context, run func(ctx context.Context) error) error {
+	timeout := lockHoldTimeout
+	held, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := run(held)
+	if err != nil && held.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return LockHoldTimeoutError{Timeout: timeout}
+	}
+	return err
+}
+
+// IndexLock acquires the lock for allocations at an interface index,
+// returning the function releasing it. Allocations at different indexes
+// proceed in parallel, while LockfileRun still excludes all of them. A
+// zero timeout uses DefaultLockTimeout.
+func IndexLock(index int, timeout time.Duration) (func(), error) {
+	return acquireLocks(timeout,
+		lockRequest{globalLockName, syscall.LOCK_SH},
+		lockRequest{fmt.Sprintf("cni-ipvlan-vpc-k8s-index-%d.flock", index), syscall.LOCK_EX})
+}
+
+// IndexLockContext is IndexLock for an operation taking a context. The
+// context returned is cancelled once ctx is done or the lock has been
+// held for the lock hold timeout, and the operation must pass it to every
+// EC2 call. The lock is held until the returned function is called.
+func IndexLockContext(ctx context.Context, index int, timeout time.Duration) (context.Context, func(), error) {
+	unlock, err := IndexLock(index, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	held, cancel := context.WithTimeout(ctx, lockHoldTimeout)
+	return held, func() {
+		cancel()
+		unlock()
+	}, nil
+}
+
+// IndexLockfileRun wraps execution of a function taking a context around
+// IndexLock, bounding it like LockfileRunContext
+func IndexLockfileRun(ctx context.Context, index int, timeout time.Duration, run func(ctx context.Context) error) error {
+	unlock, err := IndexLock(index, timeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return runHeld(ctx, run)
+}
+
+// InterfaceLockfileRun wraps execution of a function around the lock
+// serializing interface creation, which must be held in addition to an
+// IndexLock as interfaces are attached at the next free device index
+func InterfaceLockfileRun(timeout time.Duration, run func() error) error {
+	unlock, err := acquireLocks(timeout, lockRequest{interfaceLockName, syscall.LOCK_EX})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return run()
+}
+
+type lockRequest struct {
+	name string
+	how  int
+}
+
+// acquireLocks takes flock(2) locks in order, waiting at most timeout for
+// all of them. Unlike a lockfile, flock supports shared locks and is
+// released by the kernel if the process dies.
+func acquireLocks(timeout time.Duration, requests ...lockRequest) (func(), error) {
+	if !locksEnabled() {
+		return func() {}, nil
+	}
+	if timeout <= 0 {
+		timeout = DefaultLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	dir := lockDirectory()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	var files []*os.File
+	releaseLegacy := func() {}
+	unlock := func() {
+		for i := len(files) - 1; i >= 0; i-- {
+			syscall.Flock(int(files[i].Fd()), syscall.LOCK_UN)
+			files[i].Close()
+		}
+		releaseLegacy()
+	}
+
+	// The legacy lock is taken first, as older releases take nothing else
+	for _, request := range requests {
+		if request.name == globalLockName && legacyLockEnabled() {
+			release, err := acquireLegacyLock(timeout, deadline)
+			if err != nil {
+				return nil, err
+			}
+			releaseLegacy = release
+			break
+		}
+	}
+
+	for _, request := range requests {
+		file, err := os.OpenFile(filepath.Join(dir, request.name), os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		files = append(files, file)
+
+		for {
+			err = syscall.Flock(int(file.Fd()), request.how|syscall.LOCK_NB)
+			if err == nil {
+				break
+			}
+			if err != syscall.EWOULDBLOCK {
+				unlock()
+				return nil, err
+			}
+			if time.Now().After(deadline) {
+				unlock()
+				return nil, LockTimeoutError{Name: request.name, Timeout: timeout}
+			}
+			time.Sleep(lockPollInterval)
+		}
+	}
+	return unlock, nil
+}
+
+// acquireLegacyLock takes the legacy lockfile unless the process holds it
+// already, waiting until deadline
+func acquireLegacyLock(timeout time.Duration, deadline time.Time) (func(), error) {
+	release := func() {
+		legacyLockMu.Lock()
+		defer legacyLockMu.Unlock()
+		if legacyLockHolders--; legacyLockHolders == 0 {
+			legacyLock.Unlock()
+		}
+	}
+	for {
+		legacyLockMu.Lock()
+		if legacyLockHolders > 0 {
+			legacyLockHolders++
+			legacyLockMu.Unlock()
+			return release, nil
+		}
+		lock, err := lockfile.New(filepath.Join(os.TempDir(), legacyLockName))
+		if err == nil {
+			err = lock.TryLock()
+		}
+		if err == nil {
+			legacyLock = lock
+			legacyLockHolders = 1
+			legacyLockMu.Unlock()
+			return release, nil
+		}
+		legacyLockMu.Unlock()
+
+		if err != lockfile.ErrBusy && err != lockfile.ErrNotExist {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, LockTimeoutError{Name: legacyLockName, Timeout: timeout}
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// lockfileRunNamed wraps execution of a function around a named file
+// lock. Separate names must be used for locks which can be nested, as the
+// lockfile considers a lock already held by this process as acquired.
+func lockfileRunNamed(name string, run func() error) error {
+	if !locksEnabled() {
+		return run()
+	}
+	lock, err := lockfile.New(filepath.Join(lockDirectory(), name))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,247 @@
+package cniipvlanvpck8s
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIndexLocksInParallel(t *testing.T) {
+	unlock, err := IndexLock(1, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to lock index 1: %v", err)
+	}
+	defer unlock()
+
+	// A different index isn't blocked
+	err = IndexLockfileRun(context.Background(), 2, 100*time.Millisecond, func(context.Context) error { return nil })
+	if err != nil {
+		t.Fatalf("Index 2 was blocked by index 1: %v", err)
+	}
+
+	// The same index times out with a temporary error
+	err = IndexLockfileRun(context.Background(), 1, 100*time.Millisecond, func(context.Context) error { return nil })
+	if lockErr, ok := err.(LockTimeoutError); !ok || !lockErr.Temporary() {
+		t.Fatalf("Expected a lock timeout for index 1, got %v", err)
+	}
+}
+
+func TestIndexLockExcludesGlobal(t *testing.T) {
+	unlock, err := IndexLock(3, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to lock index 3: %v", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		LockfileRun(func() error {
+			close(acquired)
+			return nil
+		})
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("Global lock acquired while an index lock was held")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Global lock not acquired after the index lock was released")
+	}
+}
+
+func TestLockfileRunHoldTimeout(t *testing.T) {
+	defer SetLockHoldTimeout(0)
+	SetLockHoldTimeout(100 * time.Millisecond)
+
+	err := LockfileRunContext(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		// Past its cancellation the run still holds the lock
+		if err := IndexLockfileRun(context.Background(), 1, 100*time.Millisecond, func(context.Context) error { return nil }); err == nil {
+			t.Errorf("Lock released before the run returned")
+		}
+		return ctx.Err()
+	})
+	if holdErr, ok := err.(LockHoldTimeoutError); !ok || !holdErr.Temporary() {
+		t.Fatalf("Expected a lock hold timeout, got %v", err)
+	}
+
+	// A run which succeeds regardless isn't failed
+	err = IndexLockfileRun(context.Background(), 1, 100*time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected the run's result, got %v", err)
+	}
+
+	// The context of an index lock is bounded too
+	ctx, unlock, err := IndexLockContext(context.Background(), 1, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Lock still held after the timeout: %v", err)
+	}
+	defer unlock()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("The context of the index lock wasn't cancelled")
+	}
+}
+
+func TestLockDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locks")
+	if err != nil {
+		t.Fatalf("Failed to create lock dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetLockDir("")
+	SetLockDir(filepath.Join(dir, "nested"))
+
+	if err := LockfileRun(func() error { return nil }); err != nil {
+		t.Fatalf("Failed to lock in %v: %v", dir, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nested", globalLockName)); err != nil {
+		t.Fatalf("lock file not created in the lock dir: %v", err)
+	}
+	if env := LockEnv(); len(env) != 1 || env[0] != LockDirEnv+"="+filepath.Join(dir, "nested") {
+		t.Fatalf("lock dir not passed on in %v", env)
+	}
+}
+
+func TestDisableLocking(t *testing.T) {
+	unlock, err := IndexLock(4, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to lock index 4: %v", err)
+	}
+	defer unlock()
+
+	DisableLocking(true)
+	defer DisableLocking(false)
+	err = IndexLockfileRun(context.Background(), 4, 100*time.Millisecond, func(context.Context) error { return nil })
+	if err != nil {
+		t.Fatalf("Disabled lock was waited for: %v", err)
+	}
+	if env := LockEnv(); len(env) != 1 || env[0] != DisableLockEnv+"=1" {
+		t.Fatalf("disabled locking not passed on in %v", env)
+	}
+}
+
+func TestLegacyLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locks")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oldTmpDir := os.Getenv("TMPDIR")
+	defer os.Setenv("TMPDIR", oldTmpDir)
+	os.Setenv("TMPDIR", dir)
+	legacy := filepath.Join(dir, legacyLockName)
+
+	// Held by an older release's invocation, here init's, which is
+	// ignored unless enabled
+	if err := ioutil.WriteFile(legacy, []byte("1\n"), 0644); err != nil {
+		t.Fatalf("Failed to write the legacy lock: %v", err)
+	}
+	err = IndexLockfileRun(context.Background(), 1, 100*time.Millisecond, func(context.Context) error { return nil })
+	if err != nil {
+		t.Fatalf("Expected the legacy lock to be ignored by default, got %v", err)
+	}
+	SetLegacyLock(true)
+	defer SetLegacyLock(false)
+	err = IndexLockfileRun(context.Background(), 1, 100*time.Millisecond, func(context.Context) error { return nil })
+	if lockErr, ok := err.(LockTimeoutError); !ok || lockErr.Name != legacyLockName {
+		t.Fatalf("Expected the legacy lock to be waited for, got %v", err)
+	}
+	os.Remove(legacy)
+
+	// Nested holders share it, the last one removes it
+	unlock, err := IndexLock(1, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to lock index 1: %v", err)
+	}
+	err = IndexLockfileRun(context.Background(), 2, 100*time.Millisecond, func(context.Context) error {
+		if _, err := os.Stat(legacy); err != nil {
+			t.Errorf("legacy lock not held: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Index 2 was blocked by index 1: %v", err)
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		t.Errorf("legacy lock released while index 1 holds it: %v", err)
+	}
+	unlock()
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("legacy lock not released: %v", err)
+	}
+}
+
+// lockHelperEnv makes the test binary hold the lock of an index, as
+// another invocation on the node would
+const lockHelperEnv = "CNI_IPVLAN_LOCK_HELPER_INDEX"
+
+// TestLockHelper holds an index lock until its stdin is closed when run
+// by TestIndexLocksAcrossProcesses
+func TestLockHelper(t *testing.T) {
+	index, err := strconv.Atoi(os.Getenv(lockHelperEnv))
+	if err != nil {
+		t.Skip("only run as a helper process")
+	}
+	unlock, err := IndexLock(index, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to lock index %d: %v", index, err)
+	}
+	defer unlock()
+	os.Stdout.WriteString("locked\n")
+	ioutil.ReadAll(os.Stdin)
+}
+
+func TestIndexLocksAcrossProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locks")
+	if err != nil {
+		t.Fatalf("Failed to create lock dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetLockDir("")
+	SetLockDir(dir)
+
+	helper := exec.Command(os.Args[0], "-test.run=^TestLockHelper$")
+	helper.Env = append(os.Environ(), lockHelperEnv+"=1", LockDirEnv+"="+dir)
+	stdin, err := helper.StdinPipe()
+	if err != nil {
+		t.Fatalf("Failed to create stdin: %v", err)
+	}
+	stdout, err := helper.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Failed to create stdout: %v", err)
+	}
+	if err := helper.Start(); err != nil {
+		t.Fatalf("Failed to start the helper: %v", err)
+	}
+	defer helper.Wait()
+	defer stdin.Close()
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "locked\n" {
+		t.Fatalf("helper didn't lock index 1: %q, %v", line, err)
+	}
+
+	// Another process's index lock only excludes the same index
+	err = IndexLockfileRun(context.Background(), 2, 100*time.Millisecond, func(context.Context) error { return nil })
+	if err != nil {
+		t.Fatalf("Index 2 was blocked by index 1 in another process: %v", err)
+	}
+	err = IndexLockfileRun(context.Background(), 1, 100*time.Millisecond, func(context.Context) error { return nil })
+	if _, ok := err.(LockTimeoutError); !ok {
+		t.Fatalf("Expected a lock timeout for index 1, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package cniipvlanvpck8s
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Fields contains the structured values of a log entry
+type Fields map[string]interface{}
+
+// Logger writes structured log entries to a file, one JSON object per
+// line. A nil Logger discards all entries, so callers don't need to check
+// whether logging is enabled.
+type Logger struct {
+	out io.Writer
+	// file is set when the Logger owns out and closes it
+	file   *os.File
+	fields Fields
+}
+
+// NewLogger opens path for appending, creating it if needed. An empty
+// path returns a nil Logger.
+func NewLogger(path string) (*Logger, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{out: file, file: file, fields: Fields{}}, nil
+}
+
+// NewStreamLogger returns a Logger writing to w, which Close leaves open
+func NewStreamLogger(w io.Writer) *Logger {
+	return &Logger{out: w, fields: Fields{}}
+}
+
+// With returns a Logger which adds key to every entry
+func (l *Logger) With(key string, value interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	fields := Fields{}
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return &Logger{out: l.out, file: l.file, fields: fields}
+}
+
+// Log writes an entry with a message and additional fields. Errors are
+// stored by their message, as error values don't serialize to JSON.
+func (l *Logger) Log(msg string, fields Fields) {
+	if l == nil {
+		return
+	}
+	entry := Fields{}
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["msg"] = msg
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	// A single write per line keeps entries from concurrent plugin
+	// invocations from interleaving in the append-only file
+	_, _ = l.out.Write(append(data, '\n'))
+}
+
+// Close closes the underlying file
+func (l *Logger) Close() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
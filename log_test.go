@@ -0,0 +1,84 @@
+package cniipvlanvpck8s
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cni-log")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cni.log")
+
+	logger, err := NewLogger(path)
+	if err != nil {
+		t.Fatalf("NewLogger returned an error: %v", err)
+	}
+	logger = logger.With("containerID", "abc123")
+	logger.Log("allocated", Fields{"ip": "10.0.0.5"})
+	logger.Log("failed", Fields{"error": fmt.Errorf("no IPs")})
+	logger.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("log file not written: %v", err)
+	}
+	defer file.Close()
+
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if entries[0]["containerID"] != "abc123" || entries[0]["ip"] != "10.0.0.5" || entries[0]["msg"] != "allocated" {
+		t.Fatalf("unexpected first entry %v", entries[0])
+	}
+	if entries[1]["error"] != "no IPs" {
+		t.Fatalf("error not logged by message: %v", entries[1])
+	}
+}
+
+func TestStreamLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewStreamLogger(&out).With("trace", true)
+	logger.Log("aws call", Fields{"operation": "DescribeSubnets"})
+	if err := logger.Close(); err != nil {
+		t.Fatalf("stream logger Close returned an error: %v", err)
+	}
+
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("log line is not JSON: %v", err)
+	}
+	if entry["trace"] != true || entry["operation"] != "DescribeSubnets" {
+		t.Fatalf("unexpected entry %v", entry)
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	logger, err := NewLogger("")
+	if err != nil || logger != nil {
+		t.Fatalf("empty path should return a nil logger")
+	}
+	logger.With("key", "value").Log("discarded", nil)
+	if err := logger.Close(); err != nil {
+		t.Fatalf("nil logger Close returned an error: %v", err)
+	}
+}
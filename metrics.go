@@ -0,0 +1,284 @@
+package cniipvlanvpck8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Metrics are exported as a Prometheus textfile rather than served by the
+// plugin. Every invocation is a short-lived process, so serving metrics
+// would need a long-running daemon the plugin pushes to; that daemon has
+// to be deployed and supervised and pod setup would stall or lose data
+// whenever it is unavailable. A textfile only needs node_exporter's
+// textfile collector (or the tool's serve-metrics command), at the cost
+// of values only changing when the plugin runs and of a small file update
+// per invocation. Counters are kept in a JSON state file next to the
+// textfile and merged under a lock, as invocations run concurrently.
+
+// latencyBuckets are the upper bounds of the EC2 call latency histogram, in seconds
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram contains cumulative bucket counts for latencyBuckets
+type Histogram struct {
+	Buckets []int64 `json:"buckets"`
+	Sum     float64 `json:"sum"`
+	Count   int64   `json:"count"`
+}
+
+func (h *Histogram) observe(seconds float64) {
+	if len(h.Buckets) != len(latencyBuckets) {
+		h.Buckets = make([]int64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.Buckets[i]++
+		}
+	}
+	h.Sum += seconds
+	h.Count++
+}
+
+func (h *Histogram) merge(other *Histogram) {
+	if len(h.Buckets) != len(latencyBuckets) {
+		h.Buckets = make([]int64, len(latencyBuckets))
+	}
+	for i := range other.Buckets {
+		if i < len(h.Buckets) {
+			h.Buckets[i] += other.Buckets[i]
+		}
+	}
+	h.Sum += other.Sum
+	h.Count += other.Count
+}
+
+// Metrics contains counters accumulated across plugin invocations
+type Metrics struct {
+	Allocations        int64                 `json:"allocations"`
+	AllocationFailures map[string]int64      `json:"allocationFailures"`
+	InterfacesCreated  int64                 `json:"interfacesCreated"`
+	Deallocations      int64                 `json:"deallocations"`
+	EC2Errors          map[string]int64      `json:"ec2Errors"`
+	EC2Latency         map[string]*Histogram `json:"ec2Latency"`
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		AllocationFailures: map[string]int64{},
+		EC2Errors:          map[string]int64{},
+		EC2Latency:         map[string]*Histogram{},
+	}
+}
+
+func (m *Metrics) merge(other *Metrics) {
+	m.Allocations += other.Allocations
+	m.InterfacesCreated += other.InterfacesCreated
+	m.Deallocations += other.Deallocations
+	for reason, count := range other.AllocationFailures {
+		m.AllocationFailures[reason] += count
+	}
+	for operation, count := range other.EC2Errors {
+		m.EC2Errors[operation] += count
+	}
+	for operation, histogram := range other.EC2Latency {
+		if m.EC2Latency[operation] == nil {
+			m.EC2Latency[operation] = &Histogram{}
+		}
+		m.EC2Latency[operation].merge(histogram)
+	}
+}
+
+func sortedKeys(counters map[string]int64) []string {
+	var keys []string
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteText renders the metrics in the Prometheus text exposition format
+func (m *Metrics) WriteText(w io.Writer) error {
+	var err error
+	printf := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+
+	printf("# HELP cni_ipvlan_vpc_k8s_allocations_total Successful IP allocations.\n")
+	printf("# TYPE cni_ipvlan_vpc_k8s_allocations_total counter\n")
+	printf("cni_ipvlan_vpc_k8s_allocations_total %d\n", m.Allocations)
+
+	printf("# HELP cni_ipvlan_vpc_k8s_allocation_failures_total Failed IP allocations by reason.\n")
+	printf("# TYPE cni_ipvlan_vpc_k8s_allocation_failures_total counter\n")
+	for _, reason := range sortedKeys(m.AllocationFailures) {
+		printf("cni_ipvlan_vpc_k8s_allocation_failures_total{reason=%q} %d\n", reason, m.AllocationFailures[reason])
+	}
+
+	printf("# HELP cni_ipvlan_vpc_k8s_interfaces_created_total Elastic network interfaces created.\n")
+	printf("# TYPE cni_ipvlan_vpc_k8s_interfaces_created_total counter\n")
+	printf("cni_ipvlan_vpc_k8s_interfaces_created_total %d\n", m.InterfacesCreated)
+
+	printf("# HELP cni_ipvlan_vpc_k8s_deallocations_total IPs released back to EC2.\n")
+	printf("# TYPE cni_ipvlan_vpc_k8s_deallocations_total counter\n")
+	printf("cni_ipvlan_vpc_k8s_deallocations_total %d\n", m.Deallocations)
+
+	printf("# HELP cni_ipvlan_vpc_k8s_ec2_errors_total Failed EC2 API calls by operation.\n")
+	printf("# TYPE cni_ipvlan_vpc_k8s_ec2_errors_total counter\n")
+	for _, operation := range sortedKeys(m.EC2Errors) {
+		printf("cni_ipvlan_vpc_k8s_ec2_errors_total{operation=%q} %d\n", operation, m.EC2Errors[operation])
+	}
+
+	printf("# HELP cni_ipvlan_vpc_k8s_ec2_call_duration_seconds Latency of EC2 API calls by operation.\n")
+	printf("# TYPE cni_ipvlan_vpc_k8s_ec2_call_duration_seconds histogram\n")
+	var operations []string
+	for operation := range m.EC2Latency {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	for _, operation := range operations {
+		histogram := m.EC2Latency[operation]
+		for i, bound := range latencyBuckets {
+			var count int64
+			if i < len(histogram.Buckets) {
+				count = histogram.Buckets[i]
+			}
+			printf("cni_ipvlan_vpc_k8s_ec2_call_duration_seconds_bucket{operation=%q,le=\"%g\"} %d\n", operation, bound, count)
+		}
+		printf("cni_ipvlan_vpc_k8s_ec2_call_duration_seconds_bucket{operation=%q,le=\"+Inf\"} %d\n", operation, histogram.Count)
+		printf("cni_ipvlan_vpc_k8s_ec2_call_duration_seconds_sum{operation=%q} %g\n", operation, histogram.Sum)
+		printf("cni_ipvlan_vpc_k8s_ec2_call_duration_seconds_count{operation=%q} %d\n", operation, histogram.Count)
+	}
+
+	return err
+}
+
+// MetricsRecorder collects the metrics of a single invocation. A nil
+// recorder, as returned for an empty path, discards everything.
+type MetricsRecorder struct {
+	path  string
+	delta *Metrics
+}
+
+// NewMetricsRecorder returns a recorder which merges into the textfile
+// at path when flushed, or nil if path is empty
+func NewMetricsRecorder(path string) *MetricsRecorder {
+	if path == "" {
+		return nil
+	}
+	return &MetricsRecorder{path: path, delta: newMetrics()}
+}
+
+// AllocationSucceeded counts a successful allocation
+func (r *MetricsRecorder) AllocationSucceeded() {
+	if r != nil {
+		r.delta.Allocations++
+	}
+}
+
+// AllocationFailed counts a failed allocation with a short reason
+func (r *MetricsRecorder) AllocationFailed(reason string) {
+	if r != nil {
+		r.delta.AllocationFailures[reason]++
+	}
+}
+
+// InterfaceCreated counts a newly created interface
+func (r *MetricsRecorder) InterfaceCreated() {
+	if r != nil {
+		r.delta.InterfacesCreated++
+	}
+}
+
+// Deallocated counts IPs released back to EC2
+func (r *MetricsRecorder) Deallocated(count int) {
+	if r != nil {
+		r.delta.Deallocations += int64(count)
+	}
+}
+
+// ObserveEC2Call records the latency and outcome of an EC2 call. It
+// matches aws.CallObserver.
+func (r *MetricsRecorder) ObserveEC2Call(operation string, duration time.Duration, err error) {
+	if r == nil {
+		return
+	}
+	if r.delta.EC2Latency[operation] == nil {
+		r.delta.EC2Latency[operation] = &Histogram{}
+	}
+	r.delta.EC2Latency[operation].observe(duration.Seconds())
+	if err != nil {
+		r.delta.EC2Errors[operation]++
+	}
+}
+
+// Flush merges the recorded metrics into the node's totals and rewrites
+// the textfile
+func (r *MetricsRecorder) Flush() error {
+	if r == nil {
+		return nil
+	}
+	return lockfileRunNamed("cni-ipvlan-vpc-k8s-metrics.lock", func() error {
+		totals := newMetrics()
+		statePath := r.path + ".json"
+		data, err := ioutil.ReadFile(statePath)
+		if err == nil {
+			if err := json.Unmarshal(data, totals); err != nil {
+				// Start over rather than failing every invocation
+				totals = newMetrics()
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		totals.merge(r.delta)
+		r.delta = newMetrics()
+
+		data, err = json.Marshal(totals)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(statePath, data); err != nil {
+			return err
+		}
+		return writeFileAtomicWith(r.path, totals.WriteText)
+	})
+}
+
+// writeFileAtomic replaces the file at path with data, so readers never
+// observe a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	return writeFileAtomicWith(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func writeFileAtomicWith(path string, write func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
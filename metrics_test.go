@@ -0,0 +1,64 @@
+package cniipvlanvpck8s
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsRecorderFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cni-metrics")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cni.prom")
+
+	// Two invocations accumulate into the same file
+	for i := 0; i < 2; i++ {
+		recorder := NewMetricsRecorder(path)
+		recorder.AllocationSucceeded()
+		recorder.AllocationFailed("InsufficientFreeAddressesInSubnet")
+		recorder.ObserveEC2Call("AssignPrivateIpAddresses", 300*time.Millisecond, nil)
+		recorder.ObserveEC2Call("AssignPrivateIpAddresses", 3*time.Second, fmt.Errorf("failed"))
+		if err := recorder.Flush(); err != nil {
+			t.Fatalf("Flush returned an error: %v", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("metrics textfile not written: %v", err)
+	}
+	text := string(data)
+	for _, expected := range []string{
+		"cni_ipvlan_vpc_k8s_allocations_total 2\n",
+		"cni_ipvlan_vpc_k8s_allocation_failures_total{reason=\"InsufficientFreeAddressesInSubnet\"} 2\n",
+		"cni_ipvlan_vpc_k8s_ec2_errors_total{operation=\"AssignPrivateIpAddresses\"} 2\n",
+		"cni_ipvlan_vpc_k8s_ec2_call_duration_seconds_bucket{operation=\"AssignPrivateIpAddresses\",le=\"0.5\"} 2\n",
+		"cni_ipvlan_vpc_k8s_ec2_call_duration_seconds_bucket{operation=\"AssignPrivateIpAddresses\",le=\"+Inf\"} 4\n",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Fatalf("metrics missing %q:\n%s", expected, text)
+		}
+	}
+}
+
+func TestNilMetricsRecorder(t *testing.T) {
+	recorder := NewMetricsRecorder("")
+	recorder.AllocationSucceeded()
+	recorder.ObserveEC2Call("DescribeSubnets", time.Second, nil)
+	if err := recorder.Flush(); err != nil {
+		t.Fatalf("nil recorder returned an error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := newMetrics().WriteText(&buf); err != nil {
+		t.Fatalf("WriteText returned an error: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package nl
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// shapingLatency bounds how long packets queue in the token bucket
+// before they're dropped, in seconds
+const shapingLatency = 0.025
+
+// ifbName returns the name of the device the ingress of a link is shaped
+// on, within the kernel's 15 character limit
+func ifbName(name string) string {
+	ifb := "ifb-" + name
+	if len(ifb) > 15 {
+		ifb = ifb[:15]
+	}
+	return ifb
+}
+
+// ShapeBandwidth limits the traffic leaving and entering the link to the
+// rates in kbit/s, zero leaving a direction unlimited. Egress is shaped by
+// a token bucket filter on the link. Ingress is redirected to an ifb
+// device, which shapes it the same way. It must be called in the link's
+// namespace.
+func ShapeBandwidth(name string, egressKbps, ingressKbps int) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+
+	if egressKbps > 0 {
+		if err := netlink.QdiscAdd(tokenBucket(link, egressKbps)); err != nil {
+			return fmt.Errorf("unable to shape the egress of %v: %v", name, err)
+		}
+	}
+	if ingressKbps > 0 {
+		if err := shapeIngress(link, ingressKbps); err != nil {
+			return fmt.Errorf("unable to shape the ingress of %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func shapeIngress(link netlink.Link, kbps int) error {
+	ifb := &netlink.Ifb{LinkAttrs: netlink.LinkAttrs{
+		Name:  ifbName(link.Attrs().Name),
+		Flags: net.FlagUp,
+		MTU:   link.Attrs().MTU,
+	}}
+	if err := netlink.LinkAdd(ifb); err != nil {
+		return err
+	}
+	ifbLink, err := netlink.LinkByName(ifb.Name)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(ifbLink); err != nil {
+		return err
+	}
+	if err := netlink.QdiscAdd(tokenBucket(ifbLink, kbps)); err != nil {
+		return err
+	}
+
+	ingress := &netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    netlink.MakeHandle(0xffff, 0),
+		Parent:    netlink.HANDLE_INGRESS,
+	}}
+	if err := netlink.QdiscAdd(ingress); err != nil {
+		return err
+	}
+	redirect := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId: netlink.MakeHandle(1, 1),
+		Actions: []netlink.Action{&netlink.MirredAction{
+			MirredAction: netlink.TCA_EGRESS_REDIR,
+			Ifindex:      ifbLink.Attrs().Index,
+		}},
+	}
+	return netlink.FilterAdd(redirect)
+}
+
+// RemoveBandwidthShaping removes the ifb device ShapeBandwidth created for
+// the link, if any. The link's own qdiscs go away with it.
+func RemoveBandwidthShaping(name string) error {
+	ifb, err := netlink.LinkByName(ifbName(name))
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(ifb)
+}
+
+// tokenBucket returns the root qdisc limiting the link to kbps, with a
+// burst of at least a packet
+func tokenBucket(link netlink.Link, kbps int) *netlink.Tbf {
+	rate := uint64(kbps) * 1000 / 8
+	burst := uint32(rate / 100)
+	mtu := uint32(link.Attrs().MTU)
+	if mtu == 0 {
+		mtu = 1500
+	}
+	if burst < mtu {
+		burst = mtu
+	}
+	return &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rate,
+		Limit:  uint32(float64(rate)*shapingLatency) + burst,
+		Buffer: netlink.Xmittime(rate, burst),
+	}
+}
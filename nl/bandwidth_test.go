@@ -0,0 +1,54 @@
+package nl
+
+import (
+	"os"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestTokenBucket(t *testing.T) {
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Index: 7, MTU: 9001}}
+
+	// 800 kbit/s is 100 kB/s, whose 10ms worth is below the MTU
+	tbf := tokenBucket(link, 800)
+	if tbf.Rate != 100000 || tbf.Limit != 2500+9001 || tbf.LinkIndex != 7 {
+		t.Fatalf("unexpected qdisc %+v", tbf)
+	}
+	tbf = tokenBucket(link, 8000000)
+	if tbf.Limit != 25000000+10000000 {
+		t.Fatalf("expected a burst of 10ms, got %+v", tbf)
+	}
+}
+
+func TestIfbName(t *testing.T) {
+	if name := ifbName("eth0"); name != "ifb-eth0" {
+		t.Fatalf("unexpected name %v", name)
+	}
+	if name := ifbName("a-very-long-name"); len(name) != 15 {
+		t.Fatalf("expected the name to be truncated, got %v", name)
+	}
+}
+
+func TestShapeBandwidth(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	CreateTestInterface("lyft5")
+	defer RemoveInterface("lyft5")
+
+	if err := ShapeBandwidth("lyft5", 1000, 2000); err != nil {
+		t.Fatalf("Failed to ShapeBandwidth lyft5: %v", err)
+	}
+	if _, err := netlink.LinkByName(ifbName("lyft5")); err != nil {
+		t.Fatalf("ifb of lyft5 wasn't created: %v", err)
+	}
+	if err := RemoveBandwidthShaping("lyft5"); err != nil {
+		t.Fatalf("Failed to RemoveBandwidthShaping lyft5: %v", err)
+	}
+	if err := RemoveBandwidthShaping("lyft5"); err != nil {
+		t.Fatalf("RemoveBandwidthShaping isn't idempotent: %v", err)
+	}
+}
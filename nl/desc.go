@@ -26,7 +26,7 @@ func getIpsOnHandle(handle *netlink.Handle) ([]BoundIP, error) {
 	}
 
 	for _, link := range links {
-		addrs, err := handle.AddrList(link, netlink.FAMILY_V4)
+		addrs, err := handle.AddrList(link, netlink.FAMILY_ALL)
 		if err != nil {
 			return nil, err
 		}
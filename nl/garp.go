@@ -0,0 +1,80 @@
+package nl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	arpHardwareEthernet = 1
+	arpRequest          = 1
+)
+
+// SendGratuitousARP broadcasts an ARP announcement of ip from the link, so
+// neighbors holding a stale entry for it learn the link's MAC right away
+func SendGratuitousARP(name string, ip net.IP) error {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return fmt.Errorf("%v is not an IPv4 address", ip)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	mac := link.Attrs().HardwareAddr
+	if len(mac) != 6 {
+		return fmt.Errorf("%v has no Ethernet address", name)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  link.Attrs().Index,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], broadcastMAC)
+	return syscall.Sendto(fd, garpFrame(mac, ip4), 0, addr)
+}
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// garpFrame returns the Ethernet frame of an ARP request for ip sent from
+// it, which every neighbor updates its entry from
+func garpFrame(mac net.HardwareAddr, ip net.IP) []byte {
+	return arpRequestFrame(mac, ip, ip)
+}
+
+// arpRequestFrame returns the broadcast Ethernet frame of an ARP request
+// for target sent from the sender IP at mac
+func arpRequestFrame(mac net.HardwareAddr, sender, target net.IP) []byte {
+	frame := make([]byte, 0, 42)
+	frame = append(frame, broadcastMAC...)
+	frame = append(frame, mac...)
+	frame = append(frame, 0, 0)
+	binary.BigEndian.PutUint16(frame[12:], syscall.ETH_P_ARP)
+
+	arp := make([]byte, 8)
+	binary.BigEndian.PutUint16(arp[0:], arpHardwareEthernet)
+	binary.BigEndian.PutUint16(arp[2:], syscall.ETH_P_IP)
+	arp[4], arp[5] = 6, 4
+	binary.BigEndian.PutUint16(arp[6:], arpRequest)
+	frame = append(frame, arp...)
+	frame = append(frame, mac...)
+	frame = append(frame, sender...)
+	frame = append(frame, make([]byte, 6)...)
+	return append(frame, target...)
+}
+
+// htons converts to network byte order on the little endian hosts EC2 runs
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,42 @@
+package nl
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestGarpFrame(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	frame := garpFrame(mac, net.ParseIP("10.0.0.10").To4())
+
+	expected := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0x42, 0xac, 0x11, 0x00, 0x02, 0x08, 0x06,
+		0x00, 0x01, 0x08, 0x00, 6, 4, 0x00, 0x01,
+		0x02, 0x42, 0xac, 0x11, 0x00, 0x02, 10, 0, 0, 10,
+		0, 0, 0, 0, 0, 0, 10, 0, 0, 10,
+	}
+	if !bytes.Equal(frame, expected) {
+		t.Fatalf("expected frame %x, got %x", expected, frame)
+	}
+}
+
+func TestIsARPReply(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	ip, gateway := net.ParseIP("10.0.0.10").To4(), net.ParseIP("10.0.0.1").To4()
+
+	reply := arpRequestFrame(mac, gateway, ip)
+	reply[21] = arpReply
+	if !isARPReply(reply, gateway, ip) {
+		t.Fatalf("reply from the gateway not recognized")
+	}
+	if isARPReply(reply, ip, gateway) {
+		t.Fatalf("reply from another sender recognized")
+	}
+	if isARPReply(arpRequestFrame(mac, gateway, ip), gateway, ip) {
+		t.Fatalf("request recognized as a reply")
+	}
+	if isARPReply(reply[:30], gateway, ip) {
+		t.Fatalf("truncated frame recognized")
+	}
+}
@@ -0,0 +1,58 @@
+package nl
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// LinkNameByMac returns the name of the link with a hardware address.
+// Kernel enumeration order doesn't necessarily match the EC2 device index,
+// so an ENI's link is best found by its MAC rather than assuming ethN.
+func LinkNameByMac(mac string) (string, error) {
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", err
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return "", err
+	}
+	for _, link := range links {
+		if link.Attrs().HardwareAddr.String() == hwAddr.String() {
+			// ipvlan links share their master's MAC
+			if _, ok := link.(*netlink.IPVlan); ok {
+				continue
+			}
+			return link.Attrs().Name, nil
+		}
+	}
+	return "", fmt.Errorf("no link with MAC %v", mac)
+}
+
+// LinkNameByMacPoll waits up to timeout for a link with a hardware address
+// to appear, checking every interval. Zero values use the UpInterfacePoll
+// defaults.
+func LinkNameByMacPoll(mac string, timeout, interval time.Duration) (string, error) {
+	if timeout <= 0 {
+		timeout = interfaceSettleDeadline
+	}
+	if interval <= 0 {
+		interval = interfaceSettleWaitTime
+	}
+
+	var lastErr error
+	start := time.Now()
+	for ; time.Since(start) <= timeout; time.Sleep(interval) {
+		var name string
+		name, lastErr = LinkNameByMac(mac)
+		if lastErr == nil {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("link for MAC %v was not found after %v: %v",
+		mac, time.Since(start).Round(time.Millisecond), lastErr)
+}
@@ -0,0 +1,43 @@
+package nl
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestLinkNameByMac(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	mac, _ := net.ParseMAC("0a:1f:00:00:00:01")
+	dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{
+		Name:         "lyft4",
+		HardwareAddr: mac,
+	}}
+	if err := netlink.LinkAdd(dummy); err != nil {
+		t.Fatalf("Could not add %s: %v", dummy.Name, err)
+	}
+	defer RemoveInterface("lyft4")
+
+	name, err := LinkNameByMac("0A:1F:00:00:00:01")
+	if err != nil {
+		t.Fatalf("Failed to find link by MAC: %v", err)
+	}
+	if name != "lyft4" {
+		t.Fatalf("Expected lyft4, got %v", name)
+	}
+}
+
+func TestLinkNameByMacMissing(t *testing.T) {
+	if _, err := LinkNameByMac("0a:1f:00:00:00:ff"); err == nil {
+		t.Fatalf("Found a link for an unused MAC")
+	}
+	if _, err := LinkNameByMac("not-a-mac"); err == nil {
+		t.Fatalf("Invalid MAC was accepted")
+	}
+}
@@ -0,0 +1,76 @@
+package nl
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// GatewayMAC returns the MAC the host's neighbor table holds for gateway
+// on the link, or nil when the host hasn't resolved it yet
+func GatewayMAC(name string, gateway net.IP) (net.HardwareAddr, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	for _, neigh := range neighs {
+		if !neigh.IP.Equal(gateway) || len(neigh.HardwareAddr) != 6 {
+			continue
+		}
+		if neigh.State&(netlink.NUD_INCOMPLETE|netlink.NUD_FAILED) != 0 {
+			continue
+		}
+		return neigh.HardwareAddr, nil
+	}
+	return nil, nil
+}
+
+// PreseedNeighbor adds a permanent neighbor entry mapping ip to mac on the
+// link, replacing any entry a previous ADD left
+func PreseedNeighbor(name string, ip net.IP, mac net.HardwareAddr) error {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return fmt.Errorf("%v is not an IPv4 address", ip)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlink.NeighSet(&netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       netlink.FAMILY_V4,
+		State:        netlink.NUD_PERMANENT,
+		IP:           ip4,
+		HardwareAddr: mac,
+	})
+}
+
+// RemovePermanentNeighbors removes the permanent IPv4 neighbor entries of
+// the link. A missing link has none.
+func RemovePermanentNeighbors(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for i := range neighs {
+		if neighs[i].State&netlink.NUD_PERMANENT == 0 {
+			continue
+		}
+		if err := netlink.NeighDel(&neighs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package nl
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestPreseedNeighbor(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	CreateTestInterface("lyft8")
+	defer RemoveInterface("lyft8")
+
+	gateway := net.ParseIP("10.99.0.1")
+	if mac, err := GatewayMAC("lyft8", gateway); err != nil || mac != nil {
+		t.Fatalf("expected no MAC before the gateway is known, got %v, %v", mac, err)
+	}
+
+	mac, _ := net.ParseMAC("02:42:ac:11:00:01")
+	// Seeding twice, as a retried ADD does, replaces the entry
+	for i := 0; i < 2; i++ {
+		if err := PreseedNeighbor("lyft8", gateway, mac); err != nil {
+			t.Fatalf("Failed to preseed the neighbor: %v", err)
+		}
+	}
+	if found, err := GatewayMAC("lyft8", gateway); err != nil || found.String() != mac.String() {
+		t.Fatalf("expected %v, got %v, %v", mac, found, err)
+	}
+
+	if err := RemovePermanentNeighbors("lyft8"); err != nil {
+		t.Fatalf("Failed to remove the neighbors: %v", err)
+	}
+	if found, err := GatewayMAC("lyft8", gateway); err != nil || found != nil {
+		t.Errorf("expected the entry to be removed, got %v, %v", found, err)
+	}
+	if err := RemovePermanentNeighbors("lyft-missing"); err != nil {
+		t.Errorf("expected a missing link to have no neighbors, got %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package nl
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// policyTableBase is the routing table of the interface at device index
+// 0. The table of every other interface is offset by its index.
+const policyTableBase = 10000
+
+// PolicyRulePriority is the priority of the rules from Pod IPs. The kernel
+// numbers rules added without a priority, such as unnumbered-ptp's, below
+// it, so those are looked up first.
+const PolicyRulePriority = 32765
+
+// PolicyRule is a rule AddPolicyRoute added, recorded so DEL removes
+// exactly it
+type PolicyRule struct {
+	IP       string `json:"ip"`
+	Table    int    `json:"table"`
+	Priority int    `json:"priority"`
+}
+
+// PolicyTable returns the routing table of the interface at the device
+// index
+func PolicyTable(number int) int {
+	return policyTableBase + number
+}
+
+// AddPolicyRoute makes traffic from ip egress the master, by a rule
+// looking it up in table and a default route there via the gateway of the
+// master's subnet. The master has no address in the subnet, so the route
+// is on-link. The table is shared by the Pods on the master.
+func AddPolicyRoute(master string, table int, ip, gateway net.IP) (PolicyRule, error) {
+	added := PolicyRule{IP: ip.String(), Table: table, Priority: PolicyRulePriority}
+	link, err := netlink.LinkByName(master)
+	if err != nil {
+		return added, err
+	}
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Gw:        gateway,
+		Table:     table,
+		Flags:     int(netlink.FLAG_ONLINK),
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return added, fmt.Errorf("unable to add the default route of table %d: %v", table, err)
+	}
+
+	// A retried ADD replaces the rule it added before
+	if err := RemovePolicyRules(ip); err != nil {
+		return added, err
+	}
+	if err := netlink.RuleAdd(added.rule()); err != nil {
+		return added, fmt.Errorf("unable to add the rule from %v: %v", ip, err)
+	}
+	return added, nil
+}
+
+// RemovePolicyRule removes the rule, and the routes of its table once no
+// other rule looks the table up. A rule which is already gone isn't an
+// error.
+func RemovePolicyRule(rule PolicyRule) error {
+	ip := net.ParseIP(rule.IP)
+	if ip == nil {
+		return fmt.Errorf("policy rule from %q isn't an IP address", rule.IP)
+	}
+	if err := netlink.RuleDel(rule.rule()); err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("unable to remove the rule from %v: %v", ip, err)
+	}
+
+	rules, err := netlink.RuleList(family(ip))
+	if err != nil {
+		return err
+	}
+	for _, other := range rules {
+		if other.Table == rule.Table {
+			return nil
+		}
+	}
+	routes, err := netlink.RouteListFiltered(family(ip), &netlink.Route{Table: rule.Table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for i := range routes {
+		if err := netlink.RouteDel(&routes[i]); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("unable to remove the routes of table %d: %v", rule.Table, err)
+		}
+	}
+	return nil
+}
+
+// RemovePolicyRules removes every rule from ip at PolicyRulePriority, for
+// attachments whose rules weren't recorded. Tables are left alone.
+func RemovePolicyRules(ip net.IP) error {
+	rules, err := netlink.RuleList(family(ip))
+	if err != nil {
+		return err
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Priority != PolicyRulePriority || rule.Src == nil || !rule.Src.IP.Equal(ip) {
+			continue
+		}
+		if err := netlink.RuleDel(rule); err != nil && err != syscall.ENOENT {
+			return fmt.Errorf("unable to remove the rule from %v: %v", ip, err)
+		}
+	}
+	return nil
+}
+
+func (r PolicyRule) rule() *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Src = hostNet(net.ParseIP(r.IP))
+	rule.Table = r.Table
+	rule.Priority = r.Priority
+	return rule
+}
+
+func family(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+// hostNet returns the network of ip alone
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
@@ -0,0 +1,126 @@
+package nl
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestPolicyRoute(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft6"}}
+	if err := netlink.LinkAdd(dummy); err != nil {
+		t.Fatalf("Could not add %s: %v", dummy.Name, err)
+	}
+	defer RemoveInterface("lyft6")
+	if err := netlink.LinkSetUp(dummy); err != nil {
+		t.Fatalf("Could not bring up %s: %v", dummy.Name, err)
+	}
+
+	ip := net.ParseIP("10.99.0.5")
+	table := PolicyTable(1)
+	// Adding twice, as a retried ADD does, leaves a single rule
+	for i := 0; i < 2; i++ {
+		if _, err := AddPolicyRoute("lyft6", table, ip, net.ParseIP("10.99.0.1")); err != nil {
+			t.Fatalf("Failed to add policy route: %v", err)
+		}
+	}
+	if rules := policyRules(t, ip); len(rules) != 1 || rules[0].Table != table {
+		t.Fatalf("expected a rule looking up table %d, got %v", table, rules)
+	}
+
+	if err := RemovePolicyRules(ip); err != nil {
+		t.Fatalf("Failed to remove policy rules: %v", err)
+	}
+	if rules := policyRules(t, ip); len(rules) != 0 {
+		t.Errorf("expected the rule to be removed, got %v", rules)
+	}
+}
+
+func policyRules(t *testing.T, ip net.IP) []netlink.Rule {
+	rules, err := netlink.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatalf("Failed to list rules: %v", err)
+	}
+	var matching []netlink.Rule
+	for _, rule := range rules {
+		if rule.Src != nil && rule.Src.IP.Equal(ip) {
+			matching = append(matching, rule)
+		}
+	}
+	return matching
+}
+
+func TestPolicyRouteCycles(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft7"}}
+	if err := netlink.LinkAdd(dummy); err != nil {
+		t.Fatalf("Could not add %s: %v", dummy.Name, err)
+	}
+	defer RemoveInterface("lyft7")
+	if err := netlink.LinkSetUp(dummy); err != nil {
+		t.Fatalf("Could not bring up %s: %v", dummy.Name, err)
+	}
+
+	before, err := netlink.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatalf("Failed to list rules: %v", err)
+	}
+
+	// Another Pod on the interface keeps its rule and the table's route
+	// throughout
+	table := PolicyTable(2)
+	gateway := net.ParseIP("10.98.0.1")
+	other, err := AddPolicyRoute("lyft7", table, net.ParseIP("10.98.0.200"), gateway)
+	if err != nil {
+		t.Fatalf("Failed to add policy route: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		ip := net.IPv4(10, 98, 0, byte(10+i%5))
+		added, err := AddPolicyRoute("lyft7", table, ip, gateway)
+		if err != nil {
+			t.Fatalf("Failed to add policy route %d: %v", i, err)
+		}
+		if err := RemovePolicyRule(added); err != nil {
+			t.Fatalf("Failed to remove policy rule %d: %v", i, err)
+		}
+	}
+	if rules := policyRules(t, net.ParseIP("10.98.0.200")); len(rules) != 1 {
+		t.Errorf("expected the other Pod's rule to stay, got %v", rules)
+	}
+	if routes := tableRoutes(t, table); len(routes) != 1 {
+		t.Errorf("expected the route of table %d to stay, got %v", table, routes)
+	}
+
+	if err := RemovePolicyRule(other); err != nil {
+		t.Fatalf("Failed to remove policy rule: %v", err)
+	}
+	after, err := netlink.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatalf("Failed to list rules: %v", err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("expected %d rules after the cycles, got %d", len(before), len(after))
+	}
+	if routes := tableRoutes(t, table); len(routes) != 0 {
+		t.Errorf("expected table %d to be emptied, got %v", table, routes)
+	}
+}
+
+func tableRoutes(t *testing.T, table int) []netlink.Route {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatalf("Failed to list routes: %v", err)
+	}
+	return routes
+}
@@ -0,0 +1,90 @@
+package nl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const arpReply = 2
+
+// gatewayProbeInterval is how often the ARP request is repeated while
+// waiting for the gateway
+var gatewayProbeInterval = 200 * time.Millisecond
+
+// ProbeGateway verifies the gateway answers ARP requests sent from the
+// link on behalf of ip within timeout. Routes via a gateway which doesn't
+// answer blackhole the traffic.
+func ProbeGateway(name string, ip, gateway net.IP, timeout time.Duration) error {
+	ip4, gateway4 := ip.To4(), gateway.To4()
+	if ip4 == nil || gateway4 == nil {
+		return fmt.Errorf("%v and %v must be IPv4 addresses", ip, gateway)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	mac := link.Attrs().HardwareAddr
+	if len(mac) != 6 {
+		return fmt.Errorf("%v has no Ethernet address", name)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  link.Attrs().Index,
+		Halen:    6,
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		return err
+	}
+	copy(addr.Addr[:], broadcastMAC)
+	wait := syscall.NsecToTimeval(gatewayProbeInterval.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &wait); err != nil {
+		return err
+	}
+
+	request := arpRequestFrame(mac, ip4, gateway4)
+	buf := make([]byte, 128)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if err := syscall.Sendto(fd, request, 0, addr); err != nil {
+			return err
+		}
+		for sent := time.Now(); time.Since(sent) < gatewayProbeInterval; {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if isARPReply(buf[:n], gateway4, ip4) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("gateway %v didn't answer ARP on %v within %v", gateway, name, timeout)
+}
+
+// isARPReply reports whether the Ethernet frame is an ARP reply from
+// sender to target
+func isARPReply(frame []byte, sender, target net.IP) bool {
+	if len(frame) < 42 || binary.BigEndian.Uint16(frame[12:]) != syscall.ETH_P_ARP {
+		return false
+	}
+	arp := frame[14:]
+	return binary.BigEndian.Uint16(arp[6:]) == arpReply &&
+		bytes.Equal(arp[14:18], sender) &&
+		bytes.Equal(arp[24:28], target)
+}
@@ -22,15 +22,32 @@ func UpInterface(name string) error {
 
 // UpInterfacePoll waits until an interface can be resolved by netlink and then call up on the interface.
 func UpInterfacePoll(name string) error {
-	for start := time.Now(); time.Since(start) <= interfaceSettleDeadline; time.Sleep(interfaceSettleWaitTime) {
-		err := UpInterface(name)
-		if err == nil {
+	return UpInterfacePollTimeout(name, interfaceSettleDeadline, interfaceSettleWaitTime)
+}
+
+// UpInterfacePollTimeout waits up to timeout for an interface to be
+// resolved by netlink, checking every interval, and then calls up on the
+// interface. Zero values use the UpInterfacePoll defaults.
+func UpInterfacePollTimeout(name string, timeout, interval time.Duration) error {
+	if timeout <= 0 {
+		timeout = interfaceSettleDeadline
+	}
+	if interval <= 0 {
+		interval = interfaceSettleWaitTime
+	}
+
+	var lastErr error
+	start := time.Now()
+	for ; time.Since(start) <= timeout; time.Sleep(interval) {
+		lastErr = UpInterface(name)
+		if lastErr == nil {
 			return nil
 		}
-		_, err = fmt.Fprintf(os.Stderr, "Failing to enumerate %v due to %v\n", name, err)
+		_, err := fmt.Fprintf(os.Stderr, "Failing to enumerate %v due to %v\n", name, lastErr)
 		if err != nil {
 			panic(err)
 		}
 	}
-	return fmt.Errorf("Interface was not found after setting time")
+	return fmt.Errorf("interface %v was not ready after %v: %v",
+		name, time.Since(start).Round(time.Millisecond), lastErr)
 }
@@ -3,7 +3,9 @@ package nl
 import (
 	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/vishvananda/netlink"
 )
@@ -51,3 +53,31 @@ func TestUpInterfacePoll(t *testing.T) {
 		t.Fatalf("Failed to failed to stand up interface lyft2")
 	}
 }
+
+func TestUpInterfacePollDelayed(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	// The link only appears after polling has started
+	timer := time.AfterFunc(500*time.Millisecond, func() {
+		CreateTestInterface("lyft3")
+	})
+	defer timer.Stop()
+	defer RemoveInterface("lyft3")
+
+	if err := UpInterfacePollTimeout("lyft3", 5*time.Second, 50*time.Millisecond); err != nil {
+		t.Fatalf("Failed to stand up delayed interface lyft3: %v", err)
+	}
+}
+
+func TestUpInterfacePollTimeout(t *testing.T) {
+	err := UpInterfacePollTimeout("lyftmissing0", 200*time.Millisecond, 50*time.Millisecond)
+	if err == nil {
+		t.Fatalf("Missing interface was brought up")
+	}
+	if !strings.Contains(err.Error(), "lyftmissing0") {
+		t.Fatalf("Error doesn't name the interface: %v", err)
+	}
+}
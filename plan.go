@@ -0,0 +1,87 @@
+package cniipvlanvpck8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// plansDir holds the plan of each ADD, one file per container ID
+var plansDir = "/var/lib/cni-ipvlan-vpc-k8s/plans"
+
+// AllocationPlan is the decision an ADD made for a container, for audit
+// pipelines. Its fields are stable.
+type AllocationPlan struct {
+	ContainerID  string    `json:"containerID"`
+	IfName       string    `json:"ifName"`
+	PodNamespace string    `json:"podNamespace,omitempty"`
+	PodName      string    `json:"podName,omitempty"`
+	Time         time.Time `json:"time"`
+	// Source is where the IP came from: free, requested, existing-interface,
+	// new-interface or exclusive-interface
+	Source string `json:"source"`
+	// ReusedFreeIP is set when the IP was already assigned in EC2 and no
+	// allocation was needed
+	ReusedFreeIP bool   `json:"reusedFreeIP"`
+	IP           string `json:"ip,omitempty"`
+	IPv6         string `json:"ipv6,omitempty"`
+	InterfaceID  string `json:"interfaceID"`
+	Adapter      string `json:"adapter"`
+	SubnetID     string `json:"subnetID"`
+	// AWSCalls is the number of EC2 API calls the ADD made
+	AWSCalls int `json:"awsCalls"`
+}
+
+// planPath returns the file of the container's plan. Container IDs come
+// from the runtime, so ones which aren't plain file names are refused.
+func planPath(containerID string) (string, error) {
+	if containerID == "" || containerID == "." || containerID == ".." || filepath.Base(containerID) != containerID {
+		return "", fmt.Errorf("container ID %q can't name a plan file", containerID)
+	}
+	return filepath.Join(plansDir, containerID+".json"), nil
+}
+
+// RecordPlan writes the plan of an ADD, replacing an earlier one for the
+// same container
+func RecordPlan(plan AllocationPlan) error {
+	path, err := planPath(plan.ContainerID)
+	if err != nil {
+		return err
+	}
+	return writeJSONAtomic(path, plan)
+}
+
+// LoadPlan reads the plan recorded for the container
+func LoadPlan(containerID string) (*AllocationPlan, error) {
+	path, err := planPath(containerID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no plan recorded for container %v", containerID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var plan AllocationPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("plan of container %v is corrupt: %v", containerID, err)
+	}
+	return &plan, nil
+}
+
+// RemovePlan deletes the plan of a container torn down by DEL
+func RemovePlan(containerID string) error {
+	path, err := planPath(containerID)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package cniipvlanvpck8s
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlanRoundTrip(t *testing.T) {
+	defer withTestClaims(t)()
+
+	plan := AllocationPlan{
+		ContainerID:  "abc123",
+		IfName:       "eth0",
+		Time:         time.Now().UTC().Truncate(time.Second),
+		Source:       "free",
+		ReusedFreeIP: true,
+		IP:           "10.0.0.10",
+		InterfaceID:  "eni-1",
+		Adapter:      "eth1",
+		SubnetID:     "subnet-a",
+		AWSCalls:     2,
+	}
+	if err := RecordPlan(plan); err != nil {
+		t.Fatalf("Failed to record plan: %v", err)
+	}
+	loaded, err := LoadPlan("abc123")
+	if err != nil {
+		t.Fatalf("Failed to load plan: %v", err)
+	}
+	if !loaded.Time.Equal(plan.Time) {
+		t.Fatalf("expected time %v, got %v", plan.Time, loaded.Time)
+	}
+	loaded.Time = plan.Time
+	if *loaded != plan {
+		t.Fatalf("expected %+v, got %+v", plan, *loaded)
+	}
+
+	if err := RemovePlan("abc123"); err != nil {
+		t.Fatalf("Failed to remove plan: %v", err)
+	}
+	if _, err := LoadPlan("abc123"); err == nil {
+		t.Fatalf("removed plan still loads")
+	}
+	if err := RemovePlan("abc123"); err != nil {
+		t.Fatalf("removing a missing plan failed: %v", err)
+	}
+}
+
+func TestPlanPathRejectsTraversal(t *testing.T) {
+	for _, id := range []string{"", ".", "..", "../etc/passwd", "a/b"} {
+		if err := RecordPlan(AllocationPlan{ContainerID: id}); err == nil {
+			t.Fatalf("recorded a plan for %q", id)
+		}
+	}
+}
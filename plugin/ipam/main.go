@@ -18,14 +18,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/url"
+	"os"
+	"os/exec"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
@@ -35,21 +45,229 @@ import (
 	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
 )
 
+// awsClient allocates addresses and interfaces. Tests replace it with an
+// aws.FakeClient.
+var awsClient aws.Client = aws.EC2Client{}
+
 // PluginConf contains configuration parameters
 type PluginConf struct {
 	Name       string      `json:"name"`
 	CNIVersion string      `json:"cniVersion"`
 	IPAM       *IPAMConfig `json:"ipam"`
+
+	// The previous result is only supplied on CHECK, where it holds the
+	// addresses to verify
+	RawPrevResult *map[string]interface{} `json:"prevResult"`
+	PrevResult    *current.Result         `json:"-"`
+
+	// The attachments the runtime still knows about are only supplied on
+	// GC
+	ValidAttachments []types.GCAttachment `json:"cni.dev/valid-attachments"`
+
+	// indexErr is why the configured interfaceIndex can't be allocated
+	// at, which only fails ADD
+	indexErr error
 }
 
 // IPAMConfig contains IPAM driver configuration parameters
 type IPAMConfig struct {
-	SecGroupIds      []string          `json:"secGroupIds"`
-	SubnetTags       map[string]string `json:"subnetTags"`
-	IfaceIndex       int               `json:"interfaceIndex"`
-	SkipDeallocation bool              `json:"skipDeallocation"`
+	SecGroupIds             []string                     `json:"secGroupIds"`
+	SubnetTags              map[string]string            `json:"subnetTags"`
+	SubnetExcludeTags       map[string]string            `json:"subnetExcludeTags"`
+	SubnetIds               []string                     `json:"subnetIds"`
+	IfaceIndex              int                          `json:"interfaceIndex"`
+	AllowPrimaryENI         bool                         `json:"allowPrimaryENI"`
+	SkipDeallocation        bool                         `json:"skipDeallocation"`
+	EnableIPv6              bool                         `json:"enableIPv6"`
+	WarmIPTarget            int                          `json:"warmIPTarget"`
+	WarmENITarget           int                          `json:"warmENITarget"`
+	UseVPCDefaultSG         bool                         `json:"useVPCDefaultSG"`
+	EC2Retries              int                          `json:"ec2Retries"`
+	EC2RetryDelay           Duration                     `json:"ec2RetryBaseDelay"`
+	DNSNameservers          []string                     `json:"dnsNameservers"`
+	DNSDomain               string                       `json:"dnsDomain"`
+	DNSSearch               []string                     `json:"dnsSearch"`
+	DNSOptions              []string                     `json:"dnsOptions"`
+	DNSHostOffset           int                          `json:"dnsHostOffset"`
+	NetworkCardIndex        int                          `json:"networkCardIndex"`
+	MinimumFreeIPs          int                          `json:"minimumFreeIPs"`
+	MetricsFile             string                       `json:"metricsFile"`
+	LogFile                 string                       `json:"logFile"`
+	MaxENIs                 int                          `json:"maxENIs"`
+	ENITags                 map[string]string            `json:"eniTags"`
+	NodeName                string                       `json:"nodeName"`
+	MTU                     int                          `json:"mtu"`
+	IpvlanMode              string                       `json:"ipvlanMode"`
+	DisableSourceDestCheck  bool                         `json:"disableSourceDestCheck"`
+	MetadataCacheTTL        Duration                     `json:"metadataCacheTTL"`
+	LinkReadyTimeout        Duration                     `json:"linkReadyTimeout"`
+	SubnetSecGroups         []SubnetSecGroups            `json:"subnetSecGroups"`
+	AllocationStrategy      string                       `json:"allocationStrategy"`
+	LockTimeout             Duration                     `json:"lockTimeout"`
+	AssumeRoleARN           string                       `json:"assumeRoleArn"`
+	AssumeRoleExternalID    string                       `json:"assumeRoleExternalId"`
+	ExtraRoutes             []RouteEntry                 `json:"extraRoutes"`
+	SetDefaultRoute         bool                         `json:"setDefaultRoute"`
+	ReservationTTL          Duration                     `json:"reservationTTL"`
+	NamespaceSubnetTags     map[string]map[string]string `json:"namespaceSubnetTags"`
+	AWSEndpointEC2          string                       `json:"awsEndpointEC2"`
+	AWSRegion               string                       `json:"awsRegion"`
+	UseFIPS                 bool                         `json:"useFIPS"`
+	ReleaseEmptyENIs        bool                         `json:"releaseEmptyENIs"`
+	MinimumWarmENIs         int                          `json:"minimumWarmENIs"`
+	ENIReleaseCooldown      Duration                     `json:"eniReleaseCooldown"`
+	RouteMetric             int                          `json:"routeMetric"`
+	UseExistingENI          string                       `json:"useExistingENI"`
+	IPv6Only                bool                         `json:"ipv6Only"`
+	NAT64Prefix             string                       `json:"nat64Prefix"`
+	UseDhcpOptionsDNS       bool                         `json:"useDhcpOptionsDNS"`
+	NoCreateENI             bool                         `json:"noCreateENI"`
+	MasterInterfaceOverride string                       `json:"masterInterfaceOverride"`
+	OperationTimeout        Duration                     `json:"operationTimeout"`
+	ENIDescriptionPrefix    string                       `json:"eniDescriptionPrefix"`
+	ClusterName             string                       `json:"clusterName"`
+	EC2RateLimit            float64                      `json:"ec2RateLimit"`
+	EnablePrefixDelegation  bool                         `json:"enablePrefixDelegation"`
+	MaxIPsPerNode           int                          `json:"maxIPsPerNode"`
+	EgressRateKbps          int                          `json:"egressRateKbps"`
+	IngressRateKbps         int                          `json:"ingressRateKbps"`
+	SummarizeVPCRoutes      bool                         `json:"summarizeVPCRoutes"`
+	IMDSHopLimit            int                          `json:"imdsHopLimit"`
+	IMDSTokenTTL            Duration                     `json:"imdsTokenTTL"`
+	SendGratuitousARP       bool                         `json:"sendGratuitousARP"`
+	VerifyGateway           bool                         `json:"verifyGateway"`
+	VerifyGatewayTimeout    Duration                     `json:"verifyGatewayTimeout"`
+	PolicyRouting           bool                         `json:"policyRouting"`
+	LockDir                 string                       `json:"lockDir"`
+	LockHoldTimeout         Duration                     `json:"lockHoldTimeout"`
+	IPReuseCooldown         Duration                     `json:"ipReuseCooldown"`
+	DeallocateDelay         Duration                     `json:"deallocateDelay"`
+	ImportSubnetRoutes      bool                         `json:"importSubnetRoutes"`
+	KubeAPIServer           string                       `json:"kubeAPIServer"`
+	KubeTokenFile           string                       `json:"kubeTokenFile"`
+	KubeCAFile              string                       `json:"kubeCAFile"`
+	DisableLock             bool                         `json:"disableLock"`
+	LegacyLock              bool                         `json:"legacyLock"`
+}
+
+// K8sArgs are the Kubernetes details of the pod the runtime passes in
+// CNI_ARGS, along with the IP and interface index it requests, if any
+type K8sArgs struct {
+	types.CommonArgs
+	IP                net.IP
+	K8S_POD_NAMESPACE types.UnmarshallableString // nolint: golint
+	K8S_POD_NAME      types.UnmarshallableString // nolint: golint
+	K8S_POD_UID       types.UnmarshallableString // nolint: golint
+	// ExclusiveENI asks for a new ENI no other pod shares
+	ExclusiveENI types.UnmarshallableBool
+	// PREFERRED_IFACE_INDEX overrides interfaceIndex for the pod
+	PREFERRED_IFACE_INDEX types.UnmarshallableString // nolint: golint
+}
+
+// Pod returns the pod details for the allocation code
+func (a *K8sArgs) Pod() aws.PodInfo {
+	return aws.PodInfo{
+		Namespace: string(a.K8S_POD_NAMESPACE),
+		Name:      string(a.K8S_POD_NAME),
+		UID:       string(a.K8S_POD_UID),
+	}
+}
+
+// loadK8sArgs parses CNI_ARGS, ignoring unknown keys. All fields are
+// empty when the runtime isn't Kubernetes.
+func loadK8sArgs(args *skel.CmdArgs) (*K8sArgs, error) {
+	k8sArgs := &K8sArgs{}
+	k8sArgs.IgnoreUnknown = true
+	if err := types.LoadArgs(args.Args, k8sArgs); err != nil {
+		return nil, fmt.Errorf("unable to parse CNI_ARGS: %v", err)
+	}
+	return k8sArgs, nil
+}
+
+// applyIndexHint replaces the configured interfaceIndex by the one the
+// pod prefers, if any, validated the same way
+func applyIndexHint(conf *PluginConf, k8sArgs *K8sArgs) error {
+	hint := string(k8sArgs.PREFERRED_IFACE_INDEX)
+	if hint == "" {
+		return nil
+	}
+	index, err := strconv.Atoi(hint)
+	if err != nil {
+		return fmt.Errorf("PREFERRED_IFACE_INDEX %q is not an integer", hint)
+	}
+	interfaces, err := awsClient.GetInterfaces()
+	if err != nil {
+		return fmt.Errorf("unable to check PREFERRED_IFACE_INDEX %d: %v", index, err)
+	}
+	index, err = resolveInterfaceIndex(index, interfaces, conf.IPAM.AllowPrimaryENI)
+	if err != nil {
+		return fmt.Errorf("invalid PREFERRED_IFACE_INDEX: %v", err)
+	}
+	conf.IPAM.IfaceIndex = index
+	return nil
+}
+
+// RouteEntry is an additional route for Pods. It's via the subnet gateway
+// unless GW is set.
+type RouteEntry struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+// SubnetSecGroups selects the security groups of new ENIs created in
+// subnets carrying all of the tags
+type SubnetSecGroups struct {
+	SubnetTags  map[string]string `json:"subnetTags"`
+	SecGroupIds []string          `json:"secGroupIds"`
+}
+
+// Duration is a time.Duration read from a JSON string such as "500ms"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("durations must be strings such as \"2s\": %v", err)
+	}
+	var err error
+	d.Duration, err = time.ParseDuration(value)
+	return err
 }
 
+// defaultVerifyGatewayTimeout bounds the wait for the subnet gateway to
+// answer with verifyGateway
+const defaultVerifyGatewayTimeout = 2 * time.Second
+
+// defaultIPReuseCooldown is how long an IP released by DEL isn't found free
+const defaultIPReuseCooldown = 5 * time.Second
+
+// warmPoolCommand is the argument used when the plugin re-executes itself
+// to refill the warm IP pool in the background
+const warmPoolCommand = "warm-pool"
+
+// warmENIsCommand is the argument used when the plugin re-executes itself
+// to keep warmENITarget ENIs with spare capacity attached
+const warmENIsCommand = "warm-enis"
+
+// releaseENIsCommand is the argument used when the plugin re-executes
+// itself to release empty ENIs after a DEL
+const releaseENIsCommand = "release-empty-enis"
+
+// deallocateHeldCommand is the argument used when the plugin re-executes
+// itself to deallocate the IPs a DEL held once deallocateDelay passes
+const deallocateHeldCommand = "deallocate-held-ips"
+
+// defaultDNSHostOffset is where the VPC resolver sits in the VPC's primary
+// CIDR
+const defaultDNSHostOffset = 2
+
+// vpcIPv6DNS is the VPC DNS server's address on Nitro instances, used by
+// IPv6-only pods without configured nameservers
+const vpcIPv6DNS = "fd00:ec2::253"
+
 func init() {
 	// this ensures that main runs only on main thread (thread group leader).
 	// since namespace ops (unshare, setns) are done for a single thread, we
@@ -69,127 +287,1977 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 		return nil, fmt.Errorf("IPAM config missing 'ipam' key")
 	}
 
-	if conf.IPAM.SecGroupIds == nil {
-		return nil, fmt.Errorf("secGroupIds must be specified")
+	if conf.RawPrevResult != nil {
+		resultBytes, err := json.Marshal(conf.RawPrevResult)
+		if err != nil {
+			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+		res, err := version.NewResult(conf.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+		}
+		conf.RawPrevResult = nil
+		conf.PrevResult, err = current.NewResultFromResult(res)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+		}
 	}
 
-	return &conf, nil
-}
+	if conf.IPAM.SecGroupIds == nil && len(conf.IPAM.SubnetSecGroups) == 0 && !conf.IPAM.UseVPCDefaultSG {
+		return nil, fmt.Errorf("secGroupIds must be specified unless useVPCDefaultSG is set")
+	}
+	if len(conf.IPAM.SubnetTags) == 0 && len(conf.IPAM.SubnetIds) == 0 {
+		return nil, fmt.Errorf("subnetTags or subnetIds must be specified")
+	}
 
-// cmdAdd is called for ADD requests
-func cmdAdd(args *skel.CmdArgs) error {
-	conf, err := parseConfig(args.StdinData)
-	if err != nil {
-		return err
+	if conf.IPAM.AWSEndpointEC2 != "" {
+		endpoint, err := url.Parse(conf.IPAM.AWSEndpointEC2)
+		if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+			return nil, fmt.Errorf("awsEndpointEC2 %q is not a URL", conf.IPAM.AWSEndpointEC2)
+		}
 	}
 
-	var alloc *aws.AllocationResult
-	// Try to find a free IP first - possibly from a broken container,
-	// or torn down namespace.
-	free, err := cniipvlanvpck8s.FindFreeIPsAtIndex(conf.IPAM.IfaceIndex)
-	if err == nil && len(free) > 0 {
-		alloc = free[0]
-	} else {
-		// allocate an IP on an available interface
-		alloc, err = aws.AllocateIPFirstAvailableAtIndex(conf.IPAM.IfaceIndex)
+	if conf.IPAM.MinimumWarmENIs < 0 {
+		return nil, fmt.Errorf("minimumWarmENIs must not be negative")
+	}
+
+	if conf.IPAM.WarmENITarget < 0 {
+		return nil, fmt.Errorf("warmENITarget must not be negative")
+	}
+
+	if conf.IPAM.RouteMetric < 0 {
+		return nil, fmt.Errorf("routeMetric must not be negative")
+	}
+
+	if conf.IPAM.OperationTimeout.Duration < 0 {
+		return nil, fmt.Errorf("operationTimeout must not be negative")
+	}
+
+	if conf.IPAM.LockHoldTimeout.Duration < 0 {
+		return nil, fmt.Errorf("lockHoldTimeout must not be negative")
+	}
+
+	if conf.IPAM.MaxIPsPerNode < 0 {
+		return nil, fmt.Errorf("maxIPsPerNode must not be negative")
+	}
+
+	if conf.IPAM.EgressRateKbps < 0 || conf.IPAM.IngressRateKbps < 0 {
+		return nil, fmt.Errorf("egressRateKbps and ingressRateKbps must not be negative")
+	}
+
+	if conf.IPAM.EC2RateLimit < 0 {
+		return nil, fmt.Errorf("ec2RateLimit must not be negative")
+	}
+
+	if conf.IPAM.IMDSHopLimit < 0 {
+		return nil, fmt.Errorf("imdsHopLimit must not be negative")
+	}
+
+	if conf.IPAM.VerifyGatewayTimeout.Duration < 0 {
+		return nil, fmt.Errorf("verifyGatewayTimeout must not be negative")
+	}
+	if conf.IPAM.VerifyGatewayTimeout.Duration == 0 {
+		conf.IPAM.VerifyGatewayTimeout.Duration = defaultVerifyGatewayTimeout
+	}
+
+	if conf.IPAM.KubeAPIServer != "" && conf.IPAM.KubeTokenFile == "" {
+		return nil, fmt.Errorf("kubeTokenFile is required with kubeAPIServer")
+	}
+
+	if conf.IPAM.DeallocateDelay.Duration < 0 {
+		return nil, fmt.Errorf("deallocateDelay must not be negative")
+	}
+
+	if conf.IPAM.IPReuseCooldown.Duration < 0 {
+		return nil, fmt.Errorf("ipReuseCooldown must not be negative")
+	}
+	if conf.IPAM.IPReuseCooldown.Duration == 0 {
+		conf.IPAM.IPReuseCooldown.Duration = defaultIPReuseCooldown
+	}
+
+	if conf.IPAM.IPv6Only {
+		conf.IPAM.EnableIPv6 = true
+		if conf.IPAM.SetDefaultRoute {
+			return nil, fmt.Errorf("setDefaultRoute is not supported with ipv6Only")
+		}
+		if conf.IPAM.WarmIPTarget > 0 {
+			return nil, fmt.Errorf("warmIPTarget is not supported with ipv6Only")
+		}
+	}
+
+	if conf.IPAM.NAT64Prefix != "" {
+		_, prefix, err := net.ParseCIDR(conf.IPAM.NAT64Prefix)
+		if err != nil || prefix.IP.To4() != nil {
+			return nil, fmt.Errorf("nat64Prefix %q is not an IPv6 CIDR", conf.IPAM.NAT64Prefix)
+		}
+		if !conf.IPAM.IPv6Only {
+			return nil, fmt.Errorf("nat64Prefix requires ipv6Only")
+		}
+	}
+
+	if override := conf.IPAM.MasterInterfaceOverride; strings.Count(override, "%") > 1 ||
+		strings.Count(override, "%") != strings.Count(override, "%d") {
+		return nil, fmt.Errorf("masterInterfaceOverride %q must be a name or contain a single %%d", override)
+	}
+
+	if conf.IPAM.UseExistingENI != "" && !strings.HasPrefix(conf.IPAM.UseExistingENI, "eni-") {
+		return nil, fmt.Errorf("useExistingENI %q is not an interface ID", conf.IPAM.UseExistingENI)
+	}
+
+	for namespace, tags := range conf.IPAM.NamespaceSubnetTags {
+		if namespace == "" || len(tags) == 0 {
+			return nil, fmt.Errorf("namespaceSubnetTags entries must map a namespace to subnet tags")
+		}
+	}
+
+	for _, subnetSecGroups := range conf.IPAM.SubnetSecGroups {
+		if len(subnetSecGroups.SecGroupIds) == 0 {
+			return nil, fmt.Errorf("subnetSecGroups entries must specify secGroupIds")
+		}
+	}
+
+	for _, nameserver := range conf.IPAM.DNSNameservers {
+		if net.ParseIP(nameserver) == nil {
+			return nil, fmt.Errorf("dnsNameservers entry %q is not an IP address", nameserver)
+		}
+	}
+
+	if conf.IPAM.NetworkCardIndex < 0 {
+		return nil, fmt.Errorf("networkCardIndex must not be negative")
+	}
+
+	if conf.IPAM.DNSHostOffset < 0 {
+		return nil, fmt.Errorf("dnsHostOffset must not be negative")
+	}
+	if conf.IPAM.DNSHostOffset == 0 {
+		conf.IPAM.DNSHostOffset = defaultDNSHostOffset
+	}
+
+	for _, route := range conf.IPAM.ExtraRoutes {
+		_, dst, err := net.ParseCIDR(route.Dst)
 		if err != nil {
-			// failed, so attempt to add an IP to a new interface
-			newIf, err := aws.NewInterface(conf.IPAM.SecGroupIds, conf.IPAM.SubnetTags)
-			// If this interface has somehow gained more than one IP since being allocated,
-			// abort this process and let a subsequent run find a valid IP.
-			if err != nil || len(newIf.IPv4s) != 1 {
-				return fmt.Errorf("unable to create a new elastic network interface due to %v",
-					err)
+			return nil, fmt.Errorf("extraRoutes entry %q is not a CIDR: %v", route.Dst, err)
+		}
+		if route.GW != "" && net.ParseIP(route.GW) == nil {
+			return nil, fmt.Errorf("extraRoutes gateway %q is not an IP address", route.GW)
+		}
+		if dst.IP.To4() == nil && !conf.IPAM.EnableIPv6 {
+			return nil, fmt.Errorf("extraRoutes entry %v requires enableIPv6", route.Dst)
+		}
+		if dst.IP.To4() != nil && conf.IPAM.IPv6Only {
+			return nil, fmt.Errorf("extraRoutes entry %v is IPv4, which ipv6Only pods can't reach", route.Dst)
+		}
+		if ones, _ := dst.Mask.Size(); ones == 0 && dst.IP.To4() != nil && conf.IPAM.SetDefaultRoute {
+			return nil, fmt.Errorf("extraRoutes entry %v conflicts with setDefaultRoute", route.Dst)
+		}
+	}
+
+	switch aws.AllocationStrategy(conf.IPAM.AllocationStrategy) {
+	case "":
+		conf.IPAM.AllocationStrategy = string(aws.FirstAvailable)
+	case aws.FirstAvailable, aws.LeastLoaded:
+	default:
+		return nil, fmt.Errorf("unknown allocationStrategy: %q", conf.IPAM.AllocationStrategy)
+	}
+
+	switch conf.IPAM.IpvlanMode {
+	case "", "l2", "l3", "l3s":
+	default:
+		return nil, fmt.Errorf("unknown ipvlanMode: %q", conf.IPAM.IpvlanMode)
+	}
+
+	aws.SetRetryPolicy(conf.IPAM.EC2Retries, conf.IPAM.EC2RetryDelay.Duration)
+	aws.SetRateLimit(conf.IPAM.EC2RateLimit)
+	aws.SetPrefixDelegation(conf.IPAM.EnablePrefixDelegation)
+	aws.SetIPsInUse(cniipvlanvpck8s.IPsInUse)
+	aws.SetInterfacesInUse(cniipvlanvpck8s.InterfaceIDsInUse)
+	aws.SetMetadataCacheTTL(conf.IPAM.MetadataCacheTTL.Duration)
+	aws.SetAssumeRole(conf.IPAM.AssumeRoleARN, conf.IPAM.AssumeRoleExternalID)
+	aws.SetEndpoints(conf.IPAM.AWSRegion, conf.IPAM.AWSEndpointEC2, conf.IPAM.UseFIPS)
+	aws.SetIMDSHopLimit(conf.IPAM.IMDSHopLimit)
+	if err := aws.SetIMDSTokenTTL(conf.IPAM.IMDSTokenTTL.Duration); err != nil {
+		return nil, fmt.Errorf("invalid imdsTokenTTL: %v", err)
+	}
+	cniipvlanvpck8s.SetLockDir(conf.IPAM.LockDir)
+	cniipvlanvpck8s.DisableLocking(conf.IPAM.DisableLock)
+	cniipvlanvpck8s.SetLegacyLock(conf.IPAM.LegacyLock)
+	cniipvlanvpck8s.SetLockHoldTimeout(conf.IPAM.LockHoldTimeout.Duration)
+
+	// Without metadata the index can't be checked, and allocations
+	// report the failure themselves. Only ADD refuses the primary ENI or
+	// an index no longer attached, so the Pods of an older config, or
+	// allocated before their ENI was released, can still be deleted.
+	if interfaces, err := awsClient.GetInterfaces(); err == nil {
+		index, err := resolveInterfaceIndex(conf.IPAM.IfaceIndex, interfaces, true)
+		switch {
+		case err == nil:
+			conf.IPAM.IfaceIndex = index
+		case conf.IPAM.IfaceIndex < 0:
+			return nil, err
+		default:
+			conf.indexErr = err
+		}
+		if len(interfaces) > 0 && interfaces[0].VpcPrimaryCidr != nil {
+			if _, err := vpcDNSServer(interfaces[0].VpcPrimaryCidr, conf.IPAM.DNSHostOffset); err != nil {
+				return nil, fmt.Errorf("invalid dnsHostOffset: %v", err)
 			}
-			// Freshly allocated interfaces will always have one valid IP - use
-			// this IP address.
-			alloc = &aws.AllocationResult{
-				&newIf.IPv4s[0],
-				*newIf,
+		}
+	} else if conf.IPAM.IfaceIndex == anyInterfaceIndex {
+		conf.IPAM.IfaceIndex = 1
+	}
+
+	return &conf, nil
+}
+
+// anyInterfaceIndex is the interfaceIndex letting the plugin choose the
+// ENIs Pod IPs are allocated on, which are all but the primary one
+const anyInterfaceIndex = -1
+
+// errPrimaryENI refuses an interfaceIndex of 0, which would allocate Pod
+// IPs on the primary ENI
+var errPrimaryENI = fmt.Errorf("interfaceIndex 0 uses the primary ENI, which requires allowPrimaryENI")
+
+// resolveInterfaceIndex checks the configured interfaceIndex is the device
+// index of an attached interface, or the one the next interface is
+// attached at. Any other index would never be reached by new interfaces,
+// so allocations would keep creating them up to the instance's limit.
+// Index 0 is refused unless allowPrimary.
+func resolveInterfaceIndex(index int, interfaces []aws.Interface, allowPrimary bool) (int, error) {
+	if index == anyInterfaceIndex {
+		return 1, nil
+	}
+	if index == 0 && !allowPrimary {
+		return 0, errPrimaryENI
+	}
+	if index < 0 {
+		return 0, fmt.Errorf("interfaceIndex must not be negative, except %d for any index", anyInterfaceIndex)
+	}
+	if index == len(interfaces) {
+		return index, nil
+	}
+	var attached []int
+	for _, intf := range interfaces {
+		if intf.Number == index {
+			return index, nil
+		}
+		attached = append(attached, intf.Number)
+	}
+	return 0, fmt.Errorf("interfaceIndex %d is not attached: ENIs are attached at %v and the next one at %d",
+		index, attached, len(interfaces))
+}
+
+// newMetrics returns the metrics recorder for this invocation, observing
+// all EC2 calls made until it is flushed
+func newMetrics(conf *PluginConf) *cniipvlanvpck8s.MetricsRecorder {
+	metrics := cniipvlanvpck8s.NewMetricsRecorder(conf.IPAM.MetricsFile)
+	if metrics != nil {
+		aws.ObserveCalls(metrics.ObserveEC2Call)
+	}
+	return metrics
+}
+
+// subnetRoutes returns routes to the imported destinations of the address
+// families the Pod has, skipping destinations routed already
+func subnetRoutes(routes []*types.Route, dsts []*net.IPNet, alloc *aws.AllocationResult, gw, gw6 net.IP) []*types.Route {
+	routed := map[string]bool{}
+	for _, route := range routes {
+		routed[route.Dst.String()] = true
+	}
+	var imported []*types.Route
+	for _, dst := range dsts {
+		if routed[dst.String()] {
+			continue
+		}
+		routeGW := gw
+		if dst.IP.To4() == nil {
+			if alloc.IPv6 == nil {
+				continue
 			}
+			routeGW = gw6
+		} else if alloc.IP == nil {
+			continue
 		}
+		routed[dst.String()] = true
+		imported = append(imported, &types.Route{Dst: *dst, GW: routeGW})
 	}
+	return imported
+}
 
-	err = nl.UpInterfacePoll(alloc.Interface.LocalName())
-	if err != nil {
-		return fmt.Errorf("unable to bring up interface %v due to %v",
-			alloc.Interface.LocalName(),
-			err)
+// reportExhaustion reports an ADD failing for lack of IPs or ENIs to the
+// API server, if one is configured. Reports are best effort, failures are
+// only logged.
+func reportExhaustion(conf *PluginConf, err error, logger *cniipvlanvpck8s.Logger) {
+	if conf.IPAM.KubeAPIServer == "" {
+		return
+	}
+	var reason string
+	switch aws.ErrorKind(err) {
+	case aws.ErrInsufficientIPs:
+		reason = "IPExhausted"
+	case aws.ErrENILimit:
+		reason = "ENILimitReached"
+	default:
+		return
+	}
+	node := conf.IPAM.NodeName
+	if node == "" {
+		node, _ = os.Hostname()
+	}
+	api := cniipvlanvpck8s.KubeAPI{
+		Server:    conf.IPAM.KubeAPIServer,
+		TokenFile: conf.IPAM.KubeTokenFile,
+		CAFile:    conf.IPAM.KubeCAFile,
+	}
+	if reportErr := cniipvlanvpck8s.ReportExhaustion(api, node, reason, err.Error()); reportErr != nil {
+		logger.Log("unable to report exhaustion", cniipvlanvpck8s.Fields{"reason": reason, "error": reportErr})
+	}
+}
+
+// vpcRoutes returns the destinations routed via the subnet gateway for the
+// VPC's CIDR blocks of one address family, aggregated if configured
+func vpcRoutes(conf *PluginConf, cidrs []*net.IPNet) []*net.IPNet {
+	if conf.IPAM.SummarizeVPCRoutes {
+		return aws.AggregateCIDRs(cidrs)
+	}
+	return cidrs
+}
+
+// subnetSecurityGroups converts the configured subnet security group
+// mapping for aws.InterfaceOptions
+func subnetSecurityGroups(conf *PluginConf) []aws.SubnetSecurityGroups {
+	var groups []aws.SubnetSecurityGroups
+	for _, subnetSecGroups := range conf.IPAM.SubnetSecGroups {
+		groups = append(groups, aws.SubnetSecurityGroups{
+			SubnetTags:     subnetSecGroups.SubnetTags,
+			SecurityGroups: subnetSecGroups.SecGroupIds,
+		})
 	}
+	return groups
+}
 
-	// Per https://docs.aws.amazon.com/AmazonVPC/latest/UserGuide/VPC_Subnets.html
-	// subnet + 1 is our gateway
-	// primary cidr + 2 is the dns server
-	subnetAddr := alloc.Interface.SubnetCidr.IP.To4()
-	gw := net.IP(append(subnetAddr[:3], subnetAddr[3]+1))
-	vpcPrimaryAddr := alloc.Interface.VpcPrimaryCidr.IP.To4()
-	dns := net.IP(append(vpcPrimaryAddr[:3], vpcPrimaryAddr[3]+2))
-	addr := net.IPNet{
-		IP:   *alloc.IP,
-		Mask: alloc.Interface.SubnetCidr.Mask,
+// newLogger returns the structured logger for this invocation, which also
+// records every EC2 call made while it is open. Logging is best effort and
+// never fails the invocation.
+func newLogger(conf *PluginConf, args *skel.CmdArgs, pod aws.PodInfo, command string) *cniipvlanvpck8s.Logger {
+	logger, err := cniipvlanvpck8s.NewLogger(conf.IPAM.LogFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open log file %v: %v\n", conf.IPAM.LogFile, err)
+		return nil
+	}
+	if logger == nil {
+		return nil
+	}
+	logger = logger.With("command", command).With("containerID", args.ContainerID)
+	if pod.Name != "" {
+		logger = logger.With("podNamespace", pod.Namespace).
+			With("podName", pod.Name).
+			With("podUID", pod.UID)
 	}
+	aws.ObserveCalls(func(operation string, duration time.Duration, err error) {
+		fields := cniipvlanvpck8s.Fields{
+			"operation":  operation,
+			"durationMs": milliseconds(duration),
+		}
+		if err != nil {
+			fields["error"] = err
+		}
+		logger.Log("ec2 call", fields)
+	})
+	return logger
+}
 
-	master := fmt.Sprintf("eth%d", alloc.Interface.Number)
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
 
-	iface := &current.Interface{
-		Name: master,
+// lockError converts a lock timeout, or an operation timing out holding
+// the lock, into a CNI "try again later" error so the runtime retries the
+// request
+func lockError(err error) error {
+	switch err.(type) {
+	case cniipvlanvpck8s.LockTimeoutError, cniipvlanvpck8s.LockHoldTimeoutError:
+		return &types.Error{
+			Code:    11,
+			Msg:     "try again later",
+			Details: err.Error(),
+		}
 	}
+	return err
+}
 
-	ipconfig := &current.IPConfig{
-		Version:   "4",
-		Address:   addr,
-		Gateway:   gw,
-		Interface: current.Int(0),
+// operationContext bounds the EC2 calls of an invocation by
+// operationTimeout, if set
+func operationContext(conf *PluginConf) (context.Context, context.CancelFunc) {
+	if conf.IPAM.OperationTimeout.Duration > 0 {
+		return context.WithTimeout(context.Background(), conf.IPAM.OperationTimeout.Duration)
 	}
+	return context.WithCancel(context.Background())
+}
 
-	result := &current.Result{}
-	rDNS := types.DNS{}
-	rDNS.Nameservers = append(rDNS.Nameservers, dns.String())
-	result.DNS = rDNS
-	result.IPs = append(result.IPs, ipconfig)
-	result.Interfaces = append(result.Interfaces, iface)
+// timeoutError converts a failure of an invocation which ran out of its
+// operationTimeout into a CNI "try again later" error, like lockError
+func timeoutError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return &types.Error{
+			Code:    11,
+			Msg:     "try again later",
+			Details: fmt.Sprintf("operation timed out: %v", err),
+		}
+	}
+	return err
+}
+
+// Plugin specific CNI error codes of the failures aws.ErrorKind tells apart
+const (
+	errCodeInsufficientIPs = 100
+	errCodeENILimit        = 101
+)
 
-	// add routes for all VPC cidrs via the subnet gateway
-	for _, dst := range alloc.Interface.VpcCidrs {
-		result.Routes = append(result.Routes, &types.Route{*dst, gw})
+// cniError converts a failure of a known kind into a CNI error with the
+// kind's code, so runtimes and wrappers can build retry policies around
+// them. Throttling is retried by the runtime like a lock timeout.
+func cniError(err error) error {
+	if _, ok := err.(*types.Error); ok {
+		return err
+	}
+	kind := aws.ErrorKind(err)
+	var code uint
+	switch kind {
+	case aws.ErrInsufficientIPs:
+		code = errCodeInsufficientIPs
+	case aws.ErrENILimit:
+		code = errCodeENILimit
+	case aws.ErrThrottled:
+		code = types.ErrTryAgainLater
+	case aws.ErrConfig:
+		code = types.ErrInvalidNetworkConfig
+	default:
+		return err
+	}
+	return &types.Error{
+		Code:    code,
+		Msg:     kind.Error(),
+		Details: err.Error(),
 	}
+}
 
-	return types.PrintResult(result, conf.CNIVersion)
+// failureReason returns the EC2 error code of err, if any, as a metrics
+// label, or fallback otherwise
+func failureReason(err error, fallback string) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return fallback
 }
 
-// cmdDel is called for DELETE requests
-func cmdDel(args *skel.CmdArgs) error {
+// cmdAdd is called for ADD requests
+func cmdAdd(args *skel.CmdArgs) (err error) {
 	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return cniError(&aws.Error{Kind: aws.ErrConfig, Err: err})
+	}
+	if conf.IPAM.IfaceIndex == 0 && !conf.IPAM.AllowPrimaryENI {
+		return cniError(&aws.Error{Kind: aws.ErrConfig, Err: errPrimaryENI})
+	}
+	if conf.indexErr != nil {
+		return cniError(&aws.Error{Kind: aws.ErrConfig, Err: conf.indexErr})
+	}
+	k8sArgs, err := loadK8sArgs(args)
 	if err != nil {
 		return err
 	}
-	_ = conf
+	// The warm pool is kept at the configured index, which its process
+	// parses from the configuration again
+	if err := applyIndexHint(conf, k8sArgs); err != nil {
+		return cniError(&aws.Error{Kind: aws.ErrConfig, Err: err})
+	}
 
-	var addrs []netlink.Addr
+	pod := k8sArgs.Pod()
 
-	// enter the namespace to grab the list of IPs
-	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		iface, err := netlink.LinkByName(args.IfName)
+	ctx, cancel := operationContext(conf)
+	defer cancel()
+	defer func() {
+		err = cniError(timeoutError(ctx, err))
+	}()
+
+	logger := newLogger(conf, args, pod, "add")
+	defer logger.Close()
+	start := time.Now()
+	defer func() {
 		if err != nil {
-			return err
+			logger.Log("add failed", cniipvlanvpck8s.Fields{
+				"error":      err,
+				"durationMs": milliseconds(time.Since(start)),
+			})
+			reportExhaustion(conf, err, logger)
 		}
-		addrs, err = netlink.AddrList(iface, netlink.FAMILY_V4)
-		return err
+	}()
+
+	metrics := newMetrics(conf)
+	defer metrics.Flush()
+	var awsCalls int
+	aws.ObserveCalls(func(string, time.Duration, error) {
+		awsCalls++
 	})
 
-	if !conf.IPAM.SkipDeallocation {
-		// deallocate IPs outside of the namespace so creds are correct
-		for _, addr := range addrs {
-			aws.DeallocateIP(&addr.IP)
+	// Holding the lock too long cancels the EC2 calls, which then fail as
+	// timed out
+	held, unlock, err := cniipvlanvpck8s.IndexLockContext(ctx, conf.IPAM.IfaceIndex, conf.IPAM.LockTimeout.Duration)
+	if err != nil {
+		metrics.AllocationFailed("lock_timeout")
+		return lockError(err)
+	}
+	defer unlock()
+	ctx = held
+
+	// Pods in a namespace with its own subnet tags only use interfaces in
+	// the matching subnets
+	var subnetIDs []string
+	if tags, ok := conf.IPAM.NamespaceSubnetTags[pod.Namespace]; ok && pod.Namespace != "" {
+		subnetIDs, err = awsClient.SubnetIDsWithTags(tags)
+		if err != nil {
+			metrics.AllocationFailed(failureReason(err, "subnets"))
+			return aws.WrapError(err, "unable to find the subnets of namespace %v due to %v", pod.Namespace, err)
 		}
 	}
-	return nil
-}
 
-func main() {
-	run := func() error {
-		skel.PluginMain(cmdAdd, cmdDel, version.PluginSupports(version.Current()))
-		return nil
+	// A pre-provisioned interface is used exclusively, and never replaced
+	// by a new one
+	var existing *aws.Interface
+	if conf.IPAM.UseExistingENI != "" {
+		existing, err = awsClient.AttachedInterface(conf.IPAM.UseExistingENI)
+		if err != nil {
+			metrics.AllocationFailed(failureReason(err, "existing_interface"))
+			return aws.WrapError(err, "unable to use interface %v due to %v", conf.IPAM.UseExistingENI, err)
+		}
+	}
+
+	// Interfaces dedicated to other pods are never shared
+	exclusive, err := cniipvlanvpck8s.ExclusiveInterfaceIDs()
+	if err != nil {
+		metrics.AllocationFailed("lock_timeout")
+		return lockError(err)
+	}
+	aws.SetExclusiveInterfaces(exclusive)
+	// So are those whose gateway didn't answer a recent ADD, for its retry
+	unreachable, err := cniipvlanvpck8s.UnreachableInterfaceIDs()
+	if err != nil {
+		metrics.AllocationFailed("lock_timeout")
+		return lockError(err)
+	}
+	aws.SetUnreachableInterfaces(unreachable)
+
+	var alloc *aws.AllocationResult
+	var source string
+	if k8sArgs.ExclusiveENI {
+		if k8sArgs.IP != nil || conf.IPAM.IPv6Only || existing != nil {
+			metrics.AllocationFailed("exclusive_interface")
+			return &aws.Error{
+				Kind: aws.ErrConfig,
+				Err:  fmt.Errorf("ExclusiveENI isn't supported with a requested IP, ipv6Only or useExistingENI"),
+			}
+		}
+		alloc, source, err = allocateExclusive(ctx, conf, pod, args.ContainerID, metrics)
+	} else if k8sArgs.IP != nil {
+		if conf.IPAM.IPv6Only || existing != nil {
+			metrics.AllocationFailed("requested_ip")
+			return &aws.Error{
+				Kind: aws.ErrConfig,
+				Err:  fmt.Errorf("requesting IP %v isn't supported with ipv6Only or useExistingENI", k8sArgs.IP),
+			}
+		}
+		alloc, source, err = allocateRequestedIP(ctx, conf, pod, k8sArgs.IP, metrics)
+	} else if conf.IPAM.IPv6Only {
+		alloc, source, err = allocateIPv6Only(ctx, conf, pod, existing, subnetIDs, metrics, logger)
+	} else {
+		alloc, source, err = allocateIP(ctx, conf, pod, existing, subnetIDs, metrics, logger)
+	}
+	if err != nil {
+		return err
+	}
+
+	// A failed ADD isn't retried with the same allocation, so what was
+	// allocated for it is given back rather than leaked. The operation may
+	// have run out of time, so the release gets its own.
+	var policyRules []nl.PolicyRule
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, rule := range policyRules {
+			if removeErr := nl.RemovePolicyRule(rule); removeErr != nil {
+				logger.Log("unable to remove policy rule", cniipvlanvpck8s.Fields{"ip": rule.IP, "table": rule.Table, "error": removeErr})
+			}
+		}
+		releaseCtx, cancel := operationContext(conf)
+		defer cancel()
+		if releaseErr := releaseAllocation(releaseCtx, alloc, source, args.ContainerID); releaseErr != nil {
+			logger.Log("unable to release allocation", cniipvlanvpck8s.Fields{"source": source, "error": releaseErr})
+		}
+	}()
+
+	master, err := upMaster(conf, alloc.Interface)
+	if err != nil {
+		metrics.AllocationFailed("link_down")
+		return err
+	}
+
+	// ipvlan links inherit the master's MTU and can't exceed it, so the
+	// MTU is applied to the master
+	if conf.IPAM.MTU > 0 {
+		err = nl.SetMtu(master, conf.IPAM.MTU)
+		if err != nil {
+			metrics.AllocationFailed("mtu")
+			return fmt.Errorf("unable to set MTU %d on interface %v due to %v",
+				conf.IPAM.MTU, master, err)
+		}
+	}
+
+	if conf.IPAM.EnableIPv6 && alloc.IPv6 == nil {
+		// Reuse an IPv6 address left behind on this interface before
+		// asking EC2 for a new one
+		alloc.IPv6, err = cniipvlanvpck8s.ClaimFreeIPv6On(alloc.Interface)
+		if err == nil && alloc.IPv6 == nil {
+			alloc.IPv6, err = awsClient.AllocateIPv6On(ctx, alloc.Interface)
+			if err == nil {
+				err = cniipvlanvpck8s.ClaimIP(*alloc.IPv6)
+			}
+		}
+		if err != nil {
+			metrics.AllocationFailed(failureReason(err, "ipv6"))
+			return fmt.Errorf("unable to allocate an IPv6 address on %v due to %v",
+				alloc.Interface.LocalName(),
+				err)
+		}
 	}
-	_ = cniipvlanvpck8s.LockfileRun(run)
+
+	// In the l3 modes the master routes for the ipvlan link and there is no
+	// ARP, so routes are on-link rather than via the gateway
+	onLink := conf.IPAM.IpvlanMode == "l3" || conf.IPAM.IpvlanMode == "l3s"
+
+	result := &current.Result{}
+	result.Interfaces = resultInterfaces(master, alloc.Interface, args)
+
+	// IPv6-only pods get no IPv4 address, gateway or routes
+	var gw net.IP
+	if alloc.IP != nil {
+		// Per https://docs.aws.amazon.com/AmazonVPC/latest/UserGuide/VPC_Subnets.html
+		// the first host of the subnet is our gateway
+		gw, err = alloc.Interface.Gateway()
+		if err == nil && gw.Equal(*alloc.IP) {
+			err = fmt.Errorf("%v is the gateway of subnet %v", gw, alloc.Interface.SubnetCidr)
+		}
+		if err != nil {
+			metrics.AllocationFailed("gateway")
+			return fmt.Errorf("unable to determine the subnet gateway: %v", err)
+		}
+		if onLink {
+			gw = nil
+		}
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Address: net.IPNet{
+				IP:   *alloc.IP,
+				Mask: alloc.Interface.SubnetCidr.Mask,
+			},
+			Gateway:   gw,
+			Interface: current.Int(sandboxInterface),
+		})
+
+		// add routes for all VPC cidrs via the subnet gateway. The metric is
+		// carried in the result's route priority.
+		for _, dst := range vpcRoutes(conf, alloc.Interface.VpcCidrs) {
+			result.Routes = append(result.Routes, &types.Route{Dst: *dst, GW: gw, Priority: conf.IPAM.RouteMetric})
+		}
+
+		// send all other traffic out of the ENI instead of the host's default
+		if conf.IPAM.SetDefaultRoute {
+			result.Routes = append(result.Routes, &types.Route{
+				Dst: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+				GW:  gw,
+			})
+		}
+	}
+
+	var gw6 net.IP
+	if alloc.IPv6 != nil {
+		gw6, err = alloc.Interface.IPv6Gateway()
+		if err == nil && gw6.Equal(*alloc.IPv6) {
+			err = fmt.Errorf("%v is the gateway of subnet %v", gw6, alloc.Interface.SubnetIPv6Cidr)
+		}
+		if err != nil {
+			metrics.AllocationFailed("gateway")
+			return fmt.Errorf("unable to determine the IPv6 subnet gateway: %v", err)
+		}
+		if onLink {
+			gw6 = nil
+		}
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Address: net.IPNet{
+				IP:   *alloc.IPv6,
+				Mask: alloc.Interface.SubnetIPv6Cidr.Mask,
+			},
+			Gateway:   gw6,
+			Interface: current.Int(sandboxInterface),
+		})
+		for _, dst := range vpcRoutes(conf, alloc.Interface.VpcIPv6Cidrs) {
+			result.Routes = append(result.Routes, &types.Route{Dst: *dst, GW: gw6, Priority: conf.IPAM.RouteMetric})
+		}
+	}
+
+	// IPv4 destinations are reached through the NAT64 prefix, which the
+	// VPC routes to a NAT gateway
+	if conf.IPAM.NAT64Prefix != "" {
+		_, dst, _ := net.ParseCIDR(conf.IPAM.NAT64Prefix)
+		result.Routes = append(result.Routes, &types.Route{Dst: *dst, GW: gw6})
+	}
+
+	// add the configured routes beyond the VPC, by default via the subnet
+	// gateway of their address family
+	for _, route := range conf.IPAM.ExtraRoutes {
+		_, dst, _ := net.ParseCIDR(route.Dst)
+		routeGW := net.ParseIP(route.GW)
+		if routeGW == nil {
+			routeGW = gw
+			if dst.IP.To4() == nil {
+				routeGW = gw6
+			}
+		}
+		result.Routes = append(result.Routes, &types.Route{Dst: *dst, GW: routeGW})
+	}
+
+	// add the routes of the subnet's route table, such as those to transit
+	// gateways, via the subnet gateway
+	if conf.IPAM.ImportSubnetRoutes {
+		dsts, err := awsClient.SubnetRoutes(alloc.Interface)
+		if err != nil {
+			metrics.AllocationFailed(failureReason(err, "route_table"))
+			return aws.WrapError(err, "unable to import the routes of subnet %v due to %v", alloc.Interface.SubnetID, err)
+		}
+		result.Routes = append(result.Routes, subnetRoutes(result.Routes, dsts, alloc, gw, gw6)...)
+	}
+
+	result.DNS, err = podDNS(conf, alloc)
+	if err != nil {
+		metrics.AllocationFailed(failureReason(err, "dns"))
+		return err
+	}
+
+	// Pod traffic routed by the host, such as via unnumbered-ptp, must
+	// leave through the ENI owning its IP, or the VPC's source/dest check
+	// drops it
+	if conf.IPAM.PolicyRouting {
+		policyRules, err = addPolicyRoutes(master, alloc)
+		if err != nil {
+			metrics.AllocationFailed("policy_routing")
+			return fmt.Errorf("unable to add policy routes via interface %v: %v", alloc.Interface.ID, err)
+		}
+	}
+
+	// A gateway which doesn't answer would blackhole the Pod's routes, so
+	// the ADD fails for the runtime to retry on another interface
+	if conf.IPAM.VerifyGateway && alloc.IP != nil {
+		gateway, err := alloc.Interface.Gateway()
+		if err == nil {
+			err = nl.ProbeGateway(master, *alloc.IP, gateway, conf.IPAM.VerifyGatewayTimeout.Duration)
+		}
+		if err != nil {
+			metrics.AllocationFailed("gateway_unreachable")
+			if markErr := cniipvlanvpck8s.MarkGatewayUnreachable(alloc.Interface.ID); markErr != nil {
+				logger.Log("unable to skip the interface", cniipvlanvpck8s.Fields{"interfaceID": alloc.Interface.ID, "error": markErr})
+			}
+			return fmt.Errorf("subnet gateway of interface %v is unreachable: %v", alloc.Interface.ID, err)
+		}
+	}
+
+	// Announcing the IP only speeds up the first packets, so a failure
+	// doesn't fail the ADD
+	if conf.IPAM.SendGratuitousARP && alloc.IP != nil {
+		if err := nl.SendGratuitousARP(master, *alloc.IP); err != nil {
+			logger.Log("unable to send a gratuitous ARP", cniipvlanvpck8s.Fields{"error": err})
+		}
+	}
+
+	// Only recorded for tooling, so a failed lookup doesn't fail the ADD
+	az, azErr := awsClient.AvailabilityZone()
+	if azErr != nil {
+		logger.Log("unable to find the availability zone", cniipvlanvpck8s.Fields{"error": azErr})
+	}
+
+	metrics.AllocationSucceeded()
+	fields := cniipvlanvpck8s.Fields{
+		"source":           source,
+		"strategy":         conf.IPAM.AllocationStrategy,
+		"interface":        alloc.Interface.LocalName(),
+		"master":           master,
+		"interfaceID":      alloc.Interface.ID,
+		"subnetID":         alloc.Interface.SubnetID,
+		"availabilityZone": az,
+		"durationMs":       milliseconds(time.Since(start)),
+	}
+	if alloc.IP != nil {
+		fields["ip"] = alloc.IP.String()
+	}
+	if conf.IPAM.SetDefaultRoute {
+		fields["defaultRoute"] = "via " + master
+	} else {
+		fields["defaultRoute"] = "inherited"
+	}
+	if alloc.IPv6 != nil {
+		fields["ipv6"] = alloc.IPv6.String()
+	}
+	logger.Log("add succeeded", fields)
+
+	// GC releases the IPs of attachments the runtime no longer lists
+	var ips []net.IP
+	for _, ipc := range result.IPs {
+		ips = append(ips, ipc.Address.IP)
+	}
+	attachment := cniipvlanvpck8s.Attachment{ContainerID: args.ContainerID, IfName: args.IfName}
+	if err := cniipvlanvpck8s.RecordAttachment(attachment, ips, alloc.Interface, az, pod, policyRules); err != nil {
+		logger.Log("unable to record attachment", cniipvlanvpck8s.Fields{"error": err})
+	}
+	if err := cniipvlanvpck8s.RecordPlan(allocationPlan(args, pod, alloc, source, awsCalls)); err != nil {
+		logger.Log("unable to record plan", cniipvlanvpck8s.Fields{"error": err})
+	}
+
+	err = types.PrintResult(result, conf.CNIVersion)
+	if err == nil && conf.IPAM.WarmIPTarget > 0 {
+		startWarmPool(args.StdinData)
+	}
+	if err == nil && conf.IPAM.WarmENITarget > 0 {
+		startWarmENIs(args.StdinData)
+	}
+	return err
+}
+
+// allocationPlan describes the decision of an ADD for the audit trail
+func allocationPlan(args *skel.CmdArgs, pod aws.PodInfo, alloc *aws.AllocationResult, source string, awsCalls int) cniipvlanvpck8s.AllocationPlan {
+	plan := cniipvlanvpck8s.AllocationPlan{
+		ContainerID:  args.ContainerID,
+		IfName:       args.IfName,
+		PodNamespace: pod.Namespace,
+		PodName:      pod.Name,
+		Time:         time.Now(),
+		Source:       source,
+		ReusedFreeIP: source == "free",
+		InterfaceID:  alloc.Interface.ID,
+		Adapter:      alloc.Interface.LocalName(),
+		SubnetID:     alloc.Interface.SubnetID,
+		AWSCalls:     awsCalls,
+	}
+	if alloc.IP != nil {
+		plan.IP = alloc.IP.String()
+	}
+	if alloc.IPv6 != nil {
+		plan.IPv6 = alloc.IPv6.String()
+	}
+	return plan
+}
+
+// sandboxInterface is the index of the container's link in the result's
+// interfaces, which the IPs refer to
+const sandboxInterface = 1
+
+// addPolicyRoutes routes the Pod's IPs through the table of its interface,
+// via the subnet gateway of each address family. It returns the rules
+// added, for DEL to remove, also when it fails part way.
+func addPolicyRoutes(master string, alloc *aws.AllocationResult) ([]nl.PolicyRule, error) {
+	table := nl.PolicyTable(alloc.Interface.Number)
+	var rules []nl.PolicyRule
+	if alloc.IP != nil {
+		gw, err := alloc.Interface.Gateway()
+		if err != nil {
+			return nil, err
+		}
+		rule, err := nl.AddPolicyRoute(master, table, *alloc.IP, gw)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	if alloc.IPv6 != nil {
+		gw6, err := alloc.Interface.IPv6Gateway()
+		if err != nil {
+			return rules, err
+		}
+		rule, err := nl.AddPolicyRoute(master, table, *alloc.IPv6, gw6)
+		if err != nil {
+			return rules, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// resultInterfaces returns the interfaces of the result: the master, then
+// the container's ipvlan link, which shares the master's MAC and holds the
+// addresses. Chained plugins like portmap and bandwidth find the
+// container's link by its sandbox.
+func resultInterfaces(master string, intf aws.Interface, args *skel.CmdArgs) []*current.Interface {
+	return []*current.Interface{{
+		Name: master,
+		Mac:  intf.Mac,
+	}, {
+		Name:    args.IfName,
+		Mac:     intf.Mac,
+		Sandbox: args.Netns,
+	}}
+}
+
+// upMaster finds the master link of the interface and brings it up. The
+// kernel's ethN naming doesn't necessarily follow the EC2 device index, so
+// the master is found by its MAC unless it's configured. It's a variable
+// for tests.
+var upMaster = func(conf *PluginConf, intf aws.Interface) (string, error) {
+	master := masterOverride(conf, intf.Number)
+	if master == "" {
+		var err error
+		master, err = nl.LinkNameByMacPoll(intf.Mac, conf.IPAM.LinkReadyTimeout.Duration, 0)
+		if err != nil {
+			return "", fmt.Errorf("unable to find the link for interface %v due to %v",
+				intf.LocalName(),
+				err)
+		}
+	} else if _, err := netlink.LinkByName(master); err != nil {
+		return "", fmt.Errorf("master %v of interface %v not found: %v",
+			master, intf.LocalName(), err)
+	}
+
+	if err := nl.UpInterfacePollTimeout(master, conf.IPAM.LinkReadyTimeout.Duration, 0); err != nil {
+		return "", fmt.Errorf("unable to bring up interface %v due to %v",
+			master,
+			err)
+	}
+	return master, nil
+}
+
+// releaseAllocation undoes an allocation of a failed ADD by its source:
+// interfaces created for it are freed, addresses assigned for it are
+// unassigned, and IPs which were free already are only unclaimed.
+func releaseAllocation(ctx context.Context, alloc *aws.AllocationResult, source string, containerID string) error {
+	var ips []net.IP
+	if alloc.IP != nil {
+		ips = append(ips, *alloc.IP)
+	}
+	if alloc.IPv6 != nil {
+		ips = append(ips, *alloc.IPv6)
+	}
+	defer cniipvlanvpck8s.ReleaseClaims(ips)
+
+	switch source {
+	case "new-interface", "exclusive-interface":
+		if err := awsClient.FreeInterface(alloc.Interface); err != nil {
+			return fmt.Errorf("unable to free interface %v: %v", alloc.Interface.ID, err)
+		}
+		if source == "exclusive-interface" {
+			return cniipvlanvpck8s.ReleaseExclusiveInterface(containerID)
+		}
+	case "existing-interface", "requested":
+		if _, err := awsClient.DeallocateIPs(ctx, ips); err != nil {
+			return fmt.Errorf("unable to deallocate %v: %v", ips, err)
+		}
+	}
+	return nil
+}
+
+// masterOverride returns the configured master of the interface with the
+// given device number, or "" if it's found by MAC
+func masterOverride(conf *PluginConf, number int) string {
+	override := conf.IPAM.MasterInterfaceOverride
+	if strings.Contains(override, "%d") {
+		return fmt.Sprintf(override, number)
+	}
+	return override
+}
+
+// podDNS returns the DNS configuration of the pod. Unless nameservers are
+// configured, it's the VPC's DHCP options when enabled or the VPC DNS
+// server, which is at the primary cidr + 2, or on Nitro instances at a
+// fixed IPv6 address for IPv6-only pods.
+func podDNS(conf *PluginConf, alloc *aws.AllocationResult) (types.DNS, error) {
+	dns := types.DNS{
+		Nameservers: conf.IPAM.DNSNameservers,
+		Domain:      conf.IPAM.DNSDomain,
+		Search:      conf.IPAM.DNSSearch,
+		Options:     conf.IPAM.DNSOptions,
+	}
+	if len(dns.Nameservers) > 0 {
+		return dns, nil
+	}
+
+	servers := []string{aws.AmazonProvidedDNS}
+	if conf.IPAM.UseDhcpOptionsDNS {
+		options, err := aws.VPCDHCPOptions(alloc.Interface.VpcID)
+		if err != nil {
+			return dns, fmt.Errorf("unable to look up the DHCP options of VPC %v: %v", alloc.Interface.VpcID, err)
+		}
+		if len(options.DomainNameServers) > 0 {
+			servers = options.DomainNameServers
+		}
+		if dns.Domain == "" {
+			dns.Domain = options.DomainName
+		}
+	}
+
+	for _, server := range servers {
+		if server == aws.AmazonProvidedDNS {
+			if alloc.IP == nil {
+				server = vpcIPv6DNS
+			} else {
+				ip, err := vpcDNSServer(alloc.Interface.VpcPrimaryCidr, conf.IPAM.DNSHostOffset)
+				if err != nil {
+					return dns, fmt.Errorf("unable to determine the VPC DNS server: %v", err)
+				}
+				server = ip.String()
+			}
+		}
+		dns.Nameservers = append(dns.Nameservers, server)
+	}
+	return dns, nil
+}
+
+// vpcDNSServer returns the host at offset in the VPC's primary CIDR. It
+// must be neither the network nor the broadcast address.
+func vpcDNSServer(cidr *net.IPNet, offset int) (net.IP, error) {
+	if cidr == nil {
+		return nil, fmt.Errorf("no VPC CIDR block available")
+	}
+	ones, bits := cidr.Mask.Size()
+	if last := 1<<uint(bits-ones) - 1; offset < 1 || offset >= last {
+		return nil, fmt.Errorf("offset %d is not a host of %v", offset, cidr)
+	}
+	return aws.OffsetIP(cidr, offset)
+}
+
+// interfaceOptions returns the options new interfaces are created with,
+// for pod unless it's the zero PodInfo
+func interfaceOptions(conf *PluginConf, pod aws.PodInfo) aws.InterfaceOptions {
+	return aws.InterfaceOptions{
+		SecurityGroups:             conf.IPAM.SecGroupIds,
+		SubnetTags:                 conf.IPAM.SubnetTags,
+		SubnetExcludeTags:          conf.IPAM.SubnetExcludeTags,
+		SubnetIDs:                  conf.IPAM.SubnetIds,
+		MinimumFreeIPs:             conf.IPAM.MinimumFreeIPs,
+		MaxInterfaces:              conf.IPAM.MaxENIs,
+		Tags:                       conf.IPAM.ENITags,
+		NodeName:                   conf.IPAM.NodeName,
+		DisableSourceDestCheck:     conf.IPAM.DisableSourceDestCheck,
+		SubnetSecurityGroups:       subnetSecurityGroups(conf),
+		Pod:                        pod,
+		NamespaceSubnetTags:        conf.IPAM.NamespaceSubnetTags,
+		DescriptionPrefix:          conf.IPAM.ENIDescriptionPrefix,
+		ClusterName:                conf.IPAM.ClusterName,
+		UseVPCDefaultSecurityGroup: conf.IPAM.UseVPCDefaultSG,
+		NetworkCardIndex:           conf.IPAM.NetworkCardIndex,
+	}
+}
+
+// newInterface creates an interface for an ADD which found no room on the
+// existing ones
+func newInterface(ctx context.Context, conf *PluginConf, pod aws.PodInfo, metrics *cniipvlanvpck8s.MetricsRecorder) (*aws.Interface, error) {
+	if conf.IPAM.NoCreateENI {
+		metrics.AllocationFailed("interface_create_disabled")
+		return nil, &aws.Error{Kind: aws.ErrInsufficientIPs, Err: fmt.Errorf("no capacity and ENI creation disabled")}
+	}
+
+	var newIf *aws.Interface
+	err := cniipvlanvpck8s.InterfaceLockfileRun(conf.IPAM.LockTimeout.Duration, func() (err error) {
+		newIf, err = awsClient.NewInterface(ctx, interfaceOptions(conf, pod))
+		return
+	})
+	if _, ok := err.(cniipvlanvpck8s.LockTimeoutError); ok {
+		metrics.AllocationFailed("lock_timeout")
+		return nil, lockError(err)
+	}
+	if err != nil {
+		metrics.AllocationFailed(failureReason(err, "interface_create"))
+		return nil, aws.WrapError(err, "unable to create a new elastic network interface due to %v",
+			err)
+	}
+	metrics.InterfaceCreated()
+	return newIf, nil
+}
+
+// allocateRequestedIP allocates the IPv4 address the pod asked for in
+// CNI_ARGS. It's used as is when it's already assigned to an interface at
+// the index without being in use, otherwise it's assigned from EC2.
+func allocateRequestedIP(ctx context.Context, conf *PluginConf, pod aws.PodInfo, ip net.IP, metrics *cniipvlanvpck8s.MetricsRecorder) (*aws.AllocationResult, string, error) {
+	interfaces, err := awsClient.GetInterfaces()
+	if err != nil {
+		metrics.AllocationFailed(failureReason(err, "metadata"))
+		return nil, "", fmt.Errorf("unable to list interfaces due to %v", err)
+	}
+	// The claim keeps concurrent ADDs from handing out the IP, whether
+	// it's free already or about to be assigned
+	if err := cniipvlanvpck8s.ClaimRequestedIP(ip, pod.UID); err != nil {
+		metrics.AllocationFailed("requested_ip")
+		return nil, "", fmt.Errorf("unable to claim requested IP %v due to %v", ip, err)
+	}
+	release := func() {
+		_ = cniipvlanvpck8s.ReleaseClaims([]net.IP{ip})
+	}
+
+	for _, intf := range interfaces {
+		for _, assigned := range intf.AssignedIPv4s() {
+			if !assigned.Equal(ip) {
+				continue
+			}
+			if intf.Number < conf.IPAM.IfaceIndex {
+				release()
+				metrics.AllocationFailed("requested_ip")
+				return nil, "", fmt.Errorf("requested IP %v is in use on interface %v", ip, intf.ID)
+			}
+			return &aws.AllocationResult{IP: &ip, Interface: intf}, "free", nil
+		}
+	}
+
+	if err := checkIPBudget(conf, metrics); err != nil {
+		release()
+		return nil, "", err
+	}
+	alloc, err := awsClient.AllocateSpecificIPAtIndex(ctx, conf.IPAM.IfaceIndex, ip)
+	if err != nil {
+		release()
+		metrics.AllocationFailed(failureReason(err, "requested_ip"))
+		return nil, "", aws.WrapError(err, "unable to allocate requested IP %v due to %v", ip, err)
+	}
+	return alloc, "requested", nil
+}
+
+// checkIPBudget fails once the interfaces created by the plugin hold
+// maxIPsPerNode secondary IPs, counted across all interface indexes
+func checkIPBudget(conf *PluginConf, metrics *cniipvlanvpck8s.MetricsRecorder) error {
+	if conf.IPAM.MaxIPsPerNode == 0 {
+		return nil
+	}
+	count, err := awsClient.ManagedIPCount()
+	if err != nil {
+		metrics.AllocationFailed(failureReason(err, "ip_budget"))
+		return aws.WrapError(err, "unable to count the IPs of the node due to %v", err)
+	}
+	if count >= conf.IPAM.MaxIPsPerNode {
+		metrics.AllocationFailed("ip_budget")
+		return &aws.Error{
+			Kind: aws.ErrInsufficientIPs,
+			Err: fmt.Errorf("node holds %d IPs on its interfaces, the maxIPsPerNode budget of %d is used up",
+				count, conf.IPAM.MaxIPsPerNode),
+		}
+	}
+	return nil
+}
+
+// allocateIP allocates an IPv4 address for the pod, preferring a free one,
+// then one on an existing interface, then a new interface. It returns
+// where the address came from.
+func allocateIP(ctx context.Context, conf *PluginConf, pod aws.PodInfo, existing *aws.Interface, subnetIDs []string, metrics *cniipvlanvpck8s.MetricsRecorder, logger *cniipvlanvpck8s.Logger) (*aws.AllocationResult, string, error) {
+	source := "free"
+	var alloc *aws.AllocationResult
+	var err error
+	// Try to find a free IP first - possibly from a broken container,
+	// or torn down namespace. It's claimed so concurrent ADDs, including
+	// at other indexes, can't pick it before it's bound.
+	if existing != nil {
+		alloc, err = cniipvlanvpck8s.ClaimFreeIPOn(*existing, pod.UID)
+	} else {
+		var interfaces []aws.Interface
+		interfaces, err = awsClient.GetInterfaces()
+		if err == nil {
+			alloc, err = cniipvlanvpck8s.ClaimFreeIPAtIndex(interfaces, conf.IPAM.IfaceIndex, pod.UID, subnetIDs)
+		}
+	}
+	if err == nil && alloc != nil && !freeIPAssigned(alloc, logger) {
+		alloc = nil
+	}
+	if err != nil || alloc == nil {
+		if err := checkIPBudget(conf, metrics); err != nil {
+			return nil, "", err
+		}
+		// allocate an IP on an available interface
+		source = "existing-interface"
+		if existing != nil {
+			alloc, err = awsClient.AllocateIPOn(ctx, *existing)
+			if err != nil {
+				metrics.AllocationFailed(failureReason(err, "allocate"))
+				return nil, "", aws.WrapError(err, "unable to allocate an IP on interface %v due to %v", existing.ID, err)
+			}
+		} else {
+			alloc, source, err = allocateAtIndex(ctx, conf, pod, subnetIDs, logger)
+		}
+		// Out of time, an ENI can't be created either
+		if err != nil && ctx.Err() != nil {
+			metrics.AllocationFailed("timeout")
+			return nil, "", fmt.Errorf("unable to allocate an IP due to %v", err)
+		}
+		if err != nil {
+			logger.Log("no interface with free capacity", cniipvlanvpck8s.Fields{"error": err})
+			source = "new-interface"
+			// failed, so attempt to add an IP to a new interface
+			alloc, err = allocateOnNewInterface(ctx, conf, pod, metrics)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		// The new IP may show up as free in metadata before it's bound.
+		// A free IP of the warm pool fallback was claimed as it was found.
+		if source != "free" {
+			if err := cniipvlanvpck8s.ClaimIP(*alloc.IP); err != nil {
+				metrics.AllocationFailed("claim")
+				return nil, "", fmt.Errorf("unable to claim %v due to %v", alloc.IP, err)
+			}
+		}
+	}
+	return alloc, source, nil
+}
+
+// freeIPAssigned verifies with EC2 that a free IP found in metadata is
+// still assigned to its interface, as an IP moved to another ENI out of
+// band is no longer routed to this one. A moved IP stays claimed, so
+// other ADDs skip it until metadata catches up. When EC2 can't be asked
+// the IP is trusted, as free IPs were before.
+func freeIPAssigned(alloc *aws.AllocationResult, logger *cniipvlanvpck8s.Logger) bool {
+	assigned, err := awsClient.IsIPAssigned(alloc.Interface.ID, *alloc.IP)
+	if err != nil {
+		logger.Log("unable to verify free IP", cniipvlanvpck8s.Fields{"ip": alloc.IP.String(), "error": err})
+		return true
+	}
+	if !assigned {
+		logger.Log("free IP moved", cniipvlanvpck8s.Fields{
+			"ip":          alloc.IP.String(),
+			"interfaceID": alloc.Interface.ID,
+		})
+	}
+	return assigned
+}
+
+// allocateOnNewInterface creates an interface and returns its primary IP
+func allocateOnNewInterface(ctx context.Context, conf *PluginConf, pod aws.PodInfo, metrics *cniipvlanvpck8s.MetricsRecorder) (*aws.AllocationResult, error) {
+	newIf, err := newInterface(ctx, conf, pod, metrics)
+	if err != nil {
+		return nil, err
+	}
+	// If this interface has somehow gained more than one IP since being allocated,
+	// abort this process and let a subsequent run find a valid IP. The interface
+	// is released so repeated failures don't accumulate ENIs.
+	if len(newIf.IPv4s) != 1 {
+		metrics.AllocationFailed("interface_unusable")
+		if freeErr := awsClient.FreeInterface(*newIf); freeErr != nil {
+			return nil, fmt.Errorf("new elastic network interface %v has %d IPs and could not be freed: %v",
+				newIf.ID, len(newIf.IPv4s), freeErr)
+		}
+		return nil, fmt.Errorf("new elastic network interface %v has %d IPs, expected 1",
+			newIf.ID, len(newIf.IPv4s))
+	}
+	// Freshly allocated interfaces will always have one valid IP - use
+	// this IP address.
+	return &aws.AllocationResult{
+		IP:        &newIf.IPv4s[0],
+		Interface: *newIf,
+	}, nil
+}
+
+// allocateExclusive creates an interface dedicated to the container and
+// returns its primary IP. Other pods skip the interface until DEL of the
+// container releases it.
+func allocateExclusive(ctx context.Context, conf *PluginConf, pod aws.PodInfo, containerID string, metrics *cniipvlanvpck8s.MetricsRecorder) (*aws.AllocationResult, string, error) {
+	if err := checkIPBudget(conf, metrics); err != nil {
+		return nil, "", err
+	}
+	alloc, err := allocateOnNewInterface(ctx, conf, pod, metrics)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := cniipvlanvpck8s.ReserveExclusiveInterface(alloc.Interface.ID, containerID); err != nil {
+		metrics.AllocationFailed("exclusive_interface")
+		if freeErr := awsClient.FreeInterface(alloc.Interface); freeErr != nil {
+			return nil, "", fmt.Errorf("unable to dedicate interface %v due to %v, and it could not be freed: %v",
+				alloc.Interface.ID, err, freeErr)
+		}
+		return nil, "", fmt.Errorf("unable to dedicate interface %v due to %v", alloc.Interface.ID, err)
+	}
+	if err := cniipvlanvpck8s.ClaimIP(*alloc.IP); err != nil {
+		metrics.AllocationFailed("claim")
+		return nil, "", fmt.Errorf("unable to claim %v due to %v", alloc.IP, err)
+	}
+	return alloc, "exclusive-interface", nil
+}
+
+// allocateAtIndex allocates an IP on an interface at or above the index.
+// When EC2 finds the subnet of the chosen interface exhausted, IPs the
+// warm pool added since are taken, then the interfaces in the other
+// subnets are tried, before the caller falls back to a new interface. It
+// returns where the address came from.
+func allocateAtIndex(ctx context.Context, conf *PluginConf, pod aws.PodInfo, subnetIDs []string, logger *cniipvlanvpck8s.Logger) (*aws.AllocationResult, string, error) {
+	strategy := aws.AllocationStrategy(conf.IPAM.AllocationStrategy)
+	candidates := subnetIDs
+	var exhausted []string
+	for {
+		alloc, err := awsClient.AllocateIPAtIndex(ctx, conf.IPAM.IfaceIndex, strategy, candidates)
+		exhaustedErr, ok := err.(aws.SubnetExhaustedError)
+		if !ok {
+			return alloc, "existing-interface", err
+		}
+		exhausted = append(exhausted, exhaustedErr.SubnetID)
+
+		interfaces, err := awsClient.GetInterfaces()
+		if err != nil {
+			return nil, "", err
+		}
+		alloc, err = cniipvlanvpck8s.ClaimFreeIPAtIndex(interfaces, conf.IPAM.IfaceIndex, pod.UID, subnetIDs)
+		if err == nil && alloc != nil {
+			logger.Log("subnet exhausted", cniipvlanvpck8s.Fields{
+				"subnet":   exhaustedErr.SubnetID,
+				"fallback": "warm-pool",
+				"ip":       alloc.IP.String(),
+			})
+			return alloc, "free", nil
+		}
+
+		candidates = remainingSubnets(interfaces, conf.IPAM.IfaceIndex, subnetIDs, exhausted)
+		if len(candidates) == 0 {
+			logger.Log("subnet exhausted", cniipvlanvpck8s.Fields{
+				"subnet":   exhaustedErr.SubnetID,
+				"fallback": "new-interface",
+			})
+			return nil, "", exhaustedErr
+		}
+		logger.Log("subnet exhausted", cniipvlanvpck8s.Fields{
+			"subnet":     exhaustedErr.SubnetID,
+			"fallback":   "other-subnet",
+			"candidates": candidates,
+		})
+	}
+}
+
+// remainingSubnets returns the subnets of the pool at index which aren't
+// exhausted, restricted to subnetIDs unless it's nil
+func remainingSubnets(interfaces []aws.Interface, index int, subnetIDs []string, exhausted []string) []string {
+	return aws.Pool{Index: index, SubnetIDs: subnetIDs}.Subnets(interfaces, exhausted)
+}
+
+// allocateIPv6Only allocates only an IPv6 address for the pod, preferring a
+// free one, then one on an existing interface, then a new interface. The
+// interfaces' primary IPv4 addresses are never handed to pods.
+func allocateIPv6Only(ctx context.Context, conf *PluginConf, pod aws.PodInfo, existing *aws.Interface, subnetIDs []string, metrics *cniipvlanvpck8s.MetricsRecorder, logger *cniipvlanvpck8s.Logger) (*aws.AllocationResult, string, error) {
+	source := "free"
+	var alloc *aws.AllocationResult
+	var err error
+	if existing != nil {
+		var ip *net.IP
+		ip, err = cniipvlanvpck8s.ClaimFreeIPv6On(*existing)
+		if ip != nil {
+			alloc = &aws.AllocationResult{Interface: *existing, IPv6: ip}
+		}
+	} else {
+		var interfaces []aws.Interface
+		interfaces, err = awsClient.GetInterfaces()
+		if err == nil {
+			alloc, err = cniipvlanvpck8s.ClaimFreeIPv6AtIndex(interfaces, conf.IPAM.IfaceIndex, subnetIDs)
+		}
+	}
+	if err == nil && alloc != nil {
+		return alloc, source, nil
+	}
+
+	source = "existing-interface"
+	var intf *aws.Interface
+	if existing != nil {
+		intf = existing
+	} else {
+		alloc, err = awsClient.AllocateIPv6AtIndex(ctx, conf.IPAM.IfaceIndex, subnetIDs)
+		if err != nil {
+			logger.Log("no interface with free capacity", cniipvlanvpck8s.Fields{"error": err})
+			source = "new-interface"
+			intf, err = newInterface(ctx, conf, pod, metrics)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	if intf != nil {
+		var ip *net.IP
+		ip, err = awsClient.AllocateIPv6On(ctx, *intf)
+		if err != nil {
+			metrics.AllocationFailed(failureReason(err, "ipv6"))
+			return nil, "", aws.WrapError(err, "unable to allocate an IPv6 address on interface %v due to %v", intf.ID, err)
+		}
+		alloc = &aws.AllocationResult{Interface: *intf, IPv6: ip}
+	}
+
+	// The new address may show up as free in metadata before it's bound
+	if err := cniipvlanvpck8s.ClaimIP(*alloc.IPv6); err != nil {
+		metrics.AllocationFailed("claim")
+		return nil, "", fmt.Errorf("unable to claim %v due to %v", alloc.IPv6, err)
+	}
+	return alloc, source, nil
+}
+
+// startWarmPool refills the warm pool from a detached copy of this
+// binary. The runtime blocks until the plugin exits, so topping up the
+// pool synchronously would add EC2 latency to every pod start. The child
+// has no stdio attached so the runtime isn't left waiting on our output,
+// and it serializes against other invocations on the lockfile. The child
+// parses the configuration again, for EC2 calls made like the ADD's.
+func startWarmPool(config []byte) {
+	cmd := exec.Command(os.Args[0], warmPoolArgs(config)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.Env = append(os.Environ(), cniipvlanvpck8s.LockEnv()...)
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to refill the warm IP pool: %v\n", err)
+		return
+	}
+	_ = cmd.Process.Release()
+}
+
+// warmPoolArgs returns the arguments starting the warm pool process
+func warmPoolArgs(config []byte) []string {
+	return []string{warmPoolCommand, string(config)}
+}
+
+// parseWarmPoolArgs parses the configuration the warm pool process was
+// started with, applying its settings
+func parseWarmPoolArgs(args []string) (*PluginConf, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: %s config", warmPoolCommand)
+	}
+	return parseConfig([]byte(args[0]))
+}
+
+// runWarmPool is the entry point of the detached warm pool process
+func runWarmPool(args []string) error {
+	conf, err := parseWarmPoolArgs(args)
+	if err != nil {
+		return err
+	}
+	index := conf.IPAM.IfaceIndex
+	return cniipvlanvpck8s.IndexLockfileRun(context.Background(), index, 0, func(ctx context.Context) error {
+		exclusive, err := cniipvlanvpck8s.ExclusiveInterfaceIDs()
+		if err != nil {
+			return err
+		}
+		aws.SetExclusiveInterfaces(exclusive)
+		return cniipvlanvpck8s.TopUpWarmPool(ctx, index, conf.IPAM.WarmIPTarget, conf.IPAM.MaxIPsPerNode)
+	})
+}
+
+// startWarmENIs creates ENIs up to warmENITarget from a detached copy of
+// this binary, like startWarmPool. The child needs the configuration to
+// create ENIs the way ADD does.
+func startWarmENIs(config []byte) {
+	cmd := exec.Command(os.Args[0], warmENIsCommand, string(config))
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.Env = append(os.Environ(), cniipvlanvpck8s.LockEnv()...)
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create warm ENIs: %v\n", err)
+		return
+	}
+	_ = cmd.Process.Release()
+}
+
+// runWarmENIs is the entry point of the detached process creating warm
+// ENIs
+func runWarmENIs(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s config", warmENIsCommand)
+	}
+	conf, err := parseConfig([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+	return cniipvlanvpck8s.IndexLockfileRun(context.Background(), conf.IPAM.IfaceIndex, conf.IPAM.LockTimeout.Duration, func(ctx context.Context) error {
+		return cniipvlanvpck8s.TopUpWarmInterfaces(ctx, conf.IPAM.WarmENITarget,
+			interfaceOptions(conf, aws.PodInfo{}), conf.IPAM.LockTimeout.Duration)
+	})
+}
+
+// cmdCheck is called for CHECK requests. It verifies the container's
+// ipvlan interface still exists and that EC2 still assigns each address
+// of the previous result to the interface acting as its master.
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called with a prevResult to check")
+	}
+
+	var parentIndex int
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+		}
+		if _, ok := link.(*netlink.IPVlan); !ok {
+			return fmt.Errorf("%q is a %v interface, expected ipvlan", args.IfName, link.Type())
+		}
+		parentIndex = link.Attrs().ParentIndex
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	master, err := netlink.LinkByIndex(parentIndex)
+	if err != nil {
+		return fmt.Errorf("failed to lookup the master of %q: %v", args.IfName, err)
+	}
+
+	interfaces, err := awsClient.GetInterfaces()
+	if err != nil {
+		return err
+	}
+	for _, ipc := range conf.PrevResult.IPs {
+		index, err := aws.InterfaceIndexForIP(ipc.Address.IP)
+		if err != nil {
+			return err
+		}
+		expected, err := expectedMaster(conf, interfaces, index)
+		if err != nil {
+			return err
+		}
+		if expected != master.Attrs().Name {
+			return fmt.Errorf("%v is assigned to %v but %q uses master %v",
+				ipc.Address.IP, expected, args.IfName, master.Attrs().Name)
+		}
+	}
+
+	return nil
+}
+
+// expectedMaster returns the name of the master link of the interface at
+// index: the configured override, or else the link with its MAC, as it's
+// found by ADD
+func expectedMaster(conf *PluginConf, interfaces []aws.Interface, index int) (string, error) {
+	if master := masterOverride(conf, index); master != "" {
+		return master, nil
+	}
+	for _, intf := range interfaces {
+		if intf.Number == index {
+			return nl.LinkNameByMac(intf.Mac)
+		}
+	}
+	return "", fmt.Errorf("no interface at index %d in the instance metadata", index)
+}
+
+// isMissingNamespaceError reports whether err means the container's
+// namespace or interface no longer exists
+func isMissingNamespaceError(err error) bool {
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return true
+	}
+	return err.Error() == "Link not found" || os.IsNotExist(err)
+}
+
+// prevResultAddrs returns the addresses of the previous result passed to
+// DEL, if any
+func prevResultAddrs(conf *PluginConf) []netlink.Addr {
+	var addrs []netlink.Addr
+	if conf.PrevResult == nil {
+		return addrs
+	}
+	for _, ipc := range conf.PrevResult.IPs {
+		addr := ipc.Address
+		addrs = append(addrs, netlink.Addr{IPNet: &addr})
+	}
+	return addrs
+}
+
+// cmdDel is called for DELETE requests
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	k8sArgs, err := loadK8sArgs(args)
+	if err != nil {
+		return err
+	}
+	pod := k8sArgs.Pod()
+
+	ctx, cancel := operationContext(conf)
+	defer cancel()
+
+	logger := newLogger(conf, args, pod, "del")
+	defer logger.Close()
+
+	// DEL locks the index its ADD did. Deallocation doesn't depend on
+	// it, so an index no longer valid falls back to the configured one.
+	if err := applyIndexHint(conf, k8sArgs); err != nil {
+		logger.Log("ignoring interface index hint", cniipvlanvpck8s.Fields{"error": err})
+	}
+
+	metrics := newMetrics(conf)
+	defer metrics.Flush()
+
+	held, unlock, err := cniipvlanvpck8s.IndexLockContext(ctx, conf.IPAM.IfaceIndex, conf.IPAM.LockTimeout.Duration)
+	if err != nil {
+		return lockError(err)
+	}
+	defer unlock()
+	ctx = held
+
+	// The IPs the ADD returned are recorded, so they're released even
+	// when the namespace is gone. Otherwise they're read from the
+	// namespace.
+	var ips []net.IP
+	attachment := cniipvlanvpck8s.Attachment{ContainerID: args.ContainerID, IfName: args.IfName}
+	record, err := cniipvlanvpck8s.LookupAttachment(attachment)
+	if err != nil {
+		logger.Log("unable to look up attachment", cniipvlanvpck8s.Fields{"error": err})
+	}
+	if record != nil {
+		for _, recorded := range record.IPs {
+			if ip := net.ParseIP(recorded); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	} else {
+		ips = namespaceIPs(conf, args, logger)
+	}
+	removePolicyRules(conf, record, ips, logger)
+
+	// kept IPs become free again after the cooldown rather than after
+	// their claim expires
+	if err := cniipvlanvpck8s.ReleaseIPs(ips, conf.IPAM.IPReuseCooldown.Duration); err != nil {
+		logger.Log("unable to release claims", cniipvlanvpck8s.Fields{"error": err})
+	}
+
+	// keep the pod's IPv4 assigned for its next ADD, where a restarted pod
+	// gets it back
+	if conf.IPAM.ReservationTTL.Duration > 0 && pod.UID != "" {
+		for i, ip := range ips {
+			if ip.To4() == nil {
+				continue
+			}
+			if err := cniipvlanvpck8s.ReserveIP(pod.UID, ip, conf.IPAM.ReservationTTL.Duration); err != nil {
+				logger.Log("unable to reserve IP", cniipvlanvpck8s.Fields{"ip": ip.String(), "error": err})
+				break
+			}
+			logger.Log("reserved", cniipvlanvpck8s.Fields{"ip": ip.String()})
+			ips = append(append([]net.IP{}, ips[:i]...), ips[i+1:]...)
+			break
+		}
+	}
+
+	// keep the IPs assigned for pods replacing this one, and deallocate
+	// those left unused in the background once the delay passes. IPs
+	// which can't be held are deallocated right away.
+	deallocate := !conf.IPAM.SkipDeallocation
+	if deallocate && conf.IPAM.DeallocateDelay.Duration > 0 && len(ips) > 0 {
+		if err := cniipvlanvpck8s.HoldIPs(ips, conf.IPAM.DeallocateDelay.Duration); err != nil {
+			logger.Log("unable to hold IPs", cniipvlanvpck8s.Fields{"error": err})
+		} else {
+			logger.Log("held", cniipvlanvpck8s.Fields{"ips": len(ips)})
+			startDeallocateHeld(args.StdinData)
+			deallocate = false
+		}
+	}
+
+	if deallocate {
+		// deallocate IPs outside of the namespace so creds are correct
+		released, err := awsClient.DeallocateIPs(ctx, ips)
+		metrics.Deallocated(released)
+		if err != nil {
+			logger.Log("deallocation failed", cniipvlanvpck8s.Fields{"released": released, "error": err})
+			// Fail so the runtime retries DEL rather than leaking the IPs.
+			// The record is kept for the retry.
+			return timeoutError(ctx, err)
+		}
+		logger.Log("deallocated", cniipvlanvpck8s.Fields{"released": released})
+		if released > 0 && conf.IPAM.ReleaseEmptyENIs {
+			startReleaseEmptyENIs(args.StdinData)
+		}
+	}
+
+	if err := cniipvlanvpck8s.RemoveAttachment(attachment); err != nil {
+		logger.Log("unable to remove attachment", cniipvlanvpck8s.Fields{"error": err})
+	}
+	if err := cniipvlanvpck8s.RemovePlan(args.ContainerID); err != nil {
+		logger.Log("unable to remove plan", cniipvlanvpck8s.Fields{"error": err})
+	}
+	if err := cniipvlanvpck8s.ReleaseExclusiveInterface(args.ContainerID); err != nil {
+		logger.Log("unable to release exclusive interface", cniipvlanvpck8s.Fields{"error": err})
+	}
+	return nil
+}
+
+// removePolicyRules removes the rules the ADD recorded for the attachment,
+// and with them the routes of tables no other Pod uses. Without a record,
+// the rules from the container's IPs are. A leftover rule is replaced when
+// the IP is next allocated, so failures are logged.
+func removePolicyRules(conf *PluginConf, record *cniipvlanvpck8s.AttachmentRecord, ips []net.IP, logger *cniipvlanvpck8s.Logger) {
+	if record != nil {
+		for _, rule := range record.PolicyRules {
+			if err := nl.RemovePolicyRule(rule); err != nil {
+				logger.Log("unable to remove policy rule", cniipvlanvpck8s.Fields{"ip": rule.IP, "table": rule.Table, "error": err})
+			}
+		}
+		return
+	}
+	if !conf.IPAM.PolicyRouting {
+		return
+	}
+	for _, ip := range ips {
+		if err := nl.RemovePolicyRules(ip); err != nil {
+			logger.Log("unable to remove policy rules", cniipvlanvpck8s.Fields{"ip": ip.String(), "error": err})
+		}
+	}
+}
+
+// namespaceIPs returns the IPs bound in the container's namespace, or
+// those of the previous result if the namespace is gone
+func namespaceIPs(conf *PluginConf, args *skel.CmdArgs, logger *cniipvlanvpck8s.Logger) []net.IP {
+	var addrs []netlink.Addr
+
+	// enter the namespace to grab the list of IPs
+	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		iface, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return err
+		}
+		addrs, err = netlink.AddrList(iface, netlink.FAMILY_V4)
+		if err != nil || !conf.IPAM.EnableIPv6 {
+			return err
+		}
+		v6addrs, err := netlink.AddrList(iface, netlink.FAMILY_V6)
+		for _, addr := range v6addrs {
+			// Link-local addresses are kernel assigned, not from EC2
+			if !addr.IP.IsLinkLocalUnicast() {
+				addrs = append(addrs, addr)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		logger.Log("unable to list container addresses", cniipvlanvpck8s.Fields{"error": err})
+		if isMissingNamespaceError(err) {
+			// The container is already gone, as happens on abrupt
+			// shutdown. DEL must still succeed, so release what the
+			// runtime recorded in the previous result instead.
+			addrs = prevResultAddrs(conf)
+		}
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips
+}
+
+// startReleaseEmptyENIs releases empty ENIs from a detached copy of this
+// binary, like startWarmPool. The child must exclude all allocations,
+// which it can't while this invocation holds its index lock.
+func startReleaseEmptyENIs(config []byte) {
+	cmd := exec.Command(os.Args[0], releaseENIsCommand, string(config))
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to release empty ENIs: %v\n", err)
+		return
+	}
+	_ = cmd.Process.Release()
+}
+
+// runReleaseEmptyENIs is the entry point of the detached process
+// releasing empty ENIs
+func runReleaseEmptyENIs(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s config", releaseENIsCommand)
+	}
+	conf, err := parseConfig([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+	release := func() (next time.Time, err error) {
+		err = cniipvlanvpck8s.LockfileRunContext(context.Background(), func(ctx context.Context) (err error) {
+			_, next, err = aws.ReleaseEmptyInterfaces(ctx, conf.IPAM.MinimumWarmENIs, conf.IPAM.WarmENITarget,
+				conf.IPAM.ENIReleaseCooldown.Duration)
+			return
+		})
+		return
+	}
+
+	next, err := release()
+	if err != nil || next.IsZero() {
+		return err
+	}
+	// Wait out the cooldown of the ENIs this DEL emptied. Their deadlines
+	// are persisted, so a release due earlier is done by whichever process
+	// gets to it first.
+	time.Sleep(time.Until(next))
+	_, err = release()
+	return err
+}
+
+// startDeallocateHeld deallocates the IPs held by a DEL from a detached
+// copy of this binary, like startReleaseEmptyENIs
+func startDeallocateHeld(config []byte) {
+	cmd := exec.Command(os.Args[0], deallocateHeldCommand, string(config))
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to deallocate held IPs: %v\n", err)
+		return
+	}
+	_ = cmd.Process.Release()
+}
+
+// runDeallocateHeld is the entry point of the detached process
+// deallocating held IPs. It waits out the delay of the DEL which started
+// it, then deallocates every held IP due and unused. IPs held later are
+// due later, and left to the process of their own DEL. IPs which fail to
+// deallocate are left to GC.
+func runDeallocateHeld(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s config", deallocateHeldCommand)
+	}
+	conf, err := parseConfig([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+	time.Sleep(conf.IPAM.DeallocateDelay.Duration)
+
+	ips, err := cniipvlanvpck8s.TakeHeldIPs()
+	if err != nil || len(ips) == 0 {
+		return err
+	}
+	defer cniipvlanvpck8s.ReleaseClaims(ips)
+
+	ctx, cancel := operationContext(conf)
+	defer cancel()
+	metrics := newMetrics(conf)
+	defer metrics.Flush()
+
+	released, err := awsClient.DeallocateIPs(ctx, ips)
+	metrics.Deallocated(released)
+	if released > 0 && conf.IPAM.ReleaseEmptyENIs {
+		startReleaseEmptyENIs([]byte(args[0]))
+	}
+	return err
+}
+
+// cmdGC is called for GC requests. IPs of attachments missing from the
+// valid ones the runtime supplies are deallocated, as are unbound managed
+// IPs beyond the warm pool, excluding all allocations meanwhile.
+func cmdGC(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := operationContext(conf)
+	defer cancel()
+
+	logger := newLogger(conf, args, aws.PodInfo{}, "gc")
+	defer logger.Close()
+
+	metrics := newMetrics(conf)
+	defer metrics.Flush()
+
+	var valid []cniipvlanvpck8s.Attachment
+	for _, attachment := range conf.ValidAttachments {
+		valid = append(valid, cniipvlanvpck8s.Attachment{
+			ContainerID: attachment.ContainerID,
+			IfName:      attachment.IfName,
+		})
+	}
+
+	var released int
+	err = cniipvlanvpck8s.LockfileRunContext(ctx, func(ctx context.Context) error {
+		garbage, err := cniipvlanvpck8s.CollectGarbage(valid, conf.IPAM.WarmIPTarget)
+		if err != nil || len(garbage) == 0 || conf.IPAM.SkipDeallocation {
+			return err
+		}
+		released, err = awsClient.DeallocateIPs(ctx, garbage)
+		return err
+	})
+	metrics.Deallocated(released)
+	if err != nil {
+		logger.Log("gc failed", cniipvlanvpck8s.Fields{"released": released, "error": err})
+		return lockError(timeoutError(ctx, err))
+	}
+	logger.Log("gc succeeded", cniipvlanvpck8s.Fields{"released": released, "valid": len(valid)})
+	if released > 0 && conf.IPAM.ReleaseEmptyENIs {
+		startReleaseEmptyENIs(args.StdinData)
+	}
+	return nil
+}
+
+// cmdStatus is called for STATUS requests. The plugin is available while
+// instance metadata and EC2 answer and another IP can be handed out.
+func cmdStatus(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	unavailable := func(msg string, err error) error {
+		return &types.Error{
+			Code:    types.ErrPluginNotAvailable,
+			Msg:     msg,
+			Details: err.Error(),
+		}
+	}
+	if err := awsClient.CheckMetadata(); err != nil {
+		return unavailable("instance metadata unreachable", err)
+	}
+	if err := awsClient.CheckDescribeInstance(); err != nil {
+		return unavailable("EC2 unreachable", err)
+	}
+
+	interfaces, err := awsClient.GetInterfaces()
+	if err != nil {
+		return unavailable("unable to list interfaces", err)
+	}
+	free, err := cniipvlanvpck8s.FindFreeIPsAmong(interfaces, conf.IPAM.IfaceIndex)
+	if err != nil {
+		return unavailable("unable to find free IPs", err)
+	}
+	if len(free) > 0 {
+		return nil
+	}
+	if !aws.HasCapacity(interfaces, awsClient.ENILimits(), conf.IPAM.IfaceIndex) {
+		return unavailable("no IP capacity", fmt.Errorf("every interface is full and no more can be attached"))
+	}
+	return nil
+}
+
+func main() {
+	rand.Seed(time.Now().UnixNano())
+
+	if len(os.Args) > 1 && os.Args[1] == warmPoolCommand {
+		if err := runWarmPool(os.Args[2:]); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == warmENIsCommand {
+		if err := runWarmENIs(os.Args[2:]); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == releaseENIsCommand {
+		if err := runReleaseEmptyENIs(os.Args[2:]); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == deallocateHeldCommand {
+		if err := runDeallocateHeld(os.Args[2:]); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// ADD and DEL lock the interface index they allocate at. Results are
+	// built in the 1.0.0 schema and converted to the requested version.
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    cmdAdd,
+		Del:    cmdDel,
+		Check:  cmdCheck,
+		GC:     cmdGC,
+		Status: cmdStatus,
+	}, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", "1.0.0", "1.1.0"),
+		"cni-ipvlan-vpc-k8s IPAM plugin")
 }
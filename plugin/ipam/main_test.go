@@ -0,0 +1,761 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+)
+
+// withFakeClient allocates through fake, keeping the plugin's state in a
+// temporary directory
+func withFakeClient(t *testing.T, fake *aws.FakeClient) func() {
+	dir, err := ioutil.TempDir("", "ipam")
+	if err != nil {
+		t.Fatalf("Failed to create state dir: %v", err)
+	}
+	cniipvlanvpck8s.SetStateDir(dir)
+	oldClient := awsClient
+	awsClient = fake
+	return func() {
+		awsClient = oldClient
+		os.RemoveAll(dir)
+	}
+}
+
+// newFake returns an instance with a pod interface at index 1 holding two
+// unbound IPs, with room for one more
+func newFake() *aws.FakeClient {
+	_, cidr, _ := net.ParseCIDR("198.18.0.0/24")
+	return &aws.FakeClient{
+		Interfaces: []aws.Interface{{
+			ID:         "eni-primary",
+			Number:     0,
+			IPv4s:      []net.IP{net.ParseIP("198.18.0.4")},
+			SubnetID:   "subnet-a",
+			SubnetCidr: cidr,
+		}, {
+			ID:         "eni-pods",
+			Number:     1,
+			IPv4s:      []net.IP{net.ParseIP("198.18.0.5"), net.ParseIP("198.18.0.6")},
+			SubnetID:   "subnet-a",
+			SubnetCidr: cidr,
+		}},
+		Subnets: []aws.Subnet{
+			{ID: "subnet-a", Cidr: "198.18.0.0/24", AvailabilityZone: "us-east-1a", AvailableAddressCount: 100},
+			{ID: "subnet-b", Cidr: "198.18.1.0/24", AvailabilityZone: "us-east-1a", AvailableAddressCount: 100},
+		},
+		Limits: aws.ENILimit{Adapters: 3, IPv4: 3},
+		AZ:     "us-east-1a",
+	}
+}
+
+func testConf() *PluginConf {
+	return &PluginConf{IPAM: &IPAMConfig{
+		IfaceIndex:         1,
+		AllocationStrategy: string(aws.FirstAvailable),
+	}}
+}
+
+func TestAllocateIPSources(t *testing.T) {
+	fake := newFake()
+	defer withFakeClient(t, fake)()
+	conf := testConf()
+
+	expected := []struct {
+		ip     string
+		source string
+	}{
+		{"198.18.0.5", "free"},
+		{"198.18.0.6", "free"},
+		{"198.18.0.7", "existing-interface"},
+		{"198.18.1.4", "new-interface"},
+	}
+	for _, e := range expected {
+		alloc, source, err := allocateIP(context.Background(), conf, aws.PodInfo{}, nil, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to allocate %v: %v", e.ip, err)
+		}
+		if !alloc.IP.Equal(net.ParseIP(e.ip)) || source != e.source {
+			t.Fatalf("expected %v from %v, got %v from %v", e.ip, e.source, alloc.IP, source)
+		}
+	}
+}
+
+func TestNewInterfaceVPCDefaultSG(t *testing.T) {
+	fake := newFake()
+	fake.DefaultSecurityGroup = "sg-default"
+	fake.Limits.Adapters = 4
+	fake.Subnets = append(fake.Subnets, aws.Subnet{ID: "subnet-c", Cidr: "198.18.2.0/24", AvailabilityZone: "us-east-1a", AvailableAddressCount: 100})
+	defer withFakeClient(t, fake)()
+	conf := testConf()
+
+	conf.IPAM.UseVPCDefaultSG = true
+	newIf, err := newInterface(context.Background(), conf, aws.PodInfo{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create an interface: %v", err)
+	}
+	if !reflect.DeepEqual(newIf.SecurityGroupIds, []string{"sg-default"}) {
+		t.Fatalf("expected the VPC default security group, got %v", newIf.SecurityGroupIds)
+	}
+
+	// Configured security groups take precedence
+	conf.IPAM.SecGroupIds = []string{"sg-pods"}
+	newIf, err = newInterface(context.Background(), conf, aws.PodInfo{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create an interface: %v", err)
+	}
+	if !reflect.DeepEqual(newIf.SecurityGroupIds, []string{"sg-pods"}) {
+		t.Fatalf("expected the configured security groups, got %v", newIf.SecurityGroupIds)
+	}
+}
+
+func TestAllocateIPPrefixDelegation(t *testing.T) {
+	aws.SetPrefixDelegation(true)
+	defer aws.SetPrefixDelegation(false)
+	fake := newFake()
+	defer withFakeClient(t, fake)()
+	conf := testConf()
+
+	expected := []struct {
+		ip     string
+		source string
+	}{
+		{"198.18.0.5", "free"},
+		{"198.18.0.6", "free"},
+		{"198.18.0.16", "existing-interface"},
+		{"198.18.0.17", "free"},
+		{"198.18.0.18", "free"},
+	}
+	for _, e := range expected {
+		alloc, source, err := allocateIP(context.Background(), conf, aws.PodInfo{}, nil, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to allocate %v: %v", e.ip, err)
+		}
+		if !alloc.IP.Equal(net.ParseIP(e.ip)) || source != e.source {
+			t.Fatalf("expected %v from %v, got %v from %v", e.ip, e.source, alloc.IP, source)
+		}
+	}
+	if len(fake.Calls) != 1 {
+		t.Fatalf("expected a single prefix allocation, got %v", fake.Calls)
+	}
+}
+
+func TestAllocateIPMovedFreeIP(t *testing.T) {
+	fake := newFake()
+	// EC2 moved 198.18.0.5 to another instance, metadata still lists it
+	fake.Moved = []string{"198.18.0.5"}
+	defer withFakeClient(t, fake)()
+	conf := testConf()
+
+	alloc, source, err := allocateIP(context.Background(), conf, aws.PodInfo{}, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to allocate: %v", err)
+	}
+	if !alloc.IP.Equal(net.ParseIP("198.18.0.7")) || source != "existing-interface" {
+		t.Fatalf("expected a fresh allocation of 198.18.0.7, got %v from %v", alloc.IP, source)
+	}
+
+	// The moved IP stays claimed, the other free one is still used
+	alloc, source, err = allocateIP(context.Background(), conf, aws.PodInfo{}, nil, nil, nil, nil)
+	if err != nil || !alloc.IP.Equal(net.ParseIP("198.18.0.6")) || source != "free" {
+		t.Fatalf("expected the free 198.18.0.6, got %v from %v: %v", alloc, source, err)
+	}
+}
+
+func TestVPCDNSServer(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/16")
+	for _, c := range []struct {
+		offset   int
+		expected string
+	}{
+		{2, "10.0.0.2"},
+		{10, "10.0.0.10"},
+		{300, "10.0.1.44"},
+		{65534, "10.0.255.254"},
+		{0, ""},
+		{65535, ""},
+		{70000, ""},
+	} {
+		ip, err := vpcDNSServer(cidr, c.offset)
+		if c.expected == "" {
+			if err == nil {
+				t.Errorf("offset %d: expected an error, got %v", c.offset, ip)
+			}
+			continue
+		}
+		if err != nil || !ip.Equal(net.ParseIP(c.expected)) {
+			t.Errorf("offset %d: expected %v, got %v: %v", c.offset, c.expected, ip, err)
+		}
+	}
+}
+
+func TestSubnetRoutes(t *testing.T) {
+	parse := func(cidrs ...string) []*net.IPNet {
+		var nets []*net.IPNet
+		for _, cidr := range cidrs {
+			_, n, _ := net.ParseCIDR(cidr)
+			nets = append(nets, n)
+		}
+		return nets
+	}
+	vpc := parse("10.0.0.0/16")[0]
+	routes := []*types.Route{{Dst: *vpc}}
+	ip := net.ParseIP("10.0.0.5")
+	alloc := &aws.AllocationResult{IP: &ip}
+	gw := net.ParseIP("10.0.0.1")
+
+	// IPv6 destinations are skipped without an IPv6, as are routed ones
+	imported := subnetRoutes(routes, parse("10.0.0.0/16", "172.16.0.0/12", "2600:1f14:1::/56", "172.16.0.0/12"), alloc, gw, nil)
+	if len(imported) != 1 || imported[0].Dst.String() != "172.16.0.0/12" || !imported[0].GW.Equal(gw) {
+		t.Fatalf("expected a route to 172.16.0.0/12 via %v, got %v", gw, imported)
+	}
+
+	ip6 := net.ParseIP("2600:1f14::5")
+	alloc.IPv6 = &ip6
+	gw6 := net.ParseIP("fe80::1")
+	imported = subnetRoutes(routes, parse("2600:1f14:1::/56"), alloc, gw, gw6)
+	if len(imported) != 1 || !imported[0].GW.Equal(gw6) {
+		t.Fatalf("expected an IPv6 route via %v, got %v", gw6, imported)
+	}
+}
+
+func TestAllocateRequestedIP(t *testing.T) {
+	fake := newFake()
+	fake.Interfaces[1].IPv4s = fake.Interfaces[1].IPv4s[:1]
+	defer withFakeClient(t, fake)()
+	conf := testConf()
+
+	alloc, source, err := allocateRequestedIP(context.Background(), conf, aws.PodInfo{}, net.ParseIP("198.18.0.50"), nil)
+	if err != nil || !alloc.IP.Equal(net.ParseIP("198.18.0.50")) || alloc.Interface.ID != "eni-pods" || source != "requested" {
+		t.Fatalf("expected 198.18.0.50 on eni-pods, got %v from %v: %v", alloc, source, err)
+	}
+	// Claimed until it's bound
+	if _, _, err := allocateRequestedIP(context.Background(), conf, aws.PodInfo{}, net.ParseIP("198.18.0.50"), nil); err == nil {
+		t.Fatalf("allocated the requested IP twice")
+	}
+
+	alloc, source, err = allocateRequestedIP(context.Background(), conf, aws.PodInfo{}, net.ParseIP("198.18.0.5"), nil)
+	if err != nil || !alloc.IP.Equal(net.ParseIP("198.18.0.5")) || source != "free" {
+		t.Fatalf("expected the free 198.18.0.5, got %v from %v: %v", alloc, source, err)
+	}
+
+	for _, ip := range []string{"198.18.0.4", "198.18.5.5", "198.18.0.255"} {
+		if _, _, err := allocateRequestedIP(context.Background(), conf, aws.PodInfo{}, net.ParseIP(ip), nil); err == nil {
+			t.Fatalf("allocated %v", ip)
+		}
+	}
+	if len(fake.Calls) != 3 {
+		t.Fatalf("expected EC2 to be asked for 198.18.0.50, 198.18.5.5 and 198.18.0.255, got %v", fake.Calls)
+	}
+}
+
+func TestAllocateIPBudget(t *testing.T) {
+	fake := newFake()
+	defer withFakeClient(t, fake)()
+	conf := testConf()
+	conf.IPAM.MaxIPsPerNode = 2
+
+	for _, ip := range []string{"198.18.0.5", "198.18.0.6", "198.18.0.7"} {
+		alloc, _, err := allocateIP(context.Background(), conf, aws.PodInfo{}, nil, nil, nil, nil)
+		if err != nil || !alloc.IP.Equal(net.ParseIP(ip)) {
+			t.Fatalf("expected %v, got %v: %v", ip, alloc, err)
+		}
+	}
+	_, _, err := allocateIP(context.Background(), conf, aws.PodInfo{}, nil, nil, nil, nil)
+	if cniErr, ok := cniError(err).(*types.Error); !ok || cniErr.Code != errCodeInsufficientIPs {
+		t.Fatalf("expected an insufficient IPs error beyond the budget, got %v", err)
+	}
+	if len(fake.Interfaces) != 2 {
+		t.Fatalf("an interface was created beyond the budget")
+	}
+}
+
+// TestCmdAddFailureReleases checks an ADD failing anywhere after the
+// allocation gives it back
+func TestCmdAddFailureReleases(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Master error
+		IPAM   string
+	}{
+		{Name: "link down", Master: fmt.Errorf("injected link failure")},
+		{Name: "mtu", IPAM: `"mtu": 9001,`},
+		// The fake's interfaces have no VPC CIDR to find the DNS server in
+		{Name: "dns"},
+	}
+
+	for _, c := range cases {
+		fake := newFake()
+		cleanup := withFakeClient(t, fake)
+		for _, ip := range fake.Interfaces[1].IPv4s {
+			if err := cniipvlanvpck8s.ClaimIP(ip); err != nil {
+				t.Fatalf("Failed to claim %v: %v", ip, err)
+			}
+		}
+		lockDir, err := ioutil.TempDir("", "locks")
+		if err != nil {
+			t.Fatalf("Failed to create lock dir: %v", err)
+		}
+		oldUpMaster := upMaster
+		upMaster = func(*PluginConf, aws.Interface) (string, error) {
+			return "lyft-missing", c.Master
+		}
+
+		stdin := fmt.Sprintf(`{"cniVersion": "0.3.1", "name": "test", "type": "ipvlan", "ipam": {
+			"type": "cni-ipvlan-vpc-k8s-ipam", "interfaceIndex": 1, "secGroupIds": ["sg-1"], %s
+			"subnetIds": ["subnet-a"], "lockDir": %q}}`, c.IPAM, lockDir)
+		err = cmdAdd(&skel.CmdArgs{ContainerID: "container", IfName: "eth0", StdinData: []byte(stdin)})
+		upMaster = oldUpMaster
+		cniipvlanvpck8s.SetLockDir("")
+		os.RemoveAll(lockDir)
+		if err == nil {
+			t.Errorf("%s: expected the ADD to fail", c.Name)
+		}
+
+		// The IP assigned for the ADD is unassigned again
+		if !reflect.DeepEqual(fake.Calls, []string{"AllocateIPAtIndex 1", "DeallocateIPs 1"}) {
+			t.Errorf("%s: expected the allocation to be undone, got calls %v", c.Name, fake.Calls)
+		}
+		if len(fake.Interfaces[1].IPv4s) != 2 {
+			t.Errorf("%s: expected the allocated IP to be unassigned, got %v", c.Name, fake.Interfaces[1].IPv4s)
+		}
+		cleanup()
+	}
+}
+
+func TestReleaseAllocation(t *testing.T) {
+	fake := newFake()
+	defer withFakeClient(t, fake)()
+	ctx := context.Background()
+
+	// A free IP stays assigned
+	free := fake.Interfaces[1].IPv4s[1]
+	if err := releaseAllocation(ctx, &aws.AllocationResult{IP: &free, Interface: fake.Interfaces[1]}, "free", "c"); err != nil {
+		t.Fatalf("Failed to release free IP: %v", err)
+	}
+	if len(fake.Calls) != 0 {
+		t.Fatalf("expected a free IP to be left assigned, got calls %v", fake.Calls)
+	}
+
+	// An interface created for the ADD is freed
+	alloc, err := allocateOnNewInterface(ctx, testConf(), aws.PodInfo{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to allocate on a new interface: %v", err)
+	}
+	if err := releaseAllocation(ctx, alloc, "new-interface", "c"); err != nil {
+		t.Fatalf("Failed to release new interface: %v", err)
+	}
+	if len(fake.Interfaces) != 2 {
+		t.Fatalf("expected the new interface to be freed, got %v", fake.Interfaces)
+	}
+}
+
+func TestAllocateIPNoCreateENI(t *testing.T) {
+	fake := newFake()
+	fake.Interfaces[1].IPv4s = append(fake.Interfaces[1].IPv4s, net.ParseIP("198.18.0.7"))
+	defer withFakeClient(t, fake)()
+	for _, ip := range fake.Interfaces[1].IPv4s {
+		if err := cniipvlanvpck8s.ClaimIP(ip); err != nil {
+			t.Fatalf("Failed to claim %v: %v", ip, err)
+		}
+	}
+	conf := testConf()
+	conf.IPAM.NoCreateENI = true
+
+	_, _, err := allocateIP(context.Background(), conf, aws.PodInfo{}, nil, nil, nil, nil)
+	if aws.ErrorKind(err) != aws.ErrInsufficientIPs {
+		t.Fatalf("expected allocation to fail with insufficient IPs without ENI creation, got %v", err)
+	}
+	if len(fake.Interfaces) != 2 {
+		t.Fatalf("an interface was created: %v", fake.Interfaces)
+	}
+}
+
+func TestAllocateIPTimeout(t *testing.T) {
+	fake := newFake()
+	defer withFakeClient(t, fake)()
+	for _, ip := range fake.Interfaces[1].IPv4s {
+		if err := cniipvlanvpck8s.ClaimIP(ip); err != nil {
+			t.Fatalf("Failed to claim %v: %v", ip, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+
+	_, _, err := allocateIP(ctx, testConf(), aws.PodInfo{}, nil, nil, nil, nil)
+	if err == nil {
+		t.Fatalf("expected allocation to fail after the deadline")
+	}
+	if _, ok := timeoutError(ctx, err).(*types.Error); !ok {
+		t.Fatalf("expected a retriable error, got %v", timeoutError(ctx, err))
+	}
+	if len(fake.Interfaces) != 2 {
+		t.Fatalf("an interface was created after the deadline")
+	}
+}
+
+// TestAllocateIPSubnetExhausted allocates on an interface whose subnet EC2
+// reports exhausted although its cached count is the highest
+func TestAllocateIPSubnetExhausted(t *testing.T) {
+	fake := newFake()
+	_, small, _ := net.ParseCIDR("198.18.0.0/29")
+	_, large, _ := net.ParseCIDR("198.18.1.0/24")
+	fake.Interfaces = []aws.Interface{{
+		ID:         "eni-small",
+		Number:     1,
+		IPv4s:      []net.IP{net.ParseIP("198.18.0.4"), net.ParseIP("198.18.0.5"), net.ParseIP("198.18.0.6"), net.ParseIP("198.18.0.7")},
+		SubnetID:   "subnet-a",
+		SubnetCidr: small,
+	}, {
+		ID:         "eni-large",
+		Number:     2,
+		IPv4s:      []net.IP{net.ParseIP("198.18.1.4")},
+		SubnetID:   "subnet-b",
+		SubnetCidr: large,
+	}}
+	fake.Subnets[0].AvailableAddressCount = 200
+	fake.Subnets[1].AvailableAddressCount = 10
+	fake.Limits = aws.ENILimit{Adapters: 3, IPv4: 10}
+	defer withFakeClient(t, fake)()
+	for _, intf := range fake.Interfaces {
+		for _, ip := range intf.IPv4s {
+			if err := cniipvlanvpck8s.ClaimIP(ip); err != nil {
+				t.Fatalf("Failed to claim %v: %v", ip, err)
+			}
+		}
+	}
+
+	alloc, source, err := allocateIP(context.Background(), testConf(), aws.PodInfo{}, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to allocate: %v", err)
+	}
+	if alloc.Interface.ID != "eni-large" || source != "existing-interface" {
+		t.Fatalf("expected an IP on eni-large from an existing interface, got %v on %v from %v",
+			alloc.IP, alloc.Interface.ID, source)
+	}
+	for _, call := range fake.Calls {
+		if call == "NewInterface" {
+			t.Fatalf("an interface was created with room left in another subnet")
+		}
+	}
+}
+
+func TestRemainingSubnets(t *testing.T) {
+	interfaces := []aws.Interface{
+		{Number: 0, SubnetID: "subnet-a"},
+		{Number: 1, SubnetID: "subnet-b"},
+		{Number: 2, SubnetID: "subnet-c"},
+		{Number: 3, SubnetID: "subnet-c"},
+		{Number: 4, SubnetID: "subnet-d"},
+	}
+
+	remaining := remainingSubnets(interfaces, 1, nil, []string{"subnet-b"})
+	if len(remaining) != 2 || remaining[0] != "subnet-c" || remaining[1] != "subnet-d" {
+		t.Fatalf("expected subnet-c and subnet-d, got %v", remaining)
+	}
+	remaining = remainingSubnets(interfaces, 1, []string{"subnet-b", "subnet-d"}, []string{"subnet-b"})
+	if len(remaining) != 1 || remaining[0] != "subnet-d" {
+		t.Fatalf("expected subnet-d, got %v", remaining)
+	}
+}
+
+func TestResultInterfaces(t *testing.T) {
+	args := &skel.CmdArgs{IfName: "eth0", Netns: "/var/run/netns/pod"}
+	interfaces := resultInterfaces("eth1", aws.Interface{Mac: "0a:00:00:00:00:01"}, args)
+
+	if len(interfaces) <= sandboxInterface {
+		t.Fatalf("expected the container's link at %d, got %v", sandboxInterface, interfaces)
+	}
+	if interfaces[0].Name != "eth1" || interfaces[0].Sandbox != "" {
+		t.Fatalf("expected the master first, got %+v", interfaces[0])
+	}
+	sandbox := interfaces[sandboxInterface]
+	if sandbox.Name != "eth0" || sandbox.Sandbox != args.Netns || sandbox.Mac != "0a:00:00:00:00:01" {
+		t.Fatalf("unexpected container link %+v", sandbox)
+	}
+}
+
+func TestCniError(t *testing.T) {
+	cases := []struct {
+		Err  error
+		Code uint
+	}{
+		{awserr.New("InsufficientFreeAddressesInSubnet", "subnet full", nil), errCodeInsufficientIPs},
+		{aws.WrapError(awserr.New("AttachmentLimitExceeded", "no more", nil), "unable to attach"), errCodeENILimit},
+		{awserr.New("RequestLimitExceeded", "slow down", nil), types.ErrTryAgainLater},
+		{&aws.Error{Kind: aws.ErrConfig, Err: fmt.Errorf("bad config")}, types.ErrInvalidNetworkConfig},
+	}
+	for i, c := range cases {
+		cniErr, ok := cniError(c.Err).(*types.Error)
+		if !ok || cniErr.Code != c.Code || cniErr.Details != c.Err.Error() {
+			t.Fatalf("%d expected code %d, got %v", i, c.Code, cniErr)
+		}
+	}
+
+	// Errors of no known kind are left alone
+	err := fmt.Errorf("link down")
+	if cniError(err) != err {
+		t.Fatalf("unknown error was converted")
+	}
+}
+
+func TestResolveInterfaceIndex(t *testing.T) {
+	interfaces := []aws.Interface{{Number: 0}, {Number: 1}}
+
+	for _, c := range []struct {
+		index, expected int
+	}{
+		{0, 0},
+		{1, 1},
+		{2, 2},
+		{anyInterfaceIndex, 1},
+	} {
+		index, err := resolveInterfaceIndex(c.index, interfaces, true)
+		if err != nil || index != c.expected {
+			t.Fatalf("expected %d to resolve to %d, got %d: %v", c.index, c.expected, index, err)
+		}
+	}
+	for _, index := range []int{3, -2} {
+		if _, err := resolveInterfaceIndex(index, interfaces, true); err == nil {
+			t.Fatalf("expected %d to be rejected", index)
+		}
+	}
+
+	// The primary ENI is only used when allowed
+	if _, err := resolveInterfaceIndex(0, interfaces, false); err != errPrimaryENI {
+		t.Fatalf("expected index 0 to be rejected without allowPrimaryENI, got %v", err)
+	}
+	if index, err := resolveInterfaceIndex(anyInterfaceIndex, interfaces, false); err != nil || index != 1 {
+		t.Fatalf("expected any index to resolve to 1, got %d: %v", index, err)
+	}
+}
+
+func TestAllocateExclusive(t *testing.T) {
+	fake := newFake()
+	fake.Limits.Adapters = 4
+	fake.Subnets = append(fake.Subnets, aws.Subnet{ID: "subnet-c", Cidr: "198.18.2.0/24", AvailabilityZone: "us-east-1a", AvailableAddressCount: 100})
+	defer withFakeClient(t, fake)()
+	defer aws.SetExclusiveInterfaces(nil)
+	conf := testConf()
+
+	alloc, source, err := allocateExclusive(context.Background(), conf, aws.PodInfo{}, "container-a", nil)
+	if err != nil || source != "exclusive-interface" {
+		t.Fatalf("expected an exclusive interface, got %v from %v: %v", alloc, source, err)
+	}
+	dedicated := alloc.Interface.ID
+	exclusive, err := cniipvlanvpck8s.ExclusiveInterfaceIDs()
+	if err != nil || !reflect.DeepEqual(exclusive, []string{dedicated}) {
+		t.Fatalf("expected %v to be exclusive, got %v: %v", dedicated, exclusive, err)
+	}
+	aws.SetExclusiveInterfaces(exclusive)
+
+	// The dedicated interface has room, but other pods fill the shared
+	// one and then get a new interface
+	for i := 0; i < 4; i++ {
+		alloc, _, err := allocateIP(context.Background(), conf, aws.PodInfo{}, nil, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to allocate: %v", err)
+		}
+		if alloc.Interface.ID == dedicated {
+			t.Fatalf("allocated %v on the exclusive interface", alloc.IP)
+		}
+	}
+
+	if err := cniipvlanvpck8s.ReleaseExclusiveInterface("container-a"); err != nil {
+		t.Fatalf("Failed to release: %v", err)
+	}
+	if exclusive, _ := cniipvlanvpck8s.ExclusiveInterfaceIDs(); len(exclusive) != 0 {
+		t.Fatalf("expected no exclusive interfaces, got %v", exclusive)
+	}
+}
+
+func TestApplyIndexHint(t *testing.T) {
+	defer withFakeClient(t, newFake())()
+
+	conf := testConf()
+	if err := applyIndexHint(conf, &K8sArgs{}); err != nil || conf.IPAM.IfaceIndex != 1 {
+		t.Fatalf("expected the configured index without a hint, got %d: %v", conf.IPAM.IfaceIndex, err)
+	}
+	if err := applyIndexHint(conf, &K8sArgs{PREFERRED_IFACE_INDEX: "0"}); err == nil || conf.IPAM.IfaceIndex != 1 {
+		t.Fatalf("expected the hinted index 0 to be rejected, got %d: %v", conf.IPAM.IfaceIndex, err)
+	}
+	conf.IPAM.AllowPrimaryENI = true
+	if err := applyIndexHint(conf, &K8sArgs{PREFERRED_IFACE_INDEX: "0"}); err != nil || conf.IPAM.IfaceIndex != 0 {
+		t.Fatalf("expected the hinted index 0, got %d: %v", conf.IPAM.IfaceIndex, err)
+	}
+	for _, hint := range []string{"5", "one"} {
+		conf := testConf()
+		if err := applyIndexHint(conf, &K8sArgs{PREFERRED_IFACE_INDEX: types.UnmarshallableString(hint)}); err == nil {
+			t.Fatalf("expected hint %q to be rejected", hint)
+		}
+		if conf.IPAM.IfaceIndex != 1 {
+			t.Fatalf("rejected hint %q changed the index to %d", hint, conf.IPAM.IfaceIndex)
+		}
+	}
+}
+
+func TestExpectedMaster(t *testing.T) {
+	conf := testConf()
+	links, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("Failed to list links: %v", err)
+	}
+	var link *net.Interface
+	for i := range links {
+		if len(links[i].HardwareAddr) == 6 {
+			link = &links[i]
+			break
+		}
+	}
+	if link == nil {
+		t.Skip("Test requires an Ethernet link - skipped")
+		return
+	}
+	interfaces := []aws.Interface{{Number: 0, Mac: "02:00:00:00:00:01"}, {Number: 1, Mac: link.HardwareAddr.String()}}
+
+	// The link is found by MAC, not by ethN
+	if master, err := expectedMaster(conf, interfaces, 1); err != nil || master != link.Name {
+		t.Errorf("expected %v, got %v, %v", link.Name, master, err)
+	}
+	if _, err := expectedMaster(conf, interfaces, 2); err == nil {
+		t.Errorf("expected an error for an interface missing from metadata")
+	}
+	conf.IPAM.MasterInterfaceOverride = "ens%d"
+	if master, err := expectedMaster(conf, interfaces, 2); err != nil || master != "ens2" {
+		t.Errorf("expected the override, got %v, %v", master, err)
+	}
+}
+
+func TestPrimaryENIRefusedOnAdd(t *testing.T) {
+	fake := newFake()
+	defer withFakeClient(t, fake)()
+
+	stdin := []byte(`{"cniVersion": "0.3.1", "name": "test", "type": "ipvlan", "ipam": {
+		"type": "cni-ipvlan-vpc-k8s-ipam", "interfaceIndex": 0, "secGroupIds": ["sg-1"],
+		"subnetIds": ["subnet-a"]}}`)
+	// DEL, CHECK and GC still parse the config of Pods added before
+	conf, err := parseConfig(stdin)
+	if err != nil || conf.IPAM.IfaceIndex != 0 {
+		t.Fatalf("expected interfaceIndex 0 to parse, got %v", err)
+	}
+	err = cmdAdd(&skel.CmdArgs{ContainerID: "container", IfName: "eth0", StdinData: stdin})
+	if err == nil {
+		t.Fatalf("expected the ADD to refuse the primary ENI")
+	}
+	if len(fake.Calls) != 0 {
+		t.Errorf("expected nothing allocated, got calls %v", fake.Calls)
+	}
+}
+
+func TestCmdStatus(t *testing.T) {
+	fake := newFake()
+	defer withFakeClient(t, fake)()
+	args := &skel.CmdArgs{StdinData: []byte(`{"cniVersion": "1.1.0", "name": "test", "type": "ipvlan", "ipam": {
+		"type": "cni-ipvlan-vpc-k8s-ipam", "interfaceIndex": 1, "secGroupIds": ["sg-1"],
+		"subnetIds": ["subnet-a"]}}`)}
+
+	if err := cmdStatus(args); err != nil {
+		t.Fatalf("expected free IPs to be available, got %v", err)
+	}
+
+	// Without free IPs, room for another IP on the interface will do
+	for _, ip := range fake.Interfaces[1].IPv4s {
+		if err := cniipvlanvpck8s.ClaimIP(ip); err != nil {
+			t.Fatalf("Failed to claim %v: %v", ip, err)
+		}
+	}
+	if err := cmdStatus(args); err != nil {
+		t.Fatalf("expected capacity to be available, got %v", err)
+	}
+	fake.Limits = aws.ENILimit{Adapters: 2, IPv4: 2}
+	if err, ok := cmdStatus(args).(*types.Error); !ok || err.Code != types.ErrPluginNotAvailable {
+		t.Fatalf("expected the plugin unavailable without capacity, got %v", err)
+	}
+
+	fake.Unreachable = fmt.Errorf("injected metadata failure")
+	if err, ok := cmdStatus(args).(*types.Error); !ok || err.Code != types.ErrPluginNotAvailable {
+		t.Fatalf("expected the plugin unavailable without metadata, got %v", err)
+	}
+}
+
+// TestWarmPoolArgs checks the warm pool process makes its EC2 calls with
+// the settings of the ADD starting it
+func TestWarmPoolArgs(t *testing.T) {
+	fake := newFake()
+	defer withFakeClient(t, fake)()
+
+	stdin := []byte(`{"cniVersion": "0.3.1", "name": "test", "type": "ipvlan", "ipam": {
+		"type": "cni-ipvlan-vpc-k8s-ipam", "interfaceIndex": 1, "secGroupIds": ["sg-1"],
+		"subnetIds": ["subnet-a"], "warmIPTarget": 2, "maxIPsPerNode": 10,
+		"assumeRoleArn": "arn:aws:iam::123456789012:role/cni", "awsRegion": "us-west-2",
+		"useFIPS": true, "ec2RateLimit": 5, "ec2Retries": 2, "enablePrefixDelegation": true,
+		"metadataCacheTTL": "10s"}}`)
+	defer parseConfig([]byte(`{"cniVersion": "0.3.1", "name": "test", "type": "ipvlan", "ipam": {
+		"type": "cni-ipvlan-vpc-k8s-ipam", "interfaceIndex": 1, "secGroupIds": ["sg-1"],
+		"subnetIds": ["subnet-a"]}}`))
+
+	parent, err := parseConfig(stdin)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	args := warmPoolArgs(stdin)
+	if args[0] != warmPoolCommand {
+		t.Fatalf("expected the warm pool command, got %v", args[0])
+	}
+	child, err := parseWarmPoolArgs(args[1:])
+	if err != nil {
+		t.Fatalf("Failed to parse the warm pool arguments: %v", err)
+	}
+	if !reflect.DeepEqual(child.IPAM, parent.IPAM) {
+		t.Errorf("expected the warm pool to be configured like the ADD, got %+v, want %+v", child.IPAM, parent.IPAM)
+	}
+	if _, err := parseWarmPoolArgs([]string{"1", "2", "10"}); err == nil {
+		t.Errorf("expected the arguments of older releases to be refused")
+	}
+}
+
+// TestDetachedIndex checks only ADD refuses an interfaceIndex no longer
+// attached, so the Pods allocated before can still be deleted
+func TestDetachedIndex(t *testing.T) {
+	fake := newFake()
+	defer withFakeClient(t, fake)()
+	lockDir, err := ioutil.TempDir("", "locks")
+	if err != nil {
+		t.Fatalf("Failed to create lock dir: %v", err)
+	}
+	defer os.RemoveAll(lockDir)
+	defer cniipvlanvpck8s.SetLockDir("")
+
+	stdin := []byte(fmt.Sprintf(`{"cniVersion": "0.3.1", "name": "test", "type": "ipvlan", "ipam": {
+		"type": "cni-ipvlan-vpc-k8s-ipam", "interfaceIndex": 3, "secGroupIds": ["sg-1"],
+		"subnetIds": ["subnet-a"], "lockDir": %q}}`, lockDir))
+	args := &skel.CmdArgs{ContainerID: "container", IfName: "eth0", StdinData: stdin}
+	if err, ok := cmdAdd(args).(*types.Error); !ok || err.Code != types.ErrInvalidNetworkConfig {
+		t.Fatalf("expected the ADD to refuse the detached index, got %v", err)
+	}
+
+	attachment := cniipvlanvpck8s.Attachment{ContainerID: args.ContainerID, IfName: args.IfName}
+	ip := fake.Interfaces[1].IPv4s[0]
+	if err := cniipvlanvpck8s.RecordAttachment(attachment, []net.IP{ip}, fake.Interfaces[1], "", aws.PodInfo{}, nil); err != nil {
+		t.Fatalf("Failed to record the attachment: %v", err)
+	}
+	if err := cmdDel(args); err != nil {
+		t.Fatalf("expected the DEL to succeed, got %v", err)
+	}
+	if !reflect.DeepEqual(fake.Calls, []string{"DeallocateIPs 1"}) {
+		t.Errorf("expected the Pod's IP to be deallocated, got calls %v", fake.Calls)
+	}
+}
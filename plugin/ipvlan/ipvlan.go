@@ -15,27 +15,43 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"runtime"
 
+	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
 )
 
+// IPAMConf contains the IPAM configuration parameters also used by this
+// plugin
+type IPAMConf struct {
+	types.IPAM
+	IpvlanMode             string `json:"ipvlanMode"`
+	EgressRateKbps         int    `json:"egressRateKbps"`
+	IngressRateKbps        int    `json:"ingressRateKbps"`
+	PreseedGatewayNeighbor bool   `json:"preseedGatewayNeighbor"`
+}
+
 // NetConf contains network configuration parameters
 type NetConf struct {
 	types.NetConf
-	Master string `json:"master"`
-	Mode   string `json:"mode"`
-	MTU    int    `json:"mtu"`
+	Master string   `json:"master"`
+	Mode   string   `json:"mode"`
+	MTU    int      `json:"mtu"`
+	IPAM   IPAMConf `json:"ipam,omitempty"`
 }
 
 func init() {
@@ -53,6 +69,10 @@ func loadConf(bytes []byte) (*NetConf, string, error) {
 	if n.Master == "" {
 		return nil, "", fmt.Errorf(`"master" field is required. It specifies the host interface name to virtualize`)
 	}
+	if n.Mode == "" {
+		// The IPAM plugin builds routes for its configured mode
+		n.Mode = n.IPAM.IpvlanMode
+	}
 	return n, n.CNIVersion, nil
 }
 
@@ -104,8 +124,16 @@ func createIpvlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interf
 	}
 
 	err = netns.Do(func(_ ns.NetNS) error {
+		// The link must be named exactly ifName, which DEL looks it up by.
+		// An ipvlan link of that name is left over from an ADD whose DEL
+		// never ran, which the runtime retries with the same name.
+		if err := removeStaleIpvlan(ifName); err != nil {
+			_ = ip.DelLinkByName(tmpName)
+			return err
+		}
 		err := ip.RenameLink(tmpName, ifName)
 		if err != nil {
+			_ = ip.DelLinkByName(tmpName)
 			return fmt.Errorf("failed to rename ipvlan to %q: %v", ifName, err)
 		}
 		ipvlan.Name = ifName
@@ -127,7 +155,38 @@ func createIpvlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interf
 	return ipvlan, nil
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
+// ipv4Gateway returns the gateway of the result's IPv4 address, or nil in
+// the l3 modes, where the IPAM plugin routes on-link
+func ipv4Gateway(result *current.Result) net.IP {
+	for _, ipc := range result.IPs {
+		if ipc.Address.IP.To4() != nil && ipc.Gateway != nil {
+			return ipc.Gateway
+		}
+	}
+	return nil
+}
+
+// removeStaleIpvlan deletes the ipvlan link named ifName, if any. A link
+// of another type is an interface the runtime didn't expect us to own, so
+// it's an error.
+func removeStaleIpvlan(ifName string) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	if _, ok := link.(*netlink.IPVlan); !ok {
+		return fmt.Errorf("%q already exists as a %v interface", ifName, link.Type())
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to remove stale ipvlan %q: %v", ifName, err)
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) (err error) {
 	n, cniVersion, err := loadConf(args.StdinData)
 	if err != nil {
 		return err
@@ -144,6 +203,12 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
+	// A failed ADD gives the allocation back rather than leaking it
+	defer func() {
+		if err != nil {
+			_ = ipam.ExecDel(n.IPAM.Type, args.StdinData)
+		}
+	}()
 	// Convert whatever the IPAM result was into the current Result type
 	result, err := current.NewResultFromResult(r)
 	if err != nil {
@@ -156,7 +221,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	if n.Master == "ipam" {
 		// Use an IPAM supplied master interface
-		if len(result.Interfaces) == 1 && result.Interfaces[0].Name != "" {
+		if len(result.Interfaces) > 0 && result.Interfaces[0].Name != "" {
 			n.Master = result.Interfaces[0].Name
 		} else {
 			return errors.New("IPAM plugin returned missing master interface")
@@ -167,6 +232,13 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			_ = netns.Do(func(_ ns.NetNS) error {
+				return ip.DelLinkByName(args.IfName)
+			})
+		}
+	}()
 
 	for _, ipc := range result.IPs {
 		// All addresses belong to the ipvlan interface
@@ -175,8 +247,35 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	result.Interfaces = []*current.Interface{ipvlanInterface}
 
+	// A seeded gateway spares the Pod's first packets an ARP round trip.
+	// The Pod resolves it as usual when the host hasn't yet.
+	var gw net.IP
+	var gwMAC net.HardwareAddr
+	if n.IPAM.PreseedGatewayNeighbor {
+		gw = ipv4Gateway(result)
+	}
+	if gw != nil {
+		gwMAC, err = nl.GatewayMAC(n.Master, gw)
+		if err != nil {
+			return fmt.Errorf("failed to lookup the MAC of gateway %v on %q: %v", gw, n.Master, err)
+		}
+	}
+
 	err = netns.Do(func(_ ns.NetNS) error {
-		return ipam.ConfigureIface(args.IfName, result)
+		if err := ipam.ConfigureIface(args.IfName, result); err != nil {
+			return err
+		}
+		if n.IPAM.EgressRateKbps > 0 || n.IPAM.IngressRateKbps > 0 {
+			if err := nl.ShapeBandwidth(args.IfName, n.IPAM.EgressRateKbps, n.IPAM.IngressRateKbps); err != nil {
+				return fmt.Errorf("failed to limit the bandwidth of %q: %v", args.IfName, err)
+			}
+		}
+		if gwMAC != nil {
+			if err := nl.PreseedNeighbor(args.IfName, gw, gwMAC); err != nil {
+				return fmt.Errorf("failed to preseed gateway %v on %q: %v", gw, args.IfName, err)
+			}
+		}
+		return nil
 	})
 	if err != nil {
 		return err
@@ -205,6 +304,17 @@ func cmdDel(args *skel.CmdArgs) error {
 	// There is a netns so try to clean up. Delete can be called multiple times
 	// so don't return an error if the device is already removed.
 	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		// The ifb device shaping ingress outlives the link
+		if n.IPAM.IngressRateKbps > 0 {
+			if err := nl.RemoveBandwidthShaping(args.IfName); err != nil {
+				return err
+			}
+		}
+		if n.IPAM.PreseedGatewayNeighbor {
+			if err := nl.RemovePermanentNeighbors(args.IfName); err != nil {
+				return err
+			}
+		}
 		if err := ip.DelLinkByName(args.IfName); err != nil {
 			if err != ip.ErrLinkNotFound {
 				return err
@@ -212,10 +322,62 @@ func cmdDel(args *skel.CmdArgs) error {
 		}
 		return nil
 	})
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		// The namespace is already gone, and the link along with it
+		return nil
+	}
 
 	return err
 }
 
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	// The IPAM plugin verifies the addresses and their master interface
+	if err := ipam.ExecCheck(n.IPAM.Type, args.StdinData); err != nil {
+		return err
+	}
+
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+		}
+		if _, ok := link.(*netlink.IPVlan); !ok {
+			return fmt.Errorf("%q is a %v interface, expected ipvlan", args.IfName, link.Type())
+		}
+		return nil
+	})
+}
+
+// cmdGC is called for GC requests. The links went away with their
+// namespaces, so only the IPAM plugin has anything to collect.
+func cmdGC(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return invoke.DelegateGC(context.TODO(), n.IPAM.Type, args.StdinData, nil)
+}
+
+// cmdStatus is called for STATUS requests, which the IPAM plugin answers
+func cmdStatus(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return invoke.DelegateStatus(context.TODO(), n.IPAM.Type, args.StdinData, nil)
+}
+
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    cmdAdd,
+		Del:    cmdDel,
+		Check:  cmdCheck,
+		GC:     cmdGC,
+		Status: cmdStatus,
+	}, version.All, "cni-ipvlan-vpc-k8s ipvlan plugin")
 }
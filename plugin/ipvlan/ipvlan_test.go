@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+const testMaster = "lyftmaster0"
+
+// TestCreateIpvlanMTU checks the MTU of the ipvlan link inside the target
+// namespace, both inherited from the master and explicitly configured
+func TestCreateIpvlanMTU(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	cases := []struct {
+		MTU      int
+		Expected int
+	}{
+		{MTU: 0, Expected: 9001},
+		{MTU: 1500, Expected: 1500},
+	}
+
+	for i, c := range cases {
+		originNS, err := testutils.NewNS()
+		if err != nil {
+			t.Fatalf("%d failed to create origin namespace: %v", i, err)
+		}
+		targetNS, err := testutils.NewNS()
+		if err != nil {
+			t.Fatalf("%d failed to create target namespace: %v", i, err)
+		}
+
+		err = originNS.Do(func(ns.NetNS) error {
+			master := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{
+				Name: testMaster,
+				MTU:  9001,
+			}}
+			if err := netlink.LinkAdd(master); err != nil {
+				return err
+			}
+			_, err := createIpvlan(&NetConf{Master: testMaster, MTU: c.MTU}, "eth0", targetNS)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%d failed to create ipvlan: %v", i, err)
+		}
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			link, err := netlink.LinkByName("eth0")
+			if err != nil {
+				return err
+			}
+			if link.Attrs().MTU != c.Expected {
+				t.Errorf("%d expected MTU %d, got %d", i, c.Expected, link.Attrs().MTU)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%d failed to look up ipvlan in target namespace: %v", i, err)
+		}
+
+		targetNS.Close()
+		testutils.UnmountNS(targetNS)
+		originNS.Close()
+		testutils.UnmountNS(originNS)
+	}
+}
+
+// TestCreateIpvlanName checks the ipvlan link is named after the runtime's
+// interface, replacing a stale ipvlan link but no other kind of interface
+func TestCreateIpvlanName(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	originNS, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("failed to create origin namespace: %v", err)
+	}
+	defer testutils.UnmountNS(originNS)
+	defer originNS.Close()
+	targetNS, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("failed to create target namespace: %v", err)
+	}
+	defer testutils.UnmountNS(targetNS)
+	defer targetNS.Close()
+
+	conf := &NetConf{Master: testMaster}
+	err = originNS.Do(func(ns.NetNS) error {
+		master := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: testMaster}}
+		if err := netlink.LinkAdd(master); err != nil {
+			return err
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := createIpvlan(conf, "net1", targetNS); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to create ipvlan over a stale one: %v", err)
+	}
+
+	err = targetNS.Do(func(ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "net2"}}); err != nil {
+			return err
+		}
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		// lo, net1 and net2
+		if len(links) != 3 {
+			t.Errorf("expected a single ipvlan link, got %d links", len(links))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to inspect the target namespace: %v", err)
+	}
+
+	err = originNS.Do(func(ns.NetNS) error {
+		_, err := createIpvlan(conf, "net2", targetNS)
+		return err
+	})
+	if err == nil {
+		t.Fatalf("replaced an interface which isn't an ipvlan")
+	}
+	err = targetNS.Do(func(ns.NetNS) error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		if len(links) != 3 {
+			t.Errorf("expected the temporary link to be removed, got %d links", len(links))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to inspect the target namespace: %v", err)
+	}
+}
+
+// TestConfigureIfaceRoutePriority checks the routeMetric the IPAM plugin
+// passes as route priority is applied to the Pod's routes
+func TestConfigureIfaceRoutePriority(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	originNS, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("failed to create origin namespace: %v", err)
+	}
+	defer testutils.UnmountNS(originNS)
+	defer originNS.Close()
+	targetNS, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("failed to create target namespace: %v", err)
+	}
+	defer testutils.UnmountNS(targetNS)
+	defer targetNS.Close()
+
+	err = originNS.Do(func(ns.NetNS) error {
+		master := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: testMaster}}
+		if err := netlink.LinkAdd(master); err != nil {
+			return err
+		}
+		_, err := createIpvlan(&NetConf{Master: testMaster}, "eth0", targetNS)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to create ipvlan: %v", err)
+	}
+
+	_, addr, _ := net.ParseCIDR("198.18.0.5/24")
+	addr.IP = net.ParseIP("198.18.0.5")
+	_, dst, _ := net.ParseCIDR("198.19.0.0/16")
+	iface := 0
+	result := &current.Result{
+		Interfaces: []*current.Interface{{Name: "eth0"}},
+		IPs:        []*current.IPConfig{{Address: *addr, Interface: &iface}},
+		Routes:     []*types.Route{{Dst: *dst, GW: net.ParseIP("198.18.0.1"), Priority: 50}},
+	}
+	err = targetNS.Do(func(ns.NetNS) error {
+		if err := ipam.ConfigureIface("eth0", result); err != nil {
+			return err
+		}
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: dst}, netlink.RT_FILTER_DST)
+		if err != nil {
+			return err
+		}
+		if len(routes) != 1 || routes[0].Priority != 50 {
+			t.Errorf("expected a route to %v with metric 50, got %v", dst, routes)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to configure the Pod interface: %v", err)
+	}
+}
+
+// fakeIPAM installs an IPAM plugin on CNI_PATH which records the commands
+// it's called with and answers ADD with result. It returns the file the
+// commands are recorded in.
+func fakeIPAM(t *testing.T, result string) (string, func()) {
+	dir, err := ioutil.TempDir("", "ipam")
+	if err != nil {
+		t.Fatalf("failed to create plugin dir: %v", err)
+	}
+	calls := filepath.Join(dir, "calls")
+	script := fmt.Sprintf("#!/bin/sh\necho $CNI_COMMAND >> %s\n[ $CNI_COMMAND = ADD ] && cat <<EOF\n%s\nEOF\nexit 0\n", calls, result)
+	if err := ioutil.WriteFile(filepath.Join(dir, "fake-ipam"), []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write plugin: %v", err)
+	}
+	oldPath := os.Getenv("CNI_PATH")
+	os.Setenv("CNI_PATH", dir)
+	return calls, func() {
+		os.Setenv("CNI_PATH", oldPath)
+		os.RemoveAll(dir)
+	}
+}
+
+// TestCmdAddOrder runs an ADD the way the runtime does, IPAM first, and
+// checks what depends on the Pod's link is applied once it exists
+func TestCmdAddOrder(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	originNS, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("failed to create origin namespace: %v", err)
+	}
+	defer testutils.UnmountNS(originNS)
+	defer originNS.Close()
+	targetNS, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("failed to create target namespace: %v", err)
+	}
+	defer testutils.UnmountNS(targetNS)
+	defer targetNS.Close()
+
+	gateway := net.ParseIP("198.18.0.1")
+	gatewayMAC, _ := net.ParseMAC("02:42:ac:11:00:01")
+	calls, cleanup := fakeIPAM(t, `{"cniVersion": "1.0.0",
+		"ips": [{"address": "198.18.0.5/24", "gateway": "198.18.0.1"}],
+		"routes": [{"dst": "198.19.0.0/16", "gw": "198.18.0.1"}]}`)
+	defer cleanup()
+
+	stdin := []byte(fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "test", "type": "ipvlan",
+		"master": %q, "ipam": {"type": "fake-ipam", "egressRateKbps": 1000, "ingressRateKbps": 1000,
+			"preseedGatewayNeighbor": true}}`, testMaster))
+	args := &skel.CmdArgs{ContainerID: "container", Netns: targetNS.Path(), IfName: "eth0", StdinData: stdin}
+	os.Setenv("CNI_COMMAND", "ADD")
+	os.Setenv("CNI_CONTAINERID", args.ContainerID)
+	os.Setenv("CNI_NETNS", args.Netns)
+	os.Setenv("CNI_IFNAME", args.IfName)
+	defer func() {
+		for _, key := range []string{"CNI_COMMAND", "CNI_CONTAINERID", "CNI_NETNS", "CNI_IFNAME"} {
+			os.Unsetenv(key)
+		}
+	}()
+
+	err = originNS.Do(func(ns.NetNS) error {
+		master := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: testMaster}}
+		if err := netlink.LinkAdd(master); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(master); err != nil {
+			return err
+		}
+		// The host resolved the gateway
+		if err := nl.PreseedNeighbor(testMaster, gateway, gatewayMAC); err != nil {
+			return err
+		}
+		return cmdAdd(args)
+	})
+	if err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+
+	err = targetNS.Do(func(ns.NetNS) error {
+		link, err := netlink.LinkByName("eth0")
+		if err != nil {
+			return err
+		}
+		qdiscs, err := netlink.QdiscList(link)
+		if err != nil {
+			return err
+		}
+		shaped := false
+		for _, qdisc := range qdiscs {
+			if _, ok := qdisc.(*netlink.Tbf); ok {
+				shaped = true
+			}
+		}
+		if !shaped {
+			t.Errorf("expected the egress of eth0 to be shaped, got qdiscs %v", qdiscs)
+		}
+		if _, err := netlink.LinkByName("ifb-eth0"); err != nil {
+			t.Errorf("expected the ingress of eth0 to be shaped: %v", err)
+		}
+		if mac, err := nl.GatewayMAC("eth0", gateway); err != nil || mac.String() != gatewayMAC.String() {
+			t.Errorf("expected the gateway to be seeded with %v, got %v, %v", gatewayMAC, mac, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to inspect the target namespace: %v", err)
+	}
+
+	// DEL removes the ifb device and the neighbor entry along with the link
+	os.Setenv("CNI_COMMAND", "DEL")
+	err = originNS.Do(func(ns.NetNS) error {
+		return cmdDel(args)
+	})
+	if err != nil {
+		t.Fatalf("DEL failed: %v", err)
+	}
+	if recorded, _ := ioutil.ReadFile(calls); string(recorded) != "ADD\nDEL\n" {
+		t.Errorf("expected IPAM ADD and DEL, got %q", recorded)
+	}
+	err = targetNS.Do(func(ns.NetNS) error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		if len(links) != 1 {
+			t.Errorf("expected only lo left, got %d links", len(links))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to inspect the target namespace: %v", err)
+	}
+
+	// An ADD failing once IPAM allocated gives the allocation back
+	os.Setenv("CNI_COMMAND", "ADD")
+	calls, cleanup = fakeIPAM(t, `{"cniVersion": "1.0.0",
+		"ips": [{"address": "198.18.0.5/24", "gateway": "198.18.0.1"}],
+		"routes": [{"dst": "198.19.0.0/16", "gw": "203.0.113.1"}]}`)
+	defer cleanup()
+	err = originNS.Do(func(ns.NetNS) error {
+		return cmdAdd(args)
+	})
+	if err == nil {
+		t.Fatalf("expected the ADD to fail on a route via an unreachable gateway")
+	}
+	recorded, _ := ioutil.ReadFile(calls)
+	if string(recorded) != "ADD\nDEL\n" {
+		t.Errorf("expected IPAM DEL after the failed ADD, got %q", recorded)
+	}
+}
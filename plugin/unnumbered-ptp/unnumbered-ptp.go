@@ -30,7 +30,7 @@ import (
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
@@ -188,6 +188,7 @@ func addPolicyRules(veth *net.Interface, ipc *current.IPConfig, routes []*types.
 				Dst:       &route.Dst,
 				Gw:        ipc.Address.IP,
 				Table:     table,
+				Priority:  route.Priority,
 			})
 			if err != nil {
 				table = -1
@@ -226,7 +227,7 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, hostAddrs []netl
 	containerInterface := &current.Interface{}
 
 	err := netns.Do(func(hostNS ns.NetNS) error {
-		hostVeth, contVeth0, err := ip.SetupVeth(ifName, mtu, hostNS)
+		hostVeth, contVeth0, err := ip.SetupVeth(ifName, mtu, "", hostNS)
 		if err != nil {
 			return err
 		}
@@ -236,12 +237,10 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, hostAddrs []netl
 		containerInterface.Mac = contVeth0.HardwareAddr.String()
 		containerInterface.Sandbox = netns.Path()
 
-		for _, ipc := range pr.IPs {
-			// All addresses apply to the container veth interface
-			ipc.Interface = current.Int(1)
-		}
-
-		pr.Interfaces = []*current.Interface{hostInterface, containerInterface}
+		// The addresses stay with the ipvlan link of the previous
+		// result, so chained plugins like portmap still find the
+		// sandbox interface holding them. The veth pair follows it.
+		pr.Interfaces = append(pr.Interfaces, hostInterface, containerInterface)
 
 		contVeth, err := net.InterfaceByName(ifName)
 		if err != nil {
@@ -295,7 +294,7 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, hostAddrs []netl
 
 		// Send a gratuitous arp for all borrowed v4 addresses
 		for _, ipc := range pr.IPs {
-			if ipc.Version == "4" {
+			if ipc.Address.IP.To4() != nil {
 				_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contVeth)
 			}
 		}
@@ -527,7 +526,31 @@ func cmdDel(args *skel.CmdArgs) error {
 	return nil
 }
 
+// cmdCheck is called for CHECK requests
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	// The point-to-point link must still exist inside the container
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(conf.ContainerInterface)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", conf.ContainerInterface, err)
+		}
+		if _, ok := link.(*netlink.Veth); !ok {
+			return fmt.Errorf("%q is a %v interface, expected veth", conf.ContainerInterface, link.Type())
+		}
+		return nil
+	})
+}
+
 func main() {
 	rand.Seed(time.Now().UnixNano())
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "cni-ipvlan-vpc-k8s unnumbered point-to-point plugin")
 }
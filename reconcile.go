@@ -0,0 +1,73 @@
+package cniipvlanvpck8s
+
+import (
+	"net"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+// Reconciliation lists the differences between the IPs EC2 assigns to
+// the instance and the IPs bound to links on the host, across all
+// interface indexes
+type Reconciliation struct {
+	// Orphaned are secondary IPs on interfaces created by this plugin
+	// which no namespace on the host uses
+	Orphaned []*aws.AllocationResult
+	// Stale are addresses in the subnet of an attached interface bound
+	// on the host, but no longer assigned to any interface in EC2
+	Stale []nl.BoundIP
+}
+
+// Reconcile compares the attached interfaces and their managed secondary
+// IPs against the addresses bound in all local namespaces. Like
+// FindFreeIPsAtIndex it's subject to the metadata service's delay, so it
+// should run under LockfileRun to exclude in-flight allocations.
+func Reconcile() (*Reconciliation, error) {
+	interfaces, err := aws.GetInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	bound, err := nl.GetIPs()
+	if err != nil {
+		return nil, err
+	}
+	managed, err := aws.ManagedSecondaryIPs()
+	if err != nil {
+		return nil, err
+	}
+	claims, err := claimedIPs()
+	if err != nil {
+		return nil, err
+	}
+	return reconcile(interfaces, bound, claims, managed), nil
+}
+
+func reconcile(interfaces []aws.Interface, bound []nl.BoundIP, claims ipClaims, managed []net.IP) *Reconciliation {
+	result := &Reconciliation{
+		Orphaned: orphanedIPs(freeIPs(interfaces, bound, claims, 0), managed),
+		Stale:    []nl.BoundIP{},
+	}
+
+	for _, b := range bound {
+		if b.IP.To4() == nil {
+			continue
+		}
+		inSubnet := false
+		assigned := false
+		for _, intf := range interfaces {
+			if intf.SubnetCidr != nil && intf.SubnetCidr.Contains(b.IP) {
+				inSubnet = true
+			}
+			for _, ip := range intf.AssignedIPv4s() {
+				if ip.Equal(b.IP) {
+					assigned = true
+				}
+			}
+		}
+		if inSubnet && !assigned {
+			result.Stale = append(result.Stale, b)
+		}
+	}
+	return result
+}
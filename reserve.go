@@ -0,0 +1,50 @@
+package cniipvlanvpck8s
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// reservationsFile persists across reboots, unlike the claims
+var reservationsFile = "/var/lib/cni-ipvlan-vpc-k8s/reservations.json"
+
+type reservation struct {
+	IP      string    `json:"ip"`
+	Expires time.Time `json:"expires"`
+}
+
+// ipReservations maps a stable pod identifier to the IP it released
+type ipReservations map[string]reservation
+
+// ReserveIP keeps ip for the pod identified by key for ttl after the pod
+// released it. Until then the IP is excluded from free IPs, and the next
+// ClaimFreeIPAtIndex for key prefers it.
+func ReserveIP(key string, ip net.IP, ttl time.Duration) error {
+	return updateClaims(func(ipClaims) error {
+		reservations := loadReservations()
+		reservations[key] = reservation{
+			IP:      ip.String(),
+			Expires: time.Now().Add(ttl),
+		}
+		return writeJSONAtomic(reservationsFile, reservations)
+	})
+}
+
+// loadReservations returns the unexpired reservations. It must be called
+// under the claims lock.
+func loadReservations() ipReservations {
+	reservations := ipReservations{}
+	if data, err := ioutil.ReadFile(reservationsFile); err == nil {
+		// Corrupt reservations are treated as empty and overwritten
+		_ = json.Unmarshal(data, &reservations)
+	}
+	now := time.Now()
+	for key, r := range reservations {
+		if now.After(r.Expires) {
+			delete(reservations, key)
+		}
+	}
+	return reservations
+}
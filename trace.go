@@ -0,0 +1,25 @@
+package cniipvlanvpck8s
+
+import (
+	"time"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+)
+
+// TraceAWSCalls logs every subsequent AWS API call with its redacted
+// parameters, latency and outcome
+func TraceAWSCalls(logger *Logger) {
+	aws.TraceCalls(func(call aws.TracedCall) {
+		fields := Fields{
+			"operation":  call.Operation,
+			"params":     call.Params,
+			"durationMs": float64(call.Duration) / float64(time.Millisecond),
+			"statusCode": call.StatusCode,
+			"requestID":  call.RequestID,
+		}
+		if call.Err != nil {
+			fields["error"] = call.Err
+		}
+		logger.Log("aws call", fields)
+	})
+}
@@ -0,0 +1,60 @@
+package cniipvlanvpck8s
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+)
+
+var (
+	// unreachableFile records the interfaces whose subnet gateway didn't
+	// answer an ADD, with when they're used again. It's covered by the
+	// claims lock.
+	unreachableFile = "/run/cni-ipvlan-vpc-k8s/unreachable.json"
+	// unreachableTTL bounds how long such an interface is skipped, so it's
+	// used again once its gateway recovers
+	unreachableTTL = time.Minute
+)
+
+// MarkGatewayUnreachable skips the interface in allocations at an index
+// for a while, so the runtime's retry of the failed ADD uses another one
+func MarkGatewayUnreachable(interfaceID string) error {
+	return updateClaims(func(ipClaims) error {
+		unreachable := loadExpiring(unreachableFile)
+		unreachable[interfaceID] = time.Now().Add(unreachableTTL)
+		return writeJSONAtomic(unreachableFile, unreachable)
+	})
+}
+
+// UnreachableInterfaceIDs returns the IDs of the interfaces skipped since
+// their gateway didn't answer
+func UnreachableInterfaceIDs() ([]string, error) {
+	unlock, err := acquireLocks(DefaultLockTimeout, lockRequest{claimLockName, syscall.LOCK_SH})
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var ids []string
+	for id := range loadExpiring(unreachableFile) {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// reachableInterfaces returns the interfaces not skipped for their
+// gateway. It must be called under the claims lock.
+func reachableInterfaces(interfaces []aws.Interface) []aws.Interface {
+	unreachable := loadExpiring(unreachableFile)
+	if len(unreachable) == 0 {
+		return interfaces
+	}
+	var reachable []aws.Interface
+	for _, intf := range interfaces {
+		if _, ok := unreachable[intf.ID]; !ok {
+			reachable = append(reachable, intf)
+		}
+	}
+	return reachable
+}
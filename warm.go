@@ -0,0 +1,72 @@
+package cniipvlanvpck8s
+
+import (
+	"context"
+	"time"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+)
+
+// TopUpWarmPool allocates secondary IPs on interfaces at or above index
+// until at least target of them are free - assigned in EC2 but not bound
+// to any local interface. IPs are allocated in batches, one EC2 call per
+// interface filled. Allocation stops at the first failure, which
+// includes every candidate interface having reached the instance's IP
+// limit, or once interfaces created by the plugin hold maxIPs secondary
+// IPs, unless it's zero. Creating new interfaces is left to the regular
+// allocation path. Allocation gives up once ctx is done.
+func TopUpWarmPool(ctx context.Context, index int, target int, maxIPs int) error {
+	free, err := FindFreeIPsAtIndex(index)
+	if err != nil {
+		return err
+	}
+
+	for missing := target - len(free); missing > 0; {
+		if maxIPs > 0 {
+			managed, err := aws.ManagedIPCount()
+			if err != nil {
+				return err
+			}
+			if managed+missing > maxIPs {
+				missing = maxIPs - managed
+			}
+			if missing <= 0 {
+				return nil
+			}
+		}
+		allocs, err := aws.AllocateIPsAtIndex(ctx, index, missing)
+		if err != nil {
+			return err
+		}
+		missing -= len(allocs)
+	}
+	return nil
+}
+
+// TopUpWarmInterfaces creates interfaces until at least target of those
+// created by the plugin have spare capacity for more IPs, so pods don't
+// wait for an ENI to attach once the existing ones fill up. Reaching the
+// instance's adapter, subnet or MaxInterfaces limit ends the top up
+// without an error. At most target interfaces are created per call.
+func TopUpWarmInterfaces(ctx context.Context, target int, opts aws.InterfaceOptions, timeout time.Duration) error {
+	for created := 0; created < target; created++ {
+		spare, err := aws.SpareInterfaceCount()
+		if err != nil {
+			return err
+		}
+		if spare >= target {
+			return nil
+		}
+		err = InterfaceLockfileRun(timeout, func() error {
+			_, err := aws.NewInterface(ctx, opts)
+			return err
+		})
+		if aws.ErrorKind(err) == aws.ErrENILimit {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}